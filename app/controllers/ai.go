@@ -1,19 +1,18 @@
 package controllers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"go-trading-bot/app/models"
-	"go-trading-bot/bitflyer"
 	"go-trading-bot/config"
-	"go-trading-bot/tradingalgo"
+	"go-trading-bot/sizing"
 	"log"
-	"math"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/semaphore"
-
-	"github.com/markcheno/go-talib"
 )
 
 const (
@@ -22,84 +21,252 @@ const (
 
 // AI => stores all info to trade automatically
 type AI struct {
-	API                  *bitflyer.APIClient
-	ProductCode          string
-	CurrencyCode         string
-	CoinCode             string
-	UsePercent           float64
-	MinuteToExpires      int
-	Duration             time.Duration
-	PastPeriod           int
-	SignalEvents         *models.TradeSignalEvents
-	OptimizedTradeParams *models.TradeParams
-	TradeSemaphore       *semaphore.Weighted
-	StopLimit            float64
-	StopLimitPercent     float64
-	BackTest             bool
-	StartTrade           time.Time
+	API              Exchange
+	ProductCode      string
+	CurrencyCode     string
+	CoinCode         string
+	UsePercent       float64
+	MinuteToExpires  int
+	Duration         time.Duration
+	PastPeriod       int
+	SignalEvents     *models.TradeSignalEvents
+	Combiner         *models.SignalCombiner
+	TradeSemaphore   *semaphore.Weighted
+	StopLimitPercent float64
+	BackTest         bool
+	Order            OrderConfig       // MARKET or LIMIT orders and how limit orders are repriced
+	Sizing           sizing.Config     // how large the positions are
+	Exits            models.ExitConfig // the stop loss, take profit, trailing stop and time exit of every position
+	ExchangeExits    bool              // place the exits at bitFlyer as a special order after every entry
+	Margin           bool              // trade on margin, a sell signal while flat opens a short position
+	Leverage         float64           // positions are worth up to this many times the collateral, with Margin
+	CancelOpenOrders bool              // Reconcile cancels the open child orders an earlier run left behind
+	StartTrade       time.Time
+	ctx              context.Context // stops the optimizations once the bot shuts down
+
+	exitMu       sync.Mutex
+	exitPlan     *models.ExitPlan // the exits of the open position, nil when there is none
+	exitBusy     bool             // an exit or a check of the special order runs in the background
+	exitSyncedAt time.Time        // when the special order was last checked
+	exitRetryAt  time.Time        // a failed exit is not tried again before
+	exitPartial  orderFill        // what a special order executed before it was cancelled or expired
+
+	// mu guards the fields below, the optimizations and the exits write them in the background
+	mu                   sync.Mutex
+	optimizedTradeParams *models.TradeParams // the params traded, nil until an optimization found some
+	reconcilePending     bool                // an order was sent but not seen in a final state, Reconcile runs before the next trade
+}
+
+// OptimizedTradeParams returns the params the AI trades, nil when there are none
+func (ai *AI) OptimizedTradeParams() *models.TradeParams {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	return ai.optimizedTradeParams
+}
+
+func (ai *AI) setOptimizedTradeParams(params *models.TradeParams) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	ai.optimizedTradeParams = params
+}
+
+// setReconcilePending makes the next trade reconcile first when pending
+func (ai *AI) setReconcilePending(pending bool) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	ai.reconcilePending = pending
 }
 
-// TODO mutex, singleton is ideal
-var Ai *AI
+// takeReconcilePending reports whether a reconcile is pending and clears it
+func (ai *AI) takeReconcilePending() bool {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	pending := ai.reconcilePending
+	ai.reconcilePending = false
+	return pending
+}
+
+// ais holds the running AI of every traded product
+var (
+	aisMu sync.RWMutex
+	ais   = map[string]*AI{}
+)
+
+// RegisterAI makes ai the AI trading its product, e.g. for the chart events
+func RegisterAI(ai *AI) {
+	aisMu.Lock()
+	defer aisMu.Unlock()
+	ais[ai.ProductCode] = ai
+}
+
+// GetAI returns the AI trading productCode
+func GetAI(productCode string) (*AI, bool) {
+	aisMu.RLock()
+	defer aisMu.RUnlock()
+	ai, ok := ais[productCode]
+	return ai, ok
+}
 
 // NewAI contstructs new AI Trade Base Model, returns *AI
-func NewAI(productCode string, duration time.Duration, pastPeriod int, UsePercent, stopLimitPercent float64, backTest bool) *AI {
-	// new api client
-	apiClient := bitflyer.New(config.Config.ApiKey, config.Config.ApiSecret)
+// exchange is where orders go and balances come from, e.g. bitflyer.APIClient
+func NewAI(ctx context.Context, exchange Exchange, productCode string, duration time.Duration, pastPeriod int, UsePercent, stopLimitPercent float64, backTest bool) *AI {
 	// signal event struct
 	var signalEvents *models.TradeSignalEvents
 	// confirm if it is backtest
 	if backTest {
 		signalEvents = models.NewTradeSignalEvents()
 	} else {
-		signalEvents = models.GetTradeSignalEventsByCount(1)
+		signalEvents = models.GetTradeSignalEventsByCount(productCode, 1)
+	}
+	product, _ := config.Config.Product(productCode)
+	signalEvents.AllowShort = product.Margin
+	combiner, err := models.NewSignalCombinerFromConfig()
+	if err != nil {
+		log.Fatalln(err)
 	}
-	// split BTC & USD
-	codes := strings.Split(productCode, "_")
-	Ai = &AI{
-		API:              apiClient,
+	// split BTC & USD, FX_BTC_JPY trades BTC against JPY too
+	coinCode, currencyCode := splitProductCode(productCode)
+	ai := &AI{
+		API:              exchange,
 		ProductCode:      productCode,
-		CoinCode:         codes[0],
-		CurrencyCode:     codes[1],
+		CoinCode:         coinCode,
+		CurrencyCode:     currencyCode,
 		UsePercent:       UsePercent,
 		MinuteToExpires:  1,
 		PastPeriod:       pastPeriod,
 		Duration:         duration,
 		SignalEvents:     signalEvents,
+		Combiner:         combiner,
 		TradeSemaphore:   semaphore.NewWeighted(1), // restrict only one goroutine
 		BackTest:         backTest,
+		Order:            DefaultOrderConfig(productCode),
+		Sizing:           DefaultSizingConfig(productCode, UsePercent),
+		Exits:            models.DefaultExitConfig(stopLimitPercent),
+		ExchangeExits:    config.Config.RiskExchangeOrders == "oco",
+		Margin:           product.Margin,
+		Leverage:         product.Leverage,
+		CancelOpenOrders: config.Config.ReconcileCancelOrders,
 		StartTrade:       time.Now(),
 		StopLimitPercent: stopLimitPercent,
+		ctx:              ctx,
+	}
+	if !backTest {
+		ai.loadExitPlan()
+		ai.Reconcile()
 	}
-	// optimize parameters
-	Ai.UpdateOptimizeParams(false)
-	return Ai
+	// resume the parameters traded before the restart, or optimize them
+	if backTest || !config.Config.OptimizerResume || !ai.resumeParams() {
+		ai.UpdateOptimizeParams(false)
+	}
+	return ai
 }
 
 // UpdateOptimizeParams gets candle stick dataframe, and optimize the parameters
+// every optimization is recorded in the optimization_runs table
 func (ai *AI) UpdateOptimizeParams(isContinue bool) {
 	// get specified dataframe candle
 	df, _ := models.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
-	// optimizer returns trade params such as EMA...
-	ai.OptimizedTradeParams = df.OptimizeParams()
-	log.Printf("optimized_trade_params=%+v", ai.OptimizedTradeParams)
-	if ai.OptimizedTradeParams == nil && isContinue && !ai.BackTest {
+	optimizer := models.NewOptimizerFromConfig(ai.ProductCode)
+	run := models.NewOptimizationRun(df, optimizer)
+	optimizer.OnCandidate = run.AddCandidate
+	var err error
+	if config.Config.WalkForward {
+		err = ai.updateValidatedParams(df, optimizer, run)
+	} else {
+		err = ai.updateOptimizedParams(df, optimizer, run)
+	}
+	if err != nil {
+		log.Printf("action=UpdateOptimizeParams product_code=%s err=%s", ai.ProductCode, err.Error())
+		return
+	}
+	if !ai.BackTest {
+		if err := run.Save(); err != nil {
+			log.Printf("action=UpdateOptimizeParams product_code=%s status=save_run err=%s", ai.ProductCode, err.Error())
+		}
+	}
+	if ai.OptimizedTradeParams() == nil && isContinue && !ai.BackTest {
 		log.Print("status_no_params")
-		time.Sleep(5 * ai.Duration)
+		select {
+		case <-time.After(5 * ai.Duration):
+		case <-ai.ctx.Done():
+			return
+		}
 		ai.UpdateOptimizeParams(isContinue)
 	}
 }
 
+// updateOptimizedParams trades the best parameters over df
+func (ai *AI) updateOptimizedParams(df *models.DataFrameCandle, optimizer *models.Optimizer, run *models.OptimizationRun) error {
+	// optimizer returns trade params such as EMA...
+	params, err := optimizer.OptimizeParams(ai.ctx, df)
+	if err != nil {
+		return err
+	}
+	if params == nil {
+		run.Finish(nil, false, "no profitable strategy")
+	} else {
+		run.Finish(params, true, "")
+	}
+	ai.setOptimizedTradeParams(params)
+	log.Printf("product_code=%s optimized_trade_params=%+v", ai.ProductCode, params)
+	return nil
+}
+
+// updateValidatedParams adopts the params of the latest walk-forward window when they passed out of sample,
+// otherwise the AI keeps the params it had
+func (ai *AI) updateValidatedParams(df *models.DataFrameCandle, optimizer *models.Optimizer, run *models.OptimizationRun) error {
+	wf := models.DefaultWalkForwardConfig(ai.ProductCode)
+	wf.Optimizer = optimizer
+	params, result, err := df.ValidatedParams(ai.ctx, wf, ai.Combiner)
+	if errors.Is(err, models.ErrNotEnoughCandles) {
+		// like no params: UpdateOptimizeParams retries once more candles are stored
+		run.Finish(nil, false, err.Error())
+		log.Printf("action=UpdateOptimizeParams product_code=%s status=not_enough_candles err=%s", ai.ProductCode, err.Error())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	latest := result.Latest()
+	if params == nil {
+		reason := fmt.Sprintf("walk forward rejected: out_of_sample_score=%f latest_window_passed=%t", result.Score, latest.Passed)
+		run.Finish(latest.Params, false, reason)
+		log.Printf("action=UpdateOptimizeParams product_code=%s status=rejected %s", ai.ProductCode, reason)
+		return nil
+	}
+	run.Finish(params, true, "")
+	ai.setOptimizedTradeParams(params)
+	log.Printf("product_code=%s validated_trade_params=%+v out_of_sample_score=%f", ai.ProductCode, params, result.Score)
+	return nil
+}
+
+// resumeParams trades the params of the last accepted optimization run, true when there was one
+func (ai *AI) resumeParams() bool {
+	run, err := models.GetLastAcceptedOptimizationRun(ai.ProductCode, ai.Duration)
+	if err != nil {
+		log.Printf("action=resumeParams product_code=%s err=%s", ai.ProductCode, err.Error())
+		return false
+	}
+	if run == nil || run.Params == nil {
+		return false
+	}
+	ai.setOptimizedTradeParams(run.Params)
+	log.Printf("action=resumeParams product_code=%s run_id=%d finished_at=%s trade_params=%+v",
+		ai.ProductCode, run.ID, run.FinishedAt.Format(time.RFC3339), run.Params)
+	return true
+}
+
 // Buy returns childOrderAccenptanceID/isOrderCompleted from apiClient when the buy order is executed successfully
+// it opens a long position, or closes the short one
 func (ai *AI) Buy(candle models.Candle) (childOrderAcceptanceID string, isOrderCompleted bool) {
 	// check if backtest is true
 	if ai.BackTest {
 		couldBuy := ai.SignalEvents.Buy(ai.ProductCode, candle.Time, candle.Close, 1.0, false)
-		fmt.Println("just buy")
+		log.Printf("action=Buy product_code=%s status=backtest time=%s recorded=%t", ai.ProductCode, candle.Time.Format(time.RFC3339), couldBuy)
 		return "", couldBuy
 	}
 
-	//TODO
+	// candles before the start were traded by an earlier run, Reconcile brought its position in line
 	if ai.StartTrade.After(candle.Time) {
 		return
 	}
@@ -108,50 +275,23 @@ func (ai *AI) Buy(candle models.Candle) (childOrderAcceptanceID string, isOrderC
 		return
 	}
 
-	availableCurrency, _ := ai.GetAvailableBalance()
-	useCurrency := availableCurrency * ai.UsePercent
-	ticker, err := ai.API.GetTicker(ai.ProductCode)
-	if err != nil {
-		return
-	}
-	size := 1 / (ticker.BestAsk / useCurrency)
-	size = ai.AdjustSize(size)
-
-	order := &bitflyer.Order{
-		ProductCode:     ai.ProductCode,
-		ChildOrderType:  "MARKET",
-		Side:            "BUY",
-		Size:            size,
-		MinuteToExpires: ai.MinuteToExpires,
-		TimeInForce:     "GTC",
+	if ai.SignalEvents.Position() == models.PositionShort {
+		log.Printf("status=buy candle=%+v position=short", candle)
+		return ai.closePosition(candle.Time)
 	}
-	log.Printf("status=order candle=%+v order=%+v", candle, order)
-	resp, err := ai.API.SendOrder(order)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	childOrderAcceptanceID = resp.ChildOrderAcceptanceID
-	if resp.ChildOrderAcceptanceID == "" {
-		// Insufficient fund
-		log.Printf("order=%+v status=no_id", order)
-		return
-	}
-
-	isOrderCompleted = ai.WaitUntilOrderComplete(childOrderAcceptanceID, candle.Time)
-	fmt.Println("JUST BOUGHT: ")
-	return childOrderAcceptanceID, isOrderCompleted
+	return ai.openPosition("BUY", candle)
 }
 
 // Sell returns childOrderAccenptanceID/isOrderCompleted from apiClient when the sell order is executed successfully
+// it closes the long position or, on margin, opens a short one
 func (ai *AI) Sell(candle models.Candle) (childOrderAcceptanceID string, isOrderCompleted bool) {
 	if ai.BackTest {
 		couldSell := ai.SignalEvents.Sell(ai.ProductCode, candle.Time, candle.Close, 1.0, false)
-		fmt.Println("just sell")
+		log.Printf("action=Sell product_code=%s status=backtest time=%s recorded=%t", ai.ProductCode, candle.Time.Format(time.RFC3339), couldSell)
 		return "", couldSell
 	}
 
-	// TODO
+	// candles before the start were traded by an earlier run, Reconcile brought its position in line
 	if ai.StartTrade.After(candle.Time) {
 		return
 	}
@@ -160,30 +300,42 @@ func (ai *AI) Sell(candle models.Candle) (childOrderAcceptanceID string, isOrder
 		return
 	}
 
-	_, availableCoin := ai.GetAvailableBalance()
-	size := ai.AdjustSize(availableCoin)
-	order := &bitflyer.Order{
-		ProductCode:     ai.ProductCode,
-		ChildOrderType:  "MARKET",
-		Side:            "SELL",
-		Size:            size,
-		MinuteToExpires: ai.MinuteToExpires,
-		TimeInForce:     "GTC",
+	if ai.SignalEvents.Position() == models.PositionLong {
+		log.Printf("status=sell candle=%+v", candle)
+		return ai.closePosition(candle.Time)
 	}
-	log.Printf("status=sell candle=%+v order=%+v", candle, order)
-	resp, err := ai.API.SendOrder(order)
+	return ai.openPosition("SELL", candle)
+}
+
+// openPosition opens a position with an order of side, long with BUY and short with SELL, sized by OpenSize
+func (ai *AI) openPosition(side string, candle models.Candle) (childOrderAcceptanceID string, isOrderCompleted bool) {
+	ticker, err := ai.API.GetTicker(ai.ProductCode)
+	if err != nil {
+		return
+	}
+	price := ticker.BestAsk
+	if side == "SELL" {
+		price = ticker.BestBid
+	}
+	size, err := ai.OpenSize(side, price)
 	if err != nil {
-		log.Println(err)
+		log.Printf("action=openPosition product_code=%s side=%s status=no_size err=%s", ai.ProductCode, side, err.Error())
 		return
 	}
-	if resp.ChildOrderAcceptanceID == "" {
-		// Insufficient funds
-		log.Printf("order=%+v status=no_id", order)
+	if size == 0 {
+		log.Printf("action=openPosition product_code=%s side=%s status=no_size mode=%s", ai.ProductCode, side, ai.Sizing.Mode)
 		return
 	}
-	childOrderAcceptanceID = resp.ChildOrderAcceptanceID
-	isOrderCompleted = ai.WaitUntilOrderComplete(childOrderAcceptanceID, candle.Time)
-	return childOrderAcceptanceID, isOrderCompleted
+
+	log.Printf("status=%s candle=%+v size=%f order_type=%s", strings.ToLower(side), candle, size, ai.Order.Type)
+	fill := ai.executeOrder(side, size)
+	// an order that may still fill is left to Reconcile before the next trade
+	ai.setReconcilePending(fill.unsettled)
+	if fill.Size == 0 {
+		return fill.ChildOrderAcceptanceID, false
+	}
+	isOrderCompleted = ai.recordFill(side, candle.Time, fill)
+	return fill.ChildOrderAcceptanceID, isOrderCompleted
 }
 
 // Trade
@@ -194,8 +346,11 @@ func (ai *AI) Trade() {
 		return
 	}
 	defer ai.TradeSemaphore.Release(1)
+	if ai.takeReconcilePending() {
+		ai.Reconcile()
+	}
 	// get optimized trade parameter such as EMA...
-	params := ai.OptimizedTradeParams
+	params := ai.OptimizedTradeParams()
 	if params == nil {
 		return
 	}
@@ -204,128 +359,74 @@ func (ai *AI) Trade() {
 	// length of the candles
 	lenCandles := len(df.Candles)
 
-	// EMA
-	var emaValues1 []float64
-	var emaValues2 []float64
-	if params.EmaEnable {
-		emaValues1 = talib.Ema(df.Closes(), params.EmaPeriod1)
-		emaValues2 = talib.Ema(df.Closes(), params.EmaPeriod2)
-	}
-
-	// Bolinger Bands
-	var bbUp []float64
-	var bbDown []float64
-	if params.BbEnable {
-		bbUp, _, bbDown = talib.BBands(df.Closes(), params.BbN, params.BbK, params.BbK, 0)
-	}
-
-	// Ichimoku
-	var tenkan, kijun, senkouA, senkouB, chikou []float64
-	if params.IchimokuEnable {
-		tenkan, kijun, senkouA, senkouB, chikou = tradingalgo.IchimokuCloud(df.Closes())
-	}
-
-	// MACD
-	var outMACD, outMACDSignal []float64
-	if params.MacdEnable {
-		outMACD, outMACDSignal, _ = talib.Macd(df.Closes(), params.MacdFastPeriod, params.MacdSlowPeriod, params.MacdSignalPeriod)
+	// signals of every enabled strategy, computed by the same code the backtests run
+	var votes []models.StrategySignals
+	for _, result := range params.Enabled() {
+		strategy, ok := models.GetStrategy(result.Name)
+		if !ok {
+			log.Printf("action=Trade status=unknown_strategy name=%s", result.Name)
+			continue
+		}
+		if signals := df.Signals(strategy, result.Params); signals != nil {
+			votes = append(votes, models.StrategySignals{Name: result.Name, Performance: result.Performance, Signals: signals})
+		}
 	}
+	decisions := ai.Combiner.Combine(df, votes)
 
-	// RSI
-	var rsiValues []float64
-	if params.RsiEnable {
-		rsiValues = talib.Rsi(df.Closes(), params.RsiPeriod)
+	if ai.Margin && !ai.BackTest {
+		ai.logCollateral()
 	}
 
 	// Algorithm that find buypoint and sellpoint
 	for i := 1; i < lenCandles; i++ {
-		// we buy & sell when at least 3 of the algo say YES
-		buyPoint, sellPoint := 0, 0
-		// Golden Cross: EMA enable?EMAPeriod is less than i?
-		if params.EmaEnable && params.EmaPeriod1 <= i && params.EmaPeriod2 <= i && df.Volumes()[i] > 100 {
-			// check if it is Golden Cross
-			if emaValues1[i-1] < emaValues2[i-1] && emaValues1[i] >= emaValues2[i] {
-				buyPoint++
-			}
-			// Dead Cross??
-			if emaValues1[i-1] > emaValues2[i-1] && emaValues1[i] <= emaValues2[i] {
-				sellPoint++
-			}
-		}
-
-		// Borinder Bands
-		if params.BbEnable && params.BbN <= i {
-			// Buy when below band
-			if bbDown[i-1] > df.Candles[i-1].Close && bbDown[i] <= df.Candles[i].Close && df.Volumes()[i] > 100 {
-				buyPoint++
-			}
-			// Sell when upper band
-			if bbUp[i-1] < df.Candles[i-1].Close && bbUp[i] >= df.Candles[i].Close {
-				sellPoint++
-			}
-		}
-
-		// MACD
-		if params.MacdEnable {
-			if outMACD[i] < 0 && outMACDSignal[i] < 0 && outMACD[i-1] < outMACDSignal[i-1] && outMACD[i] >= outMACDSignal[i] && df.Volumes()[i] > 100 {
-				buyPoint++
-			}
-
-			if outMACD[i] > 0 && outMACDSignal[i] > 0 && outMACD[i-1] > outMACDSignal[i-1] && outMACD[i] <= outMACDSignal[i] {
-				sellPoint++
-			}
-		}
-
-		// Ichimoku
-		if params.IchimokuEnable {
-			if chikou[i-1] < df.Candles[i-1].High && chikou[i] >= df.Candles[i].High &&
-				senkouA[i] < df.Candles[i].Low && senkouB[i] < df.Candles[i].Low &&
-				tenkan[i] > kijun[i] && df.Volumes()[i] > 100 {
-				buyPoint++
-			}
-
-			if chikou[i-1] > df.Candles[i-1].Low && chikou[i] <= df.Candles[i].Low &&
-				senkouA[i] > df.Candles[i].High && senkouB[i] > df.Candles[i].High &&
-				tenkan[i] < kijun[i] {
-				sellPoint++
-			}
-		}
-
-		// RSI
-		if params.RsiEnable && rsiValues[i-1] != 0 && rsiValues[i-1] != 100 && df.Volumes()[i] > 100 {
-			if rsiValues[i-1] < params.RsiBuyThread && rsiValues[i] >= params.RsiBuyThread {
-				buyPoint++
-			}
-
-			if rsiValues[i-1] > params.RsiSellThread && rsiValues[i] <= params.RsiSellThread {
-				sellPoint++
-			}
-		}
-
-		// BUY when 3 algo says yes
-		if buyPoint > 1 {
+		// BUY when the strategies reach the quorum
+		if decisions[i] == models.SignalBuy {
+			opening := ai.SignalEvents.Position() == models.PositionFlat
 			_, isOrderCompleted := ai.Buy(df.Candles[i])
 			if !isOrderCompleted {
 				continue
 			}
-			// assign stop limit when ALGO was not correct... (this time 90%, i.e, 10& losscut)
-			ai.StopLimit = df.Candles[i].Close * ai.StopLimitPercent
+			ai.afterTrade(opening, df, i)
 		}
 
-		// SELl when 3 algo says yes
-		if sellPoint > 1 || ai.StopLimit > df.Candles[i].Close {
+		// SELL when the strategies reach the quorum
+		if decisions[i] == models.SignalSell {
+			opening := ai.SignalEvents.Position() == models.PositionFlat
 			_, isOrderCompleted := ai.Sell(df.Candles[i])
 			if !isOrderCompleted {
 				continue
 			}
-			ai.StopLimit = 0.0
-			// Optimize Params AGAIN after BUY=>SELL routine since the market is changed during one trade
-			// optimize is always runing backend goroutine
-			go ai.UpdateOptimizeParams(true)
+			ai.afterTrade(opening, df, i)
 		}
 	}
 }
 
+// afterTrade follows an order the AI completed at candle i of df, opening a position when opening is set
+func (ai *AI) afterTrade(opening bool, df *models.DataFrameCandle, i int) {
+	if !opening {
+		// Optimize Params AGAIN after every round trip since the market is changed during one trade
+		// optimize is always runing backend goroutine
+		go ai.UpdateOptimizeParams(true)
+		return
+	}
+	// the stop loss, take profit... are checked on every ticker from now on, see CheckExit
+	if !ai.BackTest {
+		entry := ai.SignalEvents.TradeSignals[len(ai.SignalEvents.TradeSignals)-1]
+		ai.openExitPlan(entry.Side, entry.Price, entry.Size, ai.exitATR(df, i))
+	}
+}
+
+// logCollateral logs the margin account, a keep rate below 0.8 means a margin call
+func (ai *AI) logCollateral() {
+	collateral, err := ai.API.GetCollateral()
+	if err != nil {
+		log.Printf("action=logCollateral product_code=%s err=%s", ai.ProductCode, err.Error())
+		return
+	}
+	log.Printf("action=logCollateral product_code=%s collateral=%f open_position_pnl=%f require_collateral=%f keep_rate=%f",
+		ai.ProductCode, collateral.Collateral, collateral.OpenPositionPnl, collateral.RequireCollateral, collateral.KeepRate)
+}
+
 func (ai *AI) GetAvailableBalance() (availableCurrency, availableCoin float64) {
 	balances, err := ai.API.GetBalance()
 	if err != nil {
@@ -341,51 +442,45 @@ func (ai *AI) GetAvailableBalance() (availableCurrency, availableCoin float64) {
 	return availableCurrency, availableCoin
 }
 
+// AdjustSize keeps the commission, ApiFeePercent percent, aside and rounds size down to the size step
 func (ai *AI) AdjustSize(size float64) float64 {
-	fee := size * ApiFeePercent
-	size = size - fee
-	return math.Floor(size*10000) / 10000
+	fee := size * ApiFeePercent / 100
+	return ai.Sizing.Round(size - fee)
 }
 
+// WaitUntilOrderComplete waits for the order to be COMPLETED and records it in the signal events
 func (ai *AI) WaitUntilOrderComplete(childOrderAcceptanceID string, executeTime time.Time) bool {
-	params := map[string]string{
-		"product_code":              ai.ProductCode,
-		"child_order_acceptance_id": childOrderAcceptanceID,
-	}
-	expire := time.After(time.Minute + (20 * time.Second))
-	interval := time.Tick(15 * time.Second)
-	return func() bool {
-		for {
-			select {
-			case <-expire:
-				return false
-			case <-interval:
-				listOrders, err := ai.API.ListOrder(params)
-				if err != nil {
-					return false
-				}
-				if len(listOrders) == 0 {
-					return false
-				}
-				order := listOrders[0]
-				if order.ChildOrderState == "COMPLETED" {
-					if order.Side == "BUY" {
-						couldBuy := ai.SignalEvents.Buy(ai.ProductCode, executeTime, order.AveragePrice, order.Size, true)
-						if !couldBuy {
-							log.Printf("status=buy childOrderAcceptanceID=%s order=%+v", childOrderAcceptanceID, order)
-						}
-						return couldBuy
-					}
-					if order.Side == "SELL" {
-						couldSell := ai.SignalEvents.Sell(ai.ProductCode, executeTime, order.AveragePrice, order.Size, true)
-						if !couldSell {
-							log.Printf("status=sell childOrderAcceptanceID=%s order=%+v", childOrderAcceptanceID, order)
-						}
-						return couldSell
-					}
-					return false
-				}
-			}
+	order, ok := ai.waitUntilOrderComplete(childOrderAcceptanceID)
+	if !ok {
+		return false
+	}
+	fill := orderFill{ChildOrderAcceptanceID: childOrderAcceptanceID}
+	fill.add(order)
+	return ai.recordFill(order.Side, executeTime, fill)
+}
+
+// recordFill records what the orders of a trade executed, at their average price, in the signal events
+func (ai *AI) recordFill(side string, executeTime time.Time, fill orderFill) bool {
+	recorded := false
+	switch side {
+	case "BUY":
+		recorded = ai.SignalEvents.Buy(ai.ProductCode, executeTime, fill.AveragePrice(), fill.Size, true)
+		if !recorded {
+			log.Printf("status=buy childOrderAcceptanceID=%s fill=%+v", fill.ChildOrderAcceptanceID, fill)
+		}
+	case "SELL":
+		recorded = ai.SignalEvents.Sell(ai.ProductCode, executeTime, fill.AveragePrice(), fill.Size, true)
+		if !recorded {
+			log.Printf("status=sell childOrderAcceptanceID=%s fill=%+v", fill.ChildOrderAcceptanceID, fill)
 		}
-	}()
+	}
+	if recorded {
+		// the last order is left to Reconcile when it may still fill
+		except := ""
+		if fill.unsettled {
+			except = fill.ChildOrderAcceptanceID
+		}
+		ai.markOrdersRecorded(except)
+	}
+	return recorded
 }
@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"context"
+	"go-trading-bot/app/models"
+	"go-trading-bot/bitflyer"
+	"go-trading-bot/config"
+	"log"
+	"time"
+)
+
+// number of executions per getexecutions page, the most bitFlyer returns
+const backfillPageSize = 500
+
+// ExecutionHistory is the public execution history, bitflyer.APIClient implements it
+type ExecutionHistory interface {
+	GetExecutions(productCode string, count int, before, after int64) ([]bitflyer.Execution, error)
+}
+
+// largestDuration returns the longest configured candle duration,
+// backfill ranges are aligned to it so every candle they write is complete
+func largestDuration() time.Duration {
+	largest := time.Duration(0)
+	for _, duration := range config.Config.Durations {
+		if duration > largest {
+			largest = duration
+		}
+	}
+	return largest
+}
+
+// Backfill pages through the execution history back to since and writes every duration table
+// progress is saved after each page: running it again resumes an interrupted backfill,
+// or extends a finished one further back when since is older
+func Backfill(ctx context.Context, history ExecutionHistory, productCode string, since time.Time) error {
+	largest := largestDuration()
+	since = since.UTC().Truncate(largest)
+	state := models.GetBackfillState(productCode)
+	switch {
+	case state == nil:
+		state = &models.BackfillState{
+			ProductCode: productCode,
+			Since:       since,
+			Until:       time.Now().UTC().Truncate(largest),
+		}
+	case state.Done && since.Before(state.Since):
+		// the cursor already points at the oldest execution written, carry on from there
+		state.Until = state.Since
+		state.Since = since
+		state.Done = false
+	case state.Done:
+		log.Printf("action=Backfill product_code=%s status=already_done since=%s", productCode, state.Since)
+		return nil
+	}
+	log.Printf("action=Backfill product_code=%s since=%s until=%s cursor=%d", productCode, state.Since, state.Until, state.CursorID)
+	return backfillRange(ctx, history, state, func(candles []models.Candle) error {
+		return models.SaveBackfillProgress(candles, state)
+	})
+}
+
+// FillCandleGaps finds the missing candles of the duration table between from and to, spanning at least minGap,
+// and rebuilds them, with the higher durations around them, from the execution history
+func FillCandleGaps(ctx context.Context, history ExecutionHistory, productCode string, duration, minGap time.Duration, from, to time.Time) error {
+	largest := largestDuration()
+	latest := time.Now().UTC().Truncate(largest)
+	gaps, err := models.FindCandleGaps(productCode, duration, minGap, from.UTC(), to.UTC())
+	if err != nil {
+		return err
+	}
+	for _, gap := range gaps {
+		state := &models.BackfillState{
+			ProductCode: productCode,
+			Since:       gap.Start.Truncate(largest),
+			Until:       gap.End.Add(largest - 1).Truncate(largest),
+		}
+		if state.Until.After(latest) {
+			// the newest candles are still being written by the live stream
+			state.Until = latest
+		}
+		if !state.Since.Before(state.Until) {
+			continue
+		}
+		log.Printf("action=FillCandleGaps product_code=%s gap_start=%s gap_end=%s", productCode, gap.Start, gap.End)
+		state.CursorID, err = findExecutionID(ctx, history, productCode, state.Until)
+		if err != nil {
+			return err
+		}
+		err = backfillRange(ctx, history, state, models.SaveCandles)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillRange reads executions before state.CursorID until state.Since and saves
+// the completed and partial candles after every page
+func backfillRange(ctx context.Context, history ExecutionHistory, state *models.BackfillState, save func([]models.Candle) error) error {
+	builder := models.NewHistoryCandleBuilder(state.ProductCode, config.Config.Durations)
+	if state.CursorID > 0 && !state.CursorTime.IsZero() {
+		builder.Resume(state.CursorTime)
+	}
+	for !state.Done {
+		page, err := getExecutionsWithRetry(ctx, history, state.ProductCode, state.CursorID)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			// no older history is available
+			state.Done = true
+		}
+
+		var candles []models.Candle
+		for _, execution := range page {
+			executionTime := execution.DateTime()
+			if executionTime.Before(state.Since) {
+				state.Done = true
+				break
+			}
+			state.CursorID = execution.ID
+			if !executionTime.Before(state.Until) {
+				continue
+			}
+			state.CursorTime = executionTime
+			candles = append(candles, builder.Prepend(execution)...)
+		}
+		candles = append(candles, builder.Current()...)
+		if err := save(candles); err != nil {
+			return err
+		}
+		log.Printf("action=backfillRange product_code=%s cursor=%d cursor_time=%s", state.ProductCode, state.CursorID, state.CursorTime)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(config.Config.BackfillInterval):
+		}
+	}
+	return nil
+}
+
+// getExecutionsWithRetry reads one page, retrying a few times on network or API errors
+func getExecutionsWithRetry(ctx context.Context, history ExecutionHistory, productCode string, before int64) ([]bitflyer.Execution, error) {
+	var err error
+	for attempt := 1; attempt <= 5; attempt++ {
+		var page []bitflyer.Execution
+		page, err = history.GetExecutions(productCode, backfillPageSize, before, 0)
+		if err == nil {
+			return page, nil
+		}
+		log.Printf("action=getExecutionsWithRetry attempt=%d err=%s", attempt, err.Error())
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * 5 * time.Second):
+		}
+	}
+	return nil, err
+}
+
+// findExecutionID returns the smallest execution id traded at or after t,
+// ids grow with time so a binary search over them finds it; 0 means t is in the future
+func findExecutionID(ctx context.Context, history ExecutionHistory, productCode string, t time.Time) (int64, error) {
+	latest, err := history.GetExecutions(productCode, 1, 0, 0)
+	if err != nil || len(latest) == 0 {
+		return 0, err
+	}
+	if latest[0].DateTime().Before(t) {
+		return 0, nil
+	}
+	low, high := int64(0), latest[0].ID
+	for low < high {
+		mid := low + (high-low)/2
+		// the newest execution with an id <= mid
+		page, err := history.GetExecutions(productCode, 1, mid+1, 0)
+		if err != nil {
+			return 0, err
+		}
+		if len(page) == 0 || page[0].DateTime().Before(t) {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(config.Config.BackfillInterval):
+		}
+	}
+	return low, nil
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"context"
+	"go-trading-bot/app/models"
+	"go-trading-bot/bitflyer"
+	"go-trading-bot/config"
+	"testing"
+	"time"
+)
+
+// fakeHistory serves executions, ascending by id, like getexecutions: newest first, before an id
+type fakeHistory struct {
+	executions []bitflyer.Execution
+}
+
+func (h *fakeHistory) GetExecutions(productCode string, count int, before, after int64) ([]bitflyer.Execution, error) {
+	var page []bitflyer.Execution
+	for i := len(h.executions) - 1; i >= 0 && len(page) < count; i-- {
+		execution := h.executions[i]
+		if (before > 0 && execution.ID >= before) || execution.ID <= after {
+			continue
+		}
+		page = append(page, execution)
+	}
+	return page, nil
+}
+
+func TestFillCandleGaps(t *testing.T) {
+	interval := config.Config.BackfillInterval
+	config.Config.BackfillInterval = time.Millisecond
+	defer func() { config.Config.BackfillInterval = interval }()
+
+	// a print every 30 seconds from 09:00 to 12:00, the candles of 10:20 to 10:40 are missing
+	start := time.Date(2018, 1, 1, 9, 0, 0, 0, time.UTC)
+	history := &fakeHistory{}
+	var candles []models.Candle
+	for i := 0; i < 360; i++ {
+		at := start.Add(time.Duration(i) * 30 * time.Second)
+		history.executions = append(history.executions, bitflyer.Execution{ID: int64(i + 1), Side: "BUY", Price: float64(1000 + i), Size: 0.5, ExecDate: at.Format(time.RFC3339Nano)})
+		if minute := at.Truncate(time.Minute); at.Equal(minute) && (minute.Before(start.Add(80*time.Minute)) || !minute.Before(start.Add(100*time.Minute))) {
+			candles = append(candles, models.Candle{ProductCode: "BTC_JPY", Duration: time.Minute, Time: minute, Open: 1, Close: 1, High: 1, Low: 1})
+		}
+	}
+	if err := models.SaveCandles(candles); err != nil {
+		t.Fatal(err)
+	}
+
+	err := FillCandleGaps(context.Background(), history, "BTC_JPY", time.Minute, 5*time.Minute, start.Add(time.Hour), start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10:30 holds the prints of 10:30:00 and 10:30:30, the 181st and 182nd
+	got := models.GetCandle("BTC_JPY", time.Minute, start.Add(90*time.Minute))
+	if got == nil {
+		t.Fatal("GetCandle(10:30) = nil, want the gap rebuilt")
+	}
+	if got.Open != 1180 || got.Close != 1181 || got.Volume != 1 || got.TradeCount != 2 {
+		t.Errorf("GetCandle(10:30) = %+v, want open 1180 close 1181 volume 1 of 2 prints", *got)
+	}
+	if gaps, err := models.FindCandleGaps("BTC_JPY", time.Minute, 0, start.Add(time.Hour), start.Add(2*time.Hour)); err != nil || len(gaps) != 0 {
+		t.Errorf("FindCandleGaps() = %v, %v, want no gap left", gaps, err)
+	}
+}
+
+func TestFillCandleGapsStops(t *testing.T) {
+	interval := config.Config.BackfillInterval
+	config.Config.BackfillInterval = time.Hour
+	defer func() { config.Config.BackfillInterval = interval }()
+
+	start := time.Date(2018, 1, 2, 9, 0, 0, 0, time.UTC)
+	history := &fakeHistory{}
+	for i := 0; i < 100; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		history.executions = append(history.executions, bitflyer.Execution{ID: int64(1000 + i), Side: "BUY", Price: 1000, Size: 1, ExecDate: at.Format(time.RFC3339Nano)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- FillCandleGaps(ctx, history, "BTC_JPY", time.Minute, 0, start, start.Add(time.Hour)) }()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("FillCandleGaps() err = %v, want the context's", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("FillCandleGaps() kept waiting after the context was done")
+	}
+}
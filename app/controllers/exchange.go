@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"context"
+	"go-trading-bot/bitflyer"
+	"go-trading-bot/config"
+	"go-trading-bot/papertrade"
+	"strings"
+)
+
+// Exchange is everything the trading logic needs from a venue: balances, the margin positions and collateral,
+// ticker, order placement, cancellation, order listing and the real-time ticker, executions and board streams.
+// bitflyer.APIClient implements it, so do fakes and the paper-trading backend
+type Exchange interface {
+	GetBalance() ([]bitflyer.Balance, error)
+	GetPositions(productCode string) ([]bitflyer.Position, error)
+	GetCollateral() (*bitflyer.Collateral, error)
+	GetTicker(productCode string) (*bitflyer.Ticker, error)
+	SendOrder(order *bitflyer.Order) (*bitflyer.ResponseSendChildOrder, error)
+	ListOrder(query map[string]string) ([]bitflyer.Order, error)
+	CancelChildOrder(productCode, childOrderAcceptanceID string) error
+	GetMyExecutions(query bitflyer.ExecutionQuery) ([]bitflyer.MyExecution, error)
+	GetRealTimeTicker(ctx context.Context, symbol string, ch chan<- bitflyer.Ticker)
+	GetRealTimeExecutions(ctx context.Context, symbol string, ch chan<- []bitflyer.Execution)
+	GetRealTimeBoard(ctx context.Context, symbol string, ch chan<- bitflyer.Board)
+	ConnectionEvents() <-chan bitflyer.ConnectionEvent
+}
+
+// ParentOrderExchange is an Exchange that holds special orders, e.g. the exits of a position as an OCO
+// bitflyer.APIClient implements it, the paper-trading backend does not
+type ParentOrderExchange interface {
+	SendParentOrder(order *bitflyer.ParentOrder) (*bitflyer.ResponseSendParentOrder, error)
+	CancelParentOrder(productCode, parentOrderAcceptanceID string) error
+	ListParentOrders(query bitflyer.ParentOrderQuery) ([]bitflyer.ParentOrderStatus, error)
+}
+
+// make sure every backend always satisfies Exchange
+var (
+	_ Exchange            = (*bitflyer.APIClient)(nil)
+	_ Exchange            = (*papertrade.Exchange)(nil)
+	_ ParentOrderExchange = (*bitflyer.APIClient)(nil)
+	_ ParentOrderExchange = (*guardedParentOrderExchange)(nil)
+)
+
+// NewExchange returns the exchange selected by config, behind the risk limits:
+// the paper-trading simulator fed by live bitFlyer prices, or bitFlyer itself
+func NewExchange() Exchange {
+	c := config.Config
+	apiClient := bitflyer.NewWithURL(c.ApiKey, c.ApiSecret, c.BaseURL, c.WsURL)
+	if !c.PaperTrade {
+		return NewGuardedExchange(apiClient, DefaultRiskLimits())
+	}
+	// every traded coin starts with coin_balance, the shared currency with currency_balance
+	balances := map[string]float64{}
+	for _, product := range c.Products {
+		codes := strings.Split(product.ProductCode, "_")
+		if len(codes) < 2 {
+			continue
+		}
+		balances[codes[len(codes)-2]] = c.PaperCoin
+		balances[codes[len(codes)-1]] = c.PaperCurrency
+	}
+	paper := papertrade.New(apiClient, balances, c.PaperFeePercent)
+	paper.SetCollateral(c.PaperCollateral)
+	return NewGuardedExchange(paper, DefaultRiskLimits())
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"go-trading-bot/bitflyer"
+	"sync"
+)
+
+// fakeExchange is an Exchange kept in memory: orders are listed in the state they were sent with,
+// executions are looked up by acceptance id
+type fakeExchange struct {
+	mu         sync.Mutex
+	balances   []bitflyer.Balance
+	positions  []bitflyer.Position
+	collateral bitflyer.Collateral
+	ticker     bitflyer.Ticker
+	orders     []bitflyer.Order
+	executions map[string][]bitflyer.MyExecution // by child order acceptance id
+	sendState  string                            // state of the sent orders, COMPLETED when empty
+	sendErr    error
+	sent       []bitflyer.Order
+	canceled   []string
+}
+
+var _ Exchange = (*fakeExchange)(nil)
+
+func (f *fakeExchange) GetBalance() ([]bitflyer.Balance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.balances, nil
+}
+
+func (f *fakeExchange) GetPositions(productCode string) ([]bitflyer.Position, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.positions, nil
+}
+
+func (f *fakeExchange) GetCollateral() (*bitflyer.Collateral, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	collateral := f.collateral
+	return &collateral, nil
+}
+
+func (f *fakeExchange) GetTicker(productCode string) (*bitflyer.Ticker, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ticker := f.ticker
+	return &ticker, nil
+}
+
+func (f *fakeExchange) SendOrder(order *bitflyer.Order) (*bitflyer.ResponseSendChildOrder, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sendErr != nil {
+		return nil, f.sendErr
+	}
+	sent := *order
+	sent.ChildOrderAcceptanceID = fmt.Sprintf("JRF%d", len(f.sent)+1)
+	sent.ChildOrderState = f.sendState
+	if sent.ChildOrderState == "" {
+		sent.ChildOrderState = "COMPLETED"
+	}
+	if sent.ChildOrderState == "COMPLETED" {
+		sent.ExecutedSize = sent.Size
+		sent.AveragePrice = sent.Price
+		if sent.AveragePrice == 0 {
+			sent.AveragePrice = f.ticker.Ltp
+		}
+	} else {
+		sent.OutstandingSize = sent.Size
+	}
+	f.sent = append(f.sent, sent)
+	f.orders = append(f.orders, sent)
+	return &bitflyer.ResponseSendChildOrder{ChildOrderAcceptanceID: sent.ChildOrderAcceptanceID}, nil
+}
+
+func (f *fakeExchange) ListOrder(query map[string]string) ([]bitflyer.Order, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var orders []bitflyer.Order
+	for _, order := range f.orders {
+		if id, ok := query["child_order_acceptance_id"]; ok && id != order.ChildOrderAcceptanceID {
+			continue
+		}
+		if state, ok := query["child_order_state"]; ok && state != order.ChildOrderState {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+func (f *fakeExchange) CancelChildOrder(productCode, childOrderAcceptanceID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.canceled = append(f.canceled, childOrderAcceptanceID)
+	for i := range f.orders {
+		if f.orders[i].ChildOrderAcceptanceID == childOrderAcceptanceID {
+			f.orders[i].ChildOrderState = "CANCELED"
+		}
+	}
+	return nil
+}
+
+func (f *fakeExchange) GetMyExecutions(query bitflyer.ExecutionQuery) ([]bitflyer.MyExecution, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.executions[query.ChildOrderAcceptanceID], nil
+}
+
+func (f *fakeExchange) GetRealTimeTicker(ctx context.Context, symbol string, ch chan<- bitflyer.Ticker) {
+	<-ctx.Done()
+}
+
+func (f *fakeExchange) GetRealTimeExecutions(ctx context.Context, symbol string, ch chan<- []bitflyer.Execution) {
+	<-ctx.Done()
+}
+
+func (f *fakeExchange) GetRealTimeBoard(ctx context.Context, symbol string, ch chan<- bitflyer.Board) {
+	<-ctx.Done()
+}
+
+func (f *fakeExchange) ConnectionEvents() <-chan bitflyer.ConnectionEvent {
+	return nil
+}
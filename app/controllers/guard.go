@@ -0,0 +1,336 @@
+package controllers
+
+import (
+	"fmt"
+	"go-trading-bot/app/models"
+	"go-trading-bot/bitflyer"
+	"go-trading-bot/config"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RiskLimits is what every order is checked against before it reaches the exchange, the [limits] section
+// orders closing a position are counted in the order rates but never rejected, so exits keep working
+type RiskLimits struct {
+	ProductCodes         []string           // products whose coin is part of the equity
+	Margin               map[string]bool    // products traded on margin, their position and equity come from the collateral
+	MaxPosition          map[string]float64 // coin held at most by product code, long or short, 0 disables the limit
+	MaxOrderNotional     float64            // currency a single order may be worth
+	MaxDailyDrawdown     float64            // percent below the peak equity of the day that engages the kill switch
+	MaxWeeklyDrawdown    float64            // same for the peak of the week
+	MaxConsecutiveLosses int                // losing trades of a product in a row that engage the kill switch
+	MaxOrdersPerMinute   int
+	MaxOrdersPerHour     int
+}
+
+// DefaultRiskLimits is the [limits] section with the max_position and margin of every product
+func DefaultRiskLimits() RiskLimits {
+	c := config.Config
+	limits := RiskLimits{
+		Margin:               map[string]bool{},
+		MaxPosition:          map[string]float64{},
+		MaxOrderNotional:     c.LimitOrderNotional,
+		MaxDailyDrawdown:     c.LimitDailyDrawdown,
+		MaxWeeklyDrawdown:    c.LimitWeeklyDrawdown,
+		MaxConsecutiveLosses: c.LimitConsecutiveLosses,
+		MaxOrdersPerMinute:   c.LimitOrdersPerMinute,
+		MaxOrdersPerHour:     c.LimitOrdersPerHour,
+	}
+	for _, product := range c.Products {
+		limits.ProductCodes = append(limits.ProductCodes, product.ProductCode)
+		limits.MaxPosition[product.ProductCode] = product.MaxPosition
+		limits.Margin[product.ProductCode] = product.Margin
+	}
+	return limits
+}
+
+// LimitError is an order the risk limits rejected
+type LimitError struct {
+	Limit   string // e.g. "kill_switch" or "max_position"
+	Message string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("risk limit %s: %s", e.Limit, e.Message)
+}
+
+// guardedExchange checks every order against the risk limits before the Exchange it wraps sends it
+type guardedExchange struct {
+	Exchange
+	limits RiskLimits
+	mu     sync.Mutex
+	sent   []time.Time // orders sent within the last hour
+}
+
+// guardedParentOrderExchange checks the special orders too
+type guardedParentOrderExchange struct {
+	*guardedExchange
+	parent ParentOrderExchange
+}
+
+// NewGuardedExchange puts limits in front of the orders of exchange, it keeps the special orders of exchange
+func NewGuardedExchange(exchange Exchange, limits RiskLimits) Exchange {
+	guard := &guardedExchange{Exchange: exchange, limits: limits}
+	if parent, ok := exchange.(ParentOrderExchange); ok {
+		return &guardedParentOrderExchange{guardedExchange: guard, parent: parent}
+	}
+	return guard
+}
+
+// SendOrder sends order once it passed the limits, a rejection is a *LimitError
+func (g *guardedExchange) SendOrder(order *bitflyer.Order) (*bitflyer.ResponseSendChildOrder, error) {
+	closing, err := g.checkOrder(order.ProductCode, order.Side, order.Size, order.Price)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.countOrder(closing); err != nil {
+		return nil, err
+	}
+	return g.Exchange.SendOrder(order)
+}
+
+// SendParentOrder sends order once every order of it passed the limits, it counts as one order
+// that closes a position when all of its orders do
+func (g *guardedParentOrderExchange) SendParentOrder(order *bitflyer.ParentOrder) (*bitflyer.ResponseSendParentOrder, error) {
+	closing := true
+	for _, parameter := range order.Parameters {
+		price := parameter.Price
+		if price == 0 {
+			price = parameter.TriggerPrice
+		}
+		closes, err := g.checkOrder(parameter.ProductCode, parameter.Side, parameter.Size, price)
+		if err != nil {
+			return nil, err
+		}
+		closing = closing && closes
+	}
+	if err := g.countOrder(closing); err != nil {
+		return nil, err
+	}
+	return g.parent.SendParentOrder(order)
+}
+
+func (g *guardedParentOrderExchange) CancelParentOrder(productCode, parentOrderAcceptanceID string) error {
+	return g.parent.CancelParentOrder(productCode, parentOrderAcceptanceID)
+}
+
+func (g *guardedParentOrderExchange) ListParentOrders(query bitflyer.ParentOrderQuery) ([]bitflyer.ParentOrderStatus, error) {
+	return g.parent.ListParentOrders(query)
+}
+
+// checkOrder checks an order of size at price, 0 for the ticker, against the kill switch and the position,
+// notional, loss and drawdown limits; an order reducing the position held, a sell of coin already held
+// or a buy back of a short one, closes a position and always passes, closing is true for it
+func (g *guardedExchange) checkOrder(productCode, side string, size, price float64) (closing bool, err error) {
+	balances, err := g.GetBalance()
+	if err != nil {
+		return false, err
+	}
+	coinCode, currencyCode := splitProductCode(productCode)
+	// held is negative when short
+	held := balanceAmount(balances, coinCode)
+	if g.limits.Margin[productCode] {
+		positions, err := g.GetPositions(productCode)
+		if err != nil {
+			return false, err
+		}
+		held = netPosition(positions)
+	}
+	signed := size
+	if side == "SELL" {
+		signed = -size
+	}
+	if held != 0 && (held > 0) != (signed > 0) && size <= math.Abs(held) {
+		return true, nil
+	}
+
+	killSwitch, err := models.GetKillSwitch()
+	if err != nil {
+		return false, err
+	}
+	if killSwitch.Engaged {
+		return false, g.reject(productCode, &LimitError{Limit: "kill_switch", Message: killSwitch.Reason})
+	}
+	if maxPosition := g.limits.MaxPosition[productCode]; maxPosition > 0 && math.Abs(held+signed) > maxPosition {
+		message := fmt.Sprintf("holding %f, ordering %s %f, max %f", held, side, size, maxPosition)
+		return false, g.reject(productCode, &LimitError{Limit: "max_position", Message: message})
+	}
+	if g.limits.MaxOrderNotional > 0 {
+		if price == 0 {
+			if price, err = g.tickerPrice(productCode, side); err != nil {
+				return false, err
+			}
+		}
+		if notional := size * price; notional > g.limits.MaxOrderNotional {
+			message := fmt.Sprintf("order worth %f, max %f", notional, g.limits.MaxOrderNotional)
+			return false, g.reject(productCode, &LimitError{Limit: "max_order_notional", Message: message})
+		}
+	}
+	if maxLosses := g.limits.MaxConsecutiveLosses; maxLosses > 0 {
+		// only losses since the kill switch was last released count
+		losses, err := models.ConsecutiveLosses(productCode, killSwitch.UpdatedAt)
+		if err != nil {
+			return false, err
+		}
+		if losses >= maxLosses {
+			return false, g.engage(productCode, "max_consecutive_losses", fmt.Sprintf("%d losing trades of %s in a row", losses, productCode))
+		}
+	}
+	if g.limits.MaxDailyDrawdown > 0 || g.limits.MaxWeeklyDrawdown > 0 {
+		return false, g.checkDrawdown(productCode, balances, currencyCode)
+	}
+	return false, nil
+}
+
+// checkDrawdown values the account and engages the kill switch once it fell too far below its peak of the day or week,
+// margin products count with the collateral and the profit of the open positions
+func (g *guardedExchange) checkDrawdown(productCode string, balances []bitflyer.Balance, currencyCode string) error {
+	equity := balanceAmount(balances, currencyCode)
+	margin := false
+	for _, code := range g.limits.ProductCodes {
+		coinCode, currency := splitProductCode(code)
+		if currency != currencyCode {
+			continue
+		}
+		if g.limits.Margin[code] {
+			margin = true
+			continue
+		}
+		amount := balanceAmount(balances, coinCode)
+		if amount == 0 {
+			continue
+		}
+		ticker, err := g.GetTicker(code)
+		if err != nil {
+			return err
+		}
+		equity += amount * ticker.GetMidPrice()
+	}
+	if margin {
+		collateral, err := g.GetCollateral()
+		if err != nil {
+			return err
+		}
+		equity += collateral.Collateral + collateral.OpenPositionPnl
+	}
+
+	now := time.Now()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	week := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	periods := []struct {
+		name  string
+		limit string
+		start time.Time
+		max   float64
+	}{
+		{"day", "max_daily_drawdown", day, g.limits.MaxDailyDrawdown},
+		{"week", "max_weekly_drawdown", week, g.limits.MaxWeeklyDrawdown},
+	}
+	for _, period := range periods {
+		if period.max <= 0 {
+			continue
+		}
+		peak, err := models.UpdateEquityPeak(period.name, period.start, equity)
+		if err != nil {
+			return err
+		}
+		if peak.Peak <= 0 {
+			continue
+		}
+		if drawdown := (peak.Peak - equity) / peak.Peak * 100; drawdown >= period.max {
+			message := fmt.Sprintf("equity %f is %f%% below the peak %f of the %s", equity, drawdown, peak.Peak, period.name)
+			return g.engage(productCode, period.limit, message)
+		}
+	}
+	return nil
+}
+
+// countOrder records an order about to be sent, unless it would exceed the order rates;
+// an order closing a position is always recorded
+func (g *guardedExchange) countOrder(closing bool) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for len(g.sent) > 0 && now.Sub(g.sent[0]) >= time.Hour {
+		g.sent = g.sent[1:]
+	}
+	lastMinute := 0
+	for _, t := range g.sent {
+		if now.Sub(t) < time.Minute {
+			lastMinute++
+		}
+	}
+	if closing {
+		g.sent = append(g.sent, now)
+		return nil
+	}
+	if limit := g.limits.MaxOrdersPerMinute; limit > 0 && lastMinute >= limit {
+		return g.reject("", &LimitError{Limit: "max_orders_per_minute", Message: fmt.Sprintf("%d orders in the last minute", lastMinute)})
+	}
+	if limit := g.limits.MaxOrdersPerHour; limit > 0 && len(g.sent) >= limit {
+		return g.reject("", &LimitError{Limit: "max_orders_per_hour", Message: fmt.Sprintf("%d orders in the last hour", len(g.sent))})
+	}
+	g.sent = append(g.sent, now)
+	return nil
+}
+
+// engage engages the kill switch because limit was hit and rejects the order
+func (g *guardedExchange) engage(productCode, limit, message string) error {
+	if _, err := models.SetKillSwitch(true, limit+": "+message); err != nil {
+		log.Printf("action=engage product_code=%s limit=%s err=%s", productCode, limit, err.Error())
+	}
+	log.Printf("action=engage product_code=%s status=kill_switch limit=%s %s", productCode, limit, message)
+	return g.reject(productCode, &LimitError{Limit: limit, Message: message})
+}
+
+func (g *guardedExchange) reject(productCode string, err *LimitError) error {
+	log.Printf("action=checkOrder product_code=%s status=rejected limit=%s err=%s", productCode, err.Limit, err.Message)
+	return err
+}
+
+// tickerPrice is the price a market order of side fills at about
+func (g *guardedExchange) tickerPrice(productCode, side string) (float64, error) {
+	ticker, err := g.GetTicker(productCode)
+	if err != nil {
+		return 0, err
+	}
+	if side == "BUY" {
+		return ticker.BestAsk, nil
+	}
+	return ticker.BestBid, nil
+}
+
+// splitProductCode returns the coin and the currency of productCode, FX_BTC_JPY trades BTC against JPY
+func splitProductCode(productCode string) (coinCode, currencyCode string) {
+	codes := strings.Split(productCode, "_")
+	if len(codes) < 2 {
+		return productCode, ""
+	}
+	return codes[len(codes)-2], codes[len(codes)-1]
+}
+
+// netPosition is the size of the margin positions netted, negative when short
+func netPosition(positions []bitflyer.Position) float64 {
+	size := 0.0
+	for _, position := range positions {
+		if position.Side == "SELL" {
+			size -= position.Size
+		} else {
+			size += position.Size
+		}
+	}
+	return roundSize(size)
+}
+
+// balanceAmount is the amount of code in balances, including what open orders hold
+func balanceAmount(balances []bitflyer.Balance, code string) float64 {
+	for _, balance := range balances {
+		if balance.CurrentCode == code {
+			return balance.Amount
+		}
+	}
+	return 0
+}
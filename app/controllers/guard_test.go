@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"errors"
+	"go-trading-bot/app/models"
+	"go-trading-bot/bitflyer"
+	"testing"
+)
+
+// releaseKillSwitch releases the kill switch now and once the test is over
+func releaseKillSwitch(t *testing.T) {
+	t.Helper()
+	if _, err := models.SetKillSwitch(false, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := models.SetKillSwitch(false, ""); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func wantLimit(t *testing.T, err error, limit string) {
+	t.Helper()
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != limit {
+		t.Fatalf("SendOrder() err = %v, want the %s limit", err, limit)
+	}
+}
+
+func TestGuardedExchangeLimits(t *testing.T) {
+	releaseKillSwitch(t)
+	exchange := &fakeExchange{
+		balances: []bitflyer.Balance{{CurrentCode: "GUARD", Amount: 1}, {CurrentCode: "JPY", Amount: 100000}},
+		ticker:   bitflyer.Ticker{BestBid: 990, BestAsk: 1010, Ltp: 1000},
+	}
+	guard := NewGuardedExchange(exchange, RiskLimits{
+		MaxPosition:      map[string]float64{"GUARD_JPY": 2},
+		MaxOrderNotional: 1000,
+	})
+
+	_, err := guard.SendOrder(&bitflyer.Order{ProductCode: "GUARD_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 1.5})
+	wantLimit(t, err, "max_position")
+	// the ticker ask prices a market order
+	_, err = guard.SendOrder(&bitflyer.Order{ProductCode: "GUARD_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.995})
+	wantLimit(t, err, "max_order_notional")
+	_, err = guard.SendOrder(&bitflyer.Order{ProductCode: "GUARD_JPY", ChildOrderType: "LIMIT", Side: "BUY", Size: 0.6, Price: 2000})
+	wantLimit(t, err, "max_order_notional")
+	if _, err := guard.SendOrder(&bitflyer.Order{ProductCode: "GUARD_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.5}); err != nil {
+		t.Fatalf("SendOrder() within the limits err = %v", err)
+	}
+	// selling the coin held closes the position, whatever it is worth
+	if _, err := guard.SendOrder(&bitflyer.Order{ProductCode: "GUARD_JPY", ChildOrderType: "LIMIT", Side: "SELL", Size: 1, Price: 5000}); err != nil {
+		t.Fatalf("SendOrder() closing err = %v", err)
+	}
+	if len(exchange.sent) != 2 {
+		t.Errorf("sent %d orders, want 2", len(exchange.sent))
+	}
+}
+
+func TestGuardedExchangeOrderRate(t *testing.T) {
+	releaseKillSwitch(t)
+	exchange := &fakeExchange{
+		balances: []bitflyer.Balance{{CurrentCode: "RATE", Amount: 1}, {CurrentCode: "JPY", Amount: 100000}},
+		ticker:   bitflyer.Ticker{BestBid: 990, BestAsk: 1010, Ltp: 1000},
+	}
+	guard := NewGuardedExchange(exchange, RiskLimits{MaxOrdersPerMinute: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := guard.SendOrder(&bitflyer.Order{ProductCode: "RATE_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.1}); err != nil {
+			t.Fatalf("SendOrder() %d err = %v", i, err)
+		}
+	}
+	_, err := guard.SendOrder(&bitflyer.Order{ProductCode: "RATE_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.1})
+	wantLimit(t, err, "max_orders_per_minute")
+	if _, err := guard.SendOrder(&bitflyer.Order{ProductCode: "RATE_JPY", ChildOrderType: "MARKET", Side: "SELL", Size: 0.5}); err != nil {
+		t.Fatalf("SendOrder() closing over the rate err = %v, want it sent", err)
+	}
+}
+
+func TestGuardedExchangeKillSwitch(t *testing.T) {
+	releaseKillSwitch(t)
+	exchange := &fakeExchange{
+		balances: []bitflyer.Balance{{CurrentCode: "KILL", Amount: 1}, {CurrentCode: "JPY", Amount: 1000}},
+		ticker:   bitflyer.Ticker{BestBid: 1000, BestAsk: 1000, Ltp: 1000},
+	}
+	guard := NewGuardedExchange(exchange, RiskLimits{ProductCodes: []string{"KILL_JPY"}, MaxDailyDrawdown: 10})
+	if _, err := guard.SendOrder(&bitflyer.Order{ProductCode: "KILL_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.1}); err != nil {
+		t.Fatalf("SendOrder() at the peak err = %v", err)
+	}
+
+	// equity falls from 2000 to 1500, 25% below the peak of the day
+	exchange.ticker = bitflyer.Ticker{BestBid: 500, BestAsk: 500, Ltp: 500}
+	_, err := guard.SendOrder(&bitflyer.Order{ProductCode: "KILL_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.1})
+	wantLimit(t, err, "max_daily_drawdown")
+	killSwitch, err := models.GetKillSwitch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !killSwitch.Engaged {
+		t.Fatal("GetKillSwitch() is released, want it engaged by the drawdown")
+	}
+
+	exchange.ticker = bitflyer.Ticker{BestBid: 1000, BestAsk: 1000, Ltp: 1000}
+	_, err = guard.SendOrder(&bitflyer.Order{ProductCode: "KILL_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.1})
+	wantLimit(t, err, "kill_switch")
+	if _, err := guard.SendOrder(&bitflyer.Order{ProductCode: "KILL_JPY", ChildOrderType: "MARKET", Side: "SELL", Size: 1}); err != nil {
+		t.Fatalf("SendOrder() closing with the kill switch engaged err = %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+package controllers
+
+import (
+	"go-trading-bot/app/models"
+	"go-trading-bot/config"
+	"os"
+	"testing"
+)
+
+// TestMain removes the database the package created in its directory
+func TestMain(m *testing.M) {
+	code := m.Run()
+	models.DbConnection.Close()
+	os.Remove(config.Config.DbName)
+	os.Exit(code)
+}
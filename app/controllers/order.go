@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"go-trading-bot/app/models"
+	"go-trading-bot/bitflyer"
+	"go-trading-bot/config"
+	"log"
+	"math"
+	"time"
+)
+
+// OrderConfig is how the AI gets its orders filled, the [order] section
+type OrderConfig struct {
+	Type            string        // "MARKET" or "LIMIT"
+	InsideSpread    float64       // how far into the spread limit orders go, 0 joins the best bid/ask
+	TickSize        float64       // limit prices are rounded to multiples of it
+	RepriceInterval time.Duration // how often a resting limit order is checked and moved
+	MaxSlippage     float64       // how far from the first limit price repricing may chase, in percent
+	Timeout         time.Duration // how long limit orders may rest in total
+	MarketFallback  bool          // send what is left as a MARKET order after Timeout
+}
+
+// DefaultOrderConfig is the [order] section with the tick size of productCode
+func DefaultOrderConfig(productCode string) OrderConfig {
+	c := config.Config
+	tickSize := 1.0
+	if product, ok := c.Product(productCode); ok && product.TickSize > 0 {
+		tickSize = product.TickSize
+	}
+	return OrderConfig{
+		Type:            c.OrderType,
+		InsideSpread:    c.OrderInsideSpread,
+		TickSize:        tickSize,
+		RepriceInterval: c.OrderRepriceInterval,
+		MaxSlippage:     c.OrderMaxSlippagePercent,
+		Timeout:         c.OrderTimeout,
+		MarketFallback:  c.OrderMarketFallback,
+	}
+}
+
+// orderFill is what the orders of one trade executed in total
+type orderFill struct {
+	ChildOrderAcceptanceID string // the last order placed
+	Size                   float64
+	value                  float64 // executed size times price over every order
+	unsettled              bool    // the last order was not seen in a final state, it may still fill
+}
+
+func (f *orderFill) add(order bitflyer.Order) {
+	f.Size += order.ExecutedSize
+	f.value += order.ExecutedSize * order.AveragePrice
+}
+
+// merge adds what other executed to f
+func (f *orderFill) merge(other orderFill) {
+	f.Size += other.Size
+	f.value += other.value
+}
+
+// AveragePrice is the price the executed size was filled at on average
+func (f *orderFill) AveragePrice() float64 {
+	if f.Size == 0 {
+		return 0
+	}
+	return f.value / f.Size
+}
+
+// executeOrder buys or sells size with the configured order type and returns what was executed
+// limit orders that are not filled after the timeout are cancelled and, with MarketFallback,
+// the rest is sent as a MARKET order, unless the last limit order may still fill
+func (ai *AI) executeOrder(side string, size float64) orderFill {
+	var fill orderFill
+	if ai.Order.Type == "LIMIT" {
+		var settled bool
+		fill, settled = ai.executeLimit(side, size)
+		fill.unsettled = !settled
+		remaining := roundSize(size - fill.Size)
+		if remaining <= 0 || !ai.Order.MarketFallback || ai.ctx.Err() != nil {
+			return fill
+		}
+		if !settled {
+			log.Printf("action=executeOrder product_code=%s status=no_market_fallback side=%s remaining=%f id=%s", ai.ProductCode, side, remaining, fill.ChildOrderAcceptanceID)
+			return fill
+		}
+		log.Printf("action=executeOrder product_code=%s status=market_fallback side=%s remaining=%f", ai.ProductCode, side, remaining)
+		size = remaining
+	}
+
+	order := &bitflyer.Order{
+		ProductCode:     ai.ProductCode,
+		ChildOrderType:  "MARKET",
+		Side:            side,
+		Size:            size,
+		MinuteToExpires: ai.MinuteToExpires,
+		TimeInForce:     "GTC",
+	}
+	id := ai.sendOrder(order)
+	if id == "" {
+		return fill
+	}
+	fill.ChildOrderAcceptanceID = id
+	executed, ok := ai.waitUntilOrderComplete(id)
+	if ok {
+		fill.add(executed)
+	}
+	fill.unsettled = !ok
+	return fill
+}
+
+// executeLimit rests limit orders at the best bid/ask until size is filled or the timeout,
+// every RepriceInterval an order the book moved away from is cancelled and placed again for the rest
+// settled is false when the last order could not be seen in a final state, so it may still fill
+func (ai *AI) executeLimit(side string, size float64) (fill orderFill, settled bool) {
+	ticker, err := ai.API.GetTicker(ai.ProductCode)
+	if err != nil {
+		log.Printf("action=executeLimit product_code=%s err=%s", ai.ProductCode, err.Error())
+		return fill, true
+	}
+	// repricing chases the market up to MaxSlippage away from the first price
+	bound := ai.limitPrice(side, *ticker, 0)
+	if side == "BUY" {
+		bound = ai.roundPrice(bound*(1+ai.Order.MaxSlippage/100), side)
+	} else {
+		bound = ai.roundPrice(bound*(1-ai.Order.MaxSlippage/100), side)
+	}
+	deadline := time.Now().Add(ai.Order.Timeout)
+	// an order we lose track of expires on its own shortly after the timeout
+	minuteToExpires := int(math.Ceil(ai.Order.Timeout.Minutes())) + 1
+
+	for time.Now().Before(deadline) && ai.ctx.Err() == nil {
+		remaining := roundSize(size - fill.Size)
+		if remaining <= 0 {
+			break
+		}
+		price := ai.limitPrice(side, *ticker, bound)
+		order := &bitflyer.Order{
+			ProductCode:     ai.ProductCode,
+			ChildOrderType:  "LIMIT",
+			Side:            side,
+			Price:           price,
+			Size:            remaining,
+			MinuteToExpires: minuteToExpires,
+			TimeInForce:     "GTC",
+		}
+		id := ai.sendOrder(order)
+		if id == "" {
+			break
+		}
+		fill.ChildOrderAcceptanceID = id
+		executed, ok := ai.restOrder(id, side, price, bound, deadline)
+		fill.add(executed)
+		if !ok {
+			// the order could not be cancelled, placing another one could fill twice
+			return fill, false
+		}
+		if executed.ChildOrderState == "COMPLETED" {
+			break
+		}
+		if ticker, err = ai.API.GetTicker(ai.ProductCode); err != nil {
+			log.Printf("action=executeLimit product_code=%s err=%s", ai.ProductCode, err.Error())
+			break
+		}
+	}
+	return fill, true
+}
+
+// restOrder waits for the limit order id at price to fill, it cancels the order once the best bid/ask
+// moved to another price, at the deadline or when the AI stops
+// it returns the final state of the order, false when it is still active
+func (ai *AI) restOrder(id, side string, price, bound float64, deadline time.Time) (bitflyer.Order, bool) {
+	interval := time.NewTicker(ai.Order.RepriceInterval)
+	defer interval.Stop()
+	expire := time.NewTimer(time.Until(deadline))
+	defer expire.Stop()
+	for {
+		select {
+		case <-ai.ctx.Done():
+			return ai.cancelOrder(id)
+		case <-expire.C:
+			return ai.cancelOrder(id)
+		case <-interval.C:
+			order, found := ai.getOrder(id)
+			if !found {
+				// bitFlyer lists orders a moment after accepting them
+				continue
+			}
+			if order.ChildOrderState != "ACTIVE" {
+				return order, true
+			}
+			ticker, err := ai.API.GetTicker(ai.ProductCode)
+			if err != nil {
+				continue
+			}
+			if target := ai.limitPrice(side, *ticker, bound); target != price {
+				log.Printf("action=restOrder product_code=%s status=reprice id=%s price=%f target=%f", ai.ProductCode, id, price, target)
+				return ai.cancelOrder(id)
+			}
+		}
+	}
+}
+
+// cancelOrder cancels id and waits for its final state, the order may have filled in the meantime
+func (ai *AI) cancelOrder(id string) (bitflyer.Order, bool) {
+	if err := ai.API.CancelChildOrder(ai.ProductCode, id); err != nil {
+		log.Printf("action=cancelOrder product_code=%s id=%s err=%s", ai.ProductCode, id, err.Error())
+	}
+	// the cancel is processed asynchronously
+	for i := 0; i < 5; i++ {
+		if order, found := ai.getOrder(id); found && order.ChildOrderState != "ACTIVE" {
+			return order, true
+		}
+		time.Sleep(time.Second)
+	}
+	order, _ := ai.getOrder(id)
+	log.Printf("action=cancelOrder product_code=%s id=%s status=still_active", ai.ProductCode, id)
+	return order, false
+}
+
+// getOrder returns the current state of the order id
+func (ai *AI) getOrder(id string) (bitflyer.Order, bool) {
+	orders, err := ai.API.ListOrder(map[string]string{
+		"product_code":              ai.ProductCode,
+		"child_order_acceptance_id": id,
+	})
+	if err != nil || len(orders) == 0 {
+		return bitflyer.Order{}, false
+	}
+	return orders[0], true
+}
+
+// sendOrder places order and returns its acceptance id, empty when it was rejected
+func (ai *AI) sendOrder(order *bitflyer.Order) string {
+	log.Printf("status=order order=%+v", order)
+	resp, err := ai.API.SendOrder(order)
+	if err != nil {
+		// e.g. insufficient funds, a *bitflyer.APIError
+		log.Printf("action=sendOrder order=%+v status=rejected err=%s", order, err.Error())
+		return ""
+	}
+	// Reconcile only trusts the fills of the orders the bot sent
+	sent := models.SentOrder{
+		ChildOrderAcceptanceID: resp.ChildOrderAcceptanceID,
+		ProductCode:            order.ProductCode,
+		Side:                   order.Side,
+		Size:                   order.Size,
+		SentAt:                 time.Now(),
+	}
+	if err := sent.Save(); err != nil {
+		log.Printf("action=sendOrder product_code=%s id=%s err=%s", order.ProductCode, resp.ChildOrderAcceptanceID, err.Error())
+	}
+	return resp.ChildOrderAcceptanceID
+}
+
+// limitPrice is the price inside the spread a limit order of side goes to, never crossing it,
+// capped at bound unless bound is 0
+func (ai *AI) limitPrice(side string, ticker bitflyer.Ticker, bound float64) float64 {
+	spread := ticker.BestAsk - ticker.BestBid
+	if side == "BUY" {
+		price := ai.roundPrice(ticker.BestBid+spread*ai.Order.InsideSpread, side)
+		if price >= ticker.BestAsk {
+			price = math.Max(ticker.BestAsk-ai.Order.TickSize, ticker.BestBid)
+		}
+		if bound > 0 && price > bound {
+			price = bound
+		}
+		return price
+	}
+	price := ai.roundPrice(ticker.BestAsk-spread*ai.Order.InsideSpread, side)
+	if price <= ticker.BestBid {
+		price = math.Min(ticker.BestBid+ai.Order.TickSize, ticker.BestAsk)
+	}
+	if bound > 0 && price < bound {
+		price = bound
+	}
+	return price
+}
+
+// roundPrice rounds price to the tick size, down for buys and up for sells so it stays on our side
+func (ai *AI) roundPrice(price float64, side string) float64 {
+	ticks := price / ai.Order.TickSize
+	if side == "BUY" {
+		ticks = math.Floor(ticks + 1e-9)
+	} else {
+		ticks = math.Ceil(ticks - 1e-9)
+	}
+	return math.Round(ticks*ai.Order.TickSize*1e8) / 1e8
+}
+
+// roundSize drops the float noise of sizes subtracted from each other
+func roundSize(size float64) float64 {
+	return math.Round(size*1e8) / 1e8
+}
+
+// waitUntilOrderComplete polls the order id until it is COMPLETED, false when it is not after 1m20s
+func (ai *AI) waitUntilOrderComplete(id string) (bitflyer.Order, bool) {
+	expire := time.After(time.Minute + (20 * time.Second))
+	interval := time.NewTicker(15 * time.Second)
+	defer interval.Stop()
+	for {
+		select {
+		case <-expire:
+			return bitflyer.Order{}, false
+		case <-interval.C:
+			order, found := ai.getOrder(id)
+			if !found {
+				return bitflyer.Order{}, false
+			}
+			if order.ChildOrderState == "COMPLETED" {
+				return order, true
+			}
+		}
+	}
+}
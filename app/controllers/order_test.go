@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"context"
+	"go-trading-bot/bitflyer"
+	"testing"
+	"time"
+)
+
+func TestLimitPrice(t *testing.T) {
+	ticker := bitflyer.Ticker{BestBid: 100, BestAsk: 110}
+	tests := []struct {
+		name         string
+		side         string
+		insideSpread float64
+		bound        float64
+		want         float64
+	}{
+		{name: "buy joins the best bid", side: "BUY", want: 100},
+		{name: "sell joins the best ask", side: "SELL", want: 110},
+		{name: "buy inside the spread rounds down", side: "BUY", insideSpread: 0.45, want: 104},
+		{name: "sell inside the spread rounds up", side: "SELL", insideSpread: 0.45, want: 106},
+		{name: "buy never crosses the ask", side: "BUY", insideSpread: 1, want: 109},
+		{name: "sell never crosses the bid", side: "SELL", insideSpread: 1, want: 101},
+		{name: "buy capped at the bound", side: "BUY", insideSpread: 0.5, bound: 103, want: 103},
+		{name: "sell capped at the bound", side: "SELL", insideSpread: 0.5, bound: 107, want: 107},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ai := &AI{Order: OrderConfig{InsideSpread: tt.insideSpread, TickSize: 1}}
+			if got := ai.limitPrice(tt.side, ticker, tt.bound); got != tt.want {
+				t.Errorf("limitPrice() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testOrderAI is an AI sending LIMIT orders to exchange, checked every 10ms for at most timeout
+func testOrderAI(exchange Exchange, timeout time.Duration, fallback bool) *AI {
+	return &AI{
+		API:         exchange,
+		ProductCode: "ORDER_JPY",
+		Order:       OrderConfig{Type: "LIMIT", TickSize: 1, RepriceInterval: 10 * time.Millisecond, Timeout: timeout, MarketFallback: fallback},
+		ctx:         context.Background(),
+	}
+}
+
+func TestExecuteOrderLimitFilled(t *testing.T) {
+	exchange := &fakeExchange{ticker: bitflyer.Ticker{BestBid: 100, BestAsk: 110}}
+	fill := testOrderAI(exchange, time.Second, false).executeOrder("BUY", 0.1)
+	if fill.Size != 0.1 || fill.AveragePrice() != 100 || fill.unsettled {
+		t.Errorf("fill = %+v at %v, want 0.1 at the best bid, settled", fill, fill.AveragePrice())
+	}
+	if len(exchange.sent) != 1 || exchange.sent[0].ChildOrderType != "LIMIT" {
+		t.Errorf("sent = %+v, want one LIMIT order", exchange.sent)
+	}
+}
+
+func TestExecuteOrderLimitTimeout(t *testing.T) {
+	exchange := &fakeExchange{ticker: bitflyer.Ticker{BestBid: 100, BestAsk: 110}, sendState: "ACTIVE"}
+	fill := testOrderAI(exchange, 50*time.Millisecond, false).executeOrder("SELL", 0.1)
+	if fill.Size != 0 || fill.unsettled {
+		t.Errorf("fill = %+v, want nothing executed and the order settled", fill)
+	}
+	if len(exchange.canceled) != 1 || exchange.canceled[0] != fill.ChildOrderAcceptanceID {
+		t.Errorf("canceled = %v, want the resting order %s", exchange.canceled, fill.ChildOrderAcceptanceID)
+	}
+}
@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"go-trading-bot/app/models"
+	"go-trading-bot/bitflyer"
+	"log"
+	"math"
+	"time"
+)
+
+// Reconcile brings the signal events in line with the exchange, on start and after an order the AI lost track of,
+// so a crash or a timeout never makes it open the same position twice: it cancels the open child orders it sent
+// and did not record yet, then compares the position of the last signal event with the coin held, or the net
+// position on margin.
+// A position gone from the exchange is recorded as closed, at the price of the bot's fills or the ticker; a
+// position is only adopted as far as executions of orders the bot sent and did not record yet back it, coin the
+// bot did not buy is left alone. Every correction is stored in reconciliations
+func (ai *AI) Reconcile() {
+	if ai.BackTest {
+		return
+	}
+	// the child orders of the special order holding the exits stay
+	if plan := ai.ExitPlan(); ai.CancelOpenOrders && (plan == nil || plan.ParentOrderAcceptanceID == "") {
+		ai.cancelOpenOrders()
+	}
+	held, err := ai.heldPosition()
+	if err != nil {
+		log.Printf("action=Reconcile product_code=%s err=%s", ai.ProductCode, err.Error())
+		return
+	}
+	expected := ai.SignalEvents.Position()
+	actual := models.PositionFlat
+	switch {
+	case held > 0 && held >= ai.Sizing.MinSize:
+		actual = models.PositionLong
+	case held < 0 && -held >= ai.Sizing.MinSize:
+		actual = models.PositionShort
+	}
+	if expected != actual && ai.settleExitOrder(true) {
+		// the special order holding the exits closed the position while the bot was away
+		expected = ai.SignalEvents.Position()
+	}
+	if expected == actual {
+		log.Printf("action=Reconcile product_code=%s status=ok position=%s held=%f", ai.ProductCode, actual, held)
+		ai.markOrdersRecorded("")
+		return
+	}
+	log.Printf("action=Reconcile product_code=%s status=mismatch recorded=%s held=%f", ai.ProductCode, expected, held)
+	// every order checked here is recorded, whatever the outcome
+	defer ai.markOrdersRecorded("")
+
+	fills := ai.unrecordedFills()
+	recordedSize := ai.lastTradeSize()
+	now := time.Now()
+	closeSide := ""
+	if expected != models.PositionFlat {
+		closeSide = "SELL"
+		if expected == models.PositionShort {
+			closeSide = "BUY"
+		}
+		// a cancelled special order closed part of the position, it prices the close too
+		closeFill := fills[closeSide]
+		closeFill.merge(ai.takeExitPartial())
+		if ai.ExitPlan() != nil {
+			ai.closeExitPlan()
+		}
+		if !ai.recordCorrection(closeSide, now, recordedSize, closeFill) {
+			return
+		}
+		// signal events are stored by the second
+		now = now.Add(time.Second)
+	}
+	if actual == models.PositionFlat {
+		return
+	}
+	side := "BUY"
+	if actual == models.PositionShort {
+		side = "SELL"
+	}
+	fill := fills[side]
+	backed := fill.Size
+	if side == closeSide {
+		// a flip on margin, the fills of side closed the recorded position first
+		backed -= recordedSize
+	}
+	size := ai.Sizing.Round(math.Min(backed, math.Abs(held)))
+	if size < ai.Sizing.MinSize {
+		log.Printf("action=Reconcile product_code=%s status=not_adopted position=%s held=%f backed=%f", ai.ProductCode, actual, held, backed)
+		return
+	}
+	if !ai.recordCorrection(side, now, size, fill) {
+		return
+	}
+	// the position gets its exits like any other
+	entry := ai.SignalEvents.TradeSignals[len(ai.SignalEvents.TradeSignals)-1]
+	atr := 0.0
+	if df, err := models.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod); err == nil {
+		atr = ai.exitATR(df, len(df.Candles)-1)
+	}
+	ai.openExitPlan(entry.Side, entry.Price, entry.Size, atr)
+}
+
+// lastTradeSize is the size of the last signal event, 0 without one
+func (ai *AI) lastTradeSize() float64 {
+	n := len(ai.SignalEvents.TradeSignals)
+	if n == 0 {
+		return 0
+	}
+	return ai.SignalEvents.TradeSignals[n-1].Size
+}
+
+// cancelOpenOrders cancels the ACTIVE child orders of the product the bot sent and did not record yet,
+// an earlier run placed them and lost track; orders placed by hand are left alone
+func (ai *AI) cancelOpenOrders() {
+	sent, err := models.GetUnrecordedOrders(ai.ProductCode)
+	if err != nil {
+		log.Printf("action=cancelOpenOrders product_code=%s err=%s", ai.ProductCode, err.Error())
+		return
+	}
+	if len(sent) == 0 {
+		return
+	}
+	unrecorded := make(map[string]bool, len(sent))
+	for _, order := range sent {
+		unrecorded[order.ChildOrderAcceptanceID] = true
+	}
+	orders, err := ai.API.ListOrder(map[string]string{"product_code": ai.ProductCode, "child_order_state": "ACTIVE"})
+	if err != nil {
+		log.Printf("action=cancelOpenOrders product_code=%s err=%s", ai.ProductCode, err.Error())
+		return
+	}
+	for _, order := range orders {
+		if !unrecorded[order.ChildOrderAcceptanceID] {
+			continue
+		}
+		if err := ai.API.CancelChildOrder(ai.ProductCode, order.ChildOrderAcceptanceID); err != nil {
+			log.Printf("action=cancelOpenOrders product_code=%s id=%s err=%s", ai.ProductCode, order.ChildOrderAcceptanceID, err.Error())
+			continue
+		}
+		log.Printf("action=cancelOpenOrders product_code=%s id=%s side=%s outstanding_size=%f", ai.ProductCode, order.ChildOrderAcceptanceID, order.Side, order.OutstandingSize)
+		ai.saveReconciliation(models.Reconciliation{
+			Time:        time.Now(),
+			ProductCode: ai.ProductCode,
+			Kind:        models.ReconcileCancelOrder,
+			Side:        order.Side,
+			Price:       order.Price,
+			Size:        order.OutstandingSize,
+			Detail:      order.ChildOrderAcceptanceID,
+		})
+	}
+}
+
+// heldPosition is the position at the exchange, the coin held on spot, including what open orders hold,
+// and the net position on margin, negative when short
+func (ai *AI) heldPosition() (float64, error) {
+	if ai.Margin {
+		positions, err := ai.API.GetPositions(ai.ProductCode)
+		if err != nil {
+			return 0, err
+		}
+		return netPosition(positions), nil
+	}
+	balances, err := ai.API.GetBalance()
+	if err != nil {
+		return 0, err
+	}
+	return balanceAmount(balances, ai.CoinCode), nil
+}
+
+// unrecordedFills sums up by side what the orders the bot sent and did not record yet executed
+func (ai *AI) unrecordedFills() map[string]orderFill {
+	fills := map[string]orderFill{}
+	orders, err := models.GetUnrecordedOrders(ai.ProductCode)
+	if err != nil {
+		log.Printf("action=unrecordedFills product_code=%s err=%s", ai.ProductCode, err.Error())
+		return fills
+	}
+	for _, order := range orders {
+		executions, err := ai.API.GetMyExecutions(bitflyer.ExecutionQuery{
+			ProductCode:            ai.ProductCode,
+			ChildOrderAcceptanceID: order.ChildOrderAcceptanceID,
+		})
+		if err != nil {
+			log.Printf("action=unrecordedFills product_code=%s id=%s err=%s", ai.ProductCode, order.ChildOrderAcceptanceID, err.Error())
+			continue
+		}
+		fill := fills[order.Side]
+		for _, execution := range executions {
+			fill.Size += execution.Size
+			fill.value += execution.Size * execution.Price
+		}
+		if len(executions) > 0 {
+			fill.ChildOrderAcceptanceID = order.ChildOrderAcceptanceID
+		}
+		fills[order.Side] = fill
+	}
+	return fills
+}
+
+// markOrdersRecorded marks the orders the bot sent so far as recorded in the signal events, but except
+func (ai *AI) markOrdersRecorded(except string) {
+	if err := models.MarkOrdersRecorded(ai.ProductCode, time.Now(), except); err != nil {
+		log.Printf("action=markOrdersRecorded product_code=%s err=%s", ai.ProductCode, err.Error())
+	}
+}
+
+// recordCorrection records a trade of side and size in the signal events, at the average price of fill, the
+// bot's unrecorded fills of side, or else at the ticker, and stores it as a correction
+func (ai *AI) recordCorrection(side string, executeTime time.Time, size float64, fill orderFill) bool {
+	correction := models.Reconciliation{Time: executeTime, ProductCode: ai.ProductCode, Kind: models.ReconcilePosition, Side: side, Size: size}
+	if fill.Size > 0 {
+		correction.Kind, correction.Price, correction.Detail = models.ReconcileMissedFill, fill.AveragePrice(), fill.ChildOrderAcceptanceID
+	}
+	if correction.Price <= 0 {
+		ticker, err := ai.API.GetTicker(ai.ProductCode)
+		if err != nil {
+			log.Printf("action=recordCorrection product_code=%s err=%s", ai.ProductCode, err.Error())
+			return false
+		}
+		correction.Price = ticker.BestBid
+		if side == "BUY" {
+			correction.Price = ticker.BestAsk
+		}
+	}
+	recorded := false
+	if side == "BUY" {
+		recorded = ai.SignalEvents.Buy(ai.ProductCode, executeTime, correction.Price, size, true)
+	} else {
+		recorded = ai.SignalEvents.Sell(ai.ProductCode, executeTime, correction.Price, size, true)
+	}
+	if !recorded {
+		log.Printf("action=recordCorrection product_code=%s status=not_recorded correction=%+v", ai.ProductCode, correction)
+		return false
+	}
+	log.Printf("action=recordCorrection product_code=%s correction=%+v position=%s", ai.ProductCode, correction, ai.SignalEvents.Position())
+	ai.saveReconciliation(correction)
+	return true
+}
+
+func (ai *AI) saveReconciliation(correction models.Reconciliation) {
+	if err := correction.Save(); err != nil {
+		log.Printf("action=saveReconciliation product_code=%s err=%s", ai.ProductCode, err.Error())
+	}
+}
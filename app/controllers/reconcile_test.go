@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"go-trading-bot/app/models"
+	"go-trading-bot/bitflyer"
+	"go-trading-bot/sizing"
+	"testing"
+	"time"
+)
+
+// testReconcileAI is an AI of productCode trading spot on exchange, flat in the signal events
+func testReconcileAI(productCode string, exchange Exchange) *AI {
+	return &AI{
+		API:          exchange,
+		ProductCode:  productCode,
+		CoinCode:     "BTC",
+		CurrencyCode: "JPY",
+		Duration:     time.Minute,
+		SignalEvents: models.NewTradeSignalEvents(),
+		Sizing:       sizing.Config{MinSize: 0.001, SizeStep: 0.00000001},
+	}
+}
+
+func saveSentOrder(t *testing.T, productCode, id, side string, size float64) {
+	t.Helper()
+	order := models.SentOrder{ChildOrderAcceptanceID: id, ProductCode: productCode, Side: side, Size: size, SentAt: time.Now().Add(-time.Minute)}
+	if err := order.Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelOpenOrdersOnlyUnrecorded(t *testing.T) {
+	exchange := &fakeExchange{orders: []bitflyer.Order{
+		{ChildOrderAcceptanceID: "JRF-BOT", Side: "BUY", ChildOrderState: "ACTIVE", OutstandingSize: 0.1},
+		{ChildOrderAcceptanceID: "JRF-HAND", Side: "SELL", ChildOrderState: "ACTIVE", OutstandingSize: 0.2},
+	}}
+	ai := testReconcileAI("CANCEL_JPY", exchange)
+	saveSentOrder(t, ai.ProductCode, "JRF-BOT", "BUY", 0.1)
+	ai.cancelOpenOrders()
+	if len(exchange.canceled) != 1 || exchange.canceled[0] != "JRF-BOT" {
+		t.Errorf("canceled = %v, want only the order the bot sent", exchange.canceled)
+	}
+}
+
+func TestReconcileAdoptsBackedFills(t *testing.T) {
+	exchange := &fakeExchange{
+		balances: []bitflyer.Balance{{CurrentCode: "BTC", Amount: 0.3, Available: 0.3}},
+		executions: map[string][]bitflyer.MyExecution{
+			"JRF-LOST": {{Side: "BUY", Price: 100, Size: 0.06}, {Side: "BUY", Price: 110, Size: 0.04}},
+		},
+	}
+	ai := testReconcileAI("ADOPT_JPY", exchange)
+	saveSentOrder(t, ai.ProductCode, "JRF-LOST", "BUY", 0.1)
+	ai.Reconcile()
+
+	if ai.SignalEvents.Position() != models.PositionLong {
+		t.Fatalf("Position() = %s, want the backed buy adopted", ai.SignalEvents.Position())
+	}
+	// only the 0.1 the bot's order filled, the rest of the coin is not the bot's
+	got := ai.SignalEvents.TradeSignals[len(ai.SignalEvents.TradeSignals)-1]
+	if got.Side != "BUY" || got.Size != 0.1 || got.Price != 104 {
+		t.Errorf("adopted %s %v at %v, want BUY 0.1 at 104", got.Side, got.Size, got.Price)
+	}
+	if orders, err := models.GetUnrecordedOrders(ai.ProductCode); err != nil || len(orders) != 0 {
+		t.Errorf("GetUnrecordedOrders() = %v, %v, want the order recorded", orders, err)
+	}
+}
+
+func TestReconcileLeavesCoinBoughtByHand(t *testing.T) {
+	exchange := &fakeExchange{balances: []bitflyer.Balance{{CurrentCode: "BTC", Amount: 0.3, Available: 0.3}}}
+	ai := testReconcileAI("HAND_JPY", exchange)
+	ai.Reconcile()
+	if ai.SignalEvents.Position() != models.PositionFlat {
+		t.Errorf("Position() = %s, want coin without the bot's fills left alone", ai.SignalEvents.Position())
+	}
+}
@@ -0,0 +1,388 @@
+package controllers
+
+import (
+	"go-trading-bot/app/models"
+	"go-trading-bot/bitflyer"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// exitSyncInterval is how often the special order holding the exits is checked
+	exitSyncInterval = 15 * time.Second
+	// exitRetryInterval is how long a failed exit waits before it is tried again
+	exitRetryInterval = 15 * time.Second
+	// maxParentOrderMinutes is the longest bitFlyer keeps a special order
+	maxParentOrderMinutes = 43200
+)
+
+// loadExitPlan resumes the exits of the position open before the restart
+func (ai *AI) loadExitPlan() {
+	plan, err := models.GetExitPlan(ai.ProductCode)
+	if err != nil {
+		log.Printf("action=loadExitPlan product_code=%s err=%s", ai.ProductCode, err.Error())
+		return
+	}
+	if plan == nil {
+		return
+	}
+	if ai.SignalEvents.Position() == models.PositionFlat {
+		// the position was closed but the plan was not deleted
+		log.Printf("action=loadExitPlan product_code=%s status=stale plan=%+v", ai.ProductCode, plan)
+		ai.deleteExitPlan()
+		return
+	}
+	ai.exitPlan = plan
+	log.Printf("action=loadExitPlan product_code=%s plan=%+v", ai.ProductCode, plan)
+}
+
+// ExitPlan returns a copy of the exits of the open position, nil when there is none
+func (ai *AI) ExitPlan() *models.ExitPlan {
+	ai.exitMu.Lock()
+	defer ai.exitMu.Unlock()
+	if ai.exitPlan == nil {
+		return nil
+	}
+	plan := *ai.exitPlan
+	return &plan
+}
+
+// openExitPlan sets the exits of the position just opened by side at entryPrice, atr is the ATR at the entry
+// with ExchangeExits the exits are placed at the exchange too
+func (ai *AI) openExitPlan(side string, entryPrice, size, atr float64) {
+	plan := models.NewExitPlan(ai.Exits, ai.ProductCode, side, time.Now(), entryPrice, size, atr)
+	if ai.ExchangeExits {
+		plan.ParentOrderAcceptanceID = ai.placeExitOrder(plan)
+	}
+	ai.exitMu.Lock()
+	ai.exitPlan = plan
+	ai.exitMu.Unlock()
+	ai.saveExitPlan(plan)
+	log.Printf("action=openExitPlan product_code=%s plan=%+v", ai.ProductCode, plan)
+}
+
+// closeExitPlan forgets the exits once the position is closed
+func (ai *AI) closeExitPlan() {
+	ai.exitMu.Lock()
+	ai.exitPlan = nil
+	ai.exitPartial = orderFill{}
+	ai.exitMu.Unlock()
+	ai.deleteExitPlan()
+}
+
+// takeExitPartial returns and forgets what the special orders executed before they were cancelled or expired,
+// it closed part of the position and is recorded with the fill closing the rest
+func (ai *AI) takeExitPartial() orderFill {
+	ai.exitMu.Lock()
+	defer ai.exitMu.Unlock()
+	partial := ai.exitPartial
+	ai.exitPartial = orderFill{}
+	return partial
+}
+
+func (ai *AI) saveExitPlan(plan *models.ExitPlan) {
+	ai.exitMu.Lock()
+	defer ai.exitMu.Unlock()
+	if err := plan.Save(); err != nil {
+		log.Printf("action=saveExitPlan product_code=%s err=%s", ai.ProductCode, err.Error())
+	}
+}
+
+func (ai *AI) deleteExitPlan() {
+	if err := models.DeleteExitPlan(ai.ProductCode); err != nil {
+		log.Printf("action=deleteExitPlan product_code=%s err=%s", ai.ProductCode, err.Error())
+	}
+}
+
+// CheckExit follows the price of the AI's product, it is called on every ticker or execution
+// a long position is closed at the bid and a short one at the ask; an exit that triggers closes
+// the position in the background, so the stream is not held up
+func (ai *AI) CheckExit(bid, ask float64, now time.Time) {
+	if ai.BackTest {
+		return
+	}
+	ai.exitMu.Lock()
+	defer ai.exitMu.Unlock()
+	plan := ai.exitPlan
+	if plan == nil || ai.exitBusy || now.Before(ai.exitRetryAt) {
+		return
+	}
+	price := bid
+	if plan.Short() {
+		price = ask
+	}
+	reason, moved := plan.Update(price, now)
+	if moved && plan.ParentOrderAcceptanceID == "" {
+		if err := plan.Save(); err != nil {
+			log.Printf("action=CheckExit product_code=%s err=%s", ai.ProductCode, err.Error())
+		}
+	}
+	switch {
+	case reason != "":
+		ai.exitBusy = true
+		log.Printf("action=CheckExit product_code=%s status=exit reason=%s price=%f plan=%+v", ai.ProductCode, reason, price, plan)
+		go ai.exit(reason, now)
+	case plan.ParentOrderAcceptanceID != "" && now.Sub(ai.exitSyncedAt) >= exitSyncInterval:
+		ai.exitBusy = true
+		ai.exitSyncedAt = now
+		go ai.syncExitOrder()
+	}
+}
+
+// exit closes the position because of reason
+func (ai *AI) exit(reason string, now time.Time) {
+	closed := false
+	defer func() {
+		ai.exitMu.Lock()
+		defer ai.exitMu.Unlock()
+		ai.exitBusy = false
+		if !closed {
+			ai.exitRetryAt = time.Now().Add(exitRetryInterval)
+		}
+	}()
+	if err := ai.TradeSemaphore.Acquire(ai.ctx, 1); err != nil {
+		return
+	}
+	defer ai.TradeSemaphore.Release(1)
+	if ai.ExitPlan() == nil {
+		// a signal closed the position in the meantime
+		closed = true
+		return
+	}
+	if ai.SignalEvents.Position() == models.PositionFlat {
+		log.Printf("action=exit product_code=%s reason=%s status=no_position", ai.ProductCode, reason)
+		ai.closeExitPlan()
+		closed = true
+		return
+	}
+	_, closed = ai.closePosition(now)
+	if closed {
+		go ai.UpdateOptimizeParams(true)
+	}
+}
+
+// closePosition sells the available coin, or on margin trades the net position back, and closes the exit plan,
+// the special order holding the exits is cancelled first so its coin is available
+func (ai *AI) closePosition(executeTime time.Time) (childOrderAcceptanceID string, isOrderCompleted bool) {
+	if ai.settleExitOrder(true) {
+		// the exchange closed the position already
+		return "", true
+	}
+	side := "SELL"
+	if ai.SignalEvents.Position() == models.PositionShort {
+		side = "BUY"
+	}
+	var size float64
+	if ai.Margin {
+		positions, err := ai.API.GetPositions(ai.ProductCode)
+		if err != nil {
+			log.Printf("action=closePosition product_code=%s err=%s", ai.ProductCode, err.Error())
+			return "", false
+		}
+		net := netPosition(positions)
+		if net != 0 && (net < 0) != (side == "BUY") {
+			log.Printf("action=closePosition product_code=%s status=position_mismatch side=%s net=%f", ai.ProductCode, side, net)
+			return "", false
+		}
+		size = ai.Sizing.Round(math.Abs(net))
+	} else {
+		_, availableCoin := ai.GetAvailableBalance()
+		size = ai.AdjustSize(availableCoin)
+	}
+	log.Printf("status=close side=%s size=%f order_type=%s", side, size, ai.Order.Type)
+	fill := ai.executeOrder(side, size)
+	// an order that may still fill is left to Reconcile before the next trade
+	ai.setReconcilePending(fill.unsettled)
+	if fill.Size == 0 {
+		return fill.ChildOrderAcceptanceID, false
+	}
+	fill.merge(ai.takeExitPartial())
+	isOrderCompleted = ai.recordFill(side, executeTime, fill)
+	if isOrderCompleted {
+		ai.closeExitPlan()
+	}
+	return fill.ChildOrderAcceptanceID, isOrderCompleted
+}
+
+// syncExitOrder records the closing trade once the special order holding the exits filled
+func (ai *AI) syncExitOrder() {
+	defer func() {
+		ai.exitMu.Lock()
+		defer ai.exitMu.Unlock()
+		ai.exitBusy = false
+	}()
+	if !ai.TradeSemaphore.TryAcquire(1) {
+		// trading, the next ticker checks again
+		return
+	}
+	defer ai.TradeSemaphore.Release(1)
+	if ai.settleExitOrder(false) {
+		go ai.UpdateOptimizeParams(true)
+	}
+}
+
+// settleExitOrder looks up the special order of the exit plan, cancelling it first when cancel is set
+// a filled order is recorded as the trade closing the position and closes the plan, true then;
+// once the order is cancelled or expired the bot watches the exits itself again
+func (ai *AI) settleExitOrder(cancel bool) bool {
+	exchange, ok := ai.API.(ParentOrderExchange)
+	plan := ai.ExitPlan()
+	if !ok || plan == nil || plan.ParentOrderAcceptanceID == "" {
+		return false
+	}
+	id := plan.ParentOrderAcceptanceID
+	if cancel {
+		if err := exchange.CancelParentOrder(ai.ProductCode, id); err != nil {
+			log.Printf("action=settleExitOrder product_code=%s id=%s err=%s", ai.ProductCode, id, err.Error())
+		}
+	}
+	// the cancel is processed asynchronously
+	var order bitflyer.ParentOrderStatus
+	for i := 0; i < 5; i++ {
+		var found bool
+		if order, found = ai.getParentOrder(exchange, id); found && (!cancel || order.ParentOrderState != "ACTIVE") {
+			break
+		}
+		if !cancel {
+			return false
+		}
+		time.Sleep(time.Second)
+	}
+
+	switch order.ParentOrderState {
+	case "COMPLETED":
+		fill := orderFill{Size: order.ExecutedSize, value: order.ExecutedSize * order.AveragePrice}
+		log.Printf("action=settleExitOrder product_code=%s id=%s status=filled fill=%+v", ai.ProductCode, id, fill)
+		ai.recordFill(closingSide(plan.Side), time.Now(), fill)
+		ai.closeExitPlan()
+		return true
+	case "CANCELED", "EXPIRED", "REJECTED":
+		log.Printf("action=settleExitOrder product_code=%s id=%s status=%s executed_size=%f", ai.ProductCode, id, order.ParentOrderState, order.ExecutedSize)
+		ai.exitMu.Lock()
+		if ai.exitPlan != nil {
+			ai.exitPlan.ParentOrderAcceptanceID = ""
+		}
+		// the exits in software close the rest, the close records this part with it
+		ai.exitPartial.merge(orderFill{Size: order.ExecutedSize, value: order.ExecutedSize * order.AveragePrice})
+		ai.exitMu.Unlock()
+		if plan := ai.ExitPlan(); plan != nil {
+			ai.saveExitPlan(plan)
+		}
+	default:
+		log.Printf("action=settleExitOrder product_code=%s id=%s status=still_active", ai.ProductCode, id)
+	}
+	return false
+}
+
+// getParentOrder returns the current state of the special order id among the latest ones of the product
+func (ai *AI) getParentOrder(exchange ParentOrderExchange, id string) (bitflyer.ParentOrderStatus, bool) {
+	orders, err := exchange.ListParentOrders(bitflyer.ParentOrderQuery{ProductCode: ai.ProductCode, Page: bitflyer.Page{Count: 100}})
+	if err != nil {
+		log.Printf("action=getParentOrder product_code=%s id=%s err=%s", ai.ProductCode, id, err.Error())
+		return bitflyer.ParentOrderStatus{}, false
+	}
+	for _, order := range orders {
+		if order.ParentOrderAcceptanceID == id {
+			return order, true
+		}
+	}
+	return bitflyer.ParentOrderStatus{}, false
+}
+
+// placeExitOrder places the take profit and the trailing stop, or the stop loss without one, as a special order
+// closing the position, an OCO when both are set; it returns the acceptance id, empty when nothing was placed
+func (ai *AI) placeExitOrder(plan *models.ExitPlan) string {
+	exchange, ok := ai.API.(ParentOrderExchange)
+	if !ok {
+		log.Printf("action=placeExitOrder product_code=%s status=unsupported", ai.ProductCode)
+		return ""
+	}
+	var size float64
+	if ai.Margin {
+		positions, err := ai.API.GetPositions(ai.ProductCode)
+		if err != nil {
+			log.Printf("action=placeExitOrder product_code=%s err=%s", ai.ProductCode, err.Error())
+			return ""
+		}
+		size = ai.Sizing.Round(math.Min(math.Abs(netPosition(positions)), plan.Size))
+	} else {
+		_, availableCoin := ai.GetAvailableBalance()
+		size = ai.AdjustSize(math.Min(availableCoin, plan.Size))
+	}
+	// limit prices are rounded in favor of the position and the stop away from it
+	side := closingSide(plan.Side)
+	if size <= 0 {
+		log.Printf("action=placeExitOrder product_code=%s status=no_size", ai.ProductCode)
+		return ""
+	}
+	var parameters []bitflyer.ParentOrderParameter
+	if plan.TakeProfit > 0 {
+		parameters = append(parameters, bitflyer.ParentOrderParameter{
+			ProductCode:   ai.ProductCode,
+			ConditionType: bitflyer.ConditionLimit,
+			Side:          side,
+			Size:          size,
+			Price:         ai.roundPrice(plan.TakeProfit, side),
+		})
+	}
+	switch {
+	case plan.TrailDistance > 0:
+		parameters = append(parameters, bitflyer.ParentOrderParameter{
+			ProductCode:   ai.ProductCode,
+			ConditionType: bitflyer.ConditionTrail,
+			Side:          side,
+			Size:          size,
+			Offset:        ai.roundPrice(plan.TrailDistance, "SELL"),
+		})
+	case plan.StopLoss > 0:
+		parameters = append(parameters, bitflyer.ParentOrderParameter{
+			ProductCode:   ai.ProductCode,
+			ConditionType: bitflyer.ConditionStop,
+			Side:          side,
+			Size:          size,
+			TriggerPrice:  ai.roundPrice(plan.StopLoss, plan.Side),
+		})
+	}
+	method := bitflyer.OrderMethodOCO
+	switch len(parameters) {
+	case 0:
+		return ""
+	case 1:
+		method = bitflyer.OrderMethodSimple
+	}
+	order := &bitflyer.ParentOrder{
+		OrderMethod:     method,
+		MinuteToExpires: maxParentOrderMinutes,
+		TimeInForce:     "GTC",
+		Parameters:      parameters,
+	}
+	resp, err := exchange.SendParentOrder(order)
+	if err != nil {
+		// the bot watches the exits itself instead
+		log.Printf("action=placeExitOrder product_code=%s order=%+v status=rejected err=%s", ai.ProductCode, order, err.Error())
+		return ""
+	}
+	log.Printf("action=placeExitOrder product_code=%s order=%+v id=%s", ai.ProductCode, order, resp.ParentOrderAcceptanceID)
+	return resp.ParentOrderAcceptanceID
+}
+
+// closingSide is the side of the orders closing a position opened by side
+func closingSide(side string) string {
+	if side == "SELL" {
+		return "BUY"
+	}
+	return "SELL"
+}
+
+// exitATR is the ATR the exits of an entry at candle i of df are measured with, 0 when they do not use one
+func (ai *AI) exitATR(df *models.DataFrameCandle, i int) float64 {
+	if !ai.Exits.UsesATR() {
+		return 0
+	}
+	atr := df.Atr(ai.Exits.ATRPeriod)
+	if i < 0 || i >= len(atr) {
+		return 0
+	}
+	return atr[i]
+}
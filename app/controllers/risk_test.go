@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"fmt"
+	"go-trading-bot/app/models"
+	"go-trading-bot/bitflyer"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeParentExchange is a fakeExchange holding special orders too, cancelling one leaves what it executed
+type fakeParentExchange struct {
+	*fakeExchange
+	parentMu sync.Mutex
+	parents  []bitflyer.ParentOrderStatus
+}
+
+var _ ParentOrderExchange = (*fakeParentExchange)(nil)
+
+func (f *fakeParentExchange) SendParentOrder(order *bitflyer.ParentOrder) (*bitflyer.ResponseSendParentOrder, error) {
+	f.parentMu.Lock()
+	defer f.parentMu.Unlock()
+	id := fmt.Sprintf("JRP%d", len(f.parents)+1)
+	f.parents = append(f.parents, bitflyer.ParentOrderStatus{ParentOrderAcceptanceID: id, ParentOrderState: "ACTIVE"})
+	return &bitflyer.ResponseSendParentOrder{ParentOrderAcceptanceID: id}, nil
+}
+
+func (f *fakeParentExchange) CancelParentOrder(productCode, parentOrderAcceptanceID string) error {
+	f.parentMu.Lock()
+	defer f.parentMu.Unlock()
+	for i := range f.parents {
+		if f.parents[i].ParentOrderAcceptanceID == parentOrderAcceptanceID && f.parents[i].ParentOrderState == "ACTIVE" {
+			f.parents[i].ParentOrderState = "CANCELED"
+		}
+	}
+	return nil
+}
+
+func (f *fakeParentExchange) ListParentOrders(query bitflyer.ParentOrderQuery) ([]bitflyer.ParentOrderStatus, error) {
+	f.parentMu.Lock()
+	defer f.parentMu.Unlock()
+	return f.parents, nil
+}
+
+// testExitAI is an AI long 0.1 bought at 100, its exits held by the special order parent
+func testExitAI(t *testing.T, productCode string, parent bitflyer.ParentOrderStatus, coin float64) (*AI, *fakeParentExchange) {
+	t.Helper()
+	exchange := &fakeParentExchange{
+		fakeExchange: &fakeExchange{
+			balances: []bitflyer.Balance{{CurrentCode: "BTC", Amount: coin, Available: coin}},
+			ticker:   bitflyer.Ticker{BestBid: 119, BestAsk: 120},
+		},
+		parents: []bitflyer.ParentOrderStatus{parent},
+	}
+	ai := testOrderAI(exchange, time.Second, false)
+	ai.ProductCode, ai.CoinCode, ai.CurrencyCode = productCode, "BTC", "JPY"
+	ai.SignalEvents = models.NewTradeSignalEvents()
+	ai.Sizing.MinSize, ai.Sizing.SizeStep = 0.001, 0.00000001
+	entry := time.Now().Add(-time.Hour)
+	if !ai.SignalEvents.Buy(productCode, entry, 100, 0.1, false) {
+		t.Fatal("Buy() = false")
+	}
+	ai.exitPlan = &models.ExitPlan{ProductCode: productCode, Side: "BUY", EntryTime: entry, EntryPrice: 100, Size: 0.1, ParentOrderAcceptanceID: parent.ParentOrderAcceptanceID}
+	return ai, exchange
+}
+
+func TestClosePositionExitOrderFilled(t *testing.T) {
+	parent := bitflyer.ParentOrderStatus{ParentOrderAcceptanceID: "JRP-FILLED", ParentOrderState: "COMPLETED", ExecutedSize: 0.1, AveragePrice: 110}
+	ai, exchange := testExitAI(t, "EXITFILL_JPY", parent, 0)
+	if _, closed := ai.closePosition(time.Now()); !closed {
+		t.Fatal("closePosition() = false, want the special order's fill recorded")
+	}
+	last := ai.SignalEvents.TradeSignals[len(ai.SignalEvents.TradeSignals)-1]
+	if last.Side != "SELL" || last.Size != 0.1 || last.Price != 110 {
+		t.Errorf("recorded %s %v at %v, want SELL 0.1 at 110", last.Side, last.Size, last.Price)
+	}
+	if len(exchange.sent) != 0 || ai.ExitPlan() != nil {
+		t.Errorf("sent = %+v, exit plan = %+v, want no order and the plan closed", exchange.sent, ai.ExitPlan())
+	}
+}
+
+func TestClosePositionExitOrderPartiallyFilled(t *testing.T) {
+	parent := bitflyer.ParentOrderStatus{ParentOrderAcceptanceID: "JRP-PARTIAL", ParentOrderState: "ACTIVE", ExecutedSize: 0.04, AveragePrice: 110}
+	ai, exchange := testExitAI(t, "EXITPART_JPY", parent, 0.06)
+	if _, closed := ai.closePosition(time.Now()); !closed {
+		t.Fatal("closePosition() = false, want the rest closed")
+	}
+	if len(exchange.sent) != 1 {
+		t.Fatalf("sent = %+v, want one order for the rest", exchange.sent)
+	}
+	rest := exchange.sent[0]
+	last := ai.SignalEvents.TradeSignals[len(ai.SignalEvents.TradeSignals)-1]
+	// the close records the special order's part along with the rest
+	wantSize := 0.04 + rest.Size
+	wantPrice := (0.04*110 + rest.Size*rest.AveragePrice) / wantSize
+	if last.Side != "SELL" || math.Abs(last.Size-wantSize) > 1e-9 || math.Abs(last.Price-wantPrice) > 1e-9 {
+		t.Errorf("recorded %s %v at %v, want SELL %v at %v", last.Side, last.Size, last.Price, wantSize, wantPrice)
+	}
+	if ai.ExitPlan() != nil {
+		t.Errorf("exit plan = %+v, want it closed", ai.ExitPlan())
+	}
+}
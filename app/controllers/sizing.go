@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"errors"
+	"go-trading-bot/app/models"
+	"go-trading-bot/config"
+	"go-trading-bot/sizing"
+	"math"
+)
+
+// DefaultSizingConfig is the [sizing] section with the minimum size and size step of productCode,
+// no position is larger than usePercent of the equity
+func DefaultSizingConfig(productCode string, usePercent float64) sizing.Config {
+	c := config.Config
+	cfg := sizing.Config{
+		Mode:             c.SizingMode,
+		Fraction:         usePercent,
+		Notional:         c.SizingNotional,
+		KellyFraction:    c.SizingKellyFraction,
+		KellyMinTrades:   c.SizingKellyMinTrades,
+		TargetVolatility: c.SizingTargetVolatility,
+		RiskPercent:      c.SizingRiskPercent,
+		FeePercent:       ApiFeePercent,
+		MinSize:          0.001,
+		SizeStep:         0.00000001,
+	}
+	if product, ok := c.Product(productCode); ok {
+		cfg.MinSize, cfg.SizeStep = product.MinSize, product.SizeStep
+		if product.Margin {
+			cfg.Leverage = product.Leverage
+		}
+	}
+	return cfg
+}
+
+// OpenSize returns the size of an order of side at price opening a position, sized from the balances,
+// or the free collateral on margin, and, depending on the mode, the volatility of the candles,
+// the stop loss of the exits or the backtested trades of the traded params
+func (ai *AI) OpenSize(side string, price float64) (float64, error) {
+	in := sizing.Input{Price: price}
+	if ai.Margin {
+		collateral, err := ai.API.GetCollateral()
+		if err != nil {
+			return 0, err
+		}
+		in.Cash = collateral.Collateral + collateral.OpenPositionPnl - collateral.RequireCollateral
+	} else {
+		in.Cash, in.Position = ai.GetAvailableBalance()
+	}
+	switch ai.Sizing.Mode {
+	case sizing.RiskPerTrade:
+		atr := 0.0
+		if ai.Exits.UsesATR() {
+			df, err := models.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
+			if err != nil {
+				return 0, err
+			}
+			atr = ai.exitATR(df, len(df.Candles)-1)
+		}
+		in.StopPrice = ai.Exits.StopLossPrice(side, price, atr)
+	case sizing.Volatility:
+		df, err := models.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
+		if err != nil {
+			return 0, err
+		}
+		in.Volatility = df.Volatility(config.Config.SizingVolatility, config.Config.SizingVolatilityPeriod)
+	case sizing.Kelly:
+		params := ai.OptimizedTradeParams()
+		if params == nil {
+			return 0, errors.New("kelly needs trade params")
+		}
+		df, err := models.GetAllCandle(ai.ProductCode, ai.Duration, ai.PastPeriod)
+		if err != nil {
+			return 0, err
+		}
+		report := df.BackTestCombined(params, ai.Combiner, models.DefaultBacktestConfig(ai.ProductCode)).Report()
+		in.WinRate, in.Trades = report.WinRate, report.Trades
+		in.PayoffRatio = math.Inf(1) // no losing trade
+		if report.AverageLoss < 0 {
+			in.PayoffRatio = report.AverageWin / -report.AverageLoss
+		}
+	}
+	return ai.Sizing.Size(in)
+}
@@ -1,35 +1,172 @@
 package controllers
 
 import (
+	"context"
 	"go-trading-bot/app/models"
 	"go-trading-bot/bitflyer"
 	"go-trading-bot/config"
 	"log"
+	"time"
 )
 
 // StreamIngestionData will pass data from bitflyer package to candle stick package
-func StreamIngestionData() {
+// until ctx is done; candles are built from executions, or from the ticker as a fallback
+// when candle_source is ticker or while the executions are silent
+// every configured product gets its own AI, they share the exchange connection and the aggregator
+// the returned channel is closed once every candle is written after ctx is done
+func StreamIngestionData(ctx context.Context) <-chan struct{} {
 	c := config.Config
-	ai := NewAI(c.ProductCode, c.TradeDuration, c.DataLimit, c.UsePercent, c.StopLimitPercent, c.BackTest)
+	exchange := NewExchange()
+	aggregator := models.NewCandleAggregator(c.Durations)
+	go aggregator.Run(ctx, c.FlushInterval)
+	go watchConnection(ctx, exchange.ConnectionEvents())
+	for _, product := range c.Products {
+		ai := NewAI(ctx, exchange, product.ProductCode, product.TradeDuration, product.DataLimit, product.UsePercent, product.StopLimitPercent, c.BackTest)
+		RegisterAI(ai)
+		if c.CandleSource == "ticker" {
+			go ingestTicker(ctx, exchange, aggregator, ai)
+			continue
+		}
+		go ingestExecutions(ctx, exchange, aggregator, ai)
+		if c.PaperTrade {
+			// the paper-trading exchange fills orders on ticker prices, so keep it fed
+			go exchange.GetRealTimeTicker(ctx, product.ProductCode, discardTicker(ctx))
+		}
+	}
+	return aggregator.Done()
+}
+
+// tradeOnNewCandle writes the candles and trades when a new candle of the AI's duration opened,
+// so the AI reads the candle that just closed from the database
+// trading runs in the background: waiting for an order must not hold up the shared stream
+func tradeOnNewCandle(created []time.Duration, aggregator *models.CandleAggregator, ai *AI) {
+	for _, duration := range created {
+		if duration != ai.Duration {
+			continue
+		}
+		if err := aggregator.Flush(); err != nil {
+			log.Printf("action=tradeOnNewCandle err=%s", err.Error())
+		}
+		go ai.Trade()
+		return
+	}
+}
+
+// ingestTicker adds every ticker of the AI's product to the candles
+func ingestTicker(ctx context.Context, exchange Exchange, aggregator *models.CandleAggregator, ai *AI) {
 	// new channel which contains each ticker
 	var tickerChannel = make(chan bitflyer.Ticker)
-	apiClient := bitflyer.New(config.Config.ApiKey, config.Config.ApiSecret)
-	go apiClient.GetRealTimeTicker(config.Config.ProductCode, tickerChannel)
-	// 1分間のテーブル、1秒のテーブルなどそれぞれに書き込むためのループ
+	go exchange.GetRealTimeTicker(ctx, ai.ProductCode, tickerChannel)
 	// go routineにすることでStream Dataを撮り続けつつ、UI描画したりできる
+	for {
+		var ticker bitflyer.Ticker
+		select {
+		case <-ctx.Done():
+			return
+		case ticker = <-tickerChannel:
+		}
+		addTicker(ticker, aggregator, ai)
+	}
+}
+
+// subscribeTicker streams the ticker of productCode until the returned stop is called
+func subscribeTicker(ctx context.Context, exchange Exchange, productCode string) (chan bitflyer.Ticker, context.CancelFunc) {
+	tickerCtx, stop := context.WithCancel(ctx)
+	tickerChannel := make(chan bitflyer.Ticker)
+	go exchange.GetRealTimeTicker(tickerCtx, productCode, tickerChannel)
+	return tickerChannel, stop
+}
+
+// addTicker adds a ticker to the candles and checks the exits of the AI against it
+func addTicker(ticker bitflyer.Ticker, aggregator *models.CandleAggregator, ai *AI) {
+	log.Printf("action=StreamIngestionData, %v", ticker)
+	ai.CheckExit(ticker.BestBid, ticker.BestAsk, time.Now())
+	// when the candle is newly created - we trade i.e., decide if this is the trade entry point
+	tradeOnNewCandle(aggregator.AddTicker(ticker.ProductCode, ticker), aggregator, ai)
+}
+
+// executionSilence is how long the executions channel may stay silent before the candles fall back to the ticker
+const executionSilence = time.Minute
+
+// ingestExecutions adds every trade print of the AI's product to the candles
+// while no print arrives for executionSilence the candles are built from the ticker, until the prints return
+func ingestExecutions(ctx context.Context, exchange Exchange, aggregator *models.CandleAggregator, ai *AI) {
+	executionChannel := make(chan []bitflyer.Execution)
+	go exchange.GetRealTimeExecutions(ctx, ai.ProductCode, executionChannel)
+	silence := time.NewTimer(executionSilence)
+	defer silence.Stop()
+	// tickerChannel is nil unless the executions are silent
+	var tickerChannel chan bitflyer.Ticker
+	stopTicker := func() {}
+	defer func() { stopTicker() }()
+	for {
+		var executions []bitflyer.Execution
+		select {
+		case <-ctx.Done():
+			return
+		case <-silence.C:
+			log.Printf("action=ingestExecutions product_code=%s status=fallback_ticker silence=%s", ai.ProductCode, executionSilence)
+			tickerChannel, stopTicker = subscribeTicker(ctx, exchange, ai.ProductCode)
+			continue
+		case ticker := <-tickerChannel:
+			addTicker(ticker, aggregator, ai)
+			continue
+		case executions = <-executionChannel:
+		}
+		if tickerChannel != nil {
+			log.Printf("action=ingestExecutions product_code=%s status=executions_resumed", ai.ProductCode)
+			stopTicker()
+			stopTicker, tickerChannel = func() {}, nil
+		}
+		silence.Reset(executionSilence)
+		// trade once per batch, after every print of the batch is in the candles
+		var created []time.Duration
+		for _, execution := range executions {
+			created = append(created, aggregator.AddExecution(ai.ProductCode, execution)...)
+		}
+		if len(executions) > 0 {
+			price := executions[len(executions)-1].Price
+			ai.CheckExit(price, price, time.Now())
+		}
+		tradeOnNewCandle(created, aggregator, ai)
+	}
+}
+
+// discardTicker returns a channel that is drained until ctx is done
+func discardTicker(ctx context.Context) chan<- bitflyer.Ticker {
+	ch := make(chan bitflyer.Ticker)
 	go func() {
-		for ticker := range tickerChannel {
-			log.Printf("action=StreamIngestionData, %v", ticker)
-			for _, duration := range config.Config.Durations { // Duratios: 1s, 1m, 1h
-				isCreated := models.CreateCandleWithDuration(ticker, ticker.ProductCode, duration)
-				// when the candle is newly created - we trade i.e., decide if this is the trade entry point
-				// how often candle stick is created is depends on duration
-				if isCreated == true && duration == config.Config.TradeDuration {
-
-					// TODO
-					ai.Trade()
-				}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
 			}
 		}
 	}()
+	return ch
+}
+
+// watchConnection logs every realtime connection change and how long the data gap was
+func watchConnection(ctx context.Context, events <-chan bitflyer.ConnectionEvent) {
+	var disconnectedAt time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			switch event.State {
+			case bitflyer.StateDisconnected:
+				if disconnectedAt.IsZero() {
+					disconnectedAt = event.Time
+				}
+			case bitflyer.StateConnected:
+				if !disconnectedAt.IsZero() {
+					log.Printf("action=watchConnection status=data_gap from=%s to=%s gap=%s",
+						disconnectedAt.Format(time.RFC3339), event.Time.Format(time.RFC3339), event.Time.Sub(disconnectedAt))
+					disconnectedAt = time.Time{}
+				}
+			}
+		}
+	}
 }
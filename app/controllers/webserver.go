@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"go-trading-bot/app/models"
@@ -9,20 +10,39 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"text/template"
 )
 
-var templates = template.Must(template.ParseFiles("app/views/chart.html"))
+// templates is parsed by StartWebServer, the path is relative to the repository root the bot runs from
+var templates *template.Template
+
+// chartPage is what chart.html is rendered with
+type chartPage struct {
+	ProductCode  string
+	ProductCodes []string
+	Candles      []models.Candle
+}
 
 func viewChartHandler(w http.ResponseWriter, r *http.Request) {
 
 	limit := 100
 	duration := "1s"
 	durationTime := config.Config.Durations[duration]
+	// the chart shows ?product_code= or the default product
+	productCode := r.URL.Query().Get("product_code")
+	if _, ok := config.Config.Product(productCode); !ok {
+		productCode = config.Config.ProductCode
+	}
+	page := chartPage{ProductCode: productCode}
+	for _, product := range config.Config.Products {
+		page.ProductCodes = append(page.ProductCodes, product.ProductCode)
+	}
 	// get current Candle struct
-	df, _ := models.GetAllCandle(config.Config.ProductCode, durationTime, limit)
+	df, _ := models.GetAllCandle(productCode, durationTime, limit)
+	page.Candles = df.Candles
 	// insert df.Candles which contains current all candle info
-	err := templates.ExecuteTemplate(w, "chart.html", df.Candles)
+	err := templates.ExecuteTemplate(w, "chart.html", page)
 	if err != nil {
 		log.Println("error happend")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -217,8 +237,8 @@ func apiCandleHandler(w http.ResponseWriter, r *http.Request) {
 
 	events := r.URL.Query().Get("events")
 	if events != "" {
-		if config.Config.BackTest {
-			df.Events = Ai.SignalEvents.GetAfter(df.Candles[0].Time)
+		if ai, ok := GetAI(productCode); ok && config.Config.BackTest {
+			df.Events = ai.SignalEvents.GetAfter(df.Candles[0].Time)
 			// when we have profit with the algorithm
 			// if performance > 0 {
 			// 	df.Events = df.BackTestBb(p1, p2)
@@ -238,9 +258,66 @@ func apiCandleHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(candleJSON)
 }
 
+// apiKillSwitchHandler returns the kill switch, a POST with engaged=true or false and a reason toggles it
+// when it carries the configured token; a browser cannot add the header to a cross-origin form post
+func apiKillSwitchHandler(w http.ResponseWriter, r *http.Request) {
+	var killSwitch models.KillSwitch
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		killSwitch, err = models.GetKillSwitch()
+	case http.MethodPost:
+		if !authorized(r) {
+			log.Printf("action=apiKillSwitchHandler status=unauthorized remote_addr=%s", r.RemoteAddr)
+			APIError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		engaged, parseErr := strconv.ParseBool(r.FormValue("engaged"))
+		if parseErr != nil {
+			APIError(w, "engaged must be true or false", http.StatusBadRequest)
+			return
+		}
+		reason := r.FormValue("reason")
+		if reason == "" {
+			reason = "web"
+		}
+		killSwitch, err = models.SetKillSwitch(engaged, reason)
+		log.Printf("action=apiKillSwitchHandler engaged=%t reason=%s", engaged, reason)
+	default:
+		APIError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		APIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	killSwitchJSON, err := json.Marshal(killSwitch)
+	if err != nil {
+		APIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(killSwitchJSON)
+}
+
+// authorized is whether r carries the token of the [web] section as a bearer token, never without a token
+func authorized(r *http.Request) bool {
+	token := config.Config.WebToken
+	if token == "" {
+		return false
+	}
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
 // StartWebServer initiate the chart UI
 func StartWebServer() error {
+	var err error
+	if templates, err = template.ParseFiles("app/views/chart.html"); err != nil {
+		return err
+	}
 	http.HandleFunc("/api/candle/", apiMakeHandler(apiCandleHandler))
+	http.HandleFunc("/api/killswitch/", apiKillSwitchHandler)
 	http.HandleFunc("/chart/", viewChartHandler)
 	return http.ListenAndServe(fmt.Sprintf(":%d", config.Config.Port), nil)
 }
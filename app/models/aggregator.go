@@ -0,0 +1,305 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"go-trading-bot/bitflyer"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CandleAggregator keeps the open candles in memory and writes them in batches
+// only the smallest duration is built from prints, every higher timeframe is derived
+// from it: the closed base candles of its period plus the open base candle
+type CandleAggregator struct {
+	durations []time.Duration // ascending, durations[0] is the base
+
+	mu      sync.Mutex
+	states  map[string]*aggregateState // by product code
+	pending map[string]Candle          // candles waiting to be written, by table and time
+	done    chan struct{}
+	// late holds the prints of closed candles that are neither open nor pending,
+	// Flush merges them into the stored rows once no other flush is writing
+	late map[string]Candle
+	// flushMu serializes Flush, so the candles of an older flush never overwrite a newer one
+	flushMu sync.Mutex
+}
+
+// aggregateState is the open candles of one product
+type aggregateState struct {
+	base *Candle
+	// baseOffset is what the base candle already held when loaded from the database;
+	// the higher candles loaded with it contain it too, so it is not added twice
+	baseOffset Candle
+	closed     map[time.Duration]*Candle // closed base candles of the open higher candle, nil when none
+	openTime   map[time.Duration]time.Time
+}
+
+// NewCandleAggregator creates an aggregator for every given duration
+func NewCandleAggregator(durations map[string]time.Duration) *CandleAggregator {
+	sorted := make([]time.Duration, 0, len(durations))
+	for _, duration := range durations {
+		sorted = append(sorted, duration)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &CandleAggregator{
+		durations: sorted,
+		states:    map[string]*aggregateState{},
+		pending:   map[string]Candle{},
+		late:      map[string]Candle{},
+		done:      make(chan struct{}),
+	}
+}
+
+// executionCandle turns one trade print into a candle holding only that print
+func executionCandle(productCode string, execution bitflyer.Execution) Candle {
+	candle := Candle{
+		ProductCode: productCode,
+		Time:        execution.DateTime(),
+		Open:        execution.Price,
+		Close:       execution.Price,
+		High:        execution.Price,
+		Low:         execution.Price,
+		Volume:      execution.Size,
+		TradeCount:  1,
+	}
+	switch execution.Side {
+	case "BUY":
+		candle.BuyVolume = execution.Size
+	case "SELL":
+		candle.SellVolume = execution.Size
+	}
+	return candle
+}
+
+// tickerCandle turns one ticker into a candle at its mid-price, like CreateCandleWithDuration
+func tickerCandle(productCode string, ticker bitflyer.Ticker) Candle {
+	price := ticker.GetMidPrice()
+	return Candle{
+		ProductCode: productCode,
+		Time:        ticker.DateTime(),
+		Open:        price,
+		Close:       price,
+		High:        price,
+		Low:         price,
+		// ticker.Volume is the cumulative volume of the last 24 hours, not the volume of this tick
+	}
+}
+
+// AddExecution adds a trade print and returns the durations whose candle it opened
+func (a *CandleAggregator) AddExecution(productCode string, execution bitflyer.Execution) []time.Duration {
+	return a.add(executionCandle(productCode, execution))
+}
+
+// AddTicker adds a ticker and returns the durations whose candle it opened
+func (a *CandleAggregator) AddTicker(productCode string, ticker bitflyer.Ticker) []time.Duration {
+	return a.add(tickerCandle(productCode, ticker))
+}
+
+func (a *CandleAggregator) add(print Candle) (created []time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	baseDuration := a.durations[0]
+	baseTime := print.Time.Truncate(baseDuration)
+
+	state, ok := a.states[print.ProductCode]
+	if !ok {
+		state, created = a.load(print.ProductCode, baseTime)
+		a.states[print.ProductCode] = state
+	}
+
+	switch {
+	case state.base == nil:
+		state.base = newCandleFrom(print, baseDuration, baseTime)
+	case baseTime.Equal(state.base.Time):
+		state.base.Merge(print)
+	case baseTime.After(state.base.Time):
+		// the base candle closed: fold it into every higher candle, closing those whose period ended
+		a.put(*state.base)
+		for _, duration := range a.durations[1:] {
+			candle := state.derive(duration)
+			if openTime := baseTime.Truncate(duration); openTime.After(state.openTime[duration]) {
+				a.put(candle)
+				state.closed[duration] = nil
+				state.openTime[duration] = openTime
+				created = append(created, duration)
+			} else {
+				state.closed[duration] = &candle
+			}
+		}
+		state.base = newCandleFrom(print, baseDuration, baseTime)
+		state.baseOffset = Candle{}
+		created = append([]time.Duration{baseDuration}, created...)
+	default:
+		a.addLate(state, print)
+	}
+	return created
+}
+
+// load resumes the candles a previous run left open, so a restart continues them
+func (a *CandleAggregator) load(productCode string, baseTime time.Time) (*aggregateState, []time.Duration) {
+	var created []time.Duration
+	state := &aggregateState{
+		closed:   map[time.Duration]*Candle{},
+		openTime: map[time.Duration]time.Time{},
+	}
+	state.base = GetCandle(productCode, a.durations[0], baseTime)
+	if state.base == nil {
+		created = append(created, a.durations[0])
+	} else {
+		state.baseOffset = *state.base
+	}
+	for _, duration := range a.durations[1:] {
+		openTime := baseTime.Truncate(duration)
+		state.openTime[duration] = openTime
+		state.closed[duration] = GetCandle(productCode, duration, openTime)
+		if state.closed[duration] == nil {
+			created = append(created, duration)
+		}
+	}
+	return state, created
+}
+
+// addLate applies a print older than the open base candle to the candles it belongs to, it never moves their close
+func (a *CandleAggregator) addLate(state *aggregateState, print Candle) {
+	for i, duration := range a.durations {
+		candleTime := print.Time.Truncate(duration)
+		if i > 0 && candleTime.Equal(state.openTime[duration]) {
+			if state.closed[duration] == nil {
+				state.closed[duration] = newCandleFrom(print, duration, candleTime)
+			} else {
+				state.closed[duration].MergeLate(print)
+			}
+			continue
+		}
+		key := pendingKey(print.ProductCode, duration, candleTime)
+		if candle, ok := a.pending[key]; ok {
+			candle.MergeLate(print)
+			a.pending[key] = candle
+		} else if candle, ok := a.late[key]; ok {
+			candle.MergeLate(print)
+			a.late[key] = candle
+		} else {
+			a.late[key] = *newCandleFrom(print, duration, candleTime)
+		}
+	}
+}
+
+// derive returns the open candle of a higher duration
+func (s *aggregateState) derive(duration time.Duration) Candle {
+	delta := *s.base
+	delta.Volume -= s.baseOffset.Volume
+	delta.BuyVolume -= s.baseOffset.BuyVolume
+	delta.SellVolume -= s.baseOffset.SellVolume
+	delta.TradeCount -= s.baseOffset.TradeCount
+	if s.closed[duration] == nil {
+		delta.Duration = duration
+		delta.Time = s.openTime[duration]
+		return delta
+	}
+	candle := *s.closed[duration]
+	candle.Merge(delta)
+	return candle
+}
+
+func newCandleFrom(print Candle, duration time.Duration, candleTime time.Time) *Candle {
+	candle := print
+	candle.Duration = duration
+	candle.Time = candleTime
+	return &candle
+}
+
+func pendingKey(productCode string, duration time.Duration, candleTime time.Time) string {
+	return fmt.Sprintf("%s|%d", GetCandleTableName(productCode, duration), candleTime.UnixNano())
+}
+
+// put queues a candle for the next flush, caller must hold mu
+func (a *CandleAggregator) put(candle Candle) {
+	a.pending[pendingKey(candle.ProductCode, candle.Duration, candle.Time)] = candle
+}
+
+// Flush writes the closed candles and the current state of the open ones in one transaction
+func (a *CandleAggregator) Flush() error {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+	a.mu.Lock()
+	for _, state := range a.states {
+		if state.base == nil {
+			continue
+		}
+		a.put(*state.base)
+		for _, duration := range a.durations[1:] {
+			a.put(state.derive(duration))
+		}
+	}
+	late := a.late
+	a.late = map[string]Candle{}
+	a.mu.Unlock()
+
+	// read the stored rows outside mu, flushMu keeps any other flush from writing them meanwhile
+	merged := make(map[string]Candle, len(late))
+	for key, candle := range late {
+		if stored := GetCandle(candle.ProductCode, candle.Duration, candle.Time); stored != nil {
+			stored.MergeLate(candle)
+			candle = *stored
+		}
+		merged[key] = candle
+	}
+
+	a.mu.Lock()
+	// late prints that arrived meanwhile wait in late for the next flush
+	for key, candle := range merged {
+		a.pending[key] = candle
+	}
+	candles := make([]Candle, 0, len(a.pending))
+	for _, candle := range a.pending {
+		candles = append(candles, candle)
+	}
+	a.pending = map[string]Candle{}
+	a.mu.Unlock()
+
+	if len(candles) == 0 {
+		return nil
+	}
+	if err := SaveCandles(candles); err != nil {
+		// keep them for the next flush unless a newer version is already waiting
+		a.mu.Lock()
+		for _, candle := range candles {
+			key := pendingKey(candle.ProductCode, candle.Duration, candle.Time)
+			if _, ok := a.pending[key]; !ok {
+				a.pending[key] = candle
+			}
+		}
+		a.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Run flushes every interval until ctx is done, then flushes a last time
+// Done is closed once that last flush finished
+func (a *CandleAggregator) Run(ctx context.Context, interval time.Duration) {
+	defer close(a.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := a.Flush(); err != nil {
+				log.Printf("action=CandleAggregator.Run status=final_flush err=%s", err.Error())
+			}
+			return
+		case <-ticker.C:
+			if err := a.Flush(); err != nil {
+				log.Printf("action=CandleAggregator.Run err=%s", err.Error())
+			}
+		}
+	}
+}
+
+// Done is closed when Run has written everything after its context ended
+func (a *CandleAggregator) Done() <-chan struct{} {
+	return a.done
+}
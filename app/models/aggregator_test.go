@@ -0,0 +1,67 @@
+package models
+
+import (
+	"go-trading-bot/bitflyer"
+	"testing"
+	"time"
+)
+
+func testExecution(at time.Time, price, size float64) bitflyer.Execution {
+	return bitflyer.Execution{Side: "BUY", Price: price, Size: size, ExecDate: at.Format(time.RFC3339Nano)}
+}
+
+func TestCandleAggregatorLatePrint(t *testing.T) {
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	aggregator := NewCandleAggregator(map[string]time.Duration{"1s": time.Second, "1m": time.Minute})
+	aggregator.AddExecution("BTC_JPY", testExecution(start, 100, 1))
+	if created := aggregator.AddExecution("BTC_JPY", testExecution(start.Add(time.Second), 110, 1)); len(created) != 1 || created[0] != time.Second {
+		t.Fatalf("AddExecution() created = %v, want the 1s candle", created)
+	}
+	if err := aggregator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the late print waits for the flush, a row written meanwhile is not overwritten by a stale read
+	aggregator.AddExecution("BTC_JPY", testExecution(start.Add(time.Millisecond*500), 90, 2))
+	newer := Candle{ProductCode: "BTC_JPY", Duration: time.Second, Time: start, Open: 100, Close: 105, High: 105, Low: 100, Volume: 1.5}
+	if err := SaveCandles([]Candle{newer}); err != nil {
+		t.Fatal(err)
+	}
+	if err := aggregator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := GetCandle("BTC_JPY", time.Second, start)
+	if got == nil {
+		t.Fatal("GetCandle() = nil")
+	}
+	if got.Open != 100 || got.Close != 105 || got.High != 105 || got.Low != 90 || got.Volume != 3.5 {
+		t.Errorf("GetCandle() = %+v, want the newer row with the late print", *got)
+	}
+
+	minute := GetCandle("BTC_JPY", time.Minute, start)
+	if minute == nil {
+		t.Fatal("GetCandle() of the minute = nil")
+	}
+	if minute.Close != 110 || minute.Low != 90 || minute.Volume != 4 {
+		t.Errorf("GetCandle() of the minute = %+v, want the late print inside", *minute)
+	}
+}
+
+func TestCandleAggregatorTickerVolume(t *testing.T) {
+	start := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	aggregator := NewCandleAggregator(map[string]time.Duration{"1s": time.Second})
+	for i := 0; i < 3; i++ {
+		ticker := bitflyer.Ticker{ProductCode: "BTC_JPY", Timestamp: start.Format(time.RFC3339), BestBid: 99, BestAsk: 101, Volume: 1000}
+		aggregator.AddTicker("BTC_JPY", ticker)
+	}
+	if err := aggregator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := GetCandle("BTC_JPY", time.Second, start)
+	if got == nil {
+		t.Fatal("GetCandle() = nil")
+	}
+	if got.Close != 100 || got.Volume != 0 {
+		t.Errorf("GetCandle() = %+v, want close 100 and no volume", *got)
+	}
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"fmt"
+	"go-trading-bot/bitflyer"
+	"sort"
+	"time"
+)
+
+// BackfillState is how far the execution history backfill of a product got
+// executions are read from the newest to the oldest, CursorID is the oldest one already in the candles
+type BackfillState struct {
+	ProductCode string
+	Since       time.Time // oldest time to fill
+	Until       time.Time // newest time to fill, exclusive
+	CursorID    int64     // the next page is read before this execution id, 0 starts from the newest
+	CursorTime  time.Time // time of the CursorID execution
+	Done        bool
+}
+
+// GetBackfillState returns the saved backfill progress of productCode or nil
+func GetBackfillState(productCode string) *BackfillState {
+	cmd := fmt.Sprintf("SELECT product_code, since, until, cursor_id, cursor_time, done FROM %s WHERE product_code = ?", tableNameBackfillState)
+	row := DbConnection.QueryRow(cmd, productCode)
+	var state BackfillState
+	err := row.Scan(&state.ProductCode, &state.Since, &state.Until, &state.CursorID, &state.CursorTime, &state.Done)
+	if err != nil {
+		return nil
+	}
+	return &state
+}
+
+// SaveBackfillProgress writes the candles and the state in one transaction,
+// so an interrupted backfill resumes exactly where the candles stop
+func SaveBackfillProgress(candles []Candle, state *BackfillState) error {
+	tx, err := DbConnection.Begin()
+	if err != nil {
+		return err
+	}
+	if err = saveCandles(tx, candles); err != nil {
+		tx.Rollback()
+		return err
+	}
+	cmd := fmt.Sprintf("INSERT OR REPLACE INTO %s (product_code, since, until, cursor_id, cursor_time, done) VALUES (?, ?, ?, ?, ?, ?)", tableNameBackfillState)
+	_, err = tx.Exec(cmd, state.ProductCode, state.Since.Format(time.RFC3339), state.Until.Format(time.RFC3339),
+		state.CursorID, state.CursorTime.Format(time.RFC3339Nano), state.Done)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// HistoryCandleBuilder builds candles from executions read newest first
+// for each duration only the oldest bucket seen is still open: an older print closes it
+type HistoryCandleBuilder struct {
+	productCode string
+	durations   []time.Duration
+	current     map[time.Duration]*Candle
+}
+
+// NewHistoryCandleBuilder creates a builder for every given duration
+func NewHistoryCandleBuilder(productCode string, durations map[string]time.Duration) *HistoryCandleBuilder {
+	sorted := make([]time.Duration, 0, len(durations))
+	for _, duration := range durations {
+		sorted = append(sorted, duration)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &HistoryCandleBuilder{
+		productCode: productCode,
+		durations:   sorted,
+		current:     map[time.Duration]*Candle{},
+	}
+}
+
+// Resume continues the partial candles of an interrupted backfill at cursorTime
+func (b *HistoryCandleBuilder) Resume(cursorTime time.Time) {
+	for _, duration := range b.durations {
+		b.current[duration] = GetCandle(b.productCode, duration, cursorTime.Truncate(duration))
+	}
+}
+
+// Prepend adds an execution older than every one added before
+// and returns the candles it completed
+func (b *HistoryCandleBuilder) Prepend(execution bitflyer.Execution) (completed []Candle) {
+	print := executionCandle(b.productCode, execution)
+	for _, duration := range b.durations {
+		candleTime := print.Time.Truncate(duration)
+		current := b.current[duration]
+		switch {
+		case current == nil:
+			b.current[duration] = newCandleFrom(print, duration, candleTime)
+		case candleTime.Equal(current.Time):
+			current.prepend(print)
+		case candleTime.Before(current.Time):
+			completed = append(completed, *current)
+			b.current[duration] = newCandleFrom(print, duration, candleTime)
+		}
+		// a print newer than the open candle belongs to a candle already completed,
+		// executions come ordered by id so this only happens with clock skew and is dropped
+	}
+	return completed
+}
+
+// Current returns the candles still open, they are partial until an older print arrives
+func (b *HistoryCandleBuilder) Current() []Candle {
+	candles := make([]Candle, 0, len(b.current))
+	for _, candle := range b.current {
+		if candle != nil {
+			candles = append(candles, *candle)
+		}
+	}
+	return candles
+}
+
+// prepend is Merge for a print older than everything in the candle: it becomes the open
+func (c *Candle) prepend(print Candle) {
+	if c.High < print.High {
+		c.High = print.High
+	}
+	if c.Low > print.Low {
+		c.Low = print.Low
+	}
+	c.Open = print.Open
+	c.Volume += print.Volume
+	c.BuyVolume += print.BuyVolume
+	c.SellVolume += print.SellVolume
+	c.TradeCount += print.TradeCount
+}
+
+// CandleGap is a range of missing candles, End is exclusive
+type CandleGap struct {
+	Start time.Time
+	End   time.Time
+}
+
+// FindCandleGaps returns the ranges between from and to where the duration table has no candle for at least minGap;
+// a shorter range is taken for a quiet market, no candle is written while nothing trades
+func FindCandleGaps(productCode string, duration, minGap time.Duration, from, to time.Time) ([]CandleGap, error) {
+	tableName := GetCandleTableName(productCode, duration)
+	cmd := fmt.Sprintf("SELECT time FROM %s WHERE time >= ? AND time < ? ORDER BY time ASC", tableName)
+	rows, err := DbConnection.Query(cmd, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var gaps []CandleGap
+	addGap := func(start, end time.Time) {
+		if end.After(start) && end.Sub(start) >= minGap {
+			gaps = append(gaps, CandleGap{Start: start, End: end})
+		}
+	}
+	expected := from.Truncate(duration)
+	for rows.Next() {
+		var candleTime time.Time
+		if err := rows.Scan(&candleTime); err != nil {
+			return nil, err
+		}
+		addGap(expected, candleTime)
+		expected = candleTime.Add(duration)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	addGap(expected, to.Truncate(duration))
+	return gaps, nil
+}
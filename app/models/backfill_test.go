@@ -0,0 +1,70 @@
+package models
+
+import (
+	"go-trading-bot/bitflyer"
+	"testing"
+	"time"
+)
+
+func TestFindCandleGaps(t *testing.T) {
+	start := time.Date(2019, 1, 1, 10, 0, 0, 0, time.UTC)
+	var candles []Candle
+	for _, minute := range []int{0, 1, 3, 10} {
+		candleTime := start.Add(time.Duration(minute) * time.Minute)
+		candles = append(candles, Candle{ProductCode: "BTC_JPY", Duration: time.Minute, Time: candleTime, Open: 100, Close: 100, High: 100, Low: 100})
+	}
+	if err := SaveCandles(candles); err != nil {
+		t.Fatal(err)
+	}
+	minute := func(m int) time.Time { return start.Add(time.Duration(m) * time.Minute) }
+	tests := []struct {
+		name   string
+		minGap time.Duration
+		want   []CandleGap
+	}{
+		{name: "every missing candle", want: []CandleGap{{minute(2), minute(3)}, {minute(4), minute(10)}, {minute(11), minute(12)}}},
+		{name: "quiet minutes are no gap", minGap: 5 * time.Minute, want: []CandleGap{{minute(4), minute(10)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gaps, err := FindCandleGaps("BTC_JPY", time.Minute, tt.minGap, start, minute(12))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(gaps) != len(tt.want) {
+				t.Fatalf("FindCandleGaps() = %v, want %v", gaps, tt.want)
+			}
+			for i := range gaps {
+				if !gaps[i].Start.Equal(tt.want[i].Start) || !gaps[i].End.Equal(tt.want[i].End) {
+					t.Errorf("gap %d = %v, want %v", i, gaps[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHistoryCandleBuilder(t *testing.T) {
+	start := time.Date(2019, 1, 2, 10, 0, 0, 0, time.UTC)
+	execution := func(seconds int, price, size float64) bitflyer.Execution {
+		return bitflyer.Execution{Side: "SELL", Price: price, Size: size, ExecDate: start.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339Nano)}
+	}
+	builder := NewHistoryCandleBuilder("BTC_JPY", map[string]time.Duration{"1m": time.Minute})
+	// newest first
+	if completed := builder.Prepend(execution(70, 105, 1)); len(completed) != 0 {
+		t.Fatalf("Prepend() completed %v, want none", completed)
+	}
+	builder.Prepend(execution(65, 110, 1))
+	builder.Prepend(execution(61, 95, 2))
+	completed := builder.Prepend(execution(30, 100, 1))
+	if len(completed) != 1 {
+		t.Fatalf("Prepend() completed %v, want the 10:01 candle", completed)
+	}
+	got := completed[0]
+	if !got.Time.Equal(start.Add(time.Minute)) || got.Open != 95 || got.Close != 105 || got.High != 110 || got.Low != 95 ||
+		got.Volume != 4 || got.SellVolume != 4 || got.TradeCount != 3 {
+		t.Errorf("completed %+v, want 10:01 open 95 close 105 high 110 low 95 volume 4 of 3 sells", got)
+	}
+	if current := builder.Current(); len(current) != 1 || !current[0].Time.Equal(start) || current[0].Close != 100 {
+		t.Errorf("Current() = %+v, want the partial 10:00 candle", current)
+	}
+}
@@ -0,0 +1,368 @@
+package models
+
+import (
+	"encoding/csv"
+	"go-trading-bot/config"
+	"go-trading-bot/metrics"
+	"io"
+	"math"
+	"time"
+)
+
+// when a backtest fills the order of a signal
+const (
+	FillAtClose    = "close"     // at the close of the candle that signalled
+	FillAtNextOpen = "next_open" // at the open of the following candle, the earliest a live order could fill
+)
+
+// jst is where bitFlyer's days start, the swap point of margin positions is charged at 0:00 JST
+var jst = time.FixedZone("JST", 9*60*60)
+
+// BacktestConfig is the account and market model of a backtest
+type BacktestConfig struct {
+	InitialCash     float64
+	UsePercent      float64    // share of the cash spent on each buy, like the AI's use_percent
+	FeePercent      float64    // commission per fill in percent, taken in the coin like bitFlyer spot
+	SlippagePercent float64    // each fill is this much worse than the candle price, in percent
+	Fill            string     // FillAtClose or FillAtNextOpen
+	Exits           ExitConfig // the stop loss, take profit, trailing stop and time exit, checked on every close
+	// Margin trades against the cash as collateral: a sell while flat opens a short position,
+	// positions are worth Leverage times UsePercent of the cash and pay the fee in the currency
+	Margin      bool
+	Leverage    float64 // 1 when 0
+	SwapPercent float64 // percent of the value of a margin position charged every 0:00 JST it is held over
+}
+
+// DefaultBacktestConfig is the [backtest] section with the AI's use_percent, the [risk] exits
+// and the margin and leverage of productCode
+func DefaultBacktestConfig(productCode string) BacktestConfig {
+	c := config.Config
+	cfg := BacktestConfig{
+		InitialCash:     c.BacktestCash,
+		UsePercent:      c.UsePercent,
+		FeePercent:      c.BacktestFeePercent,
+		SlippagePercent: c.BacktestSlippagePercent,
+		Fill:            c.BacktestFill,
+		Exits:           DefaultExitConfig(c.StopLimitPercent),
+		SwapPercent:     c.BacktestSwapPercent,
+	}
+	if product, ok := c.Product(productCode); ok {
+		cfg.Margin, cfg.Leverage = product.Margin, product.Leverage
+	}
+	return cfg
+}
+
+// BacktestTrade is one fill of the ledger
+type BacktestTrade struct {
+	Time   time.Time `json:"time"`
+	Side   string    `json:"side"`
+	Reason string    `json:"reason"` // "signal" or why the exit plan closed the position, e.g. "stop_loss"
+	Price  float64   `json:"price"`  // fill price after slippage
+	Size   float64   `json:"size"`
+	Fee    float64   `json:"fee"`    // commission valued in the currency
+	Profit float64   `json:"profit"` // realized profit of a fill closing a position, fees and swap points included on margin
+	Cash   float64   `json:"cash"`   // balances after the fill
+	Coin   float64   `json:"coin"`   // the position on margin, negative when short
+}
+
+// EquityPoint is the value of the account at the close of a candle
+type EquityPoint struct {
+	Time   time.Time `json:"time"`
+	Cash   float64   `json:"cash"`
+	Coin   float64   `json:"coin"` // the position on margin, negative when short
+	Equity float64   `json:"equity"`
+}
+
+// BacktestResult is the ledger and the equity curve of a backtest
+type BacktestResult struct {
+	Config        BacktestConfig  `json:"config"`
+	Trades        []BacktestTrade `json:"trades"`
+	Equity        []EquityPoint   `json:"equity"`
+	InitialEquity float64         `json:"initial_equity"`
+	FinalEquity   float64         `json:"final_equity"`
+	Swap          float64         `json:"swap"` // swap points the margin positions paid
+}
+
+// Profit is the final equity minus the initial cash, open positions valued at the last close
+func (r *BacktestResult) Profit() float64 {
+	return r.FinalEquity - r.InitialEquity
+}
+
+// Return is the profit as a ratio of the initial cash, e.g. 0.05 => +5%
+func (r *BacktestResult) Return() float64 {
+	if r.InitialEquity == 0 {
+		return 0
+	}
+	return r.Profit() / r.InitialEquity
+}
+
+// Report computes the performance metrics of the equity curve and the closed trades
+func (r *BacktestResult) Report() metrics.Report {
+	return metrics.Compute(r.curve(), r.closedProfits())
+}
+
+// curve is the equity curve for metrics, exposed while a long or a short position is open
+func (r *BacktestResult) curve() []metrics.Point {
+	curve := make([]metrics.Point, len(r.Equity))
+	for i, point := range r.Equity {
+		curve[i] = metrics.Point{Time: point.Time, Equity: point.Equity, Exposed: point.Coin != 0}
+	}
+	return curve
+}
+
+// closedProfits is the profit of every fill that closed a position
+func (r *BacktestResult) closedProfits() []float64 {
+	var profits []float64
+	for _, trade := range r.Trades {
+		if trade.Coin == 0 {
+			profits = append(profits, trade.Profit)
+		}
+	}
+	return profits
+}
+
+// backtestAccount is the state of the account while candles are replayed
+type backtestAccount struct {
+	config     BacktestConfig
+	cash       float64
+	coin       float64 // the position on margin, negative when short
+	entryCost  float64 // cash spent on the open position
+	entryPrice float64 // fill price of the open margin position
+	carry      float64 // fees and swap points the open margin position paid
+	exitPlan   *ExitPlan
+	atr        float64 // ATR at the candle being replayed, for the exit plan of a buy
+	result     *BacktestResult
+}
+
+// RunBacktest replays df candle by candle and trades the signal of each candle:
+// a buy spends UsePercent of the cash when flat, a sell sells every coin
+// on margin a sell while flat opens a short position of the same value and the next buy closes it
+// nothing is known about a candle before its close, so with FillAtNextOpen orders fill one candle later
+func RunBacktest(df *DataFrameCandle, signals []Signal, cfg BacktestConfig) *BacktestResult {
+	if cfg.UsePercent <= 0 || cfg.UsePercent > 1 {
+		cfg.UsePercent = 1
+	}
+	if cfg.Leverage <= 0 {
+		cfg.Leverage = 1
+	}
+	account := &backtestAccount{
+		config: cfg,
+		cash:   cfg.InitialCash,
+		result: &BacktestResult{Config: cfg, InitialEquity: cfg.InitialCash, FinalEquity: cfg.InitialCash},
+	}
+	var atr []float64
+	if cfg.Exits.UsesATR() {
+		atr = df.Atr(cfg.Exits.ATRPeriod)
+	}
+	pending, pendingReason := SignalNone, ""
+	for i, candle := range df.Candles {
+		account.atr = 0
+		if i < len(atr) {
+			account.atr = atr[i]
+		}
+		if i > 0 {
+			account.chargeSwap(df.Candles[i-1].Time, candle)
+		}
+		if pending != SignalNone {
+			account.execute(pending, pendingReason, candle.Time, candle.Open)
+			pending = SignalNone
+		}
+
+		decision, reason := SignalNone, "signal"
+		if i < len(signals) {
+			decision = signals[i]
+		}
+		if account.coin != 0 && account.exitPlan != nil {
+			if exit, _ := account.exitPlan.Update(candle.Close, candle.Time); exit != "" {
+				decision, reason = SignalSell, exit
+				if account.coin < 0 {
+					decision = SignalBuy
+				}
+			}
+		}
+		if decision != SignalNone {
+			if cfg.Fill == FillAtClose {
+				account.execute(decision, reason, candle.Time, candle.Close)
+			} else {
+				pending, pendingReason = decision, reason
+			}
+		}
+
+		equity := account.equity(candle.Close)
+		account.result.Equity = append(account.result.Equity, EquityPoint{
+			Time:   candle.Time,
+			Cash:   account.cash,
+			Coin:   account.coin,
+			Equity: equity,
+		})
+		account.result.FinalEquity = equity
+	}
+	return account.result
+}
+
+// equity is the cash plus the open position valued at price
+func (a *backtestAccount) equity(price float64) float64 {
+	if a.config.Margin {
+		return a.cash + a.coin*(price-a.entryPrice)
+	}
+	return a.cash + a.coin*price
+}
+
+// chargeSwap charges the swap point of the margin position for every 0:00 JST between the candle
+// at previous and candle
+func (a *backtestAccount) chargeSwap(previous time.Time, candle Candle) {
+	if !a.config.Margin || a.coin == 0 || a.config.SwapPercent <= 0 {
+		return
+	}
+	day := func(t time.Time) int64 {
+		_, offset := t.In(jst).Zone()
+		return (t.Unix() + int64(offset)) / (24 * 60 * 60)
+	}
+	days := day(candle.Time) - day(previous)
+	if days <= 0 {
+		return
+	}
+	swap := math.Abs(a.coin) * candle.Open * a.config.SwapPercent / 100 * float64(days)
+	a.cash -= swap
+	a.carry += swap
+	a.result.Swap += swap
+}
+
+// execute fills a buy when flat and a sell when holding, other signals are ignored
+func (a *backtestAccount) execute(side Signal, reason string, fillTime time.Time, price float64) {
+	if price <= 0 {
+		return
+	}
+	if a.config.Margin {
+		a.executeMargin(side, reason, fillTime, price)
+		return
+	}
+	fee := a.config.FeePercent / 100
+	slippage := a.config.SlippagePercent / 100
+	switch {
+	case side == SignalBuy && a.coin == 0:
+		price *= 1 + slippage
+		spend := a.cash * a.config.UsePercent
+		size := spend / price
+		commission := size * fee
+		a.cash -= spend
+		a.coin = size - commission
+		a.entryCost = spend
+		a.exitPlan = NewExitPlan(a.config.Exits, "", "BUY", fillTime, price, a.coin, a.atr)
+		a.record(BacktestTrade{Time: fillTime, Side: "BUY", Reason: reason, Price: price, Size: size, Fee: commission * price})
+	case side == SignalSell && a.coin > 0:
+		price *= 1 - slippage
+		size := a.coin
+		commission := size * fee
+		proceeds := price * (size - commission)
+		a.cash += proceeds
+		a.coin = 0
+		a.exitPlan = nil
+		a.record(BacktestTrade{Time: fillTime, Side: "SELL", Reason: reason, Price: price, Size: size, Fee: commission * price, Profit: proceeds - a.entryCost})
+		a.entryCost = 0
+	}
+}
+
+// executeMargin opens a long position on a buy and a short one on a sell when flat,
+// and closes the position on the opposite signal; the fee is paid in the currency
+func (a *backtestAccount) executeMargin(side Signal, reason string, fillTime time.Time, price float64) {
+	if side != SignalBuy && side != SignalSell {
+		return
+	}
+	fee := a.config.FeePercent / 100
+	slippage := a.config.SlippagePercent / 100
+	orderSide := "BUY"
+	if side == SignalSell {
+		orderSide = "SELL"
+		price *= 1 - slippage
+	} else {
+		price *= 1 + slippage
+	}
+	switch {
+	case a.coin == 0:
+		size := a.cash * a.config.UsePercent * a.config.Leverage / price
+		if size <= 0 {
+			return
+		}
+		commission := size * price * fee
+		a.cash -= commission
+		a.coin = size
+		if side == SignalSell {
+			a.coin = -size
+		}
+		a.entryPrice = price
+		a.carry = commission
+		a.exitPlan = NewExitPlan(a.config.Exits, "", orderSide, fillTime, price, size, a.atr)
+		a.record(BacktestTrade{Time: fillTime, Side: orderSide, Reason: reason, Price: price, Size: size, Fee: commission})
+	case (side == SignalSell) == (a.coin > 0):
+		size := math.Abs(a.coin)
+		commission := size * price * fee
+		pnl := a.coin * (price - a.entryPrice)
+		a.cash += pnl - commission
+		profit := pnl - commission - a.carry
+		a.coin, a.entryPrice, a.carry = 0, 0, 0
+		a.exitPlan = nil
+		a.record(BacktestTrade{Time: fillTime, Side: orderSide, Reason: reason, Price: price, Size: size, Fee: commission, Profit: profit})
+	}
+}
+
+func (a *backtestAccount) record(trade BacktestTrade) {
+	trade.Cash = a.cash
+	trade.Coin = a.coin
+	a.result.Trades = append(a.result.Trades, trade)
+}
+
+// BackTest runs strategy over df through the backtest engine, nil when df is too short
+func (df *DataFrameCandle) BackTest(strategy Strategy, params StrategyParams, cfg BacktestConfig) *BacktestResult {
+	signals := df.Signals(strategy, params)
+	if signals == nil {
+		return nil
+	}
+	return RunBacktest(df, signals, cfg)
+}
+
+// BackTestCombined runs the enabled strategies of tradeParams through combiner, the way the AI trades
+func (df *DataFrameCandle) BackTestCombined(tradeParams *TradeParams, combiner *SignalCombiner, cfg BacktestConfig) *BacktestResult {
+	return RunBacktest(df, df.combinedSignals(tradeParams, combiner), cfg)
+}
+
+// combinedSignals returns the decisions of combiner over the enabled strategies of tradeParams
+func (df *DataFrameCandle) combinedSignals(tradeParams *TradeParams, combiner *SignalCombiner) []Signal {
+	var votes []StrategySignals
+	for _, result := range tradeParams.Enabled() {
+		strategy, ok := GetStrategy(result.Name)
+		if !ok {
+			continue
+		}
+		if signals := df.Signals(strategy, result.Params); signals != nil {
+			votes = append(votes, StrategySignals{Name: result.Name, Performance: result.Performance, Signals: signals})
+		}
+	}
+	return combiner.Combine(df, votes)
+}
+
+// WriteLedgerCSV writes every fill of the backtest as CSV
+func (r *BacktestResult) WriteLedgerCSV(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write([]string{"time", "side", "reason", "price", "size", "fee", "profit", "cash", "coin"})
+	for _, trade := range r.Trades {
+		csvWriter.Write([]string{
+			trade.Time.Format(time.RFC3339), trade.Side, trade.Reason,
+			formatFloat(trade.Price), formatFloat(trade.Size), formatFloat(trade.Fee), formatFloat(trade.Profit),
+			formatFloat(trade.Cash), formatFloat(trade.Coin),
+		})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// WriteEquityCSV writes the equity curve as CSV
+func (r *BacktestResult) WriteEquityCSV(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write([]string{"time", "cash", "coin", "equity"})
+	for _, point := range r.Equity {
+		csvWriter.Write([]string{point.Time.Format(time.RFC3339), formatFloat(point.Cash), formatFloat(point.Coin), formatFloat(point.Equity)})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
@@ -0,0 +1,236 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// testCandles returns one candle a minute opening at opens and closing at closes
+func testCandles(opens, closes []float64) *DataFrameCandle {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	df := &DataFrameCandle{ProductCode: "BTC_JPY", Duration: time.Minute}
+	for i := range closes {
+		df.Candles = append(df.Candles, Candle{
+			ProductCode: "BTC_JPY",
+			Duration:    time.Minute,
+			Time:        start.Add(time.Duration(i) * time.Minute),
+			Open:        opens[i],
+			Close:       closes[i],
+			High:        math.Max(opens[i], closes[i]),
+			Low:         math.Min(opens[i], closes[i]),
+		})
+	}
+	return df
+}
+
+// backtestFill is the side, reason and price a trade of a backtest is expected at
+type backtestFill struct {
+	side   string
+	reason string
+	price  float64
+}
+
+// backtestCase runs closes, opening at opens or at the closes when nil, through RunBacktest
+// with 1000 of cash spent in full, and checks the fills and the final equity
+type backtestCase struct {
+	name    string
+	config  BacktestConfig
+	opens   []float64
+	closes  []float64
+	signals []Signal
+	want    []backtestFill
+	equity  float64
+}
+
+func (tt backtestCase) run(t *testing.T) {
+	opens := tt.opens
+	if opens == nil {
+		opens = tt.closes
+	}
+	signals := make([]Signal, len(tt.closes))
+	copy(signals, tt.signals)
+	cfg := tt.config
+	cfg.InitialCash, cfg.UsePercent = 1000, 1
+	result := RunBacktest(testCandles(opens, tt.closes), signals, cfg)
+
+	if len(result.Trades) != len(tt.want) {
+		t.Fatalf("got %d trades %+v, want %d", len(result.Trades), result.Trades, len(tt.want))
+	}
+	for i, want := range tt.want {
+		got := result.Trades[i]
+		if got.Side != want.side || got.Reason != want.reason || math.Abs(got.Price-want.price) > 1e-9 {
+			t.Errorf("trade %d = %s %s at %v, want %s %s at %v", i, got.Side, got.Reason, got.Price, want.side, want.reason, want.price)
+		}
+	}
+	if math.Abs(result.FinalEquity-tt.equity) > 1e-6 {
+		t.Errorf("FinalEquity = %v, want %v", result.FinalEquity, tt.equity)
+	}
+}
+
+func TestRunBacktest(t *testing.T) {
+	tests := []backtestCase{
+		{
+			name:    "fill at the close",
+			config:  BacktestConfig{Fill: FillAtClose},
+			closes:  []float64{100, 104, 110, 90},
+			signals: []Signal{SignalBuy, SignalNone, SignalSell},
+			want:    []backtestFill{{"BUY", "signal", 100}, {"SELL", "signal", 110}},
+			equity:  1100,
+		},
+		{
+			name:    "fill at the next open",
+			config:  BacktestConfig{Fill: FillAtNextOpen},
+			opens:   []float64{100, 102, 104, 108},
+			closes:  []float64{100, 104, 106, 108},
+			signals: []Signal{SignalBuy, SignalNone, SignalSell},
+			want:    []backtestFill{{"BUY", "signal", 102}, {"SELL", "signal", 108}},
+			equity:  1000.0 / 102 * 108,
+		},
+		{
+			name:    "open position valued at the last close",
+			config:  BacktestConfig{Fill: FillAtClose},
+			closes:  []float64{100, 120},
+			signals: []Signal{SignalBuy},
+			want:    []backtestFill{{"BUY", "signal", 100}},
+			equity:  1200,
+		},
+		{
+			name:    "sell while flat on spot",
+			config:  BacktestConfig{Fill: FillAtClose},
+			closes:  []float64{100, 90},
+			signals: []Signal{SignalSell},
+			equity:  1000,
+		},
+		{
+			name:    "fee and slippage",
+			config:  BacktestConfig{Fill: FillAtClose, FeePercent: 1, SlippagePercent: 1},
+			closes:  []float64{100, 100},
+			signals: []Signal{SignalBuy, SignalSell},
+			want:    []backtestFill{{"BUY", "signal", 101}, {"SELL", "signal", 99}},
+			// 1000/101 coin less 1% on the buy, sold at 99 less 1% again
+			equity: 1000.0 / 101 * 0.99 * 99 * 0.99,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, tt.run)
+	}
+}
+
+func TestRunBacktestExits(t *testing.T) {
+	tests := []backtestCase{
+		{
+			name:    "stop loss",
+			config:  BacktestConfig{Fill: FillAtClose, Exits: ExitConfig{StopLossPercent: 10}},
+			closes:  []float64{100, 95, 89, 120},
+			signals: []Signal{SignalBuy},
+			want:    []backtestFill{{"BUY", "signal", 100}, {"SELL", ExitStopLoss, 89}},
+			equity:  890,
+		},
+		{
+			name:    "take profit",
+			config:  BacktestConfig{Fill: FillAtClose, Exits: ExitConfig{StopLossPercent: 10, TakeProfitPercent: 10}},
+			closes:  []float64{100, 105, 112, 90},
+			signals: []Signal{SignalBuy},
+			want:    []backtestFill{{"BUY", "signal", 100}, {"SELL", ExitTakeProfit, 112}},
+			equity:  1120,
+		},
+		{
+			name:    "trailing stop",
+			config:  BacktestConfig{Fill: FillAtClose, Exits: ExitConfig{TrailingStopPercent: 10}},
+			closes:  []float64{100, 120, 107, 130},
+			signals: []Signal{SignalBuy},
+			want:    []backtestFill{{"BUY", "signal", 100}, {"SELL", ExitTrailingStop, 107}},
+			equity:  1070,
+		},
+		{
+			name:    "time exit",
+			config:  BacktestConfig{Fill: FillAtClose, Exits: ExitConfig{MaxHolding: 2 * time.Minute}},
+			closes:  []float64{100, 101, 102, 103},
+			signals: []Signal{SignalBuy},
+			want:    []backtestFill{{"BUY", "signal", 100}, {"SELL", ExitTime, 102}},
+			equity:  1020,
+		},
+		{
+			name:    "exit at the next open",
+			config:  BacktestConfig{Fill: FillAtNextOpen, Exits: ExitConfig{StopLossPercent: 10}},
+			opens:   []float64{100, 100, 95, 85, 80},
+			closes:  []float64{100, 96, 88, 82, 80},
+			signals: []Signal{SignalBuy},
+			want:    []backtestFill{{"BUY", "signal", 100}, {"SELL", ExitStopLoss, 85}},
+			equity:  850,
+		},
+		{
+			name:    "signal before any exit",
+			config:  BacktestConfig{Fill: FillAtClose, Exits: ExitConfig{StopLossPercent: 10}},
+			closes:  []float64{100, 104, 95},
+			signals: []Signal{SignalBuy, SignalSell},
+			want:    []backtestFill{{"BUY", "signal", 100}, {"SELL", "signal", 104}},
+			equity:  1040,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, tt.run)
+	}
+}
+
+func TestRunBacktestMargin(t *testing.T) {
+	tests := []backtestCase{
+		{
+			name:    "short position on a sell while flat",
+			config:  BacktestConfig{Fill: FillAtClose, Margin: true},
+			closes:  []float64{100, 95, 90},
+			signals: []Signal{SignalSell, SignalNone, SignalBuy},
+			want:    []backtestFill{{"SELL", "signal", 100}, {"BUY", "signal", 90}},
+			equity:  1100,
+		},
+		{
+			name:    "open short valued at the last close",
+			config:  BacktestConfig{Fill: FillAtClose, Margin: true},
+			closes:  []float64{100, 110},
+			signals: []Signal{SignalSell},
+			want:    []backtestFill{{"SELL", "signal", 100}},
+			equity:  900,
+		},
+		{
+			name:    "leverage",
+			config:  BacktestConfig{Fill: FillAtClose, Margin: true, Leverage: 2},
+			closes:  []float64{100, 110},
+			signals: []Signal{SignalBuy, SignalSell},
+			want:    []backtestFill{{"BUY", "signal", 100}, {"SELL", "signal", 110}},
+			equity:  1200,
+		},
+		{
+			name:    "take profit of a short position",
+			config:  BacktestConfig{Fill: FillAtClose, Margin: true, Exits: ExitConfig{StopLossPercent: 10, TakeProfitPercent: 10}},
+			closes:  []float64{100, 95, 89, 80},
+			signals: []Signal{SignalSell},
+			want:    []backtestFill{{"SELL", "signal", 100}, {"BUY", ExitTakeProfit, 89}},
+			equity:  1110,
+		},
+		{
+			name:    "stop loss of a short position",
+			config:  BacktestConfig{Fill: FillAtClose, Margin: true, Exits: ExitConfig{StopLossPercent: 10}},
+			closes:  []float64{100, 105, 111, 90},
+			signals: []Signal{SignalSell},
+			want:    []backtestFill{{"SELL", "signal", 100}, {"BUY", ExitStopLoss, 111}},
+			equity:  890,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, tt.run)
+	}
+}
+
+func TestBacktestResultReportShort(t *testing.T) {
+	cfg := BacktestConfig{Fill: FillAtClose, Margin: true, InitialCash: 1000, UsePercent: 1}
+	signals := []Signal{SignalSell, SignalNone, SignalBuy, SignalNone}
+	result := RunBacktest(testCandles([]float64{100, 95, 90, 90}, []float64{100, 95, 90, 90}), signals, cfg)
+	report := result.Report()
+	if report.Trades != 1 || report.WinRate != 1 {
+		t.Errorf("Report() trades = %d win rate = %v, want the closed short as one winning trade", report.Trades, report.WinRate)
+	}
+	if report.Exposure <= 0 || report.Exposure >= 1 {
+		t.Errorf("Report() exposure = %v, want the short counted as exposed", report.Exposure)
+	}
+}
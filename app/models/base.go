@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"go-trading-bot/config"
 	"log"
+	"strings"
 	"time"
 
 	// import sqlite3
@@ -13,7 +14,19 @@ import (
 
 // table name
 const (
-	tableNameSignalEvents = "signal_events"
+	tableNameSignalEvents  = "signal_events"
+	tableNameBackfillState = "backfill_state"
+
+	tableNameOptimizationRuns       = "optimization_runs"
+	tableNameOptimizationCandidates = "optimization_candidates"
+
+	tableNameExitPlans = "exit_plans"
+
+	tableNameKillSwitch  = "kill_switch"
+	tableNameEquityPeaks = "equity_peaks"
+
+	tableNameReconciliations = "reconciliations"
+	tableNameSentOrders      = "sent_orders"
 )
 
 var DbConnection *sql.DB
@@ -31,32 +44,241 @@ func init() {
 	}
 	// if database is not exist - create new table
 	// DATETIME (when trade initiated) | product_code (BTC_USD) | side (buy/sell) | price (current price) | size (how much)
+	// several products can trade on the same candle, so the key is the pair
 	cmd := fmt.Sprintf(`
         CREATE TABLE IF NOT EXISTS %s (
-            time DATETIME PRIMARY KEY NOT NULL,
+            time DATETIME NOT NULL,
+            product_code STRING NOT NULL,
+            side STRING,
+            price FLOAT,
+            size FLOAT,
+            position STRING,
+            PRIMARY KEY (time, product_code))`, tableNameSignalEvents)
+	_, err = DbConnection.Exec(cmd)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = migrateSignalEvents(); err != nil {
+		log.Fatalln(err)
+	}
+	if err = migrateSignalEventPositions(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// how far the execution history backfill of each product got
+	cmd = fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %s (
+            product_code STRING PRIMARY KEY NOT NULL,
+            since DATETIME,
+            until DATETIME,
+            cursor_id INTEGER,
+            cursor_time DATETIME,
+            done BOOLEAN)`, tableNameBackfillState)
+	_, err = DbConnection.Exec(cmd)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// every optimization of the traded parameters and the candidates it backtested
+	cmd = fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %s (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            product_code STRING NOT NULL,
+            duration STRING NOT NULL,
+            started_at DATETIME,
+            finished_at DATETIME,
+            data_from DATETIME,
+            data_to DATETIME,
+            candles INTEGER,
+            method STRING,
+            objective STRING,
+            params TEXT,
+            accepted BOOLEAN,
+            reason STRING)`, tableNameOptimizationRuns)
+	_, err = DbConnection.Exec(cmd)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cmd = fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %s (
+            run_id INTEGER NOT NULL,
+            strategy STRING,
+            params TEXT,
+            score FLOAT,
+            profitable BOOLEAN,
+            data_from DATETIME,
+            data_to DATETIME)`, tableNameOptimizationCandidates)
+	_, err = DbConnection.Exec(cmd)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	_, err = DbConnection.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_run_id ON %s (run_id)", tableNameOptimizationCandidates, tableNameOptimizationCandidates))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// the stop loss, take profit, trailing stop and deadline of the open position of every product
+	cmd = fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %s (
+            product_code STRING PRIMARY KEY NOT NULL,
+            entry_time DATETIME,
+            entry_price FLOAT,
+            size FLOAT,
+            stop_loss FLOAT,
+            take_profit FLOAT,
+            trail_distance FLOAT,
+            highest_price FLOAT,
+            deadline DATETIME,
+            parent_order_acceptance_id STRING,
+            side STRING DEFAULT 'BUY',
+            lowest_price FLOAT DEFAULT 0)`, tableNameExitPlans)
+	_, err = DbConnection.Exec(cmd)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, column := range []string{"side STRING DEFAULT 'BUY'", "lowest_price FLOAT DEFAULT 0"} {
+		if _, err = addColumn(tableNameExitPlans, column); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// the kill switch halting every new position, one row, and the equity peaks the drawdown limits measure from
+	cmd = fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %s (
+            id INTEGER PRIMARY KEY CHECK (id = 1),
+            engaged BOOLEAN,
+            reason STRING,
+            updated_at DATETIME)`, tableNameKillSwitch)
+	_, err = DbConnection.Exec(cmd)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cmd = fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %s (
+            period STRING PRIMARY KEY NOT NULL,
+            start DATETIME,
+            peak FLOAT)`, tableNameEquityPeaks)
+	_, err = DbConnection.Exec(cmd)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// what reconciling the signal events with the exchange corrected
+	cmd = fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %s (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            time DATETIME,
             product_code STRING,
+            kind STRING,
             side STRING,
             price FLOAT,
-            size FLOAT)`, tableNameSignalEvents)
+            size FLOAT,
+            detail STRING)`, tableNameReconciliations)
+	_, err = DbConnection.Exec(cmd)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// the orders the bot sent, until a signal event records their fills
+	cmd = fmt.Sprintf(`
+        CREATE TABLE IF NOT EXISTS %s (
+            child_order_acceptance_id STRING PRIMARY KEY NOT NULL,
+            product_code STRING,
+            side STRING,
+            size FLOAT,
+            sent_at DATETIME,
+            recorded BOOLEAN)`, tableNameSentOrders)
 	_, err = DbConnection.Exec(cmd)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	for _, duration := range config.Config.Durations {
-		// BTC_USD_1m
-		tableName := GetCandleTableName(config.Config.ProductCode, duration)
-		c := fmt.Sprintf(`
+	for _, product := range config.Config.Products {
+		for _, duration := range config.Config.Durations {
+			if err = CreateCandleTable(product.ProductCode, duration); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+}
+
+// migrateSignalEvents rebuilds a signal_events table keyed by time only,
+// as older single-product versions created it
+func migrateSignalEvents() error {
+	var schema string
+	err := DbConnection.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", tableNameSignalEvents).Scan(&schema)
+	if err != nil || strings.Contains(schema, "PRIMARY KEY (time, product_code)") {
+		return err
+	}
+	log.Printf("action=migrateSignalEvents status=rebuild table=%s", tableNameSignalEvents)
+	tx, err := DbConnection.Begin()
+	if err != nil {
+		return err
+	}
+	for _, cmd := range []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s_old", tableNameSignalEvents, tableNameSignalEvents),
+		fmt.Sprintf(`CREATE TABLE %s (
+            time DATETIME NOT NULL,
+            product_code STRING NOT NULL,
+            side STRING,
+            price FLOAT,
+            size FLOAT,
+            PRIMARY KEY (time, product_code))`, tableNameSignalEvents),
+		fmt.Sprintf("INSERT OR IGNORE INTO %s SELECT time, product_code, side, price, size FROM %s_old", tableNameSignalEvents, tableNameSignalEvents),
+		fmt.Sprintf("DROP TABLE %s_old", tableNameSignalEvents),
+	} {
+		if _, err := tx.Exec(cmd); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateSignalEventPositions adds the position after every trade to a signal_events table of a long-only version,
+// where a buy always opened a long position and a sell closed it
+func migrateSignalEventPositions() error {
+	added, err := addColumn(tableNameSignalEvents, "position STRING")
+	if err != nil || !added {
+		return err
+	}
+	log.Printf("action=migrateSignalEventPositions status=add_column table=%s", tableNameSignalEvents)
+	cmd := fmt.Sprintf("UPDATE %s SET position = CASE side WHEN 'BUY' THEN ? ELSE ? END", tableNameSignalEvents)
+	_, err = DbConnection.Exec(cmd, PositionLong, PositionFlat)
+	return err
+}
+
+// addColumn adds column, e.g. "size FLOAT", to a table created by an older version, false when it already has it
+func addColumn(tableName, column string) (bool, error) {
+	_, err := DbConnection.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", tableName, column))
+	if err != nil && strings.Contains(err.Error(), "duplicate column name") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CreateCandleTable creates the candle table of productCode and duration, e.g. BTC_USD_1m,
+// and adds the columns newer versions store when it was created by an older one
+func CreateCandleTable(productCode string, duration time.Duration) error {
+	tableName := GetCandleTableName(productCode, duration)
+	c := fmt.Sprintf(`
             CREATE TABLE IF NOT EXISTS %s (
             time DATETIME PRIMARY KEY NOT NULL,
             open FLOAT,
             close FLOAT,
             high FLOAT,
             low FLOAT,
-			volume FLOAT)`, tableName)
-		_, err = DbConnection.Exec(c)
-		if err != nil {
-			log.Fatalln(err)
+			volume FLOAT,
+			buy_volume FLOAT DEFAULT 0,
+			sell_volume FLOAT DEFAULT 0,
+			trade_count INTEGER DEFAULT 0)`, tableName)
+	if _, err := DbConnection.Exec(c); err != nil {
+		return err
+	}
+	for _, column := range []string{"buy_volume FLOAT DEFAULT 0", "sell_volume FLOAT DEFAULT 0", "trade_count INTEGER DEFAULT 0"} {
+		if _, err := addColumn(tableName, column); err != nil {
+			return err
 		}
 	}
+	return nil
 }
@@ -1,8 +1,8 @@
 package models
 
 import (
+	"database/sql"
 	"fmt"
-	"go-trading-bot/bitflyer"
 	"time"
 )
 
@@ -16,19 +16,22 @@ type Candle struct {
 	High        float64       `json:"high"`
 	Low         float64       `json:"low"`
 	Volume      float64       `json:"volume"`
+	BuyVolume   float64       `json:"buy_volume"`  // volume of executions where the taker bought
+	SellVolume  float64       `json:"sell_volume"` // volume of executions where the taker sold
+	TradeCount  int           `json:"trade_count"`
 }
 
 // NewCandle that initialize Cnadle struct
 func NewCandle(productCode string, duration time.Duration, timeDate time.Time, open, close, high, low, volume float64) *Candle {
 	return &Candle{
-		productCode,
-		duration,
-		timeDate,
-		open,
-		close,
-		high,
-		low,
-		volume,
+		ProductCode: productCode,
+		Duration:    duration,
+		Time:        timeDate,
+		Open:        open,
+		Close:       close,
+		High:        high,
+		Low:         low,
+		Volume:      volume,
 	}
 }
 
@@ -39,8 +42,8 @@ func (c *Candle) TableName() string {
 
 // Create function that insert new candle data into SQLite Database
 func (c *Candle) Create() error {
-	cmd := fmt.Sprintf("INSERT INTO %s (time, open, close, high, low, volume) VALUES (?, ?, ?, ?, ?, ?)", c.TableName())
-	_, err := DbConnection.Exec(cmd, c.Time.Format(time.RFC3339), c.Open, c.Close, c.High, c.Low, c.Volume)
+	cmd := fmt.Sprintf("INSERT INTO %s (time, open, close, high, low, volume, buy_volume, sell_volume, trade_count) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", c.TableName())
+	_, err := DbConnection.Exec(cmd, c.Time.Format(time.RFC3339), c.Open, c.Close, c.High, c.Low, c.Volume, c.BuyVolume, c.SellVolume, c.TradeCount)
 	if err != nil {
 		return err
 	}
@@ -49,8 +52,8 @@ func (c *Candle) Create() error {
 
 // Save function that update candle data in the SQLite Database, specified the time to maintain candle stick shape
 func (c *Candle) Save() error {
-	cmd := fmt.Sprintf("UPDATE %s SET open = ?, close = ?, high = ?, low = ?, volume = ? WHERE time = ?", c.TableName())
-	_, err := DbConnection.Exec(cmd, c.Open, c.Close, c.High, c.Low, c.Volume, c.Time.Format(time.RFC3339))
+	cmd := fmt.Sprintf("UPDATE %s SET open = ?, close = ?, high = ?, low = ?, volume = ?, buy_volume = ?, sell_volume = ?, trade_count = ? WHERE time = ?", c.TableName())
+	_, err := DbConnection.Exec(cmd, c.Open, c.Close, c.High, c.Low, c.Volume, c.BuyVolume, c.SellVolume, c.TradeCount, c.Time.Format(time.RFC3339))
 	if err != nil {
 		return err
 	}
@@ -60,45 +63,81 @@ func (c *Candle) Save() error {
 // GetCandle function that return Candle Struct if it exists
 func GetCandle(productCode string, duration time.Duration, dateTime time.Time) *Candle {
 	tableName := GetCandleTableName(productCode, duration)
-	cmd := fmt.Sprintf("SELECT time, open, close, high, low, volume FROM  %s WHERE time = ?", tableName)
+	cmd := fmt.Sprintf("SELECT time, open, close, high, low, volume, buy_volume, sell_volume, trade_count FROM  %s WHERE time = ?", tableName)
 	row := DbConnection.QueryRow(cmd, dateTime.Format(time.RFC3339))
 	var candle Candle
-	err := row.Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume)
+	err := row.Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume, &candle.BuyVolume, &candle.SellVolume, &candle.TradeCount)
 	if err != nil {
 		return nil
 	}
 	// return as struct - the data was from database in the first place
-	return NewCandle(productCode, duration, candle.Time, candle.Open, candle.Close, candle.High, candle.Low, candle.Volume)
+	candle.ProductCode = productCode
+	candle.Duration = duration
+	return &candle
 }
 
-// CreateCandleWithDuration returns true or not: if we create new candle => return true
-// write ticker information into the database
-func CreateCandleWithDuration(ticker bitflyer.Ticker, productCode string, duration time.Duration) bool {
-	// check candle exists @ sepcific time - BTC_USD, 1m, 1m00sec
-	currentCandle := GetCandle(productCode, duration, ticker.TruncateDateTime(duration))
-	price := ticker.GetMidPrice() // get current middle price between buy/sell
-	// when there is no candle at this moment
-	// the first candle has same price (mid-price) to both low and high
-	if currentCandle == nil {
-		candle := NewCandle(productCode, duration, ticker.TruncateDateTime(duration),
-			price, price, price, price, ticker.Volume)
-		// insert into database
-		candle.Create()
-		return true
+// Merge folds a later part of the same candle into c: the open stays, high/low widen,
+// the close moves to other's close and volumes add up
+func (c *Candle) Merge(other Candle) {
+	if c.High < other.High {
+		c.High = other.High
 	}
+	if c.Low > other.Low {
+		c.Low = other.Low
+	}
+	c.Close = other.Close
+	c.Volume += other.Volume
+	c.BuyVolume += other.BuyVolume
+	c.SellVolume += other.SellVolume
+	c.TradeCount += other.TradeCount
+}
+
+// MergeLate folds a print older than the latest one of c into c: high/low widen and volumes add up,
+// the open and close stay
+func (c *Candle) MergeLate(other Candle) {
+	last := c.Close
+	c.Merge(other)
+	c.Close = last
+}
+
+// SaveCandles inserts or replaces every candle in one transaction
+func SaveCandles(candles []Candle) error {
+	tx, err := DbConnection.Begin()
+	if err != nil {
+		return err
+	}
+	if err = saveCandles(tx, candles); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
 
-	// UPDATE current candle stick price if the candle already exists
-	if currentCandle.High <= price {
-		currentCandle.High = price
-	} else if currentCandle.Low >= price {
-		currentCandle.Low = price
+// saveCandles inserts or replaces the candles inside tx
+func saveCandles(tx *sql.Tx, candles []Candle) error {
+	statements := map[string]*sql.Stmt{}
+	defer func() {
+		for _, stmt := range statements {
+			stmt.Close()
+		}
+	}()
+	for _, c := range candles {
+		stmt, ok := statements[c.TableName()]
+		if !ok {
+			cmd := fmt.Sprintf("INSERT OR REPLACE INTO %s (time, open, close, high, low, volume, buy_volume, sell_volume, trade_count) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", c.TableName())
+			var err error
+			stmt, err = tx.Prepare(cmd)
+			if err != nil {
+				return err
+			}
+			statements[c.TableName()] = stmt
+		}
+		_, err := stmt.Exec(c.Time.Format(time.RFC3339), c.Open, c.Close, c.High, c.Low, c.Volume, c.BuyVolume, c.SellVolume, c.TradeCount)
+		if err != nil {
+			return err
+		}
 	}
-	// add volume each time
-	currentCandle.Volume += ticker.Volume
-	// update closing price
-	currentCandle.Close = price
-	currentCandle.Save()
-	return false
+	return nil
 }
 
 /**
@@ -109,7 +148,7 @@ func GetAllCandle(productCode string, duration time.Duration, limit int) (dfCand
 	tableName := GetCandleTableName(productCode, duration)
 	// select current tablename and reverse the order to get latest candle info then reverse again
 	cmd := fmt.Sprintf(`SELECT * FROM (
-		SELECT time, open, close, high, low, volume FROM %s ORDER BY time DESC LIMIT ?
+		SELECT time, open, close, high, low, volume, buy_volume, sell_volume, trade_count FROM %s ORDER BY time DESC LIMIT ?
 		) ORDER BY time ASC;`, tableName)
 	rows, err := DbConnection.Query(cmd, limit)
 	if err != nil {
@@ -127,7 +166,7 @@ func GetAllCandle(productCode string, duration time.Duration, limit int) (dfCand
 		candle.ProductCode = productCode
 		candle.Duration = duration
 		// insert every rows value into cadle obhect, then append it into dfCandle object
-		rows.Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume)
+		rows.Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume, &candle.BuyVolume, &candle.SellVolume, &candle.TradeCount)
 		dfCandle.Candles = append(dfCandle.Candles, candle)
 	}
 	err = rows.Err()
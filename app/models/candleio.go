@@ -0,0 +1,491 @@
+package models
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// CandleColumns are the columns of a candle table in export order
+var CandleColumns = []string{"time", "open", "high", "low", "close", "volume", "buy_volume", "sell_volume", "trade_count"}
+
+// columns an imported file must have, the others default to 0
+var requiredCandleColumns = []string{"time", "open", "high", "low", "close"}
+
+// CSVFormat describes how candles are laid out in a CSV file
+type CSVFormat struct {
+	Columns    map[string]string // candle column => CSV header, columns not in it use their own name
+	TimeLayout string            // a time.Parse layout, "unix" for seconds or "unixms" for milliseconds
+	Location   *time.Location    // zone of times written without one, and of exported times
+	Comma      rune
+}
+
+// DefaultCSVFormat is the format export writes: candle column names, RFC3339 times in UTC
+func DefaultCSVFormat() CSVFormat {
+	return CSVFormat{
+		Columns:    map[string]string{},
+		TimeLayout: time.RFC3339,
+		Location:   time.UTC,
+		Comma:      ',',
+	}
+}
+
+// ParseCSVColumns parses a column mapping like "time=Date,open=Open,volume=Volume BTC"
+func ParseCSVColumns(mapping string) (map[string]string, error) {
+	columns := map[string]string{}
+	if strings.TrimSpace(mapping) == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(mapping, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid column mapping %q, expected column=header", pair)
+		}
+		column := strings.TrimSpace(kv[0])
+		if !isCandleColumn(column) {
+			return nil, fmt.Errorf("unknown candle column %q", column)
+		}
+		columns[column] = strings.TrimSpace(kv[1])
+	}
+	return columns, nil
+}
+
+func isCandleColumn(column string) bool {
+	for _, c := range CandleColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+func (f CSVFormat) header(column string) string {
+	if header, ok := f.Columns[column]; ok {
+		return header
+	}
+	return column
+}
+
+func (f CSVFormat) location() *time.Location {
+	if f.Location == nil {
+		return time.UTC
+	}
+	return f.Location
+}
+
+func (f CSVFormat) parseTime(value string) (time.Time, error) {
+	switch f.TimeLayout {
+	case "unix", "unixms":
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if f.TimeLayout == "unixms" {
+			return time.Unix(0, int64(n*float64(time.Millisecond))), nil
+		}
+		return time.Unix(0, int64(n*float64(time.Second))), nil
+	case "":
+		return time.ParseInLocation(time.RFC3339, value, f.location())
+	}
+	return time.ParseInLocation(f.TimeLayout, value, f.location())
+}
+
+func (f CSVFormat) formatTime(t time.Time) string {
+	switch f.TimeLayout {
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unixms":
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	case "":
+		return t.In(f.location()).Format(time.RFC3339)
+	}
+	return t.In(f.location()).Format(f.TimeLayout)
+}
+
+// DuplicatePolicy decides what an import does with a timestamp it already has
+type DuplicatePolicy string
+
+const (
+	DuplicateSkip    DuplicatePolicy = "skip"    // keep the stored candle and the first row of the file
+	DuplicateReplace DuplicatePolicy = "replace" // the last row of the file overwrites the stored candle
+	DuplicateError   DuplicatePolicy = "error"   // abort the import, nothing is written
+)
+
+// ImportOptions controls duplicate and invalid rows
+type ImportOptions struct {
+	OnDuplicate DuplicatePolicy
+	SkipInvalid bool // log and skip rows failing validation instead of aborting
+}
+
+// ImportResult counts what happened to the rows of an imported file
+type ImportResult struct {
+	Rows       int
+	Imported   int
+	Duplicates int
+	Invalid    int
+}
+
+// ValidateCandle checks the OHLC values are consistent and the time starts a candle of duration
+func ValidateCandle(c Candle, duration time.Duration) error {
+	for _, v := range []float64{c.Open, c.High, c.Low, c.Close, c.Volume, c.BuyVolume, c.SellVolume} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("invalid number %v", v)
+		}
+	}
+	switch {
+	case c.Low <= 0:
+		return fmt.Errorf("low %v is not positive", c.Low)
+	case c.High < c.Low:
+		return fmt.Errorf("high %v is below low %v", c.High, c.Low)
+	case c.Open > c.High || c.Open < c.Low:
+		return fmt.Errorf("open %v is outside high %v and low %v", c.Open, c.High, c.Low)
+	case c.Close > c.High || c.Close < c.Low:
+		return fmt.Errorf("close %v is outside high %v and low %v", c.Close, c.High, c.Low)
+	case c.Volume < 0 || c.BuyVolume < 0 || c.SellVolume < 0 || c.TradeCount < 0:
+		return fmt.Errorf("negative volume or trade count")
+	case c.BuyVolume+c.SellVolume > c.Volume*(1+1e-9)+1e-9:
+		return fmt.Errorf("buy volume %v and sell volume %v exceed volume %v", c.BuyVolume, c.SellVolume, c.Volume)
+	case !c.Time.Equal(c.Time.Truncate(duration)):
+		return fmt.Errorf("time %s is not aligned to %s", c.Time.Format(time.RFC3339), duration)
+	}
+	return nil
+}
+
+// GetCandlesBetween returns the candles from from until to, a zero time leaves that end open
+func GetCandlesBetween(productCode string, duration time.Duration, from, to time.Time) ([]Candle, error) {
+	tableName := GetCandleTableName(productCode, duration)
+	var conditions []string
+	var args []interface{}
+	if !from.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, from.UTC().Format(time.RFC3339))
+	}
+	if !to.IsZero() {
+		conditions = append(conditions, "time < ?")
+		args = append(args, to.UTC().Format(time.RFC3339))
+	}
+	cmd := fmt.Sprintf("SELECT time, open, close, high, low, volume, buy_volume, sell_volume, trade_count FROM %s", tableName)
+	if len(conditions) > 0 {
+		cmd += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := DbConnection.Query(cmd+" ORDER BY time ASC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candles []Candle
+	for rows.Next() {
+		candle := Candle{ProductCode: productCode, Duration: duration}
+		err := rows.Scan(&candle.Time, &candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume, &candle.BuyVolume, &candle.SellVolume, &candle.TradeCount)
+		if err != nil {
+			return nil, err
+		}
+		candles = append(candles, candle)
+	}
+	return candles, rows.Err()
+}
+
+// ExportCandlesCSV writes the candles from from until to as CSV and returns how many it wrote
+func ExportCandlesCSV(w io.Writer, productCode string, duration time.Duration, from, to time.Time, format CSVFormat) (int, error) {
+	candles, err := GetCandlesBetween(productCode, duration, from, to)
+	if err != nil {
+		return 0, err
+	}
+	csvWriter := csv.NewWriter(w)
+	if format.Comma != 0 {
+		csvWriter.Comma = format.Comma
+	}
+	header := make([]string, len(CandleColumns))
+	for i, column := range CandleColumns {
+		header[i] = format.header(column)
+	}
+	if err := csvWriter.Write(header); err != nil {
+		return 0, err
+	}
+	for _, c := range candles {
+		record := []string{
+			format.formatTime(c.Time),
+			formatFloat(c.Open), formatFloat(c.High), formatFloat(c.Low), formatFloat(c.Close),
+			formatFloat(c.Volume), formatFloat(c.BuyVolume), formatFloat(c.SellVolume),
+			strconv.Itoa(c.TradeCount),
+		}
+		if err := csvWriter.Write(record); err != nil {
+			return 0, err
+		}
+	}
+	csvWriter.Flush()
+	return len(candles), csvWriter.Error()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// importRow is a parsed row and where it came from, for error messages
+type importRow struct {
+	line   int
+	candle Candle
+	err    error
+}
+
+// ImportCandlesCSV reads candles from CSV into the productCode duration table
+// the header row locates the columns, so their order does not matter
+func ImportCandlesCSV(r io.Reader, productCode string, duration time.Duration, format CSVFormat, options ImportOptions) (*ImportResult, error) {
+	csvReader := csv.NewReader(r)
+	if format.Comma != 0 {
+		csvReader.Comma = format.Comma
+	}
+	csvReader.TrimLeadingSpace = true
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	index := map[string]int{}
+	for i, name := range header {
+		for _, column := range CandleColumns {
+			if strings.EqualFold(strings.TrimSpace(name), format.header(column)) {
+				index[column] = i
+			}
+		}
+	}
+	for _, column := range requiredCandleColumns {
+		if _, ok := index[column]; !ok {
+			return nil, fmt.Errorf("column %q (%s) not found in header", format.header(column), column)
+		}
+	}
+
+	var rows []importRow
+	for line := 2; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := importRow{line: line}
+		row.candle, row.err = parseCSVCandle(record, index, format)
+		row.candle.ProductCode = productCode
+		row.candle.Duration = duration
+		rows = append(rows, row)
+	}
+	return importCandles(productCode, duration, rows, options)
+}
+
+func parseCSVCandle(record []string, index map[string]int, format CSVFormat) (candle Candle, err error) {
+	value := func(column string) (string, bool) {
+		i, ok := index[column]
+		if !ok || i >= len(record) || strings.TrimSpace(record[i]) == "" {
+			return "", false
+		}
+		return strings.TrimSpace(record[i]), true
+	}
+	timeValue, ok := value("time")
+	if !ok {
+		return candle, fmt.Errorf("missing time")
+	}
+	if candle.Time, err = format.parseTime(timeValue); err != nil {
+		return candle, err
+	}
+	fields := map[string]*float64{
+		"open": &candle.Open, "high": &candle.High, "low": &candle.Low, "close": &candle.Close,
+		"volume": &candle.Volume, "buy_volume": &candle.BuyVolume, "sell_volume": &candle.SellVolume,
+	}
+	for column, field := range fields {
+		v, ok := value(column)
+		if !ok {
+			continue
+		}
+		if *field, err = strconv.ParseFloat(v, 64); err != nil {
+			return candle, fmt.Errorf("%s: %w", column, err)
+		}
+	}
+	if v, ok := value("trade_count"); ok {
+		if candle.TradeCount, err = strconv.Atoi(v); err != nil {
+			return candle, fmt.Errorf("trade_count: %w", err)
+		}
+	}
+	return candle, nil
+}
+
+// parquetCandle is the row layout of exported Parquet files
+type parquetCandle struct {
+	Time       int64   `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Open       float64 `parquet:"name=open, type=DOUBLE"`
+	High       float64 `parquet:"name=high, type=DOUBLE"`
+	Low        float64 `parquet:"name=low, type=DOUBLE"`
+	Close      float64 `parquet:"name=close, type=DOUBLE"`
+	Volume     float64 `parquet:"name=volume, type=DOUBLE"`
+	BuyVolume  float64 `parquet:"name=buy_volume, type=DOUBLE"`
+	SellVolume float64 `parquet:"name=sell_volume, type=DOUBLE"`
+	TradeCount int64   `parquet:"name=trade_count, type=INT64"`
+}
+
+// ExportCandlesParquet writes the candles from from until to into a Parquet file at path
+func ExportCandlesParquet(path string, productCode string, duration time.Duration, from, to time.Time) (int, error) {
+	candles, err := GetCandlesBetween(productCode, duration, from, to)
+	if err != nil {
+		return 0, err
+	}
+	file, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		return 0, err
+	}
+	parquetWriter, err := writer.NewParquetWriter(file, new(parquetCandle), 4)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	for _, c := range candles {
+		err := parquetWriter.Write(parquetCandle{
+			Time:       c.Time.UnixNano() / int64(time.Millisecond),
+			Open:       c.Open,
+			High:       c.High,
+			Low:        c.Low,
+			Close:      c.Close,
+			Volume:     c.Volume,
+			BuyVolume:  c.BuyVolume,
+			SellVolume: c.SellVolume,
+			TradeCount: int64(c.TradeCount),
+		})
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+	}
+	if err := parquetWriter.WriteStop(); err != nil {
+		file.Close()
+		return 0, err
+	}
+	return len(candles), file.Close()
+}
+
+// ImportCandlesParquet reads a Parquet file with the exported layout into the productCode duration table
+func ImportCandlesParquet(path string, productCode string, duration time.Duration, options ImportOptions) (*ImportResult, error) {
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	parquetReader, err := reader.NewParquetReader(file, new(parquetCandle), 4)
+	if err != nil {
+		return nil, err
+	}
+	defer parquetReader.ReadStop()
+	records := make([]parquetCandle, parquetReader.GetNumRows())
+	if err := parquetReader.Read(&records); err != nil {
+		return nil, err
+	}
+
+	rows := make([]importRow, len(records))
+	for i, record := range records {
+		rows[i] = importRow{line: i + 1, candle: Candle{
+			ProductCode: productCode,
+			Duration:    duration,
+			Time:        time.Unix(0, record.Time*int64(time.Millisecond)),
+			Open:        record.Open,
+			High:        record.High,
+			Low:         record.Low,
+			Close:       record.Close,
+			Volume:      record.Volume,
+			BuyVolume:   record.BuyVolume,
+			SellVolume:  record.SellVolume,
+			TradeCount:  int(record.TradeCount),
+		}}
+	}
+	return importCandles(productCode, duration, rows, options)
+}
+
+// importCandles validates the rows, resolves duplicate timestamps and writes them in one transaction
+// times are stored in UTC like every other candle, so the same instant never gets two rows
+func importCandles(productCode string, duration time.Duration, rows []importRow, options ImportOptions) (*ImportResult, error) {
+	if options.OnDuplicate == "" {
+		options.OnDuplicate = DuplicateError
+	}
+	result := &ImportResult{Rows: len(rows)}
+
+	var candles []Candle
+	byTime := map[int64]int{} // unix nano => index in candles
+	for _, row := range rows {
+		err := row.err
+		if err == nil {
+			row.candle.Time = row.candle.Time.UTC()
+			err = ValidateCandle(row.candle, duration)
+		}
+		if err != nil {
+			if !options.SkipInvalid {
+				return nil, fmt.Errorf("row %d: %w", row.line, err)
+			}
+			log.Printf("action=importCandles status=invalid row=%d err=%s", row.line, err.Error())
+			result.Invalid++
+			continue
+		}
+		key := row.candle.Time.UnixNano()
+		i, ok := byTime[key]
+		if !ok {
+			byTime[key] = len(candles)
+			candles = append(candles, row.candle)
+			continue
+		}
+		result.Duplicates++
+		switch options.OnDuplicate {
+		case DuplicateError:
+			return nil, fmt.Errorf("row %d: duplicate time %s", row.line, row.candle.Time.Format(time.RFC3339))
+		case DuplicateReplace:
+			candles[i] = row.candle
+		}
+	}
+
+	if err := CreateCandleTable(productCode, duration); err != nil {
+		return nil, err
+	}
+	tx, err := DbConnection.Begin()
+	if err != nil {
+		return nil, err
+	}
+	tableName := GetCandleTableName(productCode, duration)
+	exists, err := tx.Prepare(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE time = ?", tableName))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	defer exists.Close()
+	var write []Candle
+	for _, c := range candles {
+		var count int
+		if err := exists.QueryRow(c.Time.Format(time.RFC3339)).Scan(&count); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if count > 0 {
+			result.Duplicates++
+			switch options.OnDuplicate {
+			case DuplicateError:
+				tx.Rollback()
+				return nil, fmt.Errorf("candle at %s already exists in %s", c.Time.Format(time.RFC3339), tableName)
+			case DuplicateSkip:
+				continue
+			}
+		}
+		write = append(write, c)
+	}
+	if err := saveCandles(tx, write); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	result.Imported = len(write)
+	return result, nil
+}
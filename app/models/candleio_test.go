@@ -0,0 +1,126 @@
+package models
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCSVColumns(t *testing.T) {
+	columns, err := ParseCSVColumns("time=Date, open=Open,volume=Volume BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != 3 || columns["time"] != "Date" || columns["open"] != "Open" || columns["volume"] != "Volume BTC" {
+		t.Errorf("ParseCSVColumns() = %v", columns)
+	}
+	for _, mapping := range []string{"time", "date=Date"} {
+		if _, err := ParseCSVColumns(mapping); err == nil {
+			t.Errorf("ParseCSVColumns(%q) err = nil", mapping)
+		}
+	}
+}
+
+func TestValidateCandle(t *testing.T) {
+	at := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	valid := Candle{Time: at, Open: 100, High: 110, Low: 90, Close: 105, Volume: 2, BuyVolume: 1, SellVolume: 1}
+	if err := ValidateCandle(valid, time.Minute); err != nil {
+		t.Fatalf("ValidateCandle() err = %v", err)
+	}
+	tests := map[string]func(c *Candle){
+		"low":       func(c *Candle) { c.Low = 0 },
+		"high":      func(c *Candle) { c.High = 80 },
+		"open":      func(c *Candle) { c.Open = 120 },
+		"close":     func(c *Candle) { c.Close = 85 },
+		"volume":    func(c *Candle) { c.BuyVolume = 3 },
+		"unaligned": func(c *Candle) { c.Time = at.Add(time.Second) },
+	}
+	for name, change := range tests {
+		c := valid
+		change(&c)
+		if err := ValidateCandle(c, time.Minute); err == nil {
+			t.Errorf("ValidateCandle() of the %s case err = nil", name)
+		}
+	}
+}
+
+func TestImportCandlesCSV(t *testing.T) {
+	format := DefaultCSVFormat()
+	format.Columns = map[string]string{"time": "Date", "close": "Last"}
+	format.TimeLayout = "unix"
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	unix := func(minutes int) string {
+		return strconv.FormatInt(at.Add(time.Duration(minutes)*time.Minute).Unix(), 10)
+	}
+	// columns in any order, a duplicate time and an invalid row
+	file := "Last,open,high,low,Date,volume\n" +
+		"105,100,110,90," + unix(0) + ",2\n" +
+		"106,105,110,100," + unix(1) + ",1\n" +
+		"107,105,110,100," + unix(1) + ",3\n" +
+		"50,105,110,100," + unix(2) + ",1\n"
+
+	if _, err := ImportCandlesCSV(strings.NewReader(file), "CSVIO_JPY", time.Minute, format, ImportOptions{}); err == nil {
+		t.Fatal("ImportCandlesCSV() of an invalid row err = nil, want the import aborted")
+	}
+	if _, err := ImportCandlesCSV(strings.NewReader(file), "CSVIO_JPY", time.Minute, format, ImportOptions{SkipInvalid: true}); err == nil {
+		t.Fatal("ImportCandlesCSV() of a duplicate err = nil, want the import aborted by default")
+	}
+	result, err := ImportCandlesCSV(strings.NewReader(file), "CSVIO_JPY", time.Minute, format, ImportOptions{OnDuplicate: DuplicateReplace, SkipInvalid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 4 || result.Imported != 2 || result.Duplicates != 1 || result.Invalid != 1 {
+		t.Errorf("ImportCandlesCSV() = %+v, want 4 rows, 2 imported, 1 duplicate and 1 invalid", *result)
+	}
+	candles, err := GetCandlesBetween("CSVIO_JPY", time.Minute, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candles) != 2 || !candles[0].Time.Equal(at) || candles[0].Close != 105 || candles[1].Close != 107 || candles[1].Volume != 3 {
+		t.Fatalf("GetCandlesBetween() = %+v, want the last row of the duplicate", candles)
+	}
+
+	// a second import skips what is stored
+	result, err = ImportCandlesCSV(strings.NewReader(file), "CSVIO_JPY", time.Minute, format, ImportOptions{OnDuplicate: DuplicateSkip, SkipInvalid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 0 || result.Duplicates != 3 {
+		t.Errorf("ImportCandlesCSV() again = %+v, want nothing imported and 3 duplicates", *result)
+	}
+}
+
+func TestExportCandlesCSV(t *testing.T) {
+	at := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	candles := []Candle{
+		{ProductCode: "EXPORT_JPY", Duration: time.Minute, Time: at, Open: 100, High: 110, Low: 90, Close: 105, Volume: 2.5, BuyVolume: 1, SellVolume: 1.5, TradeCount: 3},
+		{ProductCode: "EXPORT_JPY", Duration: time.Minute, Time: at.Add(time.Minute), Open: 105, High: 106, Low: 104, Close: 106, Volume: 1, TradeCount: 1},
+	}
+	if err := CreateCandleTable("EXPORT_JPY", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveCandles(candles); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := ExportCandlesCSV(&buf, "EXPORT_JPY", time.Minute, at, time.Time{}, DefaultCSVFormat())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "time,open,high,low,close,volume,buy_volume,sell_volume,trade_count\n" +
+		"2021-02-01T00:00:00Z,100,110,90,105,2.5,1,1.5,3\n" +
+		"2021-02-01T00:01:00Z,105,106,104,106,1,0,0,1\n"
+	if n != 2 || buf.String() != want {
+		t.Errorf("ExportCandlesCSV() = %d\n%s\nwant 2\n%s", n, buf.String(), want)
+	}
+	result, err := ImportCandlesCSV(&buf, "EXPORT_CSV_JPY", time.Minute, DefaultCSVFormat(), ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 2 {
+		t.Errorf("ImportCandlesCSV() of the export = %+v, want 2 imported", *result)
+	}
+}
@@ -0,0 +1,244 @@
+package models
+
+import (
+	"fmt"
+	"go-trading-bot/config"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// weightings of SignalCombiner
+const (
+	WeightingEqual       = "equal"       // every strategy counts 1
+	WeightingPerformance = "performance" // strategies count by their optimized performance, 1 on average
+)
+
+// StrategySignals are the signals of one enabled strategy over a dataframe
+type StrategySignals struct {
+	Name        string
+	Performance float64
+	Signals     []Signal
+}
+
+// SignalCombiner turns the signals of several strategies into one trade decision per candle
+type SignalCombiner struct {
+	Quorum    float64    // total weight that has to agree on a side
+	Weighting string     // WeightingEqual or WeightingPerformance
+	Required  []string   // strategies that have to be among those agreeing
+	Vetoes    []VetoRule // conditions that block a side whatever the votes
+	Window    int        // signals up to Window candles apart count together, 1 is the same candle only
+}
+
+// NewSignalCombinerFromConfig builds the combiner of the [signals] section
+func NewSignalCombinerFromConfig() (*SignalCombiner, error) {
+	c := config.Config
+	combiner := &SignalCombiner{
+		Quorum:    c.SignalQuorum,
+		Weighting: c.SignalWeighting,
+		Required:  c.SignalRequired,
+		Window:    c.SignalWindow,
+	}
+	for _, rule := range c.SignalVetoes {
+		veto, err := ParseVetoRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		combiner.Vetoes = append(combiner.Vetoes, veto)
+	}
+	return combiner, nil
+}
+
+// weights returns the weight of every strategy
+func (c *SignalCombiner) weights(votes []StrategySignals) []float64 {
+	weights := make([]float64, len(votes))
+	total := 0.0
+	for _, vote := range votes {
+		if vote.Performance > 0 {
+			total += vote.Performance
+		}
+	}
+	for i, vote := range votes {
+		switch {
+		case c.Weighting != WeightingPerformance:
+			weights[i] = 1
+		case total > 0 && vote.Performance > 0:
+			// normalized so the weights still add up to the number of strategies
+			weights[i] = vote.Performance / total * float64(len(votes))
+		}
+	}
+	return weights
+}
+
+// Combine returns the decision for every candle of df
+// a side is taken when the strategies signalling it within the window weigh at least Quorum,
+// every required strategy is among them and no veto rule holds; when both sides qualify nothing is done
+func (c *SignalCombiner) Combine(df *DataFrameCandle, votes []StrategySignals) []Signal {
+	decisions := make([]Signal, len(df.Candles))
+	weights := c.weights(votes)
+	window := c.Window
+	if window < 1 {
+		window = 1
+	}
+	vetoes := make([]vetoSeries, len(c.Vetoes))
+	for i, veto := range c.Vetoes {
+		vetoes[i] = veto.prepare(df)
+	}
+
+	for i := range df.Candles {
+		buyWeight, sellWeight := 0.0, 0.0
+		buyers, sellers := map[string]bool{}, map[string]bool{}
+		for v, vote := range votes {
+			// each strategy counts once per side, for its signals within the window
+			buy, sell := false, false
+			for j := i; j > i-window && j >= 0; j-- {
+				if j >= len(vote.Signals) {
+					continue
+				}
+				buy = buy || vote.Signals[j] == SignalBuy
+				sell = sell || vote.Signals[j] == SignalSell
+			}
+			if buy {
+				buyWeight += weights[v]
+				buyers[vote.Name] = true
+			}
+			if sell {
+				sellWeight += weights[v]
+				sellers[vote.Name] = true
+			}
+		}
+
+		isBuy := buyWeight >= c.Quorum && c.hasRequired(buyers) && !vetoed(vetoes, SignalBuy, i)
+		isSell := sellWeight >= c.Quorum && c.hasRequired(sellers) && !vetoed(vetoes, SignalSell, i)
+		switch {
+		case isBuy && !isSell:
+			decisions[i] = SignalBuy
+		case isSell && !isBuy:
+			decisions[i] = SignalSell
+		}
+	}
+	return decisions
+}
+
+func (c *SignalCombiner) hasRequired(agreeing map[string]bool) bool {
+	for _, name := range c.Required {
+		if !agreeing[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func vetoed(vetoes []vetoSeries, side Signal, i int) bool {
+	for _, veto := range vetoes {
+		if veto.side == side && veto.holds(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// VetoRule blocks Side whenever Left Op Right holds, e.g. "BUY:rsi(14)>70" never buys overbought
+// an operand is a number or one of close, volume, rsi(n), sma(n), ema(n)
+type VetoRule struct {
+	Side  Signal
+	Left  string
+	Op    string
+	Right string
+}
+
+var vetoRulePattern = regexp.MustCompile(`^(BUY|SELL)\s*:\s*(.+?)\s*(>=|<=|>|<)\s*(.+?)$`)
+var vetoOperandPattern = regexp.MustCompile(`^(close|volume|rsi|sma|ema)(?:\((\d+)\))?$`)
+
+// ParseVetoRule parses a rule like "BUY:rsi(14)>70" or "SELL:close<sma(50)"
+func ParseVetoRule(rule string) (VetoRule, error) {
+	m := vetoRulePattern.FindStringSubmatch(strings.TrimSpace(rule))
+	if m == nil {
+		return VetoRule{}, fmt.Errorf("invalid veto rule %q, expected e.g. BUY:rsi(14)>70", rule)
+	}
+	veto := VetoRule{Side: SignalBuy, Left: m[2], Op: m[3], Right: m[4]}
+	if m[1] == "SELL" {
+		veto.Side = SignalSell
+	}
+	for _, operand := range []string{veto.Left, veto.Right} {
+		if _, err := strconv.ParseFloat(operand, 64); err == nil {
+			continue
+		}
+		o := vetoOperandPattern.FindStringSubmatch(operand)
+		if o == nil {
+			return VetoRule{}, fmt.Errorf("invalid operand %q in veto rule %q", operand, rule)
+		}
+		if (o[1] == "rsi" || o[1] == "sma" || o[1] == "ema") && o[2] == "" {
+			return VetoRule{}, fmt.Errorf("%s needs a period in veto rule %q, e.g. %s(14)", o[1], rule, o[1])
+		}
+	}
+	return veto, nil
+}
+
+func (v VetoRule) String() string {
+	return fmt.Sprintf("%s:%s%s%s", v.Side, v.Left, v.Op, v.Right)
+}
+
+// vetoSeries is a veto rule with its operands computed over a dataframe
+type vetoSeries struct {
+	side        Signal
+	op          string
+	left, right []float64
+	warmUp      int // first candle every indicator of the rule has a value for
+}
+
+func (v VetoRule) prepare(df *DataFrameCandle) vetoSeries {
+	left, leftWarmUp := operandValues(v.Left, df)
+	right, rightWarmUp := operandValues(v.Right, df)
+	series := vetoSeries{side: v.Side, op: v.Op, left: left, right: right, warmUp: leftWarmUp}
+	if rightWarmUp > series.warmUp {
+		series.warmUp = rightWarmUp
+	}
+	return series
+}
+
+// holds reports whether the rule is true on candle i, never before its indicators are warmed up
+func (s vetoSeries) holds(i int) bool {
+	if i < s.warmUp {
+		return false
+	}
+	left, right := s.left[i], s.right[i]
+	switch s.op {
+	case ">":
+		return left > right
+	case "<":
+		return left < right
+	case ">=":
+		return left >= right
+	case "<=":
+		return left <= right
+	}
+	return false
+}
+
+// operandValues returns the operand on every candle and the first candle it is valid on
+func operandValues(operand string, df *DataFrameCandle) ([]float64, int) {
+	if number, err := strconv.ParseFloat(operand, 64); err == nil {
+		values := make([]float64, len(df.Candles))
+		for i := range values {
+			values[i] = number
+		}
+		return values, 0
+	}
+	o := vetoOperandPattern.FindStringSubmatch(operand)
+	period, _ := strconv.Atoi(o[2])
+	if len(df.Candles) <= period {
+		return make([]float64, len(df.Candles)), len(df.Candles)
+	}
+	switch o[1] {
+	case "volume":
+		return df.cachedVolumes(), 0
+	case "rsi":
+		return df.cachedRsi(period), period
+	case "sma":
+		return df.cachedSma(period), period
+	case "ema":
+		return df.cachedEma(period), period
+	}
+	return df.cachedCloses(), 0
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSignalCombinerCombine(t *testing.T) {
+	const N, B, S = SignalNone, SignalBuy, SignalSell
+	closes := []float64{100, 100, 100, 100, 100, 100}
+	df := testCandles(closes, closes)
+	votes := []StrategySignals{
+		{Name: "ema", Performance: 3, Signals: []Signal{B, N, N, S, B, N}},
+		{Name: "rsi", Performance: 1, Signals: []Signal{B, B, N, S, S, N}},
+		{Name: "macd", Performance: 0, Signals: []Signal{N, N, B, N, N, N}},
+	}
+	tests := []struct {
+		name     string
+		combiner SignalCombiner
+		want     []Signal
+	}{
+		{"quorum", SignalCombiner{Quorum: 2}, []Signal{B, N, N, S, N, N}},
+		{"one vote, both sides cancel", SignalCombiner{Quorum: 1}, []Signal{B, B, B, S, N, N}},
+		{"window", SignalCombiner{Quorum: 2, Window: 2}, []Signal{B, B, B, S, S, N}},
+		{"required", SignalCombiner{Quorum: 1, Required: []string{"ema"}}, []Signal{B, N, N, S, B, N}},
+		// ema weighs 2.25, rsi 0.75 and macd nothing
+		{"performance", SignalCombiner{Quorum: 2, Weighting: WeightingPerformance}, []Signal{B, N, N, S, B, N}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.combiner.Combine(df, votes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Combine() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignalCombinerVeto(t *testing.T) {
+	const N, B = SignalNone, SignalBuy
+	closes := []float64{100, 100, 100, 130, 130, 100}
+	df := testCandles(closes, closes)
+	votes := []StrategySignals{{Name: "ema", Signals: []Signal{B, B, B, B, B, B}}}
+
+	veto, err := ParseVetoRule("BUY: close > sma(3)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	combiner := SignalCombiner{Quorum: 1, Vetoes: []VetoRule{veto}}
+	// the sma is warmed up from the 4th candle, the close stays above it for two
+	want := []Signal{B, B, B, N, N, B}
+	if got := combiner.Combine(df, votes); !reflect.DeepEqual(got, want) {
+		t.Errorf("Combine() = %v, want %v", got, want)
+	}
+
+	sellVeto, err := ParseVetoRule("SELL:close<1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	combiner.Vetoes = []VetoRule{sellVeto}
+	if got := combiner.Combine(df, votes); !reflect.DeepEqual(got, votes[0].Signals) {
+		t.Errorf("Combine() with a sell veto = %v, want the buys untouched", got)
+	}
+}
+
+func TestParseVetoRule(t *testing.T) {
+	veto, err := ParseVetoRule("SELL:rsi(14)<=30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (VetoRule{Side: SignalSell, Left: "rsi(14)", Op: "<=", Right: "30"}); veto != want {
+		t.Errorf("ParseVetoRule() = %+v, want %+v", veto, want)
+	}
+	for _, rule := range []string{"HOLD:rsi(14)>70", "BUY:rsi>70", "BUY:macd(12)>0", "BUY:close=100"} {
+		if _, err := ParseVetoRule(rule); err == nil {
+			t.Errorf("ParseVetoRule(%q) err = nil", rule)
+		}
+	}
+}
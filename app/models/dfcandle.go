@@ -22,10 +22,12 @@ type DataFrameCandle struct {
 	Macd          *Macd              `json:"macd,omitempty"`
 	Hvs           []Hv               `json:"hvs,omitempty"`
 	Events        *TradeSignalEvents `json:"events,omitempty"`
+
+	indicators indicatorCache
 }
 
 func (df *DataFrameCandle) AddEvents(timeTime time.Time) bool {
-	tradeSignalEvents := GetTradeSignalEventsAfterTime(timeTime)
+	tradeSignalEvents := GetTradeSignalEventsAfterTime(df.ProductCode, timeTime)
 	if len(tradeSignalEvents.TradeSignals) > 0 {
 		df.Events = tradeSignalEvents
 		return true
@@ -33,229 +35,6 @@ func (df *DataFrameCandle) AddEvents(timeTime time.Time) bool {
 	return false
 }
 
-func (df *DataFrameCandle) BackTestEma(period1, period2 int) *TradeSignalEvents {
-	lenCandles := len(df.Candles)
-	if lenCandles <= period1 || lenCandles <= period2 {
-		return nil
-	}
-	tradeSignalEvents := NewTradeSignalEvents()
-	emaValue1 := talib.Ema(df.Closes(), period1)
-	emaValue2 := talib.Ema(df.Closes(), period2)
-
-	for i := 1; i < lenCandles; i++ {
-		if i < period1 || i < period2 {
-			continue
-		}
-		// golden cross
-		if emaValue1[i-1] < emaValue2[i-1] && emaValue1[i] >= emaValue2[i] {
-			tradeSignalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 0.05, false)
-		}
-		// dead cross
-		if emaValue1[i-1] > emaValue2[i-1] && emaValue1[i] <= emaValue2[i] {
-			tradeSignalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 0.05, false)
-		}
-
-	}
-	return tradeSignalEvents
-}
-
-func (df *DataFrameCandle) OptimizeEma() (performance float64, bestPeriod1 int, bestPeriod2 int) {
-	bestPeriod1 = 7
-	bestPeriod2 = 14
-
-	for period1 := 5; period1 < 50; period1++ {
-		for period2 := 12; period2 < 50; period2++ {
-			signalEvents := df.BackTestEma(period1, period2)
-			if signalEvents == nil {
-				continue
-			}
-			profit := signalEvents.Profit()
-			if performance < profit {
-				performance = profit
-				bestPeriod1 = period1
-				bestPeriod2 = period2
-			}
-		}
-	}
-	return performance, bestPeriod1, bestPeriod2
-}
-
-func (df *DataFrameCandle) BackTestBb(n int, k float64) *TradeSignalEvents {
-	lenCandles := len(df.Candles)
-
-	if lenCandles <= n {
-		return nil
-	}
-
-	signalEvents := &TradeSignalEvents{}
-	bbUp, _, bbDown := talib.BBands(df.Closes(), n, k, k, 0)
-	for i := 1; i < lenCandles; i++ {
-		if i < n {
-			continue
-		}
-		if bbDown[i-1] > df.Candles[i-1].Close && bbDown[i] <= df.Candles[i].Close {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 0.05, false)
-		}
-		if bbUp[i-1] < df.Candles[i-1].Close && bbUp[i] >= df.Candles[i].Close {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 0.05, false)
-		}
-	}
-	return signalEvents
-}
-
-func (df *DataFrameCandle) OptimizeBb() (performance float64, bestN int, bestK float64) {
-	bestN = 20
-	bestK = 2.0
-
-	for n := 10; n < 20; n++ {
-		for k := 1.9; k < 2.1; k += 0.1 {
-			tradeSignalEvents := df.BackTestBb(n, k)
-			if tradeSignalEvents == nil {
-				continue
-			}
-			profit := tradeSignalEvents.Profit()
-			if performance < profit {
-				performance = profit
-				bestN = n
-				bestK = k
-			}
-		}
-	}
-	return performance, bestN, bestK
-}
-
-func (df *DataFrameCandle) BackTestIchimoku() *TradeSignalEvents {
-	lenCandles := len(df.Candles)
-
-	if lenCandles <= 52 {
-		return nil
-	}
-
-	var signalEvents TradeSignalEvents
-	tenkan, kijun, senkouA, senkouB, chikou := tradingalgo.IchimokuCloud(df.Closes())
-
-	for i := 1; i < lenCandles; i++ {
-
-		if chikou[i-1] < df.Candles[i-1].High && chikou[i] >= df.Candles[i].High &&
-			senkouA[i] < df.Candles[i].Low && senkouB[i] < df.Candles[i].Low &&
-			tenkan[i] > kijun[i] {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 0.05, false)
-		}
-
-		if chikou[i-1] > df.Candles[i-1].Low && chikou[i] <= df.Candles[i].Low &&
-			senkouA[i] > df.Candles[i].High && senkouB[i] > df.Candles[i].High &&
-			tenkan[i] < kijun[i] {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 0.05, false)
-		}
-	}
-	return &signalEvents
-}
-
-func (df *DataFrameCandle) OptimizeIchimoku() (performance float64) {
-	signalEvents := df.BackTestIchimoku()
-	if signalEvents == nil {
-		return 0.0
-	}
-	performance = signalEvents.Profit()
-	return performance
-}
-
-func (df *DataFrameCandle) BackTestMacd(macdFastPeriod, macdSlowPeriod, macdSignalPeriod int) *TradeSignalEvents {
-	lenCandles := len(df.Candles)
-
-	if lenCandles <= macdFastPeriod || lenCandles <= macdSlowPeriod || lenCandles <= macdSignalPeriod {
-		return nil
-	}
-
-	signalEvents := &TradeSignalEvents{}
-	outMACD, outMACDSignal, _ := talib.Macd(df.Closes(), macdFastPeriod, macdSlowPeriod, macdSignalPeriod)
-
-	for i := 1; i < lenCandles; i++ {
-		if outMACD[i] < 0 &&
-			outMACDSignal[i] < 0 &&
-			outMACD[i-1] < outMACDSignal[i-1] &&
-			outMACD[i] >= outMACDSignal[i] {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 0.05, false)
-		}
-
-		if outMACD[i] > 0 &&
-			outMACDSignal[i] > 0 &&
-			outMACD[i-1] > outMACDSignal[i-1] &&
-			outMACD[i] <= outMACDSignal[i] {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 0.05, false)
-		}
-	}
-	return signalEvents
-}
-
-func (df *DataFrameCandle) OptimizeMacd() (performance float64, bestMacdFastPeriod, bestMacdSlowPeriod, bestMacdSignalPeriod int) {
-	bestMacdFastPeriod = 12
-	bestMacdSlowPeriod = 26
-	bestMacdSignalPeriod = 9
-
-	for fastPeriod := 10; fastPeriod < 19; fastPeriod++ {
-		for slowPeriod := 20; slowPeriod < 30; slowPeriod++ {
-			for signalPeriod := 5; signalPeriod < 15; signalPeriod++ {
-				signalEvents := df.BackTestMacd(fastPeriod, slowPeriod, signalPeriod)
-				if signalEvents == nil {
-					continue
-				}
-				profit := signalEvents.Profit()
-				if performance < profit {
-					performance = profit
-					bestMacdFastPeriod = fastPeriod
-					bestMacdSlowPeriod = slowPeriod
-					bestMacdSignalPeriod = signalPeriod
-				}
-			}
-		}
-	}
-	return performance, bestMacdFastPeriod, bestMacdSlowPeriod, bestMacdSignalPeriod
-}
-
-func (df *DataFrameCandle) BackTestRsi(period int, buyThread, sellThread float64) *TradeSignalEvents {
-	lenCandles := len(df.Candles)
-	if lenCandles <= period {
-		return nil
-	}
-
-	signalEvents := NewTradeSignalEvents()
-	values := talib.Rsi(df.Closes(), period)
-	for i := 1; i < lenCandles; i++ {
-		if values[i-1] == 0 || values[i-1] == 100 {
-			continue
-		}
-		if values[i-1] < buyThread && values[i] >= buyThread {
-			signalEvents.Buy(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 0.05, false)
-		}
-
-		if values[i-1] > sellThread && values[i] <= sellThread {
-			signalEvents.Sell(df.ProductCode, df.Candles[i].Time, df.Candles[i].Close, 0.05, false)
-		}
-	}
-	return signalEvents
-}
-
-func (df *DataFrameCandle) OptimizeRsi() (performance float64, bestPeriod int, bestBuyThread, bestSellThread float64) {
-	bestPeriod = 14
-	bestBuyThread, bestSellThread = 30.0, 70.0
-
-	for period := 5; period < 25; period++ {
-		signalEvents := df.BackTestRsi(period, bestBuyThread, bestSellThread)
-		if signalEvents == nil {
-			continue
-		}
-		profit := signalEvents.Profit()
-		if performance < profit {
-			performance = profit
-			bestPeriod = period
-			bestBuyThread = bestBuyThread
-			bestSellThread = bestSellThread
-		}
-	}
-	return performance, bestPeriod, bestBuyThread, bestSellThread
-}
-
 // SMA =>  Single Moving Average that calculates price trends with several periods
 // period => how long?, Values => actual average price
 type SMA struct {
@@ -414,6 +193,33 @@ func (df *DataFrameCandle) AddHv(period int) bool {
 	return false
 }
 
+// Atr returns the average true range of period candles at every candle, in the currency,
+// nil when df is too short
+func (df *DataFrameCandle) Atr(period int) []float64 {
+	if period <= 0 || len(df.Candles) <= period {
+		return nil
+	}
+	return talib.Atr(df.Highs(), df.Lows(), df.Closes(), period)
+}
+
+// Volatility returns the latest volatility of df in percent per candle, measured by the ATR ("atr")
+// or the historical volatility ("hv") of period candles, 0 when df is too short
+func (df *DataFrameCandle) Volatility(measure string, period int) float64 {
+	if period <= 0 || len(df.Candles) <= period {
+		return 0
+	}
+	if measure == "hv" {
+		hv := tradingalgo.HistoricalVolatility(df.Closes(), period)
+		return hv[len(hv)-1]
+	}
+	atr := df.Atr(period)
+	last := df.Candles[len(df.Candles)-1].Close
+	if last <= 0 {
+		return 0
+	}
+	return atr[len(atr)-1] / last * 100
+}
+
 // Times return slice only contains time value
 func (df *DataFrameCandle) Times() []time.Time {
 	// create slice that contains type of time & length of Candles
@@ -3,12 +3,19 @@ package models
 import (
 	"encoding/json"
 	"fmt"
-	"go-trading-bot/config"
+	"go-trading-bot/metrics"
 	"log"
 	"strings"
 	"time"
 )
 
+// the position of a product after a trade
+const (
+	PositionFlat  = "FLAT"
+	PositionLong  = "LONG"  // bought, a sell closes it
+	PositionShort = "SHORT" // sold on margin, a buy closes it
+)
+
 // TradeSignalEvent => use when trade is executed
 type TradeSignalEvent struct {
 	Time        time.Time `json:"time"`
@@ -16,12 +23,13 @@ type TradeSignalEvent struct {
 	Side        string    `json:"side"`
 	Price       float64   `json:"price"`
 	Size        float64   `json:"size"`
+	Position    string    `json:"position"` // the position after the trade, FLAT when it closed one
 }
 
 // Save will return true if successfully insert data into the database
 func (trade *TradeSignalEvent) Save() bool {
-	cmd := fmt.Sprintf("INSERT INTO %s (time, product_code, side, price, size) VALUES (?, ?, ?, ?, ?)", tableNameSignalEvents)
-	_, err := DbConnection.Exec(cmd, trade.Time.Format(time.RFC3339), trade.ProductCode, trade.Side, trade.Price, trade.Size)
+	cmd := fmt.Sprintf("INSERT INTO %s (time, product_code, side, price, size, position) VALUES (?, ?, ?, ?, ?, ?)", tableNameSignalEvents)
+	_, err := DbConnection.Exec(cmd, trade.Time.Format(time.RFC3339), trade.ProductCode, trade.Side, trade.Price, trade.Size, trade.Position)
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
 			log.Println(err)
@@ -35,6 +43,7 @@ func (trade *TradeSignalEvent) Save() bool {
 // TradeSignalEvents that holds several signal struct.
 type TradeSignalEvents struct {
 	TradeSignals []TradeSignalEvent `json:"signals,omitempty"`
+	AllowShort   bool               `json:"-"` // a sell while flat opens a short position, on margin products
 }
 
 // NewTradeSignalEvents => constructor
@@ -42,12 +51,12 @@ func NewTradeSignalEvents() *TradeSignalEvents {
 	return &TradeSignalEvents{}
 }
 
-// GetTradeSignalEventsByCount returns only specified number of latest trade result
-func GetTradeSignalEventsByCount(loadEvents int) *TradeSignalEvents {
+// GetTradeSignalEventsByCount returns only specified number of latest trade result of productCode
+func GetTradeSignalEventsByCount(productCode string, loadEvents int) *TradeSignalEvents {
 	cmd := fmt.Sprintf(`SELECT * FROM (
-		SELECT time, product_code, side, price, size FROM %s WHERE product_code = ? ORDER BY time DESC LIMIT ? )
+		SELECT time, product_code, side, price, size, position FROM %s WHERE product_code = ? ORDER BY time DESC LIMIT ? )
 		ORDER BY time ASC;`, tableNameSignalEvents)
-	rows, err := DbConnection.Query(cmd, config.Config.ProductCode, loadEvents)
+	rows, err := DbConnection.Query(cmd, productCode, loadEvents)
 	if err != nil {
 		return nil
 	}
@@ -56,7 +65,7 @@ func GetTradeSignalEventsByCount(loadEvents int) *TradeSignalEvents {
 	var tradeSignalEvents TradeSignalEvents
 	for rows.Next() {
 		var tradeSignalEvent TradeSignalEvent
-		rows.Scan(&tradeSignalEvent.Time, &tradeSignalEvent.ProductCode, &tradeSignalEvent.Side, &tradeSignalEvent.Price, &tradeSignalEvent.Size)
+		rows.Scan(&tradeSignalEvent.Time, &tradeSignalEvent.ProductCode, &tradeSignalEvent.Side, &tradeSignalEvent.Price, &tradeSignalEvent.Size, &tradeSignalEvent.Position)
 		tradeSignalEvents.TradeSignals = append(tradeSignalEvents.TradeSignals, tradeSignalEvent)
 	}
 	err = rows.Err()
@@ -66,14 +75,14 @@ func GetTradeSignalEventsByCount(loadEvents int) *TradeSignalEvents {
 	return &tradeSignalEvents
 }
 
-// GetTradeSignalEventsAfterTime returns trade data after specified time
-func GetTradeSignalEventsAfterTime(getTime time.Time) *TradeSignalEvents {
+// GetTradeSignalEventsAfterTime returns trade data of productCode after specified time
+func GetTradeSignalEventsAfterTime(productCode string, getTime time.Time) *TradeSignalEvents {
 	cmd := fmt.Sprintf(`SELECT * FROM (
-		SELECT time, product_code, side, price, size FROM %s
-		WHERE DATETIME(time) >= DATETIME(?)
+		SELECT time, product_code, side, price, size, position FROM %s
+		WHERE product_code = ? AND DATETIME(time) >= DATETIME(?)
 		ORDER BY time DESC
 ) ORDER BY time ASC;`, tableNameSignalEvents)
-	rows, err := DbConnection.Query(cmd, getTime.Format(time.RFC3339))
+	rows, err := DbConnection.Query(cmd, productCode, getTime.Format(time.RFC3339))
 	if err != nil {
 		return nil
 	}
@@ -82,7 +91,7 @@ func GetTradeSignalEventsAfterTime(getTime time.Time) *TradeSignalEvents {
 	var tradeSignalEvents TradeSignalEvents
 	for rows.Next() {
 		var tradeSignalEvent TradeSignalEvent
-		rows.Scan(&tradeSignalEvent.Time, &tradeSignalEvent.ProductCode, &tradeSignalEvent.Side, &tradeSignalEvent.Price, &tradeSignalEvent.Size)
+		rows.Scan(&tradeSignalEvent.Time, &tradeSignalEvent.ProductCode, &tradeSignalEvent.Side, &tradeSignalEvent.Price, &tradeSignalEvent.Size, &tradeSignalEvent.Position)
 		tradeSignalEvents.TradeSignals = append(tradeSignalEvents.TradeSignals, tradeSignalEvent)
 	}
 	err = rows.Err()
@@ -92,44 +101,52 @@ func GetTradeSignalEventsAfterTime(getTime time.Time) *TradeSignalEvents {
 	return &tradeSignalEvents
 }
 
-func (trade *TradeSignalEvents) CanBuy(time time.Time) bool {
-	lenTradeSignals := len(trade.TradeSignals)
-	if lenTradeSignals == 0 {
-		return true
+// Position returns the position after the last trade, FLAT without trades
+func (trade *TradeSignalEvents) Position() string {
+	if len(trade.TradeSignals) == 0 {
+		return PositionFlat
 	}
+	return trade.TradeSignals[len(trade.TradeSignals)-1].Position
+}
 
-	lastTradeSignal := trade.TradeSignals[lenTradeSignals-1]
-	if lastTradeSignal.Side == "SELL" && lastTradeSignal.Time.Before(time) {
-		return true
+// CanBuy reports whether a buy at time opens a long position or closes a short one
+func (trade *TradeSignalEvents) CanBuy(time time.Time) bool {
+	if !trade.after(time) {
+		return false
 	}
-	return false
-
+	return trade.Position() != PositionLong
 }
 
+// CanSell reports whether a sell at time closes a long position or, with AllowShort, opens a short one
 func (trade *TradeSignalEvents) CanSell(time time.Time) bool {
-	lenTradeSignals := len(trade.TradeSignals)
-	if lenTradeSignals == 0 {
+	if !trade.after(time) {
 		return false
 	}
+	position := trade.Position()
+	return position == PositionLong || (position == PositionFlat && trade.AllowShort)
+}
 
-	lastTradeSignal := trade.TradeSignals[lenTradeSignals-1]
-	if lastTradeSignal.Side == "BUY" && lastTradeSignal.Time.Before(time) {
-		return true
-	}
-	return false
-
+// after reports whether time is after the last trade
+func (trade *TradeSignalEvents) after(time time.Time) bool {
+	lenTradeSignals := len(trade.TradeSignals)
+	return lenTradeSignals == 0 || trade.TradeSignals[lenTradeSignals-1].Time.Before(time)
 }
 
 func (trade *TradeSignalEvents) Buy(ProductCode string, time time.Time, price, size float64, save bool) bool {
 	if !trade.CanBuy(time) {
 		return false
 	}
+	position := PositionLong
+	if trade.Position() == PositionShort {
+		position = PositionFlat
+	}
 	buySignal := TradeSignalEvent{
 		ProductCode: ProductCode,
 		Time:        time,
 		Side:        "BUY",
 		Price:       price,
 		Size:        size,
+		Position:    position,
 	}
 	// if it is not backtest
 	if save {
@@ -143,12 +160,17 @@ func (trade *TradeSignalEvents) Sell(ProductCode string, time time.Time, price,
 	if !trade.CanSell(time) {
 		return false
 	}
+	position := PositionShort
+	if trade.Position() == PositionLong {
+		position = PositionFlat
+	}
 	sellSignal := TradeSignalEvent{
 		ProductCode: ProductCode,
 		Time:        time,
 		Side:        "SELL",
 		Price:       price,
 		Size:        size,
+		Position:    position,
 	}
 	// if it is not backtest
 	if save {
@@ -158,30 +180,63 @@ func (trade *TradeSignalEvents) Sell(ProductCode string, time time.Time, price,
 	return true
 }
 
+// Profit is the sum of the profits of the closed positions, long or short
+// a position opened before the first trade or still open does not count
 func (trade *TradeSignalEvents) Profit() float64 {
 	total := 0.0
-	beforeSell := 0.0
-	isHolding := false
-	for i, signalTradeEvent := range trade.TradeSignals {
-		if i == 0 && signalTradeEvent.Side == "SELL" {
+	var entry *TradeSignalEvent
+	for i := range trade.TradeSignals {
+		event := &trade.TradeSignals[i]
+		if event.Position != PositionFlat {
+			entry = event
 			continue
 		}
-		if signalTradeEvent.Side == "BUY" {
-			total -= signalTradeEvent.Price * signalTradeEvent.Size
-			isHolding = true
-		}
-		if signalTradeEvent.Side == "SELL" {
-			total += signalTradeEvent.Price * signalTradeEvent.Size
-			isHolding = false
-			beforeSell = total
+		if entry != nil {
+			total += entry.profit(event)
 		}
-	}
-	if isHolding == true {
-		return beforeSell
+		entry = nil
 	}
 	return total
 }
 
+// profit is what the position opened by entry made when exit closed it
+func (entry *TradeSignalEvent) profit(exit *TradeSignalEvent) float64 {
+	if entry.Side == "SELL" {
+		return entry.Price*entry.Size - exit.Price*exit.Size
+	}
+	return exit.Price*exit.Size - entry.Price*entry.Size
+}
+
+// Report computes the performance metrics of the trades over the candles of df,
+// starting from initialCash and valuing the open position, long or short, at every close
+func (trade *TradeSignalEvents) Report(df *DataFrameCandle, initialCash float64) metrics.Report {
+	cash := initialCash
+	var entry *TradeSignalEvent
+	var profits []float64
+	curve := make([]metrics.Point, 0, len(df.Candles))
+	j := 0
+	for _, candle := range df.Candles {
+		for ; j < len(trade.TradeSignals) && !trade.TradeSignals[j].Time.After(candle.Time); j++ {
+			event := &trade.TradeSignals[j]
+			switch {
+			case entry == nil && event.Position != PositionFlat:
+				entry = event
+			case entry != nil && event.Position == PositionFlat:
+				profit := entry.profit(event)
+				cash += profit
+				profits = append(profits, profit)
+				entry = nil
+			}
+		}
+		equity := cash
+		if entry != nil {
+			equity += entry.profit(&TradeSignalEvent{Price: candle.Close, Size: entry.Size})
+		}
+		curve = append(curve, metrics.Point{Time: candle.Time, Equity: equity, Exposed: entry != nil})
+	}
+	return metrics.Compute(curve, profits)
+}
+
 func (trade TradeSignalEvents) MarshalJSON() ([]byte, error) {
 	value, err := json.Marshal(&struct {
 		AllSignals []TradeSignalEvent `json:"signals,omitempty"`
@@ -201,7 +256,7 @@ func (trade *TradeSignalEvents) GetAfter(time time.Time) *TradeSignalEvents {
 		if time.After(signal.Time) {
 			continue
 		}
-		return &TradeSignalEvents{TradeSignals: trade.TradeSignals[i:]}
+		return &TradeSignalEvents{TradeSignals: trade.TradeSignals[i:], AllowShort: trade.AllowShort}
 	}
 	return nil
 }
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTradeSignalEventsProfit(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	type trade struct {
+		side  string
+		price float64
+		size  float64
+	}
+	tests := []struct {
+		name       string
+		allowShort bool
+		trades     []trade
+		want       float64
+	}{
+		{
+			name:   "long",
+			trades: []trade{{"BUY", 100, 2}, {"SELL", 110, 2}},
+			want:   20,
+		},
+		{
+			name:       "short",
+			allowShort: true,
+			trades:     []trade{{"SELL", 110, 2}, {"BUY", 100, 2}},
+			want:       20,
+		},
+		{
+			name:       "losing short",
+			allowShort: true,
+			trades:     []trade{{"SELL", 100, 1}, {"BUY", 120, 1}},
+			want:       -20,
+		},
+		{
+			name:       "long then short",
+			allowShort: true,
+			trades:     []trade{{"BUY", 100, 1}, {"SELL", 90, 1}, {"SELL", 90, 1}, {"BUY", 80, 1}},
+			want:       0,
+		},
+		{
+			name:       "open position does not count",
+			allowShort: true,
+			trades:     []trade{{"BUY", 100, 1}, {"SELL", 130, 1}, {"SELL", 130, 1}},
+			want:       30,
+		},
+		{
+			name:   "no short on spot",
+			trades: []trade{{"SELL", 110, 1}, {"BUY", 100, 1}},
+			want:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := NewTradeSignalEvents()
+			events.AllowShort = tt.allowShort
+			for i, trade := range tt.trades {
+				at := start.Add(time.Duration(i) * time.Minute)
+				if trade.side == "BUY" {
+					events.Buy("FX_BTC_JPY", at, trade.price, trade.size, false)
+				} else {
+					events.Sell("FX_BTC_JPY", at, trade.price, trade.size, false)
+				}
+			}
+			if got := events.Profit(); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Profit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
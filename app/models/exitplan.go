@@ -0,0 +1,210 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"go-trading-bot/config"
+	"math"
+	"time"
+)
+
+// why an exit plan closes a position
+const (
+	ExitStopLoss     = "stop_loss"
+	ExitTakeProfit   = "take_profit"
+	ExitTrailingStop = "trailing_stop"
+	ExitTime         = "time"
+)
+
+// ExitConfig is where positions are closed, as a percent of the entry price or a multiple of the ATR
+// at the entry; a level set both ways uses the ATR
+type ExitConfig struct {
+	StopLossPercent     float64 // close this many percent against the entry, below it for a long position
+	StopLossATR         float64
+	TakeProfitPercent   float64 // close this many percent in favor of the entry
+	TakeProfitATR       float64
+	TrailingStopPercent float64 // close this many percent against the best price since the entry
+	TrailingStopATR     float64
+	ATRPeriod           int
+	MaxHolding          time.Duration // close once the position is this old, 0 holds it until another exit
+}
+
+// DefaultExitConfig is the [risk] section, without a stop loss there it falls back to stopLimitPercent,
+// the share of the entry price the AI used to stop at
+func DefaultExitConfig(stopLimitPercent float64) ExitConfig {
+	c := config.Config
+	cfg := ExitConfig{
+		StopLossPercent:     c.RiskStopLossPercent,
+		StopLossATR:         c.RiskStopLossATR,
+		TakeProfitPercent:   c.RiskTakeProfitPercent,
+		TakeProfitATR:       c.RiskTakeProfitATR,
+		TrailingStopPercent: c.RiskTrailingStopPercent,
+		TrailingStopATR:     c.RiskTrailingStopATR,
+		ATRPeriod:           c.RiskATRPeriod,
+		MaxHolding:          c.RiskMaxHolding,
+	}
+	if cfg.StopLossPercent == 0 && cfg.StopLossATR == 0 && stopLimitPercent > 0 && stopLimitPercent < 1 {
+		cfg.StopLossPercent = (1 - stopLimitPercent) * 100
+	}
+	return cfg
+}
+
+// UsesATR reports whether a level depends on the ATR
+func (c ExitConfig) UsesATR() bool {
+	return c.StopLossATR > 0 || c.TakeProfitATR > 0 || c.TrailingStopATR > 0
+}
+
+// distance is how far from the entry a level is, 0 when it is not set
+func (c ExitConfig) distance(entryPrice, percent, multiple, atr float64) float64 {
+	if multiple > 0 && atr > 0 {
+		return multiple * atr
+	}
+	return entryPrice * percent / 100
+}
+
+// StopLossPrice is the stop loss of a position entered at entryPrice by side, BUY for a long position
+// and SELL for a short one, 0 without one
+func (c ExitConfig) StopLossPrice(side string, entryPrice, atr float64) float64 {
+	distance := c.distance(entryPrice, c.StopLossPercent, c.StopLossATR, atr)
+	switch {
+	case distance <= 0:
+		return 0
+	case side == "SELL":
+		return entryPrice + distance
+	case distance < entryPrice:
+		return entryPrice - distance
+	}
+	return 0
+}
+
+// ExitPlan is how the open position of a product is closed besides a closing signal, stored in exit_plans
+// so it outlives a restart
+type ExitPlan struct {
+	ProductCode   string    `json:"product_code"`
+	Side          string    `json:"side"` // BUY for a long position, SELL for a short one
+	EntryTime     time.Time `json:"entry_time"`
+	EntryPrice    float64   `json:"entry_price"`
+	Size          float64   `json:"size"`
+	StopLoss      float64   `json:"stop_loss"`      // close at or beyond, 0 disables it
+	TakeProfit    float64   `json:"take_profit"`    // close at or beyond, 0 disables it
+	TrailDistance float64   `json:"trail_distance"` // close this far below HighestPrice, or above LowestPrice when short, 0 disables it
+	HighestPrice  float64   `json:"highest_price"`
+	LowestPrice   float64   `json:"lowest_price"`
+	Deadline      time.Time `json:"deadline"` // close from then on, zero disables it
+	// the special order holding the stop loss, take profit and trailing stop at the exchange,
+	// the plan only checks the deadline while it is set
+	ParentOrderAcceptanceID string `json:"parent_order_acceptance_id"`
+}
+
+// NewExitPlan sets the levels of cfg for a position of size entered at entryPrice by side, atr is the ATR at the entry
+func NewExitPlan(cfg ExitConfig, productCode, side string, entryTime time.Time, entryPrice, size, atr float64) *ExitPlan {
+	plan := &ExitPlan{
+		ProductCode:   productCode,
+		Side:          side,
+		EntryTime:     entryTime,
+		EntryPrice:    entryPrice,
+		Size:          size,
+		StopLoss:      cfg.StopLossPrice(side, entryPrice, atr),
+		TrailDistance: cfg.distance(entryPrice, cfg.TrailingStopPercent, cfg.TrailingStopATR, atr),
+		HighestPrice:  entryPrice,
+		LowestPrice:   entryPrice,
+	}
+	if distance := cfg.distance(entryPrice, cfg.TakeProfitPercent, cfg.TakeProfitATR, atr); distance > 0 {
+		plan.TakeProfit = entryPrice + distance
+		if side == "SELL" {
+			plan.TakeProfit = math.Max(entryPrice-distance, 0)
+		}
+	}
+	if cfg.MaxHolding > 0 {
+		plan.Deadline = entryTime.Add(cfg.MaxHolding)
+	}
+	return plan
+}
+
+// Short reports whether the plan closes a short position
+func (p *ExitPlan) Short() bool {
+	return p.Side == "SELL"
+}
+
+// TrailingStop is the price the trailing stop closes at, 0 without one
+func (p *ExitPlan) TrailingStop() float64 {
+	if p.TrailDistance <= 0 {
+		return 0
+	}
+	if p.Short() {
+		return p.LowestPrice + p.TrailDistance
+	}
+	return p.HighestPrice - p.TrailDistance
+}
+
+// Update follows price at now, the bid for a long position and the ask for a short one, it returns
+// why the position has to be closed, empty when it stays open, and whether the trailing stop moved
+func (p *ExitPlan) Update(price float64, now time.Time) (reason string, moved bool) {
+	if price <= 0 || now.Before(p.EntryTime) {
+		return "", false
+	}
+	if price > p.HighestPrice {
+		p.HighestPrice = price
+		moved = p.TrailDistance > 0 && !p.Short()
+	}
+	if price < p.LowestPrice || p.LowestPrice <= 0 {
+		p.LowestPrice = price
+		moved = moved || p.TrailDistance > 0 && p.Short()
+	}
+	// against is whether price reached level against the position, in favor when false
+	beyond := func(level float64, against bool) bool {
+		if level <= 0 {
+			return false
+		}
+		if p.Short() == against {
+			return price >= level
+		}
+		return price <= level
+	}
+	switch {
+	case !p.Deadline.IsZero() && !now.Before(p.Deadline):
+		return ExitTime, moved
+	case p.ParentOrderAcceptanceID != "":
+		// the exchange watches the price
+		return "", moved
+	case beyond(p.StopLoss, true):
+		return ExitStopLoss, moved
+	case beyond(p.TrailingStop(), true):
+		return ExitTrailingStop, moved
+	case beyond(p.TakeProfit, false):
+		return ExitTakeProfit, moved
+	}
+	return "", moved
+}
+
+// Save inserts or replaces the plan of its product
+func (p *ExitPlan) Save() error {
+	cmd := fmt.Sprintf(`INSERT OR REPLACE INTO %s (product_code, side, entry_time, entry_price, size, stop_loss, take_profit,
+		trail_distance, highest_price, lowest_price, deadline, parent_order_acceptance_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, tableNameExitPlans)
+	_, err := DbConnection.Exec(cmd, p.ProductCode, p.Side, p.EntryTime.Format(time.RFC3339Nano), p.EntryPrice, p.Size, p.StopLoss, p.TakeProfit,
+		p.TrailDistance, p.HighestPrice, p.LowestPrice, p.Deadline.Format(time.RFC3339Nano), p.ParentOrderAcceptanceID)
+	return err
+}
+
+// GetExitPlan returns the saved plan of productCode, nil when no position is open
+func GetExitPlan(productCode string) (*ExitPlan, error) {
+	cmd := fmt.Sprintf(`SELECT product_code, side, entry_time, entry_price, size, stop_loss, take_profit,
+		trail_distance, highest_price, lowest_price, deadline, parent_order_acceptance_id FROM %s WHERE product_code = ?`, tableNameExitPlans)
+	var p ExitPlan
+	err := DbConnection.QueryRow(cmd, productCode).Scan(&p.ProductCode, &p.Side, &p.EntryTime, &p.EntryPrice, &p.Size, &p.StopLoss, &p.TakeProfit,
+		&p.TrailDistance, &p.HighestPrice, &p.LowestPrice, &p.Deadline, &p.ParentOrderAcceptanceID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// DeleteExitPlan removes the plan of productCode once its position is closed
+func DeleteExitPlan(productCode string) error {
+	cmd := fmt.Sprintf("DELETE FROM %s WHERE product_code = ?", tableNameExitPlans)
+	_, err := DbConnection.Exec(cmd, productCode)
+	return err
+}
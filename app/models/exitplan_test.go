@@ -0,0 +1,44 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExitPlanUpdate(t *testing.T) {
+	entry := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cfg := ExitConfig{StopLossPercent: 5, TakeProfitPercent: 10, TrailingStopPercent: 3, MaxHolding: time.Hour}
+	tests := []struct {
+		name   string
+		side   string
+		prices []float64
+		at     time.Duration // after the entry, of the last price
+		want   string
+	}{
+		{name: "long holds", side: "BUY", prices: []float64{101, 102}, at: time.Minute},
+		{name: "long stop loss", side: "BUY", prices: []float64{99, 95}, at: time.Minute, want: ExitStopLoss},
+		{name: "long take profit", side: "BUY", prices: []float64{105, 106, 110}, at: time.Minute, want: ExitTakeProfit},
+		{name: "long trailing stop", side: "BUY", prices: []float64{108, 104.7}, at: time.Minute, want: ExitTrailingStop},
+		{name: "short holds", side: "SELL", prices: []float64{99, 98}, at: time.Minute},
+		{name: "short stop loss", side: "SELL", prices: []float64{101, 105}, at: time.Minute, want: ExitStopLoss},
+		{name: "short take profit", side: "SELL", prices: []float64{95, 90}, at: time.Minute, want: ExitTakeProfit},
+		{name: "short trailing stop", side: "SELL", prices: []float64{92, 95.1}, at: time.Minute, want: ExitTrailingStop},
+		{name: "time exit", side: "BUY", prices: []float64{101}, at: time.Hour, want: ExitTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := NewExitPlan(cfg, "BTC_JPY", tt.side, entry, 100, 1, 0)
+			got := ""
+			for i, price := range tt.prices {
+				now := entry.Add(time.Second * time.Duration(i+1))
+				if i == len(tt.prices)-1 {
+					now = entry.Add(tt.at)
+				}
+				got, _ = plan.Update(price, now)
+			}
+			if got != tt.want {
+				t.Errorf("Update() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"fmt"
+	"go-trading-bot/tradingalgo"
+	"sync"
+
+	"github.com/markcheno/go-talib"
+)
+
+// indicatorCache keeps the indicator series of a dataframe so the thousands of backtests
+// of an optimization compute each of them once, it is safe for concurrent use
+// the cached slices are shared and must not be modified
+type indicatorCache struct {
+	mu     sync.Mutex
+	series map[string][][]float64
+}
+
+// cached returns the series stored under key, computing them on first use
+func (df *DataFrameCandle) cached(key string, compute func() [][]float64) [][]float64 {
+	df.indicators.mu.Lock()
+	series, ok := df.indicators.series[key]
+	df.indicators.mu.Unlock()
+	if ok {
+		return series
+	}
+	// computed outside the lock so the workers do not wait on each other,
+	// two of them may compute the same key once
+	series = compute()
+	df.indicators.mu.Lock()
+	defer df.indicators.mu.Unlock()
+	if df.indicators.series == nil {
+		df.indicators.series = map[string][][]float64{}
+	}
+	df.indicators.series[key] = series
+	return series
+}
+
+func (df *DataFrameCandle) cachedCloses() []float64 {
+	return df.cached("close", func() [][]float64 {
+		return [][]float64{df.Closes()}
+	})[0]
+}
+
+func (df *DataFrameCandle) cachedVolumes() []float64 {
+	return df.cached("volume", func() [][]float64 {
+		return [][]float64{df.Volumes()}
+	})[0]
+}
+
+func (df *DataFrameCandle) cachedSma(period int) []float64 {
+	return df.cached(fmt.Sprintf("sma(%d)", period), func() [][]float64 {
+		return [][]float64{talib.Sma(df.cachedCloses(), period)}
+	})[0]
+}
+
+func (df *DataFrameCandle) cachedEma(period int) []float64 {
+	return df.cached(fmt.Sprintf("ema(%d)", period), func() [][]float64 {
+		return [][]float64{talib.Ema(df.cachedCloses(), period)}
+	})[0]
+}
+
+func (df *DataFrameCandle) cachedRsi(period int) []float64 {
+	return df.cached(fmt.Sprintf("rsi(%d)", period), func() [][]float64 {
+		return [][]float64{talib.Rsi(df.cachedCloses(), period)}
+	})[0]
+}
+
+// cachedBBands returns the upper, middle and lower band
+func (df *DataFrameCandle) cachedBBands(n int, k float64) (up, mid, down []float64) {
+	series := df.cached(fmt.Sprintf("bbands(%d,%g)", n, k), func() [][]float64 {
+		up, mid, down := talib.BBands(df.cachedCloses(), n, k, k, 0)
+		return [][]float64{up, mid, down}
+	})
+	return series[0], series[1], series[2]
+}
+
+// cachedMacd returns the MACD, its signal line and the histogram
+func (df *DataFrameCandle) cachedMacd(fastPeriod, slowPeriod, signalPeriod int) (macd, signal, hist []float64) {
+	series := df.cached(fmt.Sprintf("macd(%d,%d,%d)", fastPeriod, slowPeriod, signalPeriod), func() [][]float64 {
+		macd, signal, hist := talib.Macd(df.cachedCloses(), fastPeriod, slowPeriod, signalPeriod)
+		return [][]float64{macd, signal, hist}
+	})
+	return series[0], series[1], series[2]
+}
+
+// cachedIchimoku returns the tenkan, kijun, senkou A, senkou B and chikou lines
+func (df *DataFrameCandle) cachedIchimoku() (tenkan, kijun, senkouA, senkouB, chikou []float64) {
+	series := df.cached("ichimoku", func() [][]float64 {
+		tenkan, kijun, senkouA, senkouB, chikou := tradingalgo.IchimokuCloud(df.cachedCloses())
+		return [][]float64{tenkan, kijun, senkouA, senkouB, chikou}
+	})
+	return series[0], series[1], series[2], series[3], series[4]
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// KillSwitch halts every new position of the bot until it is released, stored in kill_switch
+type KillSwitch struct {
+	Engaged   bool      `json:"engaged"`
+	Reason    string    `json:"reason"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GetKillSwitch returns the state of the kill switch, released when it was never set
+func GetKillSwitch() (KillSwitch, error) {
+	cmd := fmt.Sprintf("SELECT engaged, reason, updated_at FROM %s WHERE id = 1", tableNameKillSwitch)
+	var k KillSwitch
+	err := DbConnection.QueryRow(cmd).Scan(&k.Engaged, &k.Reason, &k.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return KillSwitch{}, nil
+	}
+	return k, err
+}
+
+// SetKillSwitch engages or releases the kill switch, releasing it also forgets the equity peaks
+// so the drawdown limits start over
+func SetKillSwitch(engaged bool, reason string) (KillSwitch, error) {
+	k := KillSwitch{Engaged: engaged, Reason: reason, UpdatedAt: time.Now().UTC()}
+	cmd := fmt.Sprintf("INSERT OR REPLACE INTO %s (id, engaged, reason, updated_at) VALUES (1, ?, ?, ?)", tableNameKillSwitch)
+	if _, err := DbConnection.Exec(cmd, k.Engaged, k.Reason, k.UpdatedAt.Format(time.RFC3339Nano)); err != nil {
+		return k, err
+	}
+	if !engaged {
+		if _, err := DbConnection.Exec(fmt.Sprintf("DELETE FROM %s", tableNameEquityPeaks)); err != nil {
+			return k, err
+		}
+	}
+	return k, nil
+}
+
+// EquityPeak is the highest equity seen since Start, the beginning of a day or a week, stored in equity_peaks
+type EquityPeak struct {
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
+	Peak   float64   `json:"peak"`
+}
+
+// UpdateEquityPeak records equity in the period starting at start and returns the peak of that period,
+// a peak of an earlier period is replaced
+func UpdateEquityPeak(period string, start time.Time, equity float64) (EquityPeak, error) {
+	cmd := fmt.Sprintf("SELECT period, start, peak FROM %s WHERE period = ?", tableNameEquityPeaks)
+	var p EquityPeak
+	err := DbConnection.QueryRow(cmd, period).Scan(&p.Period, &p.Start, &p.Peak)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if err == sql.ErrNoRows || !p.Start.Equal(start) {
+		p = EquityPeak{Period: period, Start: start}
+	}
+	if equity <= p.Peak {
+		return p, nil
+	}
+	p.Peak = equity
+	cmd = fmt.Sprintf("INSERT OR REPLACE INTO %s (period, start, peak) VALUES (?, ?, ?)", tableNameEquityPeaks)
+	_, err = DbConnection.Exec(cmd, p.Period, p.Start.Format(time.RFC3339Nano), p.Peak)
+	return p, err
+}
+
+// ConsecutiveLosses counts the latest trades of productCode in a row that closed a position at a loss,
+// long or short; trades closed before since do not count
+func ConsecutiveLosses(productCode string, since time.Time) (int, error) {
+	cmd := fmt.Sprintf("SELECT time, side, price, position FROM %s WHERE product_code = ? ORDER BY time ASC", tableNameSignalEvents)
+	rows, err := DbConnection.Query(cmd, productCode)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	losses := 0
+	var entry *TradeSignalEvent
+	for rows.Next() {
+		var event TradeSignalEvent
+		if err := rows.Scan(&event.Time, &event.Side, &event.Price, &event.Position); err != nil {
+			return 0, err
+		}
+		if event.Position != PositionFlat {
+			entry = &event
+			continue
+		}
+		if entry != nil && !event.Time.Before(since) {
+			entry.Size, event.Size = 1, 1
+			if entry.profit(&event) < 0 {
+				losses++
+			} else {
+				losses = 0
+			}
+		}
+		entry = nil
+	}
+	return losses, rows.Err()
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"go-trading-bot/config"
+	"os"
+	"testing"
+)
+
+// TestMain removes the database the package created in its directory
+func TestMain(m *testing.M) {
+	code := m.Run()
+	DbConnection.Close()
+	os.Remove(config.Config.DbName)
+	os.Exit(code)
+}
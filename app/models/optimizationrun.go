@@ -0,0 +1,196 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// OptimizationRun is one optimization of the parameters an AI trades with, stored in optimization_runs
+type OptimizationRun struct {
+	ID          int64                   `json:"id"`
+	ProductCode string                  `json:"product_code"`
+	Duration    time.Duration           `json:"duration"`
+	StartedAt   time.Time               `json:"started_at"`
+	FinishedAt  time.Time               `json:"finished_at"`
+	DataFrom    time.Time               `json:"data_from"` // first and last candle optimized on
+	DataTo      time.Time               `json:"data_to"`
+	Candles     int                     `json:"candles"`
+	Method      string                  `json:"method"`
+	Objective   string                  `json:"objective"`
+	Params      *TradeParams            `json:"params"`   // the chosen params, nil when nothing qualified
+	Accepted    bool                    `json:"accepted"` // the AI trades with Params
+	Reason      string                  `json:"reason"`   // why the params were rejected
+	Candidates  []OptimizationCandidate `json:"-"`
+}
+
+// OptimizationCandidate is one backtested parameter set of a run, stored in optimization_candidates
+// a walk forward optimizes several windows, DataFrom and DataTo tell them apart
+type OptimizationCandidate struct {
+	Strategy   string         `json:"strategy"`
+	Params     StrategyParams `json:"params"`
+	Score      float64        `json:"score"`
+	Profitable bool           `json:"profitable"`
+	DataFrom   time.Time      `json:"data_from"`
+	DataTo     time.Time      `json:"data_to"`
+}
+
+// NewOptimizationRun starts the record of an optimization of optimizer over df
+func NewOptimizationRun(df *DataFrameCandle, optimizer *Optimizer) *OptimizationRun {
+	run := &OptimizationRun{
+		ProductCode: df.ProductCode,
+		Duration:    df.Duration,
+		StartedAt:   time.Now().UTC(),
+		Candles:     len(df.Candles),
+		Method:      optimizer.Method,
+		Objective:   optimizer.Objective,
+	}
+	if len(df.Candles) > 0 {
+		run.DataFrom = df.Candles[0].Time
+		run.DataTo = df.Candles[len(df.Candles)-1].Time
+	}
+	return run
+}
+
+// AddCandidate records a candidate, it is the Optimizer.OnCandidate of the run
+func (run *OptimizationRun) AddCandidate(candidate OptimizationCandidate) {
+	run.Candidates = append(run.Candidates, candidate)
+}
+
+// Finish sets the outcome of the run, reason is empty when params were accepted
+func (run *OptimizationRun) Finish(params *TradeParams, accepted bool, reason string) {
+	run.FinishedAt = time.Now().UTC()
+	run.Params = params
+	run.Accepted = accepted
+	run.Reason = reason
+}
+
+// Save inserts the run and its candidates in one transaction and sets its ID
+func (run *OptimizationRun) Save() error {
+	params, err := json.Marshal(run.Params)
+	if err != nil {
+		return err
+	}
+	tx, err := DbConnection.Begin()
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf(`INSERT INTO %s (product_code, duration, started_at, finished_at, data_from, data_to, candles,
+		method, objective, params, accepted, reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, tableNameOptimizationRuns)
+	result, err := tx.Exec(cmd, run.ProductCode, run.Duration.String(), run.StartedAt.Format(time.RFC3339), run.FinishedAt.Format(time.RFC3339),
+		run.DataFrom.Format(time.RFC3339), run.DataTo.Format(time.RFC3339), run.Candles,
+		run.Method, run.Objective, string(params), run.Accepted, run.Reason)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if run.ID, err = result.LastInsertId(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	cmd = fmt.Sprintf(`INSERT INTO %s (run_id, strategy, params, score, profitable, data_from, data_to)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, tableNameOptimizationCandidates)
+	stmt, err := tx.Prepare(cmd)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, candidate := range run.Candidates {
+		candidateParams, err := json.Marshal(candidate.Params)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = stmt.Exec(run.ID, candidate.Strategy, string(candidateParams), candidate.Score, candidate.Profitable,
+			candidate.DataFrom.Format(time.RFC3339), candidate.DataTo.Format(time.RFC3339))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const optimizationRunColumns = `id, product_code, duration, started_at, finished_at, data_from, data_to, candles,
+	method, objective, params, accepted, reason`
+
+// GetOptimizationRuns returns the latest limit runs of productCode and duration, newest first, without candidates
+func GetOptimizationRuns(productCode string, duration time.Duration, limit int) ([]*OptimizationRun, error) {
+	cmd := fmt.Sprintf(`SELECT %s FROM %s WHERE product_code = ? AND duration = ? ORDER BY id DESC LIMIT ?`,
+		optimizationRunColumns, tableNameOptimizationRuns)
+	rows, err := DbConnection.Query(cmd, productCode, duration.String(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []*OptimizationRun
+	for rows.Next() {
+		run, err := scanOptimizationRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// GetLastAcceptedOptimizationRun returns the latest run of productCode and duration whose params
+// were traded, nil when there is none
+func GetLastAcceptedOptimizationRun(productCode string, duration time.Duration) (*OptimizationRun, error) {
+	cmd := fmt.Sprintf(`SELECT %s FROM %s WHERE product_code = ? AND duration = ? AND accepted ORDER BY id DESC LIMIT 1`,
+		optimizationRunColumns, tableNameOptimizationRuns)
+	rows, err := DbConnection.Query(cmd, productCode, duration.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanOptimizationRun(rows)
+}
+
+// GetOptimizationCandidates returns the candidates of the run id, best score first
+func GetOptimizationCandidates(runID int64) ([]OptimizationCandidate, error) {
+	cmd := fmt.Sprintf(`SELECT strategy, params, score, profitable, data_from, data_to FROM %s
+		WHERE run_id = ? ORDER BY profitable DESC, score DESC`, tableNameOptimizationCandidates)
+	rows, err := DbConnection.Query(cmd, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var candidates []OptimizationCandidate
+	for rows.Next() {
+		var candidate OptimizationCandidate
+		var params string
+		err := rows.Scan(&candidate.Strategy, &params, &candidate.Score, &candidate.Profitable, &candidate.DataFrom, &candidate.DataTo)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(params), &candidate.Params); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, rows.Err()
+}
+
+func scanOptimizationRun(rows *sql.Rows) (*OptimizationRun, error) {
+	var run OptimizationRun
+	var duration, params string
+	err := rows.Scan(&run.ID, &run.ProductCode, &duration, &run.StartedAt, &run.FinishedAt, &run.DataFrom, &run.DataTo, &run.Candles,
+		&run.Method, &run.Objective, &params, &run.Accepted, &run.Reason)
+	if err != nil {
+		return nil, err
+	}
+	if run.Duration, err = time.ParseDuration(duration); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(params), &run.Params); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
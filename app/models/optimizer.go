@@ -0,0 +1,200 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"go-trading-bot/config"
+	"log"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// OptimizeProgress is how far the search of one strategy is
+type OptimizeProgress struct {
+	Strategy string
+	Done     int
+	Total    int
+}
+
+// Optimizer searches the parameters of the strategies, running the backtests on a pool of workers
+type Optimizer struct {
+	Method      string                                  // SearchGrid, SearchRandom, SearchTPE or SearchGenetic
+	Budget      int                                     // backtests per strategy of the methods other than grid
+	Seed        int64                                   // seed of the random methods, from the clock when 0
+	Ranges      map[string]map[string]config.ParamRange // search ranges replacing the defaults, by strategy and parameter
+	Workers     int                                     // backtests run at once, the number of CPUs when 0
+	Objective   string                                  // metric the parameters are ranked by
+	Backtest    BacktestConfig                          // account and fills of every backtest
+	Progress    func(OptimizeProgress)                  // called after every finished backtest when set
+	OnCandidate func(OptimizationCandidate)             // called with every backtested parameter set when set
+}
+
+// NewOptimizerFromConfig builds the optimizer of the [optimizer] and [backtest] sections for productCode,
+// logging its progress every 10%
+func NewOptimizerFromConfig(productCode string) *Optimizer {
+	return &Optimizer{
+		Method:    config.Config.OptimizerMethod,
+		Budget:    config.Config.OptimizerBudget,
+		Seed:      config.Config.OptimizerSeed,
+		Ranges:    config.Config.StrategyRanges,
+		Workers:   config.Config.OptimizerWorkers,
+		Objective: config.Config.BacktestObjective,
+		Backtest:  DefaultBacktestConfig(productCode),
+		Progress:  logProgress,
+	}
+}
+
+// CheckStrategyRanges returns an error for a range of a strategy that is not registered or a parameter
+// that is not in its ParamSpace, e.g. a [strategy.X] section with a typo
+func CheckStrategyRanges(ranges map[string]map[string]config.ParamRange) error {
+	for name, params := range ranges {
+		strategy, ok := GetStrategy(name)
+		if !ok {
+			return fmt.Errorf("[strategy.%s]: unknown strategy", name)
+		}
+		for param := range params {
+			found := false
+			for _, p := range strategy.ParamSpace() {
+				found = found || p.Name == param
+			}
+			if !found {
+				return fmt.Errorf("[strategy.%s]: unknown parameter %s", name, param)
+			}
+		}
+	}
+	return nil
+}
+
+func logProgress(progress OptimizeProgress) {
+	if progress.Done == progress.Total || progress.Done*10/progress.Total != (progress.Done-1)*10/progress.Total {
+		log.Printf("action=Optimize strategy=%s done=%d/%d", progress.Strategy, progress.Done, progress.Total)
+	}
+}
+
+func (o *Optimizer) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return runtime.NumCPU()
+}
+
+// space returns the parameter space of strategy with the ranges of the config applied
+func (o *Optimizer) space(strategy Strategy) []Param {
+	var space []Param
+	for _, param := range strategy.ParamSpace() {
+		if r, ok := o.Ranges[strategy.Name()][param.Name]; ok {
+			param.Min, param.Max, param.Step = r.Min, r.Max, r.Step
+		}
+		space = append(space, param)
+	}
+	return space
+}
+
+// Optimize searches the parameter space of strategy over df with the optimizer's method and returns
+// the parameters scoring best on the objective, only profitable ones count
+// without a profitable combination, or without candles, the performance is 0 and the params are the defaults
+// the error is ctx's when it is done before the search
+func (o *Optimizer) Optimize(ctx context.Context, df *DataFrameCandle, strategy Strategy) (performance float64, bestParams StrategyParams, err error) {
+	if len(df.Candles) == 0 {
+		// nothing to backtest, e.g. on the first start with an empty candle table
+		return 0, DefaultParams(strategy), nil
+	}
+	seed := o.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	search := newParameterSearch(o, df, strategy, seed)
+	budget := o.Budget
+	if budget <= 0 || budget > search.size() {
+		// small spaces are searched exhaustively whatever the method
+		budget = search.size()
+	}
+	search.total = budget
+	switch {
+	case o.Method == SearchGrid || budget == search.size():
+		err = search.grid(ctx)
+	case o.Method == SearchRandom:
+		err = search.random(ctx, budget)
+	case o.Method == SearchTPE:
+		err = search.tpe(ctx, budget)
+	case o.Method == SearchGenetic:
+		err = search.genetic(ctx, budget)
+	default:
+		err = fmt.Errorf("unknown optimizer method %q", o.Method)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	bestParams = DefaultParams(strategy)
+	for _, e := range search.evaluations {
+		if e.valid && performance < e.score {
+			performance = e.score
+			bestParams = e.params
+		}
+	}
+	return performance, bestParams, nil
+}
+
+// score backtests params and returns its objective, false when it did not make a profit
+func (o *Optimizer) score(df *DataFrameCandle, strategy Strategy, params StrategyParams) (float64, bool) {
+	result := df.BackTest(strategy, params, o.Backtest)
+	if result == nil || result.Profit() <= 0 {
+		return 0, false
+	}
+	score, err := result.Report().Score(o.Objective)
+	if err != nil {
+		log.Printf("action=Optimize strategy=%s err=%s", strategy.Name(), err.Error())
+		return 0, false
+	}
+	return score, true
+}
+
+// OptimizeParams optimizes every registered strategy and enables the num_ranking best profitable ones
+// it returns nil when none of them made a profit
+func (o *Optimizer) OptimizeParams(ctx context.Context, df *DataFrameCandle) (*TradeParams, error) {
+	tradeParams := &TradeParams{}
+	for _, strategy := range Strategies() {
+		performance, params, err := o.Optimize(ctx, df, strategy)
+		if err != nil {
+			return nil, err
+		}
+		tradeParams.Strategies = append(tradeParams.Strategies, StrategyResult{
+			Name:        strategy.Name(),
+			Params:      params,
+			Performance: performance,
+		})
+	}
+
+	ranking := make([]*StrategyResult, len(tradeParams.Strategies))
+	for i := range tradeParams.Strategies {
+		ranking[i] = &tradeParams.Strategies[i]
+	}
+	sort.SliceStable(ranking, func(i, j int) bool { return ranking[i].Performance > ranking[j].Performance })
+
+	isEnable := false
+	for i, result := range ranking {
+		if i >= config.Config.NumRanking {
+			break
+		}
+		if result.Performance > 0 {
+			result.Enable = true
+			isEnable = true
+		}
+	}
+	if !isEnable {
+		return nil, nil
+	}
+	return tradeParams, nil
+}
+
+// Optimize runs the configured optimizer over df for strategy
+func (df *DataFrameCandle) Optimize(ctx context.Context, strategy Strategy) (float64, StrategyParams, error) {
+	return NewOptimizerFromConfig(df.ProductCode).Optimize(ctx, df, strategy)
+}
+
+// OptimizeParams runs the configured optimizer over df for every registered strategy
+func (df *DataFrameCandle) OptimizeParams(ctx context.Context) (*TradeParams, error) {
+	return NewOptimizerFromConfig(df.ProductCode).OptimizeParams(ctx, df)
+}
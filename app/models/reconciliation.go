@@ -0,0 +1,52 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// what a reconciliation corrected
+const (
+	ReconcileCancelOrder = "cancel_order" // an open child order an earlier run lost track of was cancelled
+	ReconcileMissedFill  = "missed_fill"  // fills of the bot's orders the signal events did not record, e.g. after a timeout
+	ReconcilePosition    = "position"     // the recorded position is gone from the exchange without a fill of the bot, closed at the ticker
+)
+
+// Reconciliation is a correction of the signal events after comparing them with the exchange,
+// stored in reconciliations
+type Reconciliation struct {
+	Time        time.Time `json:"time"`
+	ProductCode string    `json:"product_code"`
+	Kind        string    `json:"kind"`
+	Side        string    `json:"side"`
+	Price       float64   `json:"price"`
+	Size        float64   `json:"size"`
+	Detail      string    `json:"detail"` // e.g. the child order acceptance id
+}
+
+// Save inserts the correction
+func (r *Reconciliation) Save() error {
+	cmd := fmt.Sprintf("INSERT INTO %s (time, product_code, kind, side, price, size, detail) VALUES (?, ?, ?, ?, ?, ?, ?)", tableNameReconciliations)
+	_, err := DbConnection.Exec(cmd, r.Time.Format(time.RFC3339Nano), r.ProductCode, r.Kind, r.Side, r.Price, r.Size, r.Detail)
+	return err
+}
+
+// GetReconciliations returns the latest limit corrections of productCode, newest first
+func GetReconciliations(productCode string, limit int) ([]Reconciliation, error) {
+	cmd := fmt.Sprintf(`SELECT time, product_code, kind, side, price, size, detail FROM %s
+		WHERE product_code = ? ORDER BY id DESC LIMIT ?`, tableNameReconciliations)
+	rows, err := DbConnection.Query(cmd, productCode, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reconciliations []Reconciliation
+	for rows.Next() {
+		var r Reconciliation
+		if err := rows.Scan(&r.Time, &r.ProductCode, &r.Kind, &r.Side, &r.Price, &r.Size, &r.Detail); err != nil {
+			return nil, err
+		}
+		reconciliations = append(reconciliations, r)
+	}
+	return reconciliations, rows.Err()
+}
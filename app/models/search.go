@@ -0,0 +1,427 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// search methods of Optimizer
+const (
+	SearchGrid    = "grid"    // every combination
+	SearchRandom  = "random"  // Budget combinations drawn at random
+	SearchTPE     = "tpe"     // Bayesian search with a tree-structured Parzen estimator
+	SearchGenetic = "genetic" // a population evolved by selection, crossover and mutation
+)
+
+// evaluation is one backtested point of the parameter space
+type evaluation struct {
+	point  []int // index into the values of every parameter
+	params StrategyParams
+	score  float64
+	valid  bool // the backtest made a profit
+}
+
+// better reports whether e ranks above other, unprofitable points rank below every profitable one
+func (e *evaluation) better(other *evaluation) bool {
+	if e.valid != other.valid {
+		return e.valid
+	}
+	return e.score > other.score
+}
+
+// parameterSearch is the state of the optimization of one strategy
+type parameterSearch struct {
+	optimizer   *Optimizer
+	df          *DataFrameCandle
+	strategy    Strategy
+	names       []string
+	values      [][]float64 // the values every parameter can take
+	rand        *rand.Rand
+	total       int // backtests the search will run, for the progress
+	evaluations []*evaluation
+	seen        map[string]*evaluation
+}
+
+func newParameterSearch(o *Optimizer, df *DataFrameCandle, strategy Strategy, seed int64) *parameterSearch {
+	search := &parameterSearch{
+		optimizer: o,
+		df:        df,
+		strategy:  strategy,
+		rand:      rand.New(rand.NewSource(seed)),
+		seen:      map[string]*evaluation{},
+	}
+	for _, param := range o.space(strategy) {
+		search.names = append(search.names, param.Name)
+		search.values = append(search.values, param.Values())
+	}
+	return search
+}
+
+// size is the number of combinations of the space
+func (s *parameterSearch) size() int {
+	size := 1
+	for _, values := range s.values {
+		size *= len(values)
+		if size > math.MaxInt32 {
+			return math.MaxInt32
+		}
+	}
+	return size
+}
+
+func pointKey(point []int) string {
+	return strings.Trim(fmt.Sprint(point), "[]")
+}
+
+// randomPoint returns a point drawn uniformly from the space
+func (s *parameterSearch) randomPoint() []int {
+	point := make([]int, len(s.values))
+	for d, values := range s.values {
+		point[d] = s.rand.Intn(len(values))
+	}
+	return point
+}
+
+// evaluate backtests the points not evaluated yet on the workers of the optimizer
+func (s *parameterSearch) evaluate(ctx context.Context, points [][]int) error {
+	var batch []*evaluation
+	for _, point := range points {
+		key := pointKey(point)
+		if _, ok := s.seen[key]; ok {
+			continue
+		}
+		params := StrategyParams{}
+		for d, index := range point {
+			params[s.names[d]] = s.values[d][index]
+		}
+		e := &evaluation{point: point, params: params}
+		s.seen[key] = e
+		batch = append(batch, e)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	jobs := make(chan *evaluation)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < s.optimizer.workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				// every worker writes its own evaluation only
+				e.score, e.valid = s.optimizer.score(s.df, s.strategy, e.params)
+				done <- struct{}{}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, e := range batch {
+			select {
+			case jobs <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	finished := len(s.evaluations)
+	for range done {
+		finished++
+		if s.optimizer.Progress != nil {
+			s.optimizer.Progress(OptimizeProgress{Strategy: s.strategy.Name(), Done: finished, Total: s.total})
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// kept in the order of the batch, so the result does not depend on the scheduling
+	s.evaluations = append(s.evaluations, batch...)
+	if s.optimizer.OnCandidate != nil {
+		// called from this goroutine only, like Progress
+		for _, e := range batch {
+			s.optimizer.OnCandidate(OptimizationCandidate{
+				Strategy:   s.strategy.Name(),
+				Params:     e.params,
+				Score:      e.score,
+				Profitable: e.valid,
+				DataFrom:   s.df.Candles[0].Time,
+				DataTo:     s.df.Candles[len(s.df.Candles)-1].Time,
+			})
+		}
+	}
+	return nil
+}
+
+// grid evaluates every combination in order
+func (s *parameterSearch) grid(ctx context.Context) error {
+	s.total = s.size()
+	points := [][]int{make([]int, len(s.values))}
+	for d, values := range s.values {
+		var next [][]int
+		for _, point := range points {
+			for index := range values {
+				combination := append([]int(nil), point...)
+				combination[d] = index
+				next = append(next, combination)
+			}
+		}
+		points = next
+	}
+	return s.evaluate(ctx, points)
+}
+
+// random evaluates budget distinct points drawn uniformly
+func (s *parameterSearch) random(ctx context.Context, budget int) error {
+	return s.evaluate(ctx, s.randomPoints(budget))
+}
+
+// randomPoints returns n distinct points that were not evaluated yet
+func (s *parameterSearch) randomPoints(n int) [][]int {
+	var points [][]int
+	drawn := map[string]bool{}
+	for tries := 0; len(points) < n && tries < n*100; tries++ {
+		point := s.randomPoint()
+		key := pointKey(point)
+		if _, ok := s.seen[key]; ok || drawn[key] {
+			continue
+		}
+		drawn[key] = true
+		points = append(points, point)
+	}
+	return points
+}
+
+// ranked returns the evaluations from best to worst
+func (s *parameterSearch) ranked() []*evaluation {
+	ranked := append([]*evaluation(nil), s.evaluations...)
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].better(ranked[j]) })
+	return ranked
+}
+
+// tpe starts with random points and then proposes, a batch of one per worker at a time,
+// the point most likely among the best quarter of the evaluations rather than the rest
+func (s *parameterSearch) tpe(ctx context.Context, budget int) error {
+	const gamma = 0.25
+	const candidates = 24
+	startup := budget / 5
+	if startup < 10 {
+		startup = 10
+	}
+	if startup > budget {
+		startup = budget
+	}
+	if err := s.random(ctx, startup); err != nil {
+		return err
+	}
+	for len(s.evaluations) < budget {
+		ranked := s.ranked()
+		nGood := int(math.Ceil(gamma * float64(len(ranked))))
+		good, bad := densities(s.values, ranked[:nGood]), densities(s.values, ranked[nGood:])
+
+		batchSize := s.optimizer.workers()
+		if remaining := budget - len(s.evaluations); batchSize > remaining {
+			batchSize = remaining
+		}
+		var batch [][]int
+		proposed := map[string]bool{}
+		for len(batch) < batchSize {
+			var best []int
+			bestRatio := math.Inf(-1)
+			for c := 0; c < candidates; c++ {
+				point := make([]int, len(s.values))
+				ratio := 0.0
+				for d := range s.values {
+					point[d] = sampleIndex(s.rand, good[d])
+					ratio += math.Log(good[d][point[d]]) - math.Log(bad[d][point[d]])
+				}
+				key := pointKey(point)
+				if _, ok := s.seen[key]; ok || proposed[key] {
+					continue
+				}
+				if ratio > bestRatio {
+					best, bestRatio = point, ratio
+				}
+			}
+			if best == nil {
+				// the estimator keeps proposing evaluated points, explore instead
+				points := s.randomPoints(1)
+				if len(points) == 0 {
+					break
+				}
+				best = points[0]
+			}
+			proposed[pointKey(best)] = true
+			batch = append(batch, best)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.evaluate(ctx, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// densities returns, for every parameter, the probability of each of its values under a Gaussian kernel
+// around the values of the evaluations, mixed with a uniform prior so no value has probability 0
+func densities(values [][]float64, evaluations []*evaluation) [][]float64 {
+	result := make([][]float64, len(values))
+	for d := range values {
+		n := len(values[d])
+		bandwidth := math.Max(1, float64(n)/10)
+		density := make([]float64, n)
+		for j := range density {
+			density[j] = 1 / float64(n) // prior
+		}
+		for _, e := range evaluations {
+			kernel := make([]float64, n)
+			total := 0.0
+			for j := range kernel {
+				z := float64(j-e.point[d]) / bandwidth
+				kernel[j] = math.Exp(-z * z / 2)
+				total += kernel[j]
+			}
+			for j := range density {
+				density[j] += kernel[j] / total
+			}
+		}
+		for j := range density {
+			density[j] /= float64(len(evaluations) + 1)
+		}
+		result[d] = density
+	}
+	return result
+}
+
+// sampleIndex draws an index with the probabilities of density
+func sampleIndex(r *rand.Rand, density []float64) int {
+	x := r.Float64()
+	for j, p := range density {
+		x -= p
+		if x < 0 {
+			return j
+		}
+	}
+	return len(density) - 1
+}
+
+// genetic evolves a population: the two best survive, the others are replaced by children of
+// parents picked by tournament, crossed over parameter by parameter and mutated
+func (s *parameterSearch) genetic(ctx context.Context, budget int) error {
+	populationSize := budget / 10
+	if populationSize < 4 {
+		populationSize = 4
+	}
+	if populationSize > 50 {
+		populationSize = 50
+	}
+	if populationSize > budget {
+		populationSize = budget
+	}
+	points := s.randomPoints(populationSize)
+	if err := s.evaluate(ctx, points); err != nil {
+		return err
+	}
+	population := s.lookup(points)
+
+	for len(s.evaluations) < budget {
+		sort.SliceStable(population, func(i, j int) bool { return population[i].better(population[j]) })
+		next := [][]int{population[0].point}
+		if len(population) > 1 {
+			next = append(next, population[1].point)
+		}
+		var children [][]int
+		for len(next) < populationSize {
+			child := s.crossover(s.tournament(population), s.tournament(population))
+			for tries := 0; tries < 10; tries++ {
+				child = s.mutate(child)
+				if _, ok := s.seen[pointKey(child)]; !ok {
+					break
+				}
+			}
+			if _, ok := s.seen[pointKey(child)]; !ok && len(children) < budget-len(s.evaluations) {
+				children = append(children, child)
+			}
+			next = append(next, child)
+		}
+		if len(children) == 0 {
+			// the population converged on points that are all evaluated
+			return nil
+		}
+		if err := s.evaluate(ctx, children); err != nil {
+			return err
+		}
+		population = s.lookup(next)
+	}
+	return nil
+}
+
+// lookup returns the evaluations of points, skipping the ones never evaluated
+func (s *parameterSearch) lookup(points [][]int) []*evaluation {
+	var evaluations []*evaluation
+	for _, point := range points {
+		if e, ok := s.seen[pointKey(point)]; ok {
+			evaluations = append(evaluations, e)
+		}
+	}
+	return evaluations
+}
+
+// tournament returns the best of three random members of population
+func (s *parameterSearch) tournament(population []*evaluation) []int {
+	best := population[s.rand.Intn(len(population))]
+	for i := 1; i < 3; i++ {
+		if e := population[s.rand.Intn(len(population))]; e.better(best) {
+			best = e
+		}
+	}
+	return best.point
+}
+
+// crossover takes every parameter from either parent
+func (s *parameterSearch) crossover(a, b []int) []int {
+	child := make([]int, len(a))
+	for d := range child {
+		if s.rand.Intn(2) == 0 {
+			child[d] = a[d]
+		} else {
+			child[d] = b[d]
+		}
+	}
+	return child
+}
+
+// mutate moves one parameter on average a few steps away
+func (s *parameterSearch) mutate(point []int) []int {
+	mutated := append([]int(nil), point...)
+	for d, values := range s.values {
+		if len(values) < 2 || s.rand.Float64() >= 1/float64(len(s.values)) {
+			continue
+		}
+		step := int(math.Round(s.rand.NormFloat64() * math.Max(1, float64(len(values))/10)))
+		if step == 0 {
+			step = 1 - 2*s.rand.Intn(2)
+		}
+		mutated[d] += step
+		if mutated[d] < 0 {
+			mutated[d] = 0
+		}
+		if mutated[d] >= len(values) {
+			mutated[d] = len(values) - 1
+		}
+	}
+	return mutated
+}
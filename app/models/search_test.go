@@ -0,0 +1,138 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"go-trading-bot/config"
+	"go-trading-bot/metrics"
+	"testing"
+)
+
+// timingStrategy buys on the candle of its buy parameter and sells on the candle of its sell parameter,
+// on candles rising until the last one the earliest buy and the latest sell make the most
+type timingStrategy struct{}
+
+func (timingStrategy) Name() string { return "timing" }
+
+func (timingStrategy) ParamSpace() []Param {
+	return []Param{
+		{Name: "buy", Min: 1, Max: 10, Step: 1, Default: 5},
+		{Name: "sell", Min: 1, Max: 10, Step: 1, Default: 5},
+	}
+}
+
+func (timingStrategy) WarmUp(params StrategyParams) int { return 0 }
+
+func (timingStrategy) Prepare(df *DataFrameCandle, params StrategyParams) SignalFunc {
+	buy, sell := params.Int("buy"), params.Int("sell")
+	return func(i int) Signal {
+		switch i {
+		case buy:
+			return SignalBuy
+		case sell:
+			return SignalSell
+		}
+		return SignalNone
+	}
+}
+
+func testSearchCandles() *DataFrameCandle {
+	closes := make([]float64, 12)
+	for i := range closes {
+		closes[i] = 100 + 10*float64(i)
+	}
+	// a position never sold loses
+	closes[11] = 50
+	df := testCandles(closes, closes)
+	// strategies only buy on candles with volume
+	for i := range df.Candles {
+		df.Candles[i].Volume = 1
+	}
+	return df
+}
+
+func testOptimizer(method string, budget int) *Optimizer {
+	return &Optimizer{
+		Method:    method,
+		Budget:    budget,
+		Seed:      1,
+		Workers:   4,
+		Objective: metrics.ObjectiveProfit,
+		Backtest:  BacktestConfig{Fill: FillAtClose, InitialCash: 1000, UsePercent: 1},
+	}
+}
+
+func TestOptimizeGrid(t *testing.T) {
+	optimizer := testOptimizer(SearchGrid, 0)
+	done := 0
+	optimizer.Progress = func(progress OptimizeProgress) {
+		done = progress.Done
+		if progress.Total != 100 {
+			t.Errorf("progress total = %d, want the 100 combinations", progress.Total)
+		}
+	}
+	performance, params, err := optimizer.Optimize(context.Background(), testSearchCandles(), timingStrategy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if performance <= 0 || params.Int("buy") != 1 || params.Int("sell") != 10 {
+		t.Errorf("Optimize() = %f, %v, want a profit buying at 1 and selling at 10", performance, params)
+	}
+	if done != 100 {
+		t.Errorf("progress done = %d, want 100", done)
+	}
+}
+
+func TestOptimizeBudget(t *testing.T) {
+	df := testSearchCandles()
+	for _, method := range []string{SearchRandom, SearchTPE, SearchGenetic} {
+		t.Run(method, func(t *testing.T) {
+			run := func() (StrategyParams, map[string]bool) {
+				optimizer := testOptimizer(method, 30)
+				seen := map[string]bool{}
+				optimizer.OnCandidate = func(candidate OptimizationCandidate) {
+					seen[pointKey([]int{candidate.Params.Int("buy"), candidate.Params.Int("sell")})] = true
+				}
+				performance, params, err := optimizer.Optimize(context.Background(), df, timingStrategy{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if performance <= 0 {
+					t.Errorf("Optimize() = %f, want a profitable point among 30", performance)
+				}
+				return params, seen
+			}
+			params, seen := run()
+			// the genetic search stops early once its population converged
+			if len(seen) > 30 || (method != SearchGenetic && len(seen) != 30) {
+				t.Errorf("backtested %d distinct points, want the budget of 30", len(seen))
+			}
+			// the same seed searches the same points, whatever the scheduling of the workers
+			again, _ := run()
+			if params.Int("buy") != again.Int("buy") || params.Int("sell") != again.Int("sell") {
+				t.Errorf("Optimize() = %v, then %v with the same seed", params, again)
+			}
+		})
+	}
+}
+
+func TestOptimizeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := testOptimizer(SearchTPE, 30).Optimize(ctx, testSearchCandles(), timingStrategy{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Optimize() err = %v, want context.Canceled", err)
+	}
+}
+
+func TestOptimizeRanges(t *testing.T) {
+	optimizer := testOptimizer(SearchGrid, 0)
+	optimizer.Ranges = map[string]map[string]config.ParamRange{"timing": {"buy": {Min: 2, Max: 4, Step: 1}}}
+	_, params, err := optimizer.Optimize(context.Background(), testSearchCandles(), timingStrategy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Int("buy") != 2 || params.Int("sell") != 10 {
+		t.Errorf("Optimize() = %v, want the earliest buy of the range", params)
+	}
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// SentOrder is a child order the bot sent, stored in sent_orders until a signal event records what it filled,
+// so Reconcile only adopts fills of the bot's own orders
+type SentOrder struct {
+	ChildOrderAcceptanceID string    `json:"child_order_acceptance_id"`
+	ProductCode            string    `json:"product_code"`
+	Side                   string    `json:"side"`
+	Size                   float64   `json:"size"`
+	SentAt                 time.Time `json:"sent_at"`
+}
+
+// Save inserts the order as not recorded yet, times are stored in UTC so they compare as text
+func (o *SentOrder) Save() error {
+	cmd := fmt.Sprintf(`INSERT OR REPLACE INTO %s (child_order_acceptance_id, product_code, side, size, sent_at, recorded)
+		VALUES (?, ?, ?, ?, ?, ?)`, tableNameSentOrders)
+	_, err := DbConnection.Exec(cmd, o.ChildOrderAcceptanceID, o.ProductCode, o.Side, o.Size, o.SentAt.UTC(), false)
+	return err
+}
+
+// GetUnrecordedOrders returns the orders of productCode no signal event recorded yet, oldest first
+func GetUnrecordedOrders(productCode string) ([]SentOrder, error) {
+	cmd := fmt.Sprintf(`SELECT child_order_acceptance_id, product_code, side, size, sent_at FROM %s
+		WHERE product_code = ? AND NOT recorded ORDER BY sent_at ASC`, tableNameSentOrders)
+	rows, err := DbConnection.Query(cmd, productCode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var orders []SentOrder
+	for rows.Next() {
+		var o SentOrder
+		if err := rows.Scan(&o.ChildOrderAcceptanceID, &o.ProductCode, &o.Side, &o.Size, &o.SentAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+// MarkOrdersRecorded marks the orders of productCode sent until then as recorded by the signal events, but except
+func MarkOrdersRecorded(productCode string, until time.Time, except string) error {
+	cmd := fmt.Sprintf(`UPDATE %s SET recorded = 1
+		WHERE product_code = ? AND NOT recorded AND sent_at <= ? AND child_order_acceptance_id != ?`, tableNameSentOrders)
+	_, err := DbConnection.Exec(cmd, productCode, until.UTC(), except)
+	return err
+}
@@ -0,0 +1,165 @@
+package models
+
+// the strategies every bot starts with, more can be added with RegisterStrategy
+func init() {
+	RegisterStrategy(emaStrategy{})
+	RegisterStrategy(bbandsStrategy{})
+	RegisterStrategy(ichimokuStrategy{})
+	RegisterStrategy(macdStrategy{})
+	RegisterStrategy(rsiStrategy{})
+}
+
+// emaStrategy buys on the golden cross of two EMAs and sells on the dead cross
+type emaStrategy struct{}
+
+func (emaStrategy) Name() string { return "ema" }
+
+func (emaStrategy) ParamSpace() []Param {
+	return []Param{
+		{Name: "period1", Min: 5, Max: 49, Step: 1, Default: 7},
+		{Name: "period2", Min: 12, Max: 49, Step: 1, Default: 14},
+	}
+}
+
+func (emaStrategy) WarmUp(params StrategyParams) int {
+	if params.Int("period1") > params.Int("period2") {
+		return params.Int("period1")
+	}
+	return params.Int("period2")
+}
+
+func (emaStrategy) Prepare(df *DataFrameCandle, params StrategyParams) SignalFunc {
+	emaValues1 := df.cachedEma(params.Int("period1"))
+	emaValues2 := df.cachedEma(params.Int("period2"))
+	return func(i int) Signal {
+		// golden cross
+		if emaValues1[i-1] < emaValues2[i-1] && emaValues1[i] >= emaValues2[i] {
+			return SignalBuy
+		}
+		// dead cross
+		if emaValues1[i-1] > emaValues2[i-1] && emaValues1[i] <= emaValues2[i] {
+			return SignalSell
+		}
+		return SignalNone
+	}
+}
+
+// bbandsStrategy buys when the close comes back above the lower band and sells below the upper band
+type bbandsStrategy struct{}
+
+func (bbandsStrategy) Name() string { return "bbands" }
+
+func (bbandsStrategy) ParamSpace() []Param {
+	return []Param{
+		{Name: "n", Min: 10, Max: 30, Step: 1, Default: 20},
+		{Name: "k", Min: 1.5, Max: 2.5, Step: 0.1, Default: 2.0},
+	}
+}
+
+func (bbandsStrategy) WarmUp(params StrategyParams) int { return params.Int("n") }
+
+func (bbandsStrategy) Prepare(df *DataFrameCandle, params StrategyParams) SignalFunc {
+	bbUp, _, bbDown := df.cachedBBands(params.Int("n"), params["k"])
+	return func(i int) Signal {
+		// Buy when below band
+		if bbDown[i-1] > df.Candles[i-1].Close && bbDown[i] <= df.Candles[i].Close {
+			return SignalBuy
+		}
+		// Sell when upper band
+		if bbUp[i-1] < df.Candles[i-1].Close && bbUp[i] >= df.Candles[i].Close {
+			return SignalSell
+		}
+		return SignalNone
+	}
+}
+
+// ichimokuStrategy trades the chikou span crossing the price outside the cloud
+type ichimokuStrategy struct{}
+
+func (ichimokuStrategy) Name() string { return "ichimoku" }
+
+func (ichimokuStrategy) ParamSpace() []Param { return nil }
+
+// the senkou span B needs 52 candles
+func (ichimokuStrategy) WarmUp(params StrategyParams) int { return 52 }
+
+func (ichimokuStrategy) Prepare(df *DataFrameCandle, params StrategyParams) SignalFunc {
+	tenkan, kijun, senkouA, senkouB, chikou := df.cachedIchimoku()
+	return func(i int) Signal {
+		if chikou[i-1] < df.Candles[i-1].High && chikou[i] >= df.Candles[i].High &&
+			senkouA[i] < df.Candles[i].Low && senkouB[i] < df.Candles[i].Low &&
+			tenkan[i] > kijun[i] {
+			return SignalBuy
+		}
+		if chikou[i-1] > df.Candles[i-1].Low && chikou[i] <= df.Candles[i].Low &&
+			senkouA[i] > df.Candles[i].High && senkouB[i] > df.Candles[i].High &&
+			tenkan[i] < kijun[i] {
+			return SignalSell
+		}
+		return SignalNone
+	}
+}
+
+// macdStrategy buys when the MACD crosses above its signal line below zero and sells on the opposite
+type macdStrategy struct{}
+
+func (macdStrategy) Name() string { return "macd" }
+
+func (macdStrategy) ParamSpace() []Param {
+	return []Param{
+		{Name: "fast_period", Min: 10, Max: 18, Step: 1, Default: 12},
+		{Name: "slow_period", Min: 20, Max: 29, Step: 1, Default: 26},
+		{Name: "signal_period", Min: 5, Max: 14, Step: 1, Default: 9},
+	}
+}
+
+// talib leaves the MACD at 0 until the slow EMA and the signal EMA are both filled
+func (macdStrategy) WarmUp(params StrategyParams) int {
+	return params.Int("slow_period") + params.Int("signal_period") - 1
+}
+
+func (macdStrategy) Prepare(df *DataFrameCandle, params StrategyParams) SignalFunc {
+	outMACD, outMACDSignal, _ := df.cachedMacd(params.Int("fast_period"), params.Int("slow_period"), params.Int("signal_period"))
+	return func(i int) Signal {
+		if outMACD[i] < 0 && outMACDSignal[i] < 0 && outMACD[i-1] < outMACDSignal[i-1] && outMACD[i] >= outMACDSignal[i] {
+			return SignalBuy
+		}
+		if outMACD[i] > 0 && outMACDSignal[i] > 0 && outMACD[i-1] > outMACDSignal[i-1] && outMACD[i] <= outMACDSignal[i] {
+			return SignalSell
+		}
+		return SignalNone
+	}
+}
+
+// rsiStrategy buys when the RSI crosses up through buy_thread and sells when it crosses down through sell_thread
+type rsiStrategy struct{}
+
+func (rsiStrategy) Name() string { return "rsi" }
+
+func (rsiStrategy) ParamSpace() []Param {
+	return []Param{
+		{Name: "period", Min: 5, Max: 24, Step: 1, Default: 14},
+		{Name: "buy_thread", Min: 20, Max: 40, Step: 5, Default: 30},
+		{Name: "sell_thread", Min: 60, Max: 80, Step: 5, Default: 70},
+	}
+}
+
+// the first RSI value is at index period, and every signal looks one candle back
+func (rsiStrategy) WarmUp(params StrategyParams) int { return params.Int("period") + 1 }
+
+func (rsiStrategy) Prepare(df *DataFrameCandle, params StrategyParams) SignalFunc {
+	values := df.cachedRsi(params.Int("period"))
+	buyThread, sellThread := params["buy_thread"], params["sell_thread"]
+	return func(i int) Signal {
+		if values[i-1] == 0 || values[i-1] == 100 {
+			return SignalNone
+		}
+		if values[i-1] < buyThread && values[i] >= buyThread {
+			return SignalBuy
+		}
+		if values[i-1] > sellThread && values[i] <= sellThread {
+			return SignalSell
+		}
+		return SignalNone
+	}
+}
@@ -0,0 +1,167 @@
+package models
+
+import (
+	"fmt"
+	"go-trading-bot/config"
+	"math"
+	"sync"
+)
+
+// Signal is what a strategy says about one candle
+type Signal int
+
+const (
+	SignalNone Signal = iota
+	SignalBuy
+	SignalSell
+)
+
+func (s Signal) String() string {
+	switch s {
+	case SignalBuy:
+		return "BUY"
+	case SignalSell:
+		return "SELL"
+	}
+	return "NONE"
+}
+
+// SignalFunc returns the signal of the i-th candle of the dataframe it was prepared for
+type SignalFunc func(i int) Signal
+
+// StrategyParams are the parameters of a strategy by name, e.g. {"period1": 7, "period2": 14}
+type StrategyParams map[string]float64
+
+// Int returns an integer parameter such as a period
+func (p StrategyParams) Int(name string) int {
+	return int(math.Round(p[name]))
+}
+
+// Param is one parameter of a strategy and the range the optimizer searches
+// Min == Max pins the parameter to that value
+type Param struct {
+	Name    string
+	Min     float64
+	Max     float64
+	Step    float64
+	Default float64
+}
+
+// Values returns every value of the range from Min to Max by Step
+func (p Param) Values() []float64 {
+	if p.Step <= 0 || p.Max <= p.Min {
+		return []float64{p.Min}
+	}
+	n := int(math.Floor((p.Max-p.Min)/p.Step+1e-9)) + 1
+	values := make([]float64, n)
+	for i := range values {
+		// rounded so 1.5 + 2*0.1 is 1.7 and not 1.7000000000000002
+		values[i] = math.Round((p.Min+float64(i)*p.Step)*1e9) / 1e9
+	}
+	return values
+}
+
+// Strategy turns candles into buy and sell signals
+// live trading, backtests and the optimizer all call the same Strategy through DataFrameCandle.Signals
+type Strategy interface {
+	// Name is the key the strategy is registered and stored under, e.g. "ema"
+	Name() string
+	// ParamSpace is every tunable parameter with its search range
+	ParamSpace() []Param
+	// WarmUp is how many candles the indicators need before the first signal
+	WarmUp(params StrategyParams) int
+	// Prepare computes the indicators over df once and returns the per-candle signal
+	Prepare(df *DataFrameCandle, params StrategyParams) SignalFunc
+}
+
+// DefaultParams returns the Default of every parameter of strategy
+func DefaultParams(strategy Strategy) StrategyParams {
+	params := StrategyParams{}
+	for _, param := range strategy.ParamSpace() {
+		params[param.Name] = param.Default
+	}
+	return params
+}
+
+var (
+	strategiesMu  sync.RWMutex
+	strategies    = map[string]Strategy{}
+	strategyNames []string // registration order
+)
+
+// RegisterStrategy makes strategy available to the AI and the optimizer, names must be unique
+func RegisterStrategy(strategy Strategy) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	if _, ok := strategies[strategy.Name()]; ok {
+		panic(fmt.Sprintf("strategy %s is already registered", strategy.Name()))
+	}
+	strategies[strategy.Name()] = strategy
+	strategyNames = append(strategyNames, strategy.Name())
+}
+
+// GetStrategy returns the registered strategy called name
+func GetStrategy(name string) (Strategy, bool) {
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+	strategy, ok := strategies[name]
+	return strategy, ok
+}
+
+// Strategies returns every registered strategy in registration order
+func Strategies() []Strategy {
+	strategiesMu.RLock()
+	defer strategiesMu.RUnlock()
+	list := make([]Strategy, len(strategyNames))
+	for i, name := range strategyNames {
+		list[i] = strategies[name]
+	}
+	return list
+}
+
+// Signals returns the signal of every candle, nil when df is shorter than the warm-up
+// candles before the warm-up have no signal, and buys need more volume than min_buy_volume
+func (df *DataFrameCandle) Signals(strategy Strategy, params StrategyParams) []Signal {
+	lenCandles := len(df.Candles)
+	warmUp := strategy.WarmUp(params)
+	if lenCandles <= warmUp {
+		return nil
+	}
+	signalFunc := strategy.Prepare(df, params)
+	signals := make([]Signal, lenCandles)
+	for i := 1; i < lenCandles; i++ {
+		if i < warmUp {
+			continue
+		}
+		signal := signalFunc(i)
+		if signal == SignalBuy && df.Candles[i].Volume <= config.Config.MinBuyVolume {
+			signal = SignalNone
+		}
+		signals[i] = signal
+	}
+	return signals
+}
+
+// StrategyResult is a strategy with its optimized parameters and how they performed
+type StrategyResult struct {
+	Name        string         `json:"name"`
+	Params      StrategyParams `json:"params"`
+	Performance float64        `json:"performance"`
+	Enable      bool           `json:"enable"`
+}
+
+// TradeParams are the optimized strategies, the best num_ranking profitable ones are enabled
+type TradeParams struct {
+	Strategies []StrategyResult `json:"strategies"`
+}
+
+// Enabled returns the strategies the AI trades with
+func (p *TradeParams) Enabled() []StrategyResult {
+	var enabled []StrategyResult
+	for _, result := range p.Strategies {
+		if result.Enable {
+			enabled = append(enabled, result)
+		}
+	}
+	return enabled
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-trading-bot/config"
+	"go-trading-bot/metrics"
+	"time"
+)
+
+// ErrNotEnoughCandles is returned by WalkForward when the candles do not fill one in-sample and out-of-sample window
+var ErrNotEnoughCandles = errors.New("not enough candles")
+
+// WalkForwardConfig is how the candles are cut into in-sample and out-of-sample windows
+type WalkForwardConfig struct {
+	InSample    int     // candles the parameters are optimized on
+	OutOfSample int     // candles right after them the parameters are tested on
+	Step        int     // candles the windows move by, OutOfSample when 0
+	MinScore    float64 // objective the stitched out-of-sample run has to beat
+	Optimizer   *Optimizer
+}
+
+// DefaultWalkForwardConfig is the [walkforward] section, backtesting productCode
+func DefaultWalkForwardConfig(productCode string) WalkForwardConfig {
+	c := config.Config
+	return WalkForwardConfig{
+		InSample:    c.WalkForwardInSample,
+		OutOfSample: c.WalkForwardOutOfSample,
+		Step:        c.WalkForwardStep,
+		MinScore:    c.WalkForwardMinScore,
+		Optimizer:   NewOptimizerFromConfig(productCode),
+	}
+}
+
+// WalkForwardWindow is one optimization and the test of its parameters on the following candles
+type WalkForwardWindow struct {
+	InSampleStart  time.Time       `json:"in_sample_start"`
+	OutSampleStart time.Time       `json:"out_of_sample_start"`
+	OutSampleEnd   time.Time       `json:"out_of_sample_end"`
+	Params         *TradeParams    `json:"params"` // nil when nothing was profitable in sample
+	Result         *BacktestResult `json:"-"`
+	Report         metrics.Report  `json:"report"`
+	Passed         bool            `json:"passed"`
+}
+
+// WalkForwardResult is every window and the out-of-sample windows run one after another
+type WalkForwardResult struct {
+	Windows []WalkForwardWindow `json:"windows"`
+	Report  metrics.Report      `json:"report"`
+	Score   float64             `json:"score"`
+	Passed  bool                `json:"passed"`
+}
+
+// Latest returns the params of the last window, fitted on the candles just before the latest ones
+func (r *WalkForwardResult) Latest() *WalkForwardWindow {
+	if len(r.Windows) == 0 {
+		return nil
+	}
+	return &r.Windows[len(r.Windows)-1]
+}
+
+// WalkForward optimizes every registered strategy on rolling in-sample windows and trades the enabled ones,
+// through combiner like the AI does, on the out-of-sample candles following each window
+// the windows are laid out backwards so the last out-of-sample window ends at the last candle
+// each out-of-sample run starts with the equity the previous one ended with, open positions valued at the close
+func (df *DataFrameCandle) WalkForward(ctx context.Context, cfg WalkForwardConfig, combiner *SignalCombiner) (*WalkForwardResult, error) {
+	if cfg.InSample <= 0 || cfg.OutOfSample <= 0 {
+		return nil, fmt.Errorf("in_sample and out_of_sample must be positive, got %d and %d", cfg.InSample, cfg.OutOfSample)
+	}
+	step := cfg.Step
+	if step <= 0 {
+		step = cfg.OutOfSample
+	}
+	lenCandles := len(df.Candles)
+	if lenCandles < cfg.InSample+cfg.OutOfSample {
+		return nil, fmt.Errorf("walk forward needs %d candles, got %d: %w", cfg.InSample+cfg.OutOfSample, lenCandles, ErrNotEnoughCandles)
+	}
+	var starts []int
+	for start := lenCandles - cfg.InSample - cfg.OutOfSample; start >= 0; start -= step {
+		starts = append([]int{start}, starts...)
+	}
+
+	result := &WalkForwardResult{}
+	equity := cfg.Optimizer.Backtest.InitialCash
+	var curve []metrics.Point
+	var profits []float64
+	for _, start := range starts {
+		split, end := start+cfg.InSample, start+cfg.InSample+cfg.OutOfSample
+		params, err := cfg.Optimizer.OptimizeParams(ctx, df.slice(start, split))
+		if err != nil {
+			return nil, err
+		}
+		window := WalkForwardWindow{
+			InSampleStart:  df.Candles[start].Time,
+			OutSampleStart: df.Candles[split].Time,
+			OutSampleEnd:   df.Candles[end-1].Time,
+			Params:         params,
+		}
+
+		backtest := cfg.Optimizer.Backtest
+		backtest.InitialCash = equity
+		if window.Params != nil {
+			// the signals are computed from the in-sample start so the indicators are warmed up,
+			// only the out-of-sample part is traded
+			signals := df.slice(start, end).combinedSignals(window.Params, combiner)
+			window.Result = RunBacktest(df.slice(split, end), signals[cfg.InSample:], backtest)
+		} else {
+			window.Result = RunBacktest(df.slice(split, end), nil, backtest)
+		}
+		window.Report = window.Result.Report()
+		window.Passed = window.Result.Profit() > 0
+		equity = window.Result.FinalEquity
+
+		curve = append(curve, window.Result.curve()...)
+		profits = append(profits, window.Result.closedProfits()...)
+		result.Windows = append(result.Windows, window)
+	}
+
+	result.Report = metrics.Compute(curve, profits)
+	score, err := result.Report.Score(cfg.Optimizer.Objective)
+	if err != nil {
+		return nil, err
+	}
+	result.Score = score
+	result.Passed = result.Report.Profit > 0 && score >= cfg.MinScore
+	return result, nil
+}
+
+// ValidatedParams returns the params of the latest walk-forward window when they and the
+// walk forward as a whole passed out of sample, nil otherwise
+func (df *DataFrameCandle) ValidatedParams(ctx context.Context, cfg WalkForwardConfig, combiner *SignalCombiner) (*TradeParams, *WalkForwardResult, error) {
+	result, err := df.WalkForward(ctx, cfg, combiner)
+	if err != nil {
+		return nil, nil, err
+	}
+	latest := result.Latest()
+	if !result.Passed || !latest.Passed {
+		return nil, result, nil
+	}
+	return latest.Params, result, nil
+}
+
+// slice returns the candles from..to of df as a dataframe of its own
+func (df *DataFrameCandle) slice(from, to int) *DataFrameCandle {
+	return &DataFrameCandle{ProductCode: df.ProductCode, Duration: df.Duration, Candles: df.Candles[from:to]}
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"go-trading-bot/metrics"
+	"math"
+	"testing"
+)
+
+func testWalkForwardConfig() WalkForwardConfig {
+	return WalkForwardConfig{
+		InSample:    20,
+		OutOfSample: 10,
+		Optimizer: &Optimizer{
+			Method:    SearchRandom,
+			Budget:    2,
+			Seed:      1,
+			Workers:   1,
+			Objective: metrics.ObjectiveProfit,
+			Backtest:  BacktestConfig{Fill: FillAtClose, InitialCash: 1000, UsePercent: 1},
+		},
+	}
+}
+
+func TestWalkForwardWindows(t *testing.T) {
+	closes := make([]float64, 55)
+	for i := range closes {
+		closes[i] = 100 + 10*math.Sin(float64(i)/3)
+	}
+	df := testCandles(closes, closes)
+	result, err := df.WalkForward(context.Background(), testWalkForwardConfig(), &SignalCombiner{Quorum: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// laid out backwards from the last candle: windows start at 25, 15 and 5
+	if len(result.Windows) != 3 {
+		t.Fatalf("got %d windows, want 3", len(result.Windows))
+	}
+	for i, start := range []int{5, 15, 25} {
+		window := result.Windows[i]
+		if !window.InSampleStart.Equal(df.Candles[start].Time) || !window.OutSampleStart.Equal(df.Candles[start+20].Time) ||
+			!window.OutSampleEnd.Equal(df.Candles[start+29].Time) {
+			t.Errorf("window %d = %s..%s..%s, want it to start at candle %d", i, window.InSampleStart, window.OutSampleStart, window.OutSampleEnd, start)
+		}
+	}
+}
+
+func TestWalkForwardNotEnoughCandles(t *testing.T) {
+	closes := make([]float64, 29)
+	for i := range closes {
+		closes[i] = 100
+	}
+	_, err := testCandles(closes, closes).WalkForward(context.Background(), testWalkForwardConfig(), &SignalCombiner{Quorum: 1})
+	if !errors.Is(err, ErrNotEnoughCandles) {
+		t.Errorf("WalkForward() err = %v, want ErrNotEnoughCandles", err)
+	}
+}
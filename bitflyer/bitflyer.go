@@ -2,6 +2,7 @@ package bitflyer
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -12,23 +13,41 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
-const baseURL = "https://api.bitflyer.com/v1/"
+// default endpoints of bitFlyer Lightning
+const (
+	DefaultBaseURL = "https://api.bitflyer.com/v1/"
+	DefaultWsURL   = "wss://ws.lightstream.bitflyer.com/json-rpc"
+)
 
 // create struct which is like a object
 type APIClient struct {
 	key        string
 	secret     string
 	httpClient *http.Client
+	baseURL    string
+	wsURL      string
+	stream     *stream
 }
 
 // Constractor: pass apikey and secreat as string, the nreturn pointer to APIClient
 func New(key, secret string) *APIClient {
-	apiClient := &APIClient{key, secret, &http.Client{}}
+	return NewWithURL(key, secret, DefaultBaseURL, DefaultWsURL)
+}
+
+// NewWithURL is New with custom REST and WebSocket endpoints, e.g. a local mock server
+// empty urls fall back to the bitFlyer defaults
+func NewWithURL(key, secret, baseURL, wsURL string) *APIClient {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	if wsURL == "" {
+		wsURL = DefaultWsURL
+	}
+	apiClient := &APIClient{key, secret, &http.Client{}, baseURL, wsURL, newStream(wsURL)}
 	return apiClient
 }
 
@@ -57,7 +76,7 @@ func (api APIClient) header(method, endpoint string, body []byte) map[string]str
 // parameter example: "GET", /me/deposit, map[string]string{}, nil
 func (api *APIClient) doRequest(method, urlPath string, query map[string]string, data []byte) (body []byte, err error) {
 	// check if baseurl is not nil
-	baseURL, err := url.Parse(baseURL)
+	baseURL, err := url.Parse(api.baseURL)
 	if err != nil {
 		return
 	}
@@ -105,9 +124,36 @@ func (api *APIClient) doRequest(method, urlPath string, query map[string]string,
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, newAPIError(resp.StatusCode, body)
+	}
 	return body, nil
 }
 
+// APIError is the error bitFlyer answers a failed request with
+type APIError struct {
+	StatusCode   int             `json:"-"`      // HTTP status
+	Status       int             `json:"status"` // bitFlyer error code, e.g. -200 for insufficient funds
+	ErrorMessage string          `json:"error_message"`
+	Data         json.RawMessage `json:"data"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("bitflyer: %s (status=%d http=%d)", e.ErrorMessage, e.Status, e.StatusCode)
+}
+
+// newAPIError reads the error body of a failed request, keeping the raw body when it is not the usual object
+func newAPIError(statusCode int, body []byte) *APIError {
+	apiError := &APIError{StatusCode: statusCode}
+	if err := json.Unmarshal(body, apiError); err != nil || apiError.ErrorMessage == "" {
+		apiError.ErrorMessage = strings.TrimSpace(string(body))
+		if apiError.ErrorMessage == "" {
+			apiError.ErrorMessage = http.StatusText(statusCode)
+		}
+	}
+	return apiError
+}
+
 type Balance struct {
 	CurrentCode string  `json:"currency_code"`
 	Amount      float64 `json:"amount"`
@@ -184,6 +230,29 @@ func (api *APIClient) GetTicker(productCode string) (*Ticker, error) {
 	return &ticker, nil
 }
 
+// GetExecutions returns up to count public executions, newest first
+// before/after are execution id cursors, 0 means no cursor
+func (api *APIClient) GetExecutions(productCode string, count int, before, after int64) ([]Execution, error) {
+	query := map[string]string{"product_code": productCode, "count": strconv.Itoa(count)}
+	if before > 0 {
+		query["before"] = strconv.FormatInt(before, 10)
+	}
+	if after > 0 {
+		query["after"] = strconv.FormatInt(after, 10)
+	}
+	resp, err := api.doRequest("GET", "getexecutions", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var executions []Execution
+	err = json.Unmarshal(resp, &executions)
+	if err != nil {
+		log.Printf("action=GetExecutions resp=%s err=%s", string(resp), err.Error())
+		return nil, err
+	}
+	return executions, nil
+}
+
 type JsonRPC2 struct {
 	Version string      `json:"jsonrpc"`
 	Method  string      `json:"method"`
@@ -196,49 +265,27 @@ type SubscribeParams struct {
 	Channel string `json:"channel"`
 }
 
-func (api *APIClient) GetRealTimeTicker(symbol string, ch chan<- Ticker) {
-	u := url.URL{Scheme: "wss", Host: "ws.lightstream.bitflyer.com", Path: "/json-rpc"}
-	log.Printf("connecting to %s", u.String())
-
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Fatal("dial:", err)
-	}
-	defer c.Close()
-
+// GetRealTimeTicker sends every lightning_ticker_{symbol} message to ch until ctx is done
+// the connection is shared with the other realtime subscriptions and comes back by itself
+// after a drop, watch ConnectionEvents to find out about the gaps
+func (api *APIClient) GetRealTimeTicker(ctx context.Context, symbol string, ch chan<- Ticker) {
 	channel := fmt.Sprintf("lightning_ticker_%s", symbol)
-	if err := c.WriteJSON(&JsonRPC2{Version: "2.0", Method: "subscribe", Params: &SubscribeParams{channel}}); err != nil {
-		log.Fatal("subscribe:", err)
-		return
-	}
-
-OUTER:
-	for {
-		message := new(JsonRPC2)
-		if err := c.ReadJSON(message); err != nil {
-			log.Println("read:", err)
+	api.stream.subscribe(ctx, channel, func(message json.RawMessage) {
+		var ticker Ticker
+		if err := json.Unmarshal(message, &ticker); err != nil {
+			log.Printf("action=GetRealTimeTicker err=%s", err.Error())
 			return
 		}
-
-		if message.Method == "channelMessage" {
-			switch v := message.Params.(type) {
-			case map[string]interface{}:
-				for key, binary := range v {
-					if key == "message" {
-						marshaTic, err := json.Marshal(binary)
-						if err != nil {
-							continue OUTER
-						}
-						var ticker Ticker
-						if err := json.Unmarshal(marshaTic, &ticker); err != nil {
-							continue OUTER
-						}
-						ch <- ticker
-					}
-				}
-			}
+		select {
+		case ch <- ticker:
+		case <-ctx.Done():
 		}
-	}
+	}, nil)
+}
+
+// ConnectionEvents returns the state changes of the realtime connection
+func (api *APIClient) ConnectionEvents() <-chan ConnectionEvent {
+	return api.stream.events
 }
 
 // Order struct for creating order for trading
@@ -269,19 +316,32 @@ type Order struct {
 
 // response when we order
 type ResponseSendChildOrder struct {
-	ChildOrderAcceptanceID string `json:"child_order_acceptance_id`
+	ChildOrderAcceptanceID string `json:"child_order_acceptance_id"`
 }
 
 // create order!
+// a rejected order, e.g. for insufficient funds, returns an *APIError
 func (api *APIClient) SendOrder(order *Order) (*ResponseSendChildOrder, error) {
 	// 入ってくるオーダーをＪＳＯＮにする
-	data, _ := json.Marshal(order)
+	data, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
 	url := "me/sendchildorder"
-	resp, _ := api.doRequest("POST", url, map[string]string{}, data)
+	resp, err := api.doRequest("POST", url, map[string]string{}, data)
+	if err != nil {
+		log.Printf("action=SendOrder err=%s", err.Error())
+		return nil, err
+	}
 
 	var response ResponseSendChildOrder
-	_ = json.Unmarshal(resp, &response)
-
+	if err := json.Unmarshal(resp, &response); err != nil {
+		return nil, err
+	}
+	if response.ChildOrderAcceptanceID == "" {
+		// bitFlyer sometimes reports a rejection with a 200
+		return nil, newAPIError(http.StatusOK, resp)
+	}
 	return &response, nil
 }
 
@@ -0,0 +1,767 @@
+// Package bitflyertest provides a local bitFlyer-compatible REST and JSON-RPC
+// WebSocket server, so the bitflyer client and the ingestion pipeline can run offline
+package bitflyertest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-trading-bot/bitflyer"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrorResponse is the body bitFlyer returns when a request fails
+type ErrorResponse struct {
+	Status       int         `json:"status"`
+	ErrorMessage string      `json:"error_message"`
+	Data         interface{} `json:"data"`
+}
+
+// Server is a mock bitFlyer exchange
+// REST endpoints live under URL() and the JSON-RPC channel under WsURL()
+type Server struct {
+	Key    string
+	Secret string
+	// Interval is the pause between two scripted ticker messages
+	Interval time.Duration
+
+	mu       sync.Mutex
+	balances map[string]float64
+	tickers  map[string]bitflyer.Ticker
+	scripts  map[string][]interface{} // channel => queued messages
+	orders   []bitflyer.Order
+	parents  []bitflyer.ParentOrderStatus
+	fills    map[string][]bitflyer.MyExecution // our executions by product code, ascending id
+	seq      int
+	conns    map[*websocket.Conn]bool
+	history  map[string][]bitflyer.Execution // by product code, ascending id
+
+	positions      map[string][]bitflyer.Position
+	collateral     bitflyer.Collateral
+	commissionRate float64
+	health         string
+
+	httpServer *httptest.Server
+	upgrader   websocket.Upgrader
+}
+
+// NewServer starts a mock server accepting the given credentials
+func NewServer(key, secret string) *Server {
+	s := &Server{
+		Key:      key,
+		Secret:   secret,
+		Interval: 10 * time.Millisecond,
+		balances: map[string]float64{},
+		tickers:  map[string]bitflyer.Ticker{},
+		scripts:  map[string][]interface{}{},
+		conns:    map[*websocket.Conn]bool{},
+		history:  map[string][]bitflyer.Execution{},
+		fills:    map[string][]bitflyer.MyExecution{},
+
+		positions:      map[string][]bitflyer.Position{},
+		commissionRate: 0.0015,
+		health:         bitflyer.HealthNormal,
+	}
+	s.httpServer = httptest.NewServer(s.Handler())
+	return s
+}
+
+// Handler returns the http handler, useful to serve the mock on a fixed port
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/me/getbalance", s.private(s.handleGetBalance))
+	mux.HandleFunc("/v1/ticker", s.handleTicker)
+	mux.HandleFunc("/v1/getexecutions", s.handleGetExecutions)
+	mux.HandleFunc("/v1/me/sendchildorder", s.private(s.handleSendChildOrder))
+	mux.HandleFunc("/v1/me/getchildorders", s.private(s.handleGetChildOrders))
+	mux.HandleFunc("/v1/me/cancelchildorder", s.private(s.handleCancelChildOrder))
+	mux.HandleFunc("/v1/me/cancelallchildorders", s.private(s.handleCancelAllChildOrders))
+	mux.HandleFunc("/v1/me/sendparentorder", s.private(s.handleSendParentOrder))
+	mux.HandleFunc("/v1/me/getparentorders", s.private(s.handleGetParentOrders))
+	mux.HandleFunc("/v1/me/cancelparentorder", s.private(s.handleCancelParentOrder))
+	mux.HandleFunc("/v1/me/getexecutions", s.private(s.handleGetMyExecutions))
+	mux.HandleFunc("/v1/me/getpositions", s.private(s.handleGetPositions))
+	mux.HandleFunc("/v1/me/getcollateral", s.private(s.handleGetCollateral))
+	mux.HandleFunc("/v1/me/gettradingcommission", s.private(s.handleGetTradingCommission))
+	mux.HandleFunc("/v1/board", s.handleBoard)
+	mux.HandleFunc("/v1/markets", s.handleMarkets)
+	mux.HandleFunc("/v1/gethealth", s.handleGetHealth)
+	mux.HandleFunc("/json-rpc", s.handleJSONRPC)
+	return mux
+}
+
+// URL is the REST base url to pass to bitflyer.NewWithURL
+func (s *Server) URL() string {
+	return s.httpServer.URL + "/v1/"
+}
+
+// WsURL is the JSON-RPC WebSocket url to pass to bitflyer.NewWithURL
+func (s *Server) WsURL() string {
+	return "ws" + strings.TrimPrefix(s.httpServer.URL, "http") + "/json-rpc"
+}
+
+// Client returns an APIClient already pointed at this server
+func (s *Server) Client() *bitflyer.APIClient {
+	return bitflyer.NewWithURL(s.Key, s.Secret, s.URL(), s.WsURL())
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// SetBalance sets the amount of one currency such as "JPY" or "BTC"
+func (s *Server) SetBalance(currencyCode string, amount float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.balances[currencyCode] = amount
+}
+
+// SetPositions sets the open positions /v1/me/getpositions returns for productCode
+func (s *Server) SetPositions(productCode string, positions ...bitflyer.Position) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.positions[productCode] = positions
+}
+
+// SetCollateral sets what /v1/me/getcollateral returns
+func (s *Server) SetCollateral(collateral bitflyer.Collateral) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collateral = collateral
+}
+
+// SetHealth sets the status /v1/gethealth returns, e.g. bitflyer.HealthStop
+func (s *Server) SetHealth(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health = status
+}
+
+// SetTicker sets the ticker returned by /v1/ticker and used to fill orders,
+// ACTIVE LIMIT orders the new best bid/ask reaches are filled at their price
+func (s *Server) SetTicker(ticker bitflyer.Ticker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tickers[ticker.ProductCode] = ticker
+	for i := range s.orders {
+		order := &s.orders[i]
+		if order.ProductCode != ticker.ProductCode || order.ChildOrderType != "LIMIT" || order.ChildOrderState != "ACTIVE" {
+			continue
+		}
+		if (order.Side == "BUY" && ticker.BestAsk > 0 && ticker.BestAsk <= order.Price) ||
+			(order.Side == "SELL" && ticker.BestBid > 0 && ticker.BestBid >= order.Price) {
+			s.execute(order, order.Price)
+		}
+	}
+}
+
+// ScriptTickers queues tickers that are sent in order, every Interval, to clients
+// subscribed to lightning_ticker_{productCode}; each ticker is sent once, so a
+// client that reconnects carries on where the dropped connection stopped
+func (s *Server) ScriptTickers(productCode string, tickers ...bitflyer.Ticker) {
+	for _, ticker := range tickers {
+		s.script("lightning_ticker_"+productCode, ticker)
+	}
+}
+
+// ScriptExecutions queues batches of lightning_executions_{productCode} messages
+func (s *Server) ScriptExecutions(productCode string, batches ...[]bitflyer.Execution) {
+	for _, executions := range batches {
+		s.script("lightning_executions_"+productCode, executions)
+	}
+}
+
+// ScriptBoard queues a lightning_board_snapshot_{productCode} message followed by
+// lightning_board_{productCode} diffs; the diffs wait until the snapshot is sent
+func (s *Server) ScriptBoard(productCode string, snapshot bitflyer.Board, diffs ...bitflyer.Board) {
+	s.script("lightning_board_snapshot_"+productCode, snapshot)
+	for _, diff := range diffs {
+		s.script("lightning_board_"+productCode, diff)
+	}
+}
+
+func (s *Server) script(channel string, message interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[channel] = append(s.scripts[channel], message)
+}
+
+// AddExecutionHistory appends executions, oldest first, to what /v1/getexecutions serves
+func (s *Server) AddExecutionHistory(productCode string, executions ...bitflyer.Execution) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history[productCode] = append(s.history[productCode], executions...)
+}
+
+// DropConnections closes every WebSocket connection, to exercise reconnects
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Orders returns every child order the server has accepted
+func (s *Server) Orders() []bitflyer.Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	orders := make([]bitflyer.Order, len(s.orders))
+	copy(orders, s.orders)
+	return orders
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("action=bitflyertest.writeJSON err=%s", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, code, status int, message string) {
+	writeJSON(w, code, ErrorResponse{Status: status, ErrorMessage: message})
+}
+
+// private wraps a handler with the ACCESS-KEY / ACCESS-SIGN check bitFlyer does:
+// sign = hex(HMAC-SHA256(secret, timestamp + method + request uri + body))
+func (s *Server) private(fn func(http.ResponseWriter, *http.Request, []byte)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, -100, err.Error())
+			return
+		}
+		if r.Header.Get("ACCESS-KEY") != s.Key {
+			writeError(w, http.StatusUnauthorized, -500, "Invalid API key")
+			return
+		}
+		timestamp := r.Header.Get("ACCESS-TIMESTAMP")
+		if timestamp == "" {
+			writeError(w, http.StatusUnauthorized, -500, "ACCESS-TIMESTAMP header is required")
+			return
+		}
+		mac := hmac.New(sha256.New, []byte(s.Secret))
+		mac.Write([]byte(timestamp + r.Method + r.URL.RequestURI() + string(body)))
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(expected), []byte(r.Header.Get("ACCESS-SIGN"))) {
+			writeError(w, http.StatusUnauthorized, -500, "Invalid signature")
+			return
+		}
+		fn(w, r, body)
+	}
+}
+
+func (s *Server) handleGetBalance(w http.ResponseWriter, r *http.Request, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	balances := make([]bitflyer.Balance, 0, len(s.balances))
+	for code, amount := range s.balances {
+		balances = append(balances, bitflyer.Balance{CurrentCode: code, Amount: amount, Available: amount})
+	}
+	writeJSON(w, http.StatusOK, balances)
+}
+
+func (s *Server) handleTicker(w http.ResponseWriter, r *http.Request) {
+	productCode := r.URL.Query().Get("product_code")
+	s.mu.Lock()
+	ticker, ok := s.tickers[productCode]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusBadRequest, -100, "Invalid product")
+		return
+	}
+	writeJSON(w, http.StatusOK, ticker)
+}
+
+// handleGetExecutions pages through the history newest first with before/after id cursors
+func (s *Server) handleGetExecutions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	count := 100
+	if n, err := strconv.Atoi(query.Get("count")); err == nil && n > 0 {
+		count = n
+	}
+	before, _ := strconv.ParseInt(query.Get("before"), 10, 64)
+	after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := s.history[query.Get("product_code")]
+	executions := []bitflyer.Execution{}
+	for i := len(history) - 1; i >= 0 && len(executions) < count; i-- {
+		execution := history[i]
+		if before > 0 && execution.ID >= before {
+			continue
+		}
+		if after > 0 && execution.ID <= after {
+			continue
+		}
+		executions = append(executions, execution)
+	}
+	writeJSON(w, http.StatusOK, executions)
+}
+
+// handleSendChildOrder fills MARKET orders right away at the current best bid/ask
+// and keeps LIMIT orders ACTIVE until the book reaches their price
+func (s *Server) handleSendChildOrder(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, -100, "Method not allowed")
+		return
+	}
+	var order bitflyer.Order
+	if err := json.Unmarshal(body, &order); err != nil {
+		writeError(w, http.StatusBadRequest, -100, err.Error())
+		return
+	}
+	if order.Size <= 0 || (order.Side != "BUY" && order.Side != "SELL") {
+		writeError(w, http.StatusBadRequest, -110, "The minimum order size has not been reached.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	s.seq++
+	order.ID = s.seq
+	order.ChildOrderAcceptanceID = fmt.Sprintf("JRF%s-%06d", now.Format("20060102-150405"), s.seq)
+	order.ChildOrderDate = now.Format("2006-01-02T15:04:05")
+	order.ChildOrderState = "ACTIVE"
+	order.OutstandingSize = order.Size
+
+	if order.ChildOrderType == "MARKET" {
+		ticker, ok := s.tickers[order.ProductCode]
+		if !ok {
+			writeError(w, http.StatusBadRequest, -100, "Invalid product")
+			return
+		}
+		price := ticker.BestAsk
+		if order.Side == "SELL" {
+			price = ticker.BestBid
+		}
+		if !s.execute(&order, price) {
+			writeError(w, http.StatusBadRequest, -200, "Insufficient funds")
+			return
+		}
+	}
+	if order.ChildOrderType == "LIMIT" {
+		// a limit order already crossing the book fills right away at its price
+		ticker := s.tickers[order.ProductCode]
+		if (order.Side == "BUY" && ticker.BestAsk > 0 && ticker.BestAsk <= order.Price) ||
+			(order.Side == "SELL" && ticker.BestBid > 0 && ticker.BestBid >= order.Price) {
+			s.execute(&order, order.Price)
+		}
+	}
+	s.orders = append(s.orders, order)
+	writeJSON(w, http.StatusOK, bitflyer.ResponseSendChildOrder{ChildOrderAcceptanceID: order.ChildOrderAcceptanceID})
+}
+
+// execute fills the whole order at price and moves the balances, false when they do not cover it
+// caller must hold mu
+func (s *Server) execute(order *bitflyer.Order, price float64) bool {
+	codes := strings.Split(order.ProductCode, "_")
+	if len(codes) == 2 {
+		if order.Side == "BUY" {
+			if s.balances[codes[1]] < price*order.Size {
+				return false
+			}
+			s.balances[codes[1]] -= price * order.Size
+			s.balances[codes[0]] += order.Size
+		} else {
+			if s.balances[codes[0]] < order.Size {
+				return false
+			}
+			s.balances[codes[0]] -= order.Size
+			s.balances[codes[1]] += price * order.Size
+		}
+	}
+	order.AveragePrice = price
+	order.ExecutedSize = order.Size
+	order.OutstandingSize = 0
+	order.ChildOrderState = "COMPLETED"
+	s.seq++
+	s.fills[order.ProductCode] = append(s.fills[order.ProductCode], bitflyer.MyExecution{
+		ID:                     int64(s.seq),
+		ChildOrderID:           fmt.Sprintf("JOR%06d", order.ID),
+		Side:                   order.Side,
+		Price:                  price,
+		Size:                   order.Size,
+		ExecDate:               time.Now().UTC().Format("2006-01-02T15:04:05.000"),
+		ChildOrderAcceptanceID: order.ChildOrderAcceptanceID,
+	})
+	return true
+}
+
+// handleCancelChildOrder cancels an ACTIVE order by its acceptance id and answers with an empty body
+func (s *Server) handleCancelChildOrder(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, -100, "Method not allowed")
+		return
+	}
+	var request struct {
+		ProductCode            string `json:"product_code"`
+		ChildOrderAcceptanceID string `json:"child_order_acceptance_id"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, -100, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.orders {
+		order := &s.orders[i]
+		if order.ChildOrderAcceptanceID != request.ChildOrderAcceptanceID || order.ProductCode != request.ProductCode {
+			continue
+		}
+		if order.ChildOrderState != "ACTIVE" {
+			break
+		}
+		order.ChildOrderState = "CANCELED"
+		order.CancelSize = order.OutstandingSize
+		order.OutstandingSize = 0
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeError(w, http.StatusBadRequest, -111, "Order not found")
+}
+
+// handleGetChildOrders returns the newest orders first, filtered like bitFlyer
+func (s *Server) handleGetChildOrders(w http.ResponseWriter, r *http.Request, body []byte) {
+	query := r.URL.Query()
+	count := 100
+	if n, err := strconv.Atoi(query.Get("count")); err == nil && n > 0 {
+		count = n
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	orders := []bitflyer.Order{}
+	for i := len(s.orders) - 1; i >= 0 && len(orders) < count; i-- {
+		order := s.orders[i]
+		if v := query.Get("product_code"); v != "" && v != order.ProductCode {
+			continue
+		}
+		if v := query.Get("child_order_acceptance_id"); v != "" && v != order.ChildOrderAcceptanceID {
+			continue
+		}
+		if v := query.Get("child_order_state"); v != "" && v != order.ChildOrderState {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+// handleCancelAllChildOrders cancels every ACTIVE order of the product
+func (s *Server) handleCancelAllChildOrders(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, -100, "Method not allowed")
+		return
+	}
+	var request struct {
+		ProductCode string `json:"product_code"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, -100, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.orders {
+		order := &s.orders[i]
+		if order.ProductCode == request.ProductCode && order.ChildOrderState == "ACTIVE" {
+			order.ChildOrderState = "CANCELED"
+			order.CancelSize = order.OutstandingSize
+			order.OutstandingSize = 0
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSendParentOrder accepts special orders and lists them as ACTIVE, they are never triggered
+func (s *Server) handleSendParentOrder(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, -100, "Method not allowed")
+		return
+	}
+	var order bitflyer.ParentOrder
+	if err := json.Unmarshal(body, &order); err != nil {
+		writeError(w, http.StatusBadRequest, -100, err.Error())
+		return
+	}
+	if len(order.Parameters) == 0 {
+		writeError(w, http.StatusBadRequest, -100, "parameters are required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	s.seq++
+	first := order.Parameters[0]
+	s.parents = append(s.parents, bitflyer.ParentOrderStatus{
+		ID:                      int64(s.seq),
+		ParentOrderID:           fmt.Sprintf("JCO%06d", s.seq),
+		ProductCode:             first.ProductCode,
+		Side:                    first.Side,
+		ParentOrderType:         order.OrderMethod,
+		Price:                   first.Price,
+		Size:                    first.Size,
+		ParentOrderState:        "ACTIVE",
+		ParentOrderDate:         now.Format("2006-01-02T15:04:05"),
+		ParentOrderAcceptanceID: fmt.Sprintf("JRF%s-%06d", now.Format("20060102-150405"), s.seq),
+		OutstandingSize:         first.Size,
+	})
+	writeJSON(w, http.StatusOK, bitflyer.ResponseSendParentOrder{ParentOrderAcceptanceID: s.parents[len(s.parents)-1].ParentOrderAcceptanceID})
+}
+
+// handleGetParentOrders returns special orders, newest first
+func (s *Server) handleGetParentOrders(w http.ResponseWriter, r *http.Request, body []byte) {
+	query := r.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	orders := []bitflyer.ParentOrderStatus{}
+	for i := len(s.parents) - 1; i >= 0; i-- {
+		order := s.parents[i]
+		if v := query.Get("product_code"); v != "" && v != order.ProductCode {
+			continue
+		}
+		if v := query.Get("parent_order_state"); v != "" && v != order.ParentOrderState {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+// handleCancelParentOrder cancels an ACTIVE special order by its acceptance id
+func (s *Server) handleCancelParentOrder(w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, -100, "Method not allowed")
+		return
+	}
+	var request struct {
+		ProductCode             string `json:"product_code"`
+		ParentOrderAcceptanceID string `json:"parent_order_acceptance_id"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		writeError(w, http.StatusBadRequest, -100, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.parents {
+		order := &s.parents[i]
+		if order.ParentOrderAcceptanceID != request.ParentOrderAcceptanceID || order.ProductCode != request.ProductCode {
+			continue
+		}
+		if order.ParentOrderState != "ACTIVE" {
+			break
+		}
+		order.ParentOrderState = "CANCELED"
+		order.CancelSize = order.OutstandingSize
+		order.OutstandingSize = 0
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeError(w, http.StatusBadRequest, -111, "Order not found")
+}
+
+// handleGetMyExecutions returns the fills of the orders the server executed, newest first
+func (s *Server) handleGetMyExecutions(w http.ResponseWriter, r *http.Request, body []byte) {
+	query := r.URL.Query()
+	count := 100
+	if n, err := strconv.Atoi(query.Get("count")); err == nil && n > 0 {
+		count = n
+	}
+	before, _ := strconv.ParseInt(query.Get("before"), 10, 64)
+	after, _ := strconv.ParseInt(query.Get("after"), 10, 64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fills := s.fills[query.Get("product_code")]
+	executions := []bitflyer.MyExecution{}
+	for i := len(fills) - 1; i >= 0 && len(executions) < count; i-- {
+		execution := fills[i]
+		if before > 0 && execution.ID >= before {
+			continue
+		}
+		if after > 0 && execution.ID <= after {
+			continue
+		}
+		if v := query.Get("child_order_acceptance_id"); v != "" && v != execution.ChildOrderAcceptanceID {
+			continue
+		}
+		executions = append(executions, execution)
+	}
+	writeJSON(w, http.StatusOK, executions)
+}
+
+func (s *Server) handleGetPositions(w http.ResponseWriter, r *http.Request, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	positions := append([]bitflyer.Position{}, s.positions[r.URL.Query().Get("product_code")]...)
+	writeJSON(w, http.StatusOK, positions)
+}
+
+func (s *Server) handleGetCollateral(w http.ResponseWriter, r *http.Request, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, s.collateral)
+}
+
+func (s *Server) handleGetTradingCommission(w http.ResponseWriter, r *http.Request, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, bitflyer.TradingCommission{CommissionRate: s.commissionRate})
+}
+
+// handleBoard returns a one level book made of the best bid/ask of the ticker
+func (s *Server) handleBoard(w http.ResponseWriter, r *http.Request) {
+	productCode := r.URL.Query().Get("product_code")
+	s.mu.Lock()
+	ticker, ok := s.tickers[productCode]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusBadRequest, -100, "Invalid product")
+		return
+	}
+	writeJSON(w, http.StatusOK, bitflyer.Board{
+		MidPrice: ticker.GetMidPrice(),
+		Bids:     []bitflyer.BoardOrder{{Price: ticker.BestBid, Size: ticker.BestBidSize}},
+		Asks:     []bitflyer.BoardOrder{{Price: ticker.BestAsk, Size: ticker.BestAskSize}},
+	})
+}
+
+// handleMarkets lists every product with a ticker
+func (s *Server) handleMarkets(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	markets := []bitflyer.Market{}
+	for productCode := range s.tickers {
+		marketType := "Spot"
+		if strings.HasPrefix(productCode, "FX_") {
+			marketType = "FX"
+		}
+		markets = append(markets, bitflyer.Market{ProductCode: productCode, MarketType: marketType})
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i].ProductCode < markets[j].ProductCode })
+	writeJSON(w, http.StatusOK, markets)
+}
+
+func (s *Server) handleGetHealth(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, bitflyer.Health{Status: s.health})
+}
+
+// handleJSONRPC answers subscribe requests and replays scripted tickers
+// as channelMessage notifications
+func (s *Server) handleJSONRPC(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("action=bitflyertest.handleJSONRPC err=%s", err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.conns[conn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	var writeMu sync.Mutex
+	send := func(v interface{}) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(v)
+	}
+
+	// each subscribed channel is replayed until it is unsubscribed or the connection ends
+	replaying := map[string]chan struct{}{}
+	defer func() {
+		for _, stop := range replaying {
+			close(stop)
+		}
+	}()
+	for {
+		var request struct {
+			Version string                   `json:"jsonrpc"`
+			Method  string                   `json:"method"`
+			Params  bitflyer.SubscribeParams `json:"params"`
+			Id      *int                     `json:"id,omitempty"`
+		}
+		if err := conn.ReadJSON(&request); err != nil {
+			return
+		}
+		channel := request.Params.Channel
+		switch request.Method {
+		case "subscribe":
+			if request.Id != nil {
+				send(&bitflyer.JsonRPC2{Version: "2.0", Result: true, Id: request.Id})
+			}
+			if _, ok := replaying[channel]; !ok {
+				replaying[channel] = make(chan struct{})
+				go s.replay(channel, send, replaying[channel])
+			}
+		case "unsubscribe":
+			if stop, ok := replaying[channel]; ok {
+				close(stop)
+				delete(replaying, channel)
+			}
+		}
+	}
+}
+
+// replay sends the queued messages of channel every Interval; each message is sent once
+// a lightning_board diff is held back until the snapshot of the same product went out
+func (s *Server) replay(channel string, send func(interface{}) error, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(s.Interval):
+		}
+		s.mu.Lock()
+		if len(s.scripts[channel]) == 0 {
+			s.mu.Unlock()
+			continue
+		}
+		if strings.HasPrefix(channel, "lightning_board_") && !strings.HasPrefix(channel, "lightning_board_snapshot_") {
+			snapshotChannel := "lightning_board_snapshot_" + strings.TrimPrefix(channel, "lightning_board_")
+			if len(s.scripts[snapshotChannel]) > 0 {
+				s.mu.Unlock()
+				continue
+			}
+		}
+		message := s.scripts[channel][0]
+		s.scripts[channel] = s.scripts[channel][1:]
+		if ticker, ok := message.(bitflyer.Ticker); ok {
+			s.tickers[ticker.ProductCode] = ticker
+		}
+		s.mu.Unlock()
+
+		notification := &bitflyer.JsonRPC2{
+			Version: "2.0",
+			Method:  "channelMessage",
+			Params:  map[string]interface{}{"channel": channel, "message": message},
+		}
+		if err := send(notification); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package bitflyertest
+
+import (
+	"context"
+	"fmt"
+	"go-trading-bot/bitflyer"
+	"testing"
+	"time"
+)
+
+// TestServerOrders runs the signed order endpoints of the client against the server
+func TestServerOrders(t *testing.T) {
+	server := NewServer("key", "secret")
+	defer server.Close()
+	server.SetBalance("JPY", 1000000)
+	server.SetTicker(bitflyer.Ticker{ProductCode: "BTC_JPY", BestBid: 4999000, BestAsk: 5000000})
+	client := server.Client()
+
+	resting, err := client.SendOrder(&bitflyer.Order{ProductCode: "BTC_JPY", ChildOrderType: "LIMIT", Side: "BUY", Price: 4900000, Size: 0.01})
+	if err != nil {
+		t.Fatalf("SendOrder LIMIT: %s", err)
+	}
+	market, err := client.SendOrder(&bitflyer.Order{ProductCode: "BTC_JPY", ChildOrderType: "MARKET", Side: "BUY", Size: 0.1})
+	if err != nil {
+		t.Fatalf("SendOrder MARKET: %s", err)
+	}
+
+	active, err := client.ListOrder(map[string]string{"product_code": "BTC_JPY", "child_order_state": "ACTIVE"})
+	if err != nil {
+		t.Fatalf("ListOrder: %s", err)
+	}
+	if len(active) != 1 || active[0].ChildOrderAcceptanceID != resting.ChildOrderAcceptanceID {
+		t.Fatalf("ACTIVE orders = %+v, want only %s", active, resting.ChildOrderAcceptanceID)
+	}
+	completed, err := client.ListOrder(map[string]string{"product_code": "BTC_JPY", "child_order_acceptance_id": market.ChildOrderAcceptanceID})
+	if err != nil {
+		t.Fatalf("ListOrder: %s", err)
+	}
+	if len(completed) != 1 || completed[0].ChildOrderState != "COMPLETED" || completed[0].AveragePrice != 5000000 || completed[0].ExecutedSize != 0.1 {
+		t.Fatalf("market order = %+v, want COMPLETED 0.1 at 5000000", completed)
+	}
+
+	if err := client.CancelChildOrder("BTC_JPY", resting.ChildOrderAcceptanceID); err != nil {
+		t.Fatalf("CancelChildOrder: %s", err)
+	}
+	canceled, err := client.ListOrder(map[string]string{"product_code": "BTC_JPY", "child_order_acceptance_id": resting.ChildOrderAcceptanceID})
+	if err != nil {
+		t.Fatalf("ListOrder: %s", err)
+	}
+	if len(canceled) != 1 || canceled[0].ChildOrderState != "CANCELED" || canceled[0].CancelSize != 0.01 {
+		t.Fatalf("limit order = %+v, want CANCELED", canceled)
+	}
+	if err := client.CancelChildOrder("BTC_JPY", resting.ChildOrderAcceptanceID); err == nil {
+		t.Error("CancelChildOrder of a canceled order succeeded")
+	}
+
+	balances, err := client.GetBalance()
+	if err != nil {
+		t.Fatalf("GetBalance: %s", err)
+	}
+	for _, balance := range balances {
+		if balance.CurrentCode == "JPY" && balance.Amount != 500000 {
+			t.Errorf("JPY = %v, want 500000", balance.Amount)
+		}
+	}
+}
+
+// TestServerRejectsBadSignature checks a client with another secret is refused
+func TestServerRejectsBadSignature(t *testing.T) {
+	server := NewServer("key", "secret")
+	defer server.Close()
+	client := bitflyer.NewWithURL("key", "wrong", server.URL(), server.WsURL())
+	if _, err := client.ListOrder(map[string]string{"product_code": "BTC_JPY"}); err == nil {
+		t.Fatal("ListOrder with a bad signature succeeded")
+	}
+}
+
+// TestServerTickerStream receives the scripted tickers over the JSON-RPC stream
+func TestServerTickerStream(t *testing.T) {
+	server := NewServer("key", "secret")
+	defer server.Close()
+	server.ScriptTickers("BTC_JPY",
+		bitflyer.Ticker{ProductCode: "BTC_JPY", TickID: 1, BestBid: 100, BestAsk: 101},
+		bitflyer.Ticker{ProductCode: "BTC_JPY", TickID: 2, BestBid: 102, BestAsk: 103},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tickers := make(chan bitflyer.Ticker)
+	go server.Client().GetRealTimeTicker(ctx, "BTC_JPY", tickers)
+	for want := 1; want <= 2; want++ {
+		select {
+		case ticker := <-tickers:
+			if ticker.TickID != want {
+				t.Fatalf("ticker %+v, want tick_id %d", ticker, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no ticker %d", want)
+		}
+	}
+}
+
+// TestServerStreamReconnect drops the connection between two tickers, the client reconnects and resubscribes by itself
+func TestServerStreamReconnect(t *testing.T) {
+	server := NewServer("key", "secret")
+	defer server.Close()
+	server.ScriptTickers("BTC_JPY", bitflyer.Ticker{ProductCode: "BTC_JPY", TickID: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := server.Client()
+	tickers := make(chan bitflyer.Ticker)
+	go client.GetRealTimeTicker(ctx, "BTC_JPY", tickers)
+	receive := func(want int) {
+		t.Helper()
+		select {
+		case ticker := <-tickers:
+			if ticker.TickID != want {
+				t.Fatalf("ticker %+v, want tick_id %d", ticker, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no ticker %d", want)
+		}
+	}
+	receive(1)
+
+	server.DropConnections()
+	server.ScriptTickers("BTC_JPY", bitflyer.Ticker{ProductCode: "BTC_JPY", TickID: 2})
+	receive(2)
+
+	var states []bitflyer.ConnectionState
+	for len(client.ConnectionEvents()) > 0 {
+		states = append(states, (<-client.ConnectionEvents()).State)
+	}
+	want := []bitflyer.ConnectionState{
+		bitflyer.StateConnecting, bitflyer.StateConnected, bitflyer.StateDisconnected, bitflyer.StateConnecting, bitflyer.StateConnected,
+	}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Errorf("connection states = %v, want %v", states, want)
+	}
+}
+
+// TestServerSlowSubscriber never reads the tickers, the executions on the same connection still arrive
+func TestServerSlowSubscriber(t *testing.T) {
+	server := NewServer("key", "secret")
+	defer server.Close()
+	server.ScriptTickers("BTC_JPY", bitflyer.Ticker{ProductCode: "BTC_JPY", TickID: 1}, bitflyer.Ticker{ProductCode: "BTC_JPY", TickID: 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := server.Client()
+	go client.GetRealTimeTicker(ctx, "BTC_JPY", make(chan bitflyer.Ticker))
+	// the tickers go out first, then the executions
+	time.Sleep(100 * time.Millisecond)
+	server.ScriptExecutions("BTC_JPY", []bitflyer.Execution{{ID: 1, Side: "BUY", Price: 100, Size: 0.1}})
+	executions := make(chan []bitflyer.Execution)
+	go client.GetRealTimeExecutions(ctx, "BTC_JPY", executions)
+	select {
+	case got := <-executions:
+		if len(got) != 1 || got[0].ID != 1 {
+			t.Errorf("executions %+v, want the scripted batch", got)
+		}
+	case <-ctx.Done():
+		t.Fatal("the unread tickers held up the executions")
+	}
+}
@@ -0,0 +1,286 @@
+package bitflyer
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// order methods of a parent (special) order
+const (
+	OrderMethodSimple = "SIMPLE" // one order
+	OrderMethodIFD    = "IFD"    // the second order is placed once the first one is filled
+	OrderMethodOCO    = "OCO"    // the first of the two orders to fill cancels the other
+	OrderMethodIFDOCO = "IFDOCO" // once the first order is filled, the other two are placed as an OCO
+)
+
+// condition types of the orders of a parent order
+const (
+	ConditionLimit     = "LIMIT"
+	ConditionMarket    = "MARKET"
+	ConditionStop      = "STOP"       // a market order once the price reaches TriggerPrice
+	ConditionStopLimit = "STOP_LIMIT" // a limit order at Price once the price reaches TriggerPrice
+	ConditionTrail     = "TRAIL"      // a stop following the price at Offset
+)
+
+// Page is the cursor of the list endpoints, 0 leaves a field out
+type Page struct {
+	Count  int
+	Before int64
+	After  int64
+}
+
+func (p Page) query(query map[string]string) map[string]string {
+	if p.Count > 0 {
+		query["count"] = strconv.Itoa(p.Count)
+	}
+	if p.Before > 0 {
+		query["before"] = strconv.FormatInt(p.Before, 10)
+	}
+	if p.After > 0 {
+		query["after"] = strconv.FormatInt(p.After, 10)
+	}
+	return query
+}
+
+// getJSON sends a GET request and decodes the response into v
+func (api *APIClient) getJSON(urlPath string, query map[string]string, v interface{}) error {
+	resp, err := api.doRequest("GET", urlPath, query, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp, v)
+}
+
+// postJSON sends request as the JSON body of a POST and decodes the response into v unless v is nil
+func (api *APIClient) postJSON(urlPath string, request, v interface{}) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := api.doRequest("POST", urlPath, map[string]string{}, data)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(resp, v)
+}
+
+// CancelChildOrder cancels an order still waiting to be filled, by its acceptance id
+func (api *APIClient) CancelChildOrder(productCode, childOrderAcceptanceID string) error {
+	return api.postJSON("me/cancelchildorder", map[string]string{
+		"product_code":              productCode,
+		"child_order_acceptance_id": childOrderAcceptanceID,
+	}, nil)
+}
+
+// CancelAllChildOrders cancels every order of productCode still waiting to be filled
+func (api *APIClient) CancelAllChildOrders(productCode string) error {
+	return api.postJSON("me/cancelallchildorders", map[string]string{"product_code": productCode}, nil)
+}
+
+// ParentOrderParameter is one of the orders of a parent order
+type ParentOrderParameter struct {
+	ProductCode   string  `json:"product_code"`
+	ConditionType string  `json:"condition_type"`
+	Side          string  `json:"side"`
+	Size          float64 `json:"size"`
+	Price         float64 `json:"price,omitempty"`         // LIMIT and STOP_LIMIT
+	TriggerPrice  float64 `json:"trigger_price,omitempty"` // STOP and STOP_LIMIT
+	Offset        float64 `json:"offset,omitempty"`        // TRAIL
+}
+
+// ParentOrder is a special order: IFD, OCO or IFDOCO orders, in the order the method runs them
+type ParentOrder struct {
+	OrderMethod     string                 `json:"order_method"`
+	MinuteToExpires int                    `json:"minute_to_expire,omitempty"`
+	TimeInForce     string                 `json:"time_in_force,omitempty"`
+	Parameters      []ParentOrderParameter `json:"parameters"`
+}
+
+// ResponseSendParentOrder is the answer to me/sendparentorder
+type ResponseSendParentOrder struct {
+	ParentOrderAcceptanceID string `json:"parent_order_acceptance_id"`
+}
+
+// SendParentOrder places a special order
+func (api *APIClient) SendParentOrder(order *ParentOrder) (*ResponseSendParentOrder, error) {
+	var response ResponseSendParentOrder
+	if err := api.postJSON("me/sendparentorder", order, &response); err != nil {
+		return nil, err
+	}
+	if response.ParentOrderAcceptanceID == "" {
+		return nil, &APIError{StatusCode: http.StatusOK, ErrorMessage: "no parent_order_acceptance_id"}
+	}
+	return &response, nil
+}
+
+// CancelParentOrder cancels a special order and the child orders it placed, by its acceptance id
+func (api *APIClient) CancelParentOrder(productCode, parentOrderAcceptanceID string) error {
+	return api.postJSON("me/cancelparentorder", map[string]string{
+		"product_code":               productCode,
+		"parent_order_acceptance_id": parentOrderAcceptanceID,
+	}, nil)
+}
+
+// ParentOrderStatus is a special order as me/getparentorders lists it
+type ParentOrderStatus struct {
+	ID                      int64   `json:"id"`
+	ParentOrderID           string  `json:"parent_order_id"`
+	ProductCode             string  `json:"product_code"`
+	Side                    string  `json:"side"`
+	ParentOrderType         string  `json:"parent_order_type"`
+	Price                   float64 `json:"price"`
+	AveragePrice            float64 `json:"average_price"`
+	Size                    float64 `json:"size"`
+	ParentOrderState        string  `json:"parent_order_state"`
+	ExpireDate              string  `json:"expire_date"`
+	ParentOrderDate         string  `json:"parent_order_date"`
+	ParentOrderAcceptanceID string  `json:"parent_order_acceptance_id"`
+	OutstandingSize         float64 `json:"outstanding_size"`
+	CancelSize              float64 `json:"cancel_size"`
+	ExecutedSize            float64 `json:"executed_size"`
+	TotalCommission         float64 `json:"total_commission"`
+}
+
+// ParentOrderQuery filters me/getparentorders, empty fields are left out
+type ParentOrderQuery struct {
+	ProductCode      string
+	ParentOrderState string // ACTIVE, COMPLETED, CANCELED, EXPIRED or REJECTED
+	Page
+}
+
+// ListParentOrders returns the special orders matching query, newest first
+func (api *APIClient) ListParentOrders(query ParentOrderQuery) ([]ParentOrderStatus, error) {
+	q := query.Page.query(map[string]string{})
+	if query.ProductCode != "" {
+		q["product_code"] = query.ProductCode
+	}
+	if query.ParentOrderState != "" {
+		q["parent_order_state"] = query.ParentOrderState
+	}
+	var orders []ParentOrderStatus
+	if err := api.getJSON("me/getparentorders", q, &orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// ParentOrderDetail is a special order with its orders, from me/getparentorder
+type ParentOrderDetail struct {
+	ID                      int64                  `json:"id"`
+	ParentOrderID           string                 `json:"parent_order_id"`
+	ParentOrderAcceptanceID string                 `json:"parent_order_acceptance_id"`
+	OrderMethod             string                 `json:"order_method"`
+	MinuteToExpires         int                    `json:"minute_to_expire"`
+	TimeInForce             string                 `json:"time_in_force"`
+	Parameters              []ParentOrderParameter `json:"parameters"`
+}
+
+// GetParentOrder returns the special order parentOrderAcceptanceID with its orders
+func (api *APIClient) GetParentOrder(parentOrderAcceptanceID string) (*ParentOrderDetail, error) {
+	var detail ParentOrderDetail
+	err := api.getJSON("me/getparentorder", map[string]string{"parent_order_acceptance_id": parentOrderAcceptanceID}, &detail)
+	if err != nil {
+		return nil, err
+	}
+	return &detail, nil
+}
+
+// MyExecution is one fill of our own orders, from me/getexecutions
+type MyExecution struct {
+	ID                     int64   `json:"id"`
+	ChildOrderID           string  `json:"child_order_id"`
+	Side                   string  `json:"side"`
+	Price                  float64 `json:"price"`
+	Size                   float64 `json:"size"`
+	Commission             float64 `json:"commission"`
+	ExecDate               string  `json:"exec_date"`
+	ChildOrderAcceptanceID string  `json:"child_order_acceptance_id"`
+}
+
+// ExecutionQuery filters me/getexecutions, empty fields are left out
+type ExecutionQuery struct {
+	ProductCode            string
+	ChildOrderID           string
+	ChildOrderAcceptanceID string
+	Page
+}
+
+// GetMyExecutions returns the fills of our orders matching query, newest first
+func (api *APIClient) GetMyExecutions(query ExecutionQuery) ([]MyExecution, error) {
+	q := query.Page.query(map[string]string{})
+	if query.ProductCode != "" {
+		q["product_code"] = query.ProductCode
+	}
+	if query.ChildOrderID != "" {
+		q["child_order_id"] = query.ChildOrderID
+	}
+	if query.ChildOrderAcceptanceID != "" {
+		q["child_order_acceptance_id"] = query.ChildOrderAcceptanceID
+	}
+	var executions []MyExecution
+	if err := api.getJSON("me/getexecutions", q, &executions); err != nil {
+		return nil, err
+	}
+	return executions, nil
+}
+
+// Position is an open margin position of FX_BTC_JPY
+type Position struct {
+	ProductCode         string  `json:"product_code"`
+	Side                string  `json:"side"`
+	Price               float64 `json:"price"`
+	Size                float64 `json:"size"`
+	Commission          float64 `json:"commission"`
+	SwapPointAccumulate float64 `json:"swap_point_accumulate"`
+	RequireCollateral   float64 `json:"require_collateral"`
+	OpenDate            string  `json:"open_date"`
+	Leverage            float64 `json:"leverage"`
+	Pnl                 float64 `json:"pnl"`
+	Sfd                 float64 `json:"sfd"`
+}
+
+// GetPositions returns the open positions of productCode, only FX_BTC_JPY has any
+func (api *APIClient) GetPositions(productCode string) ([]Position, error) {
+	var positions []Position
+	if err := api.getJSON("me/getpositions", map[string]string{"product_code": productCode}, &positions); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// Collateral is the margin account
+type Collateral struct {
+	Collateral        float64 `json:"collateral"`
+	OpenPositionPnl   float64 `json:"open_position_pnl"`
+	RequireCollateral float64 `json:"require_collateral"`
+	KeepRate          float64 `json:"keep_rate"` // collateral over required collateral, margin calls start below 0.8
+	MarginCallAmount  float64 `json:"margin_call_amount"`
+	MarginCallDueDate string  `json:"margin_call_due_date"`
+}
+
+// GetCollateral returns the state of the margin account
+func (api *APIClient) GetCollateral() (*Collateral, error) {
+	var collateral Collateral
+	if err := api.getJSON("me/getcollateral", map[string]string{}, &collateral); err != nil {
+		return nil, err
+	}
+	return &collateral, nil
+}
+
+// TradingCommission is the commission rate charged on productCode, 0.0015 => 0.15%
+type TradingCommission struct {
+	CommissionRate float64 `json:"commission_rate"`
+}
+
+// GetTradingCommission returns our commission rate on productCode
+func (api *APIClient) GetTradingCommission(productCode string) (*TradingCommission, error) {
+	var commission TradingCommission
+	if err := api.getJSON("me/gettradingcommission", map[string]string{"product_code": productCode}, &commission); err != nil {
+		return nil, err
+	}
+	return &commission, nil
+}
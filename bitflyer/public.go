@@ -0,0 +1,65 @@
+package bitflyer
+
+// health states of the exchange, from the best to the worst
+const (
+	HealthNormal    = "NORMAL"
+	HealthBusy      = "BUSY"
+	HealthVeryBusy  = "VERY BUSY"
+	HealthSuperBusy = "SUPER BUSY"
+	HealthNoOrder   = "NO ORDER" // orders are not accepted
+	HealthStop      = "STOP"     // the exchange is stopped
+)
+
+// GetBoard returns the order book of productCode
+func (api *APIClient) GetBoard(productCode string) (*Board, error) {
+	var board Board
+	if err := api.getJSON("board", map[string]string{"product_code": productCode}, &board); err != nil {
+		return nil, err
+	}
+	return &board, nil
+}
+
+// Market is a product traded on bitFlyer
+type Market struct {
+	ProductCode string `json:"product_code"`
+	Alias       string `json:"alias"`
+	MarketType  string `json:"market_type"` // Spot, FX or Futures
+}
+
+// GetMarkets returns every product traded on bitFlyer
+func (api *APIClient) GetMarkets() ([]Market, error) {
+	var markets []Market
+	if err := api.getJSON("markets", map[string]string{}, &markets); err != nil {
+		return nil, err
+	}
+	return markets, nil
+}
+
+// Health is how busy the exchange of a product is
+type Health struct {
+	Status string `json:"status"`
+}
+
+// GetHealth returns the health of the exchange of productCode
+func (api *APIClient) GetHealth(productCode string) (*Health, error) {
+	var health Health
+	if err := api.getJSON("gethealth", map[string]string{"product_code": productCode}, &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// BoardState is the health and the state of the order book of a product
+type BoardState struct {
+	Health string `json:"health"`
+	State  string `json:"state"` // RUNNING, CLOSED, STARTING, PREOPEN, CIRCUIT BREAK, AWAITING SQ or MATURED
+}
+
+// GetBoardState returns the state of the order book of productCode
+func (api *APIClient) GetBoardState(productCode string) (*BoardState, error) {
+	var state BoardState
+	if err := api.getJSON("getboardstate", map[string]string{"product_code": productCode}, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
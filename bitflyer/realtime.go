@@ -0,0 +1,243 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Execution is one trade print from lightning_executions_{symbol} or getexecutions
+type Execution struct {
+	ID                         int64   `json:"id"`
+	Side                       string  `json:"side"` // taker side: BUY, SELL or empty for itayose
+	Price                      float64 `json:"price"`
+	Size                       float64 `json:"size"`
+	ExecDate                   string  `json:"exec_date"`
+	BuyChildOrderAcceptanceID  string  `json:"buy_child_order_acceptance_id"`
+	SellChildOrderAcceptanceID string  `json:"sell_child_order_acceptance_id"`
+}
+
+// DateTime parses exec_date, the realtime API sends it with a Z and REST without a zone
+func (e *Execution) DateTime() time.Time {
+	dateTime, err := time.Parse(time.RFC3339Nano, e.ExecDate)
+	if err != nil {
+		dateTime, err = time.ParseInLocation("2006-01-02T15:04:05.999999999", e.ExecDate, time.UTC)
+	}
+	if err != nil {
+		log.Printf("action=Execution.DateTime, err=%s", err.Error())
+	}
+	return dateTime
+}
+
+// TruncateDateTime returns the start of the candle the execution belongs to
+func (e *Execution) TruncateDateTime(duration time.Duration) time.Time {
+	return e.DateTime().Truncate(duration)
+}
+
+// BoardOrder is one price level of the order book
+type BoardOrder struct {
+	Price float64 `json:"price"`
+	Size  float64 `json:"size"`
+}
+
+// Board is the order book: bids from the highest price, asks from the lowest
+type Board struct {
+	MidPrice float64      `json:"mid_price"`
+	Bids     []BoardOrder `json:"bids"`
+	Asks     []BoardOrder `json:"asks"`
+}
+
+// BestBid returns the highest bid or 0 when there is none
+func (b *Board) BestBid() float64 {
+	if len(b.Bids) == 0 {
+		return 0
+	}
+	return b.Bids[0].Price
+}
+
+// BestAsk returns the lowest ask or 0 when there is none
+func (b *Board) BestAsk() float64 {
+	if len(b.Asks) == 0 {
+		return 0
+	}
+	return b.Asks[0].Price
+}
+
+// EstimateMarketPrice walks the book the way a MARKET order of size would
+// and returns its average fill price; ok is false when the book is too thin
+func (b *Board) EstimateMarketPrice(side string, size float64) (averagePrice float64, ok bool) {
+	levels := b.Asks
+	if side == "SELL" {
+		levels = b.Bids
+	}
+	remaining, cost := size, 0.0
+	for _, level := range levels {
+		if remaining <= 0 {
+			break
+		}
+		fill := level.Size
+		if fill > remaining {
+			fill = remaining
+		}
+		cost += fill * level.Price
+		remaining -= fill
+	}
+	if size <= 0 || remaining > 1e-12 {
+		return 0, false
+	}
+	return cost / size, true
+}
+
+// Slippage is how much worse than the best price a MARKET order of size would fill,
+// as a ratio, e.g. 0.001 => 0.1%
+func (b *Board) Slippage(side string, size float64) (slippage float64, ok bool) {
+	averagePrice, ok := b.EstimateMarketPrice(side, size)
+	if !ok {
+		return 0, false
+	}
+	if side == "SELL" {
+		return (b.BestBid() - averagePrice) / b.BestBid(), true
+	}
+	return (averagePrice - b.BestAsk()) / b.BestAsk(), true
+}
+
+// GetRealTimeExecutions sends every batch of lightning_executions_{symbol} to ch until ctx is done
+func (api *APIClient) GetRealTimeExecutions(ctx context.Context, symbol string, ch chan<- []Execution) {
+	channel := fmt.Sprintf("lightning_executions_%s", symbol)
+	api.stream.subscribe(ctx, channel, func(message json.RawMessage) {
+		var executions []Execution
+		if err := json.Unmarshal(message, &executions); err != nil {
+			log.Printf("action=GetRealTimeExecutions err=%s", err.Error())
+			return
+		}
+		select {
+		case ch <- executions:
+		case <-ctx.Done():
+		}
+	}, nil)
+}
+
+// GetRealTimeBoard keeps a local order book from lightning_board_snapshot_{symbol}
+// and the lightning_board_{symbol} diffs, and sends a copy to ch after every update
+// diffs arriving before the first snapshot are dropped, a size of 0 removes a price level
+func (api *APIClient) GetRealTimeBoard(ctx context.Context, symbol string, ch chan<- Board) {
+	book := newOrderBook()
+	// the diffs missed while disconnected make the book stale until the next snapshot
+	api.stream.watch(ctx, func(state ConnectionState) {
+		if state == StateDisconnected {
+			book.invalidate()
+		}
+	})
+	publish := func(board Board) {
+		select {
+		case ch <- board:
+		case <-ctx.Done():
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		api.stream.subscribe(ctx, fmt.Sprintf("lightning_board_snapshot_%s", symbol), func(message json.RawMessage) {
+			var snapshot Board
+			if err := json.Unmarshal(message, &snapshot); err != nil {
+				log.Printf("action=GetRealTimeBoard err=%s", err.Error())
+				return
+			}
+			publish(book.reset(snapshot))
+		}, nil)
+	}()
+	api.stream.subscribe(ctx, fmt.Sprintf("lightning_board_%s", symbol), func(message json.RawMessage) {
+		var diff Board
+		if err := json.Unmarshal(message, &diff); err != nil {
+			log.Printf("action=GetRealTimeBoard err=%s", err.Error())
+			return
+		}
+		if board, ok := book.apply(diff); ok {
+			publish(board)
+		}
+	}, book.invalidate) // a dropped diff makes the book stale until the next snapshot
+	wg.Wait()
+}
+
+// orderBook merges snapshots and diffs into one board
+type orderBook struct {
+	mu       sync.Mutex
+	ready    bool
+	midPrice float64
+	bids     map[float64]float64
+	asks     map[float64]float64
+}
+
+func newOrderBook() *orderBook {
+	return &orderBook{bids: map[float64]float64{}, asks: map[float64]float64{}}
+}
+
+func (o *orderBook) reset(snapshot Board) Board {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.bids = map[float64]float64{}
+	o.asks = map[float64]float64{}
+	o.ready = true
+	o.merge(snapshot)
+	return o.board()
+}
+
+// invalidate drops diffs until the next snapshot
+func (o *orderBook) invalidate() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ready = false
+}
+
+func (o *orderBook) apply(diff Board) (Board, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.ready {
+		return Board{}, false
+	}
+	o.merge(diff)
+	return o.board(), true
+}
+
+func (o *orderBook) merge(update Board) {
+	if update.MidPrice > 0 {
+		o.midPrice = update.MidPrice
+	}
+	for _, bid := range update.Bids {
+		if bid.Size == 0 {
+			delete(o.bids, bid.Price)
+		} else {
+			o.bids[bid.Price] = bid.Size
+		}
+	}
+	for _, ask := range update.Asks {
+		if ask.Size == 0 {
+			delete(o.asks, ask.Price)
+		} else {
+			o.asks[ask.Price] = ask.Size
+		}
+	}
+}
+
+func (o *orderBook) board() Board {
+	board := Board{
+		MidPrice: o.midPrice,
+		Bids:     make([]BoardOrder, 0, len(o.bids)),
+		Asks:     make([]BoardOrder, 0, len(o.asks)),
+	}
+	for price, size := range o.bids {
+		board.Bids = append(board.Bids, BoardOrder{price, size})
+	}
+	for price, size := range o.asks {
+		board.Asks = append(board.Asks, BoardOrder{price, size})
+	}
+	sort.Slice(board.Bids, func(i, j int) bool { return board.Bids[i].Price > board.Bids[j].Price })
+	sort.Slice(board.Asks, func(i, j int) bool { return board.Asks[i].Price < board.Asks[j].Price })
+	return board
+}
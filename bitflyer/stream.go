@@ -0,0 +1,330 @@
+package bitflyer
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnectionState tells where the realtime connection currently is
+type ConnectionState string
+
+const (
+	StateConnecting   ConnectionState = "CONNECTING"
+	StateConnected    ConnectionState = "CONNECTED"
+	StateDisconnected ConnectionState = "DISCONNECTED"
+	StateClosed       ConnectionState = "CLOSED"
+)
+
+// ConnectionEvent is sent every time the realtime connection changes state
+// a DISCONNECTED event followed by CONNECTED means data between the two is missing
+type ConnectionEvent struct {
+	State   ConnectionState
+	Time    time.Time
+	Attempt int   // reconnect attempt, 0 on the first connection
+	Err     error // why the connection dropped, nil otherwise
+}
+
+// settings of the realtime connection
+const (
+	pongWait       = 60 * time.Second // a connection silent for this long is dead
+	pingPeriod     = 20 * time.Second // must be shorter than pongWait
+	writeWait      = 10 * time.Second
+	minBackoff     = time.Second
+	maxBackoff     = time.Minute
+	stableDuration = time.Minute // a connection alive this long resets the backoff
+	bufferSize     = 256         // messages a subscriber may fall behind before the oldest are dropped
+)
+
+// stream keeps one JSON-RPC WebSocket connection to bitFlyer Realtime API alive,
+// shared by every subscription of the client, and resubscribes after reconnecting
+type stream struct {
+	url string
+
+	mu      sync.Mutex
+	subs    map[string]map[int]*subscriber // channel => subscriber id => subscriber
+	nextID  int
+	running bool
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	// listeners are told every state change, e.g. to drop state a reconnect makes stale
+	listeners map[int]func(ConnectionState)
+
+	events chan ConnectionEvent
+}
+
+func newStream(url string) *stream {
+	return &stream{
+		url:       url,
+		subs:      map[string]map[int]*subscriber{},
+		listeners: map[int]func(ConnectionState){},
+		events:    make(chan ConnectionEvent, 32),
+	}
+}
+
+// subscriber queues the messages of one subscription, so a slow handler never holds up the connection
+type subscriber struct {
+	channel  string
+	messages chan json.RawMessage
+	onDrop   func() // called when a message is dropped, may be nil
+	dropping bool   // messages are being dropped, only read touches it
+}
+
+// deliver queues message without blocking, dropping the oldest queued message when the buffer is full
+func (sub *subscriber) deliver(message json.RawMessage) {
+	select {
+	case sub.messages <- message:
+		sub.dropping = false
+		return
+	default:
+	}
+	select {
+	case <-sub.messages:
+	default:
+	}
+	select {
+	case sub.messages <- message:
+	default:
+	}
+	if !sub.dropping {
+		sub.dropping = true
+		log.Printf("action=stream channel=%s status=dropping buffer=%d", sub.channel, bufferSize)
+	}
+	if sub.onDrop != nil {
+		sub.onDrop()
+	}
+}
+
+// subscribe calls handler with every message of the channel until ctx is done, handler runs in the caller's goroutine
+// a handler falling more than bufferSize messages behind loses the oldest ones, onDrop, when not nil, is told every time
+func (s *stream) subscribe(ctx context.Context, channel string, handler func(json.RawMessage), onDrop func()) {
+	sub := &subscriber{channel: channel, messages: make(chan json.RawMessage, bufferSize), onDrop: onDrop}
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	isFirst := len(s.subs[channel]) == 0
+	if isFirst {
+		s.subs[channel] = map[int]*subscriber{}
+	}
+	s.subs[channel][id] = sub
+	conn := s.conn
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	s.mu.Unlock()
+
+	// run subscribes every channel on connect, only a channel added to a live connection is sent here
+	if isFirst && conn != nil {
+		if err := s.send(conn, "subscribe", channel); err != nil {
+			log.Printf("action=subscribe channel=%s err=%s", channel, err.Error())
+		}
+	}
+
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case message := <-sub.messages:
+			handler(message)
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.subs[channel], id)
+	isLast := len(s.subs[channel]) == 0
+	if isLast {
+		delete(s.subs, channel)
+	}
+	isEmpty := len(s.subs) == 0
+	conn = s.conn
+	s.mu.Unlock()
+
+	if conn == nil {
+		return
+	}
+	if isEmpty {
+		// nobody listens anymore, closing makes run stop
+		conn.Close()
+	} else if isLast {
+		s.send(conn, "unsubscribe", channel)
+	}
+}
+
+// watch calls listener with every state change until ctx is done, it must not block
+func (s *stream) watch(ctx context.Context, listener func(ConnectionState)) {
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.listeners[id] = listener
+	s.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		delete(s.listeners, id)
+		s.mu.Unlock()
+	}()
+}
+
+func (s *stream) send(conn *websocket.Conn, method, channel string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteJSON(&JsonRPC2{Version: "2.0", Method: method, Params: &SubscribeParams{channel}})
+}
+
+func (s *stream) emit(state ConnectionState, attempt int, err error) {
+	if err != nil {
+		log.Printf("action=stream state=%s attempt=%d err=%s", state, attempt, err.Error())
+	} else {
+		log.Printf("action=stream state=%s attempt=%d", state, attempt)
+	}
+	s.mu.Lock()
+	listeners := make([]func(ConnectionState), 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		listeners = append(listeners, listener)
+	}
+	s.mu.Unlock()
+	for _, listener := range listeners {
+		listener(state)
+	}
+	// never block the connection on a slow listener
+	select {
+	case s.events <- ConnectionEvent{State: state, Time: time.Now(), Attempt: attempt, Err: err}:
+	default:
+	}
+}
+
+// run connects, subscribes and reads until nobody is subscribed anymore,
+// reconnecting with exponential backoff and jitter whenever the connection drops
+func (s *stream) run() {
+	attempt := 0
+	for {
+		s.mu.Lock()
+		if len(s.subs) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			s.emit(StateClosed, attempt, nil)
+			return
+		}
+		s.mu.Unlock()
+
+		if attempt > 0 {
+			time.Sleep(backoff(attempt))
+		}
+		s.emit(StateConnecting, attempt, nil)
+		conn, _, err := websocket.DefaultDialer.Dial(s.url, nil)
+		if err != nil {
+			s.emit(StateDisconnected, attempt, err)
+			attempt++
+			continue
+		}
+
+		s.mu.Lock()
+		if len(s.subs) == 0 {
+			// the last subscriber left during the backoff or the dial
+			s.running = false
+			s.mu.Unlock()
+			conn.Close()
+			s.emit(StateClosed, attempt, nil)
+			return
+		}
+		s.conn = conn
+		channels := make([]string, 0, len(s.subs))
+		for channel := range s.subs {
+			channels = append(channels, channel)
+		}
+		s.mu.Unlock()
+
+		for _, channel := range channels {
+			if err = s.send(conn, "subscribe", channel); err != nil {
+				break
+			}
+		}
+		connectedAt := time.Now()
+		if err == nil {
+			s.emit(StateConnected, attempt, nil)
+			err = s.read(conn)
+		}
+
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		conn.Close()
+		s.emit(StateDisconnected, attempt, err)
+
+		if time.Since(connectedAt) > stableDuration {
+			attempt = 0
+		}
+		attempt++
+	}
+}
+
+// read dispatches channel messages until the connection fails or goes silent;
+// pings keep an idle but healthy connection alive, pongs and messages push the deadline
+func (s *stream) read(conn *websocket.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.writeMu.Lock()
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+				s.writeMu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		var message struct {
+			Method string `json:"method"`
+			Params struct {
+				Channel string          `json:"channel"`
+				Message json.RawMessage `json:"message"`
+			} `json:"params"`
+		}
+		if err := conn.ReadJSON(&message); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		if message.Method != "channelMessage" {
+			continue
+		}
+
+		s.mu.Lock()
+		for _, sub := range s.subs[message.Params.Channel] {
+			sub.deliver(message.Params.Message)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// backoff doubles the wait on every attempt up to maxBackoff, with jitter
+// so many clients don't reconnect at the same moment
+func backoff(attempt int) time.Duration {
+	d := maxBackoff
+	if attempt < 16 {
+		if exp := minBackoff << uint(attempt-1); exp < maxBackoff {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
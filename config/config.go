@@ -1,8 +1,13 @@
 package config
 
 import (
+	"go-trading-bot/metrics"
+	"go-trading-bot/sizing"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"gopkg.in/ini.v1"
@@ -13,28 +18,158 @@ import (
 type ConfigList struct {
 	ApiKey      string
 	ApiSecret   string
+	BaseURL     string // REST endpoint, override to point at a mock server
+	WsURL       string // JSON-RPC WebSocket endpoint
 	LogFile     string
-	ProductCode string
+	ProductCode string          // first of Products, the default of the CLI and the chart
+	Products    []ProductConfig // every product the bot trades
 
+	CandleSource  string                   // "executions" builds candles from trades, "ticker" from mid-prices
 	TradeDuration time.Duration            // manually select trade duration
 	Durations     map[string]time.Duration // map of duration choices
 	DbName        string
 	SQLDriver     string
+	FlushInterval time.Duration // how often open candles are written to the database
 	Port          int
+	WebToken      string // bearer token a POST to the kill switch must carry, empty makes it read-only
+
+	BackfillInterval time.Duration // pause between two history requests, bitFlyer limits requests per IP
+	BackfillMinGap   time.Duration // missing candles spanning less than this are a market without trades, not a gap
 
 	BackTest         bool
 	UsePercent       float64
 	DataLimit        int
 	StopLimitPercent float64
 	NumRanking       int
+	MinBuyVolume     float64 // strategies only buy on candles with more volume than this
+
+	SignalQuorum    float64  // total strategy weight that has to agree before trading
+	SignalWeighting string   // "equal" or "performance": how much each strategy's vote weighs
+	SignalRequired  []string // strategies that must agree for any trade
+	SignalVetoes    []string // rules blocking a side, e.g. BUY:rsi(14)>70
+	SignalWindow    int      // signals up to this many candles apart count together
+
+	BacktestCash            float64 // cash a backtest starts with
+	BacktestFeePercent      float64 // commission per fill in percent
+	BacktestSlippagePercent float64 // how much worse than the candle price fills are, in percent
+	BacktestFill            string  // "close" or "next_open"
+	BacktestSwapPercent     float64 // swap point of margin positions per day in percent of their value
+	BacktestObjective       string  // metric the optimizer ranks parameters by, e.g. "sharpe"
+
+	WalkForward            bool    // the AI only adopts parameters that passed a walk forward
+	WalkForwardInSample    int     // candles each optimization sees
+	WalkForwardOutOfSample int     // candles after them the parameters are tested on
+	WalkForwardStep        int     // candles the windows move by, out_of_sample when 0
+	WalkForwardMinScore    float64 // objective the out-of-sample run has to reach
+
+	OptimizerWorkers int                              // backtests the optimizer runs at once, the number of CPUs when 0
+	OptimizerMethod  string                           // "grid", "random", "tpe" or "genetic"
+	OptimizerBudget  int                              // backtests per strategy of the methods other than grid
+	OptimizerSeed    int64                            // seed of the random methods, from the clock when 0
+	OptimizerResume  bool                             // start with the last accepted parameters instead of optimizing
+	StrategyRanges   map[string]map[string]ParamRange // [strategy.rsi] ranges by strategy and parameter
+
+	SizingMode             string  // how buys are sized, one of sizing.Modes
+	SizingNotional         float64 // currency per position with fixed_notional
+	SizingKellyFraction    float64 // share of the full Kelly fraction with kelly
+	SizingKellyMinTrades   int     // backtested trades kelly needs
+	SizingTargetVolatility float64 // percent of the equity a position moves per candle with volatility
+	SizingVolatility       string  // "atr" or "hv", the volatility measure
+	SizingVolatilityPeriod int
+	SizingRiskPercent      float64 // percent of the equity lost at the stop limit with risk_per_trade
+
+	RiskStopLossPercent     float64       // percent below the entry the position is sold at, stop_limit_percent when unset
+	RiskStopLossATR         float64       // ATRs below the entry, replaces the percent
+	RiskTakeProfitPercent   float64       // percent above the entry
+	RiskTakeProfitATR       float64       // ATRs above the entry
+	RiskTrailingStopPercent float64       // percent below the highest price since the entry
+	RiskTrailingStopATR     float64       // ATRs below the highest price
+	RiskATRPeriod           int           // candles of the ATR
+	RiskMaxHolding          time.Duration // positions are sold once this old, 0 keeps them
+	RiskExchangeOrders      string        // "none" or "oco": the exchange holds the exits as a special order
+
+	LimitOrderNotional     float64 // currency a single order opening a position may be worth, 0 disables the limit
+	LimitDailyDrawdown     float64 // percent the equity may fall from its peak of the day before the kill switch engages
+	LimitWeeklyDrawdown    float64 // same from the peak of the week, weeks start on Monday
+	LimitConsecutiveLosses int     // losing trades in a row of a product before the kill switch engages
+	LimitOrdersPerMinute   int     // orders the bot sends at most in any minute
+	LimitOrdersPerHour     int     // orders the bot sends at most in any hour
+
+	ReconcileCancelOrders bool // on start the open child orders of earlier runs are cancelled
+
+	OrderType               string        // "MARKET" or "LIMIT"
+	OrderInsideSpread       float64       // how far into the spread limit orders go, 0 joins the best bid/ask, 0.5 is the mid
+	OrderRepriceInterval    time.Duration // how often a resting limit order is moved to the best bid/ask
+	OrderMaxSlippagePercent float64       // how far from the first price repricing may chase, in percent
+	OrderTimeout            time.Duration // how long a limit order may rest before it is cancelled
+	OrderMarketFallback     bool          // send what is left as a MARKET order after the timeout
+
+	PaperTrade      bool    // trade against the local simulated exchange instead of bitFlyer
+	PaperCurrency   float64 // virtual currency balance (e.g. JPY) the simulator starts with
+	PaperCoin       float64 // virtual coin balance (e.g. BTC) the simulator starts with
+	PaperFeePercent float64 // commission charged by the simulator in percent
+	PaperCollateral float64 // virtual collateral (e.g. JPY) margin products such as FX_BTC_JPY trade against
+}
+
+// ProductConfig is how one product is traded, a [product.ETH_JPY] section overrides
+// the [gotradingbot] defaults for ETH_JPY
+type ProductConfig struct {
+	ProductCode      string
+	TradeDuration    time.Duration
+	UsePercent       float64
+	DataLimit        int
+	StopLimitPercent float64
+	TickSize         float64 // limit prices are rounded to multiples of it
+	MinSize          float64 // smallest order size the exchange accepts
+	SizeStep         float64 // order sizes are rounded down to multiples of it
+	MaxPosition      float64 // coin the bot may hold at most, 0 disables the limit
+	Margin           bool    // traded on margin against the collateral, a sell while flat opens a short position
+	Leverage         float64 // positions are worth at most this many times the collateral, with Margin
+}
+
+// ParamRange is the search range of a strategy parameter, "20,40,5" searches 20 to 40 by 5 and "30" pins it
+type ParamRange struct {
+	Min  float64
+	Max  float64
+	Step float64
+}
+
+// Product returns the config of productCode
+func (c *ConfigList) Product(productCode string) (ProductConfig, bool) {
+	for _, product := range c.Products {
+		if product.ProductCode == productCode {
+			return product, true
+		}
+	}
+	return ProductConfig{}, false
 }
 
 // Config to access to the struct list of configuration list
 var Config ConfigList
 
+// configFile is config.ini in the working directory or the nearest parent directory holding one,
+// so the tests of a package find the one of the repository
+func configFile() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "config.ini"
+	}
+	for {
+		path := filepath.Join(dir, "config.ini")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "config.ini"
+		}
+		dir = parent
+	}
+}
+
 // Initialize the ConfigList struct
 func init() {
-	cfg, err := ini.Load("config.ini") // load config.ini file to get the defined value
+	cfg, err := ini.Load(configFile()) // load config.ini file to get the defined value
 	if err != nil {
 		log.Printf("Failed to read file, something is wrong: %v", err)
 		os.Exit(1)
@@ -50,20 +185,152 @@ func init() {
 		"1h":  time.Hour,
 	}
 
+	defaults := cfg.Section("gotradingbot")
+	productCodes := defaults.Key("product_codes").Strings(",")
+	if len(productCodes) == 0 {
+		productCodes = []string{defaults.Key("product_code").String()}
+	}
+	var products []ProductConfig
+	for _, productCode := range productCodes {
+		// the coin and the currency are the last two parts, e.g. BTC_JPY or FX_BTC_JPY
+		codes := strings.Split(productCode, "_")
+		if len(codes) < 2 || len(codes) > 3 || slices.Contains(codes, "") {
+			log.Printf("Invalid product code %q, expected COIN_CURRENCY or PREFIX_COIN_CURRENCY", productCode)
+			os.Exit(1)
+		}
+		section := cfg.Section("product." + productCode)
+		tradeDuration := section.Key("trade_duration").MustString(defaults.Key("trade_duration").String())
+		products = append(products, ProductConfig{
+			ProductCode:      productCode,
+			TradeDuration:    durations[tradeDuration],
+			UsePercent:       section.Key("use_percent").MustFloat64(defaults.Key("use_percent").MustFloat64()),
+			DataLimit:        section.Key("data_limit").MustInt(defaults.Key("data_limit").MustInt()),
+			StopLimitPercent: section.Key("stop_limit_percent").MustFloat64(defaults.Key("stop_limit_percent").MustFloat64()),
+			TickSize:         section.Key("tick_size").MustFloat64(defaults.Key("tick_size").MustFloat64(1)),
+			MinSize:          section.Key("min_size").MustFloat64(defaults.Key("min_size").MustFloat64(0.001)),
+			SizeStep:         section.Key("size_step").MustFloat64(defaults.Key("size_step").MustFloat64(0.00000001)),
+			MaxPosition:      section.Key("max_position").MustFloat64(defaults.Key("max_position").MustFloat64()),
+			Margin:           section.Key("margin").MustBool(strings.HasPrefix(productCode, "FX_")),
+			Leverage:         section.Key("leverage").MustFloat64(1),
+		})
+	}
+
+	strategyRanges := map[string]map[string]ParamRange{}
+	for _, section := range cfg.Sections() {
+		strategy := strings.TrimPrefix(section.Name(), "strategy.")
+		if strategy == section.Name() {
+			continue
+		}
+		strategyRanges[strategy] = map[string]ParamRange{}
+		for _, key := range section.Keys() {
+			values, err := key.StrictFloat64s(",")
+			if err != nil {
+				log.Printf("Invalid range %s.%s = %q: %s", section.Name(), key.Name(), key.String(), err)
+				os.Exit(1)
+			}
+			switch len(values) {
+			case 1:
+				strategyRanges[strategy][key.Name()] = ParamRange{Min: values[0], Max: values[0]}
+			case 3:
+				strategyRanges[strategy][key.Name()] = ParamRange{Min: values[0], Max: values[1], Step: values[2]}
+			default:
+				log.Printf("Invalid range %s.%s = %q, expected min,max,step or a single value", section.Name(), key.Name(), key.String())
+				os.Exit(1)
+			}
+		}
+	}
+
 	Config = ConfigList{
-		ApiKey:           cfg.Section("bitflyer").Key("api_key").String(),
-		ApiSecret:        cfg.Section("bitflyer").Key("api_secret").String(),
-		LogFile:          cfg.Section("gotradingbot").Key("log_file").String(),
-		ProductCode:      cfg.Section("gotradingbot").Key("product_code").String(),
-		Durations:        durations,
-		TradeDuration:    durations[cfg.Section("gotradingbot").Key("trade_duration").String()],
-		DbName:           cfg.Section("db").Key("name").String(),
-		SQLDriver:        cfg.Section("db").Key("driver").String(),
-		Port:             cfg.Section("web").Key("port").MustInt(),
-		BackTest:         cfg.Section("gotradingbot").Key("back_test").MustBool(),
-		UsePercent:       cfg.Section("gotradingbot").Key("use_percent").MustFloat64(),
-		DataLimit:        cfg.Section("gotradingbot").Key("data_limit").MustInt(),
-		StopLimitPercent: cfg.Section("gotradingbot").Key("stop_limit_percent").MustFloat64(),
-		NumRanking:       cfg.Section("gotradingbot").Key("num_ranking").MustInt(),
+		ApiKey:                  cfg.Section("bitflyer").Key("api_key").String(),
+		ApiSecret:               cfg.Section("bitflyer").Key("api_secret").String(),
+		BaseURL:                 cfg.Section("bitflyer").Key("base_url").String(),
+		WsURL:                   cfg.Section("bitflyer").Key("ws_url").String(),
+		LogFile:                 cfg.Section("gotradingbot").Key("log_file").String(),
+		ProductCode:             productCodes[0],
+		Products:                products,
+		Durations:               durations,
+		CandleSource:            cfg.Section("gotradingbot").Key("candle_source").In("executions", []string{"executions", "ticker"}),
+		TradeDuration:           durations[cfg.Section("gotradingbot").Key("trade_duration").String()],
+		DbName:                  cfg.Section("db").Key("name").String(),
+		SQLDriver:               cfg.Section("db").Key("driver").String(),
+		FlushInterval:           cfg.Section("db").Key("flush_interval").MustDuration(time.Second),
+		BackfillInterval:        cfg.Section("backfill").Key("request_interval").MustDuration(600 * time.Millisecond),
+		BackfillMinGap:          cfg.Section("backfill").Key("min_gap").MustDuration(5 * time.Minute),
+		Port:                    cfg.Section("web").Key("port").MustInt(),
+		WebToken:                cfg.Section("web").Key("token").String(),
+		BackTest:                cfg.Section("gotradingbot").Key("back_test").MustBool(),
+		UsePercent:              cfg.Section("gotradingbot").Key("use_percent").MustFloat64(),
+		DataLimit:               cfg.Section("gotradingbot").Key("data_limit").MustInt(),
+		StopLimitPercent:        cfg.Section("gotradingbot").Key("stop_limit_percent").MustFloat64(),
+		NumRanking:              cfg.Section("gotradingbot").Key("num_ranking").MustInt(),
+		MinBuyVolume:            cfg.Section("gotradingbot").Key("min_buy_volume").MustFloat64(),
+		SignalQuorum:            cfg.Section("signals").Key("quorum").MustFloat64(2),
+		SignalWeighting:         cfg.Section("signals").Key("weighting").In("equal", []string{"equal", "performance"}),
+		SignalRequired:          cfg.Section("signals").Key("required").Strings(","),
+		SignalVetoes:            cfg.Section("signals").Key("veto").Strings(","),
+		SignalWindow:            cfg.Section("signals").Key("window").MustInt(1),
+		BacktestCash:            cfg.Section("backtest").Key("initial_cash").MustFloat64(1000000),
+		BacktestFeePercent:      cfg.Section("backtest").Key("fee_percent").MustFloat64(0.15),
+		BacktestSlippagePercent: cfg.Section("backtest").Key("slippage_percent").MustFloat64(),
+		BacktestFill:            cfg.Section("backtest").Key("fill").In("next_open", []string{"next_open", "close"}),
+		BacktestSwapPercent:     cfg.Section("backtest").Key("swap_percent").MustFloat64(0.04),
+		BacktestObjective:       cfg.Section("backtest").Key("objective").In("profit", metrics.Objectives),
+		WalkForward:             cfg.Section("walkforward").Key("enable").MustBool(),
+		WalkForwardInSample:     cfg.Section("walkforward").Key("in_sample").MustInt(200),
+		WalkForwardOutOfSample:  cfg.Section("walkforward").Key("out_of_sample").MustInt(50),
+		WalkForwardStep:         cfg.Section("walkforward").Key("step").MustInt(),
+		WalkForwardMinScore:     cfg.Section("walkforward").Key("min_score").MustFloat64(),
+		OptimizerWorkers:        cfg.Section("optimizer").Key("workers").MustInt(),
+		OptimizerMethod:         cfg.Section("optimizer").Key("method").In("grid", []string{"grid", "random", "tpe", "genetic"}),
+		OptimizerBudget:         cfg.Section("optimizer").Key("budget").MustInt(200),
+		OptimizerSeed:           cfg.Section("optimizer").Key("seed").MustInt64(),
+		OptimizerResume:         cfg.Section("optimizer").Key("resume").MustBool(),
+		StrategyRanges:          strategyRanges,
+		SizingMode:              cfg.Section("sizing").Key("mode").In(sizing.FixedFraction, sizing.Modes),
+		SizingNotional:          cfg.Section("sizing").Key("notional").MustFloat64(),
+		SizingKellyFraction:     cfg.Section("sizing").Key("kelly_fraction").MustFloat64(0.5),
+		SizingKellyMinTrades:    cfg.Section("sizing").Key("kelly_min_trades").MustInt(20),
+		SizingTargetVolatility:  cfg.Section("sizing").Key("target_volatility").MustFloat64(0.5),
+		SizingVolatility:        cfg.Section("sizing").Key("volatility").In("atr", []string{"atr", "hv"}),
+		SizingVolatilityPeriod:  cfg.Section("sizing").Key("volatility_period").MustInt(14),
+		SizingRiskPercent:       cfg.Section("sizing").Key("risk_percent").MustFloat64(1),
+		RiskStopLossPercent:     cfg.Section("risk").Key("stop_loss_percent").MustFloat64(),
+		RiskStopLossATR:         cfg.Section("risk").Key("stop_loss_atr").MustFloat64(),
+		RiskTakeProfitPercent:   cfg.Section("risk").Key("take_profit_percent").MustFloat64(),
+		RiskTakeProfitATR:       cfg.Section("risk").Key("take_profit_atr").MustFloat64(),
+		RiskTrailingStopPercent: cfg.Section("risk").Key("trailing_stop_percent").MustFloat64(),
+		RiskTrailingStopATR:     cfg.Section("risk").Key("trailing_stop_atr").MustFloat64(),
+		RiskATRPeriod:           cfg.Section("risk").Key("atr_period").MustInt(14),
+		RiskMaxHolding:          cfg.Section("risk").Key("max_holding").MustDuration(),
+		RiskExchangeOrders:      cfg.Section("risk").Key("exchange_orders").In("none", []string{"none", "oco"}),
+		LimitOrderNotional:      cfg.Section("limits").Key("max_order_notional").MustFloat64(),
+		LimitDailyDrawdown:      cfg.Section("limits").Key("max_daily_drawdown_percent").MustFloat64(),
+		LimitWeeklyDrawdown:     cfg.Section("limits").Key("max_weekly_drawdown_percent").MustFloat64(),
+		LimitConsecutiveLosses:  cfg.Section("limits").Key("max_consecutive_losses").MustInt(),
+		LimitOrdersPerMinute:    cfg.Section("limits").Key("max_orders_per_minute").MustInt(),
+		LimitOrdersPerHour:      cfg.Section("limits").Key("max_orders_per_hour").MustInt(),
+		ReconcileCancelOrders:   cfg.Section("reconcile").Key("cancel_open_orders").MustBool(true),
+		OrderType:               cfg.Section("order").Key("type").In("MARKET", []string{"MARKET", "LIMIT"}),
+		OrderInsideSpread:       cfg.Section("order").Key("inside_spread").MustFloat64(),
+		OrderRepriceInterval:    positiveDuration(cfg.Section("order").Key("reprice_interval"), 5*time.Second),
+		OrderMaxSlippagePercent: cfg.Section("order").Key("max_slippage_percent").MustFloat64(0.1),
+		OrderTimeout:            positiveDuration(cfg.Section("order").Key("timeout"), time.Minute),
+		OrderMarketFallback:     cfg.Section("order").Key("market_fallback").MustBool(true),
+		PaperTrade:              cfg.Section("paper").Key("enable").MustBool(),
+		PaperCurrency:           cfg.Section("paper").Key("currency_balance").MustFloat64(1000000),
+		PaperCoin:               cfg.Section("paper").Key("coin_balance").MustFloat64(),
+		PaperFeePercent:         cfg.Section("paper").Key("fee_percent").MustFloat64(0.15),
+		PaperCollateral:         cfg.Section("paper").Key("collateral").MustFloat64(1000000),
+	}
+}
+
+// positiveDuration is the duration of key, like In it falls back to defaultValue when the value is not valid,
+// here when it is not above 0
+func positiveDuration(key *ini.Key, defaultValue time.Duration) time.Duration {
+	value := key.MustDuration(defaultValue)
+	if value <= 0 {
+		log.Printf("Invalid %s = %q, expected a duration above 0, using %s", key.Name(), key.String(), defaultValue)
+		return defaultValue
 	}
+	return value
 }
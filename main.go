@@ -1,19 +1,461 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"go-trading-bot/app/controllers"
 	"go-trading-bot/app/models"
+	"go-trading-bot/bitflyer"
 	"go-trading-bot/config"
 	"go-trading-bot/utils"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
-	df, _ := models.GetAllCandle(config.Config.ProductCode, time.Minute, 365)
-	fmt.Printf("%+v\n", df.OptimizeParams())
 	utils.LoggingSettings(config.Config.LogFile)
-	controllers.StreamIngestionData()
-	log.Println(controllers.StartWebServer())
+	// stop cleanly on Ctrl-C / SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// the strategies are only known once models registered them
+	if err := models.CheckStrategyRanges(config.Config.StrategyRanges); err != nil {
+		log.Fatalln(err)
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	ingestionDone := controllers.StreamIngestionData(ctx)
+	go func() {
+		log.Println(controllers.StartWebServer())
+		stop()
+	}()
+	<-ctx.Done()
+	// wait until the open candles are written before exiting
+	<-ingestionDone
+}
+
+// runCommand runs a subcommand instead of the bot, e.g. `go run main.go backfill -days 30`
+func runCommand(ctx context.Context, name string, args []string) error {
+	switch name {
+	case "backfill":
+		return backfillCommand(ctx, args)
+	case "export":
+		return exportCommand(args)
+	case "import":
+		return importCommand(args)
+	case "backtest":
+		return backtestCommand(ctx, args)
+	case "walkforward":
+		return walkForwardCommand(ctx, args)
+	case "optimizations":
+		return optimizationsCommand(args)
+	}
+	return fmt.Errorf("unknown command %s", name)
+}
+
+func backfillCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	productCode := flags.String("product_code", config.Config.ProductCode, "product to backfill")
+	days := flags.Int("days", 30, "how many days of history to fill")
+	gaps := flags.Bool("gaps", false, "only detect and fill gaps in the existing candles")
+	duration := flags.String("duration", "1m", "candle table checked for gaps")
+	minGap := flags.Duration("min_gap", config.Config.BackfillMinGap, "shortest run of missing candles taken for a gap")
+	flags.Parse(args)
+
+	c := config.Config
+	history := bitflyer.NewWithURL(c.ApiKey, c.ApiSecret, c.BaseURL, c.WsURL)
+	since := time.Now().AddDate(0, 0, -*days)
+	if *gaps {
+		gapDuration, ok := c.Durations[*duration]
+		if !ok {
+			return fmt.Errorf("unknown duration %s", *duration)
+		}
+		return controllers.FillCandleGaps(ctx, history, *productCode, gapDuration, *minGap, since, time.Now())
+	}
+	return controllers.Backfill(ctx, history, *productCode, since)
+}
+
+// csvFlags are the flags describing a CSV layout, shared by import and export
+type csvFlags struct {
+	columns    *string
+	timeLayout *string
+	timezone   *string
+}
+
+func newCSVFlags(flags *flag.FlagSet) csvFlags {
+	return csvFlags{
+		columns:    flags.String("columns", "", "CSV headers of the candle columns, e.g. time=Date,open=Open,volume=Volume BTC"),
+		timeLayout: flags.String("time_layout", time.RFC3339, "Go time layout of the time column, or unix / unixms"),
+		timezone:   flags.String("tz", "UTC", "time zone of times written without one, e.g. Asia/Tokyo"),
+	}
+}
+
+func (f csvFlags) format() (models.CSVFormat, error) {
+	format := models.DefaultCSVFormat()
+	columns, err := models.ParseCSVColumns(*f.columns)
+	if err != nil {
+		return format, err
+	}
+	location, err := time.LoadLocation(*f.timezone)
+	if err != nil {
+		return format, err
+	}
+	format.Columns = columns
+	format.TimeLayout = *f.timeLayout
+	format.Location = location
+	return format, nil
+}
+
+// parseDuration accepts a configured duration name like 1m or any Go duration like 15m
+func parseDuration(name string) (time.Duration, error) {
+	if duration, ok := config.Config.Durations[name]; ok {
+		return duration, nil
+	}
+	return time.ParseDuration(name)
+}
+
+// fileFormat returns the -format flag, or guesses it from the file extension
+func fileFormat(format, path string) string {
+	if format != "" {
+		return format
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".parquet") {
+		return "parquet"
+	}
+	return "csv"
+}
+
+// parseDate parses -from / -to given as a date or RFC3339, empty means open
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	productCode := flags.String("product_code", config.Config.ProductCode, "product to export")
+	durationName := flags.String("duration", "1m", "candle duration to export")
+	out := flags.String("out", "", "output file, .parquet files are written as Parquet")
+	format := flags.String("format", "", "csv or parquet, guessed from -out when empty")
+	fromValue := flags.String("from", "", "first candle time, 2006-01-02 or RFC3339")
+	toValue := flags.String("to", "", "candles before this time, 2006-01-02 or RFC3339")
+	csvOptions := newCSVFlags(flags)
+	flags.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+	duration, err := parseDuration(*durationName)
+	if err != nil {
+		return err
+	}
+	from, err := parseDate(*fromValue)
+	if err != nil {
+		return err
+	}
+	to, err := parseDate(*toValue)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	switch fileFormat(*format, *out) {
+	case "parquet":
+		count, err = models.ExportCandlesParquet(*out, *productCode, duration, from, to)
+	case "csv":
+		count, err = exportCSV(*out, *productCode, duration, from, to, csvOptions)
+	default:
+		return fmt.Errorf("unknown format %s", *format)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported %d candles of %s to %s\n", count, models.GetCandleTableName(*productCode, duration), *out)
+	return nil
+}
+
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	productCode := flags.String("product_code", config.Config.ProductCode, "product the candles belong to")
+	durationName := flags.String("duration", "1m", "candle duration of the file")
+	in := flags.String("in", "", "input file, .parquet files are read as Parquet")
+	format := flags.String("format", "", "csv or parquet, guessed from -in when empty")
+	onDuplicate := flags.String("on_duplicate", string(models.DuplicateError), "skip, replace or error on timestamps already imported")
+	skipInvalid := flags.Bool("skip_invalid", false, "skip rows failing OHLC validation instead of aborting")
+	csvOptions := newCSVFlags(flags)
+	flags.Parse(args)
+
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+	duration, err := parseDuration(*durationName)
+	if err != nil {
+		return err
+	}
+	options := models.ImportOptions{OnDuplicate: models.DuplicatePolicy(*onDuplicate), SkipInvalid: *skipInvalid}
+	switch options.OnDuplicate {
+	case models.DuplicateSkip, models.DuplicateReplace, models.DuplicateError:
+	default:
+		return fmt.Errorf("unknown -on_duplicate %s", *onDuplicate)
+	}
+
+	var result *models.ImportResult
+	switch fileFormat(*format, *in) {
+	case "parquet":
+		result, err = models.ImportCandlesParquet(*in, *productCode, duration, options)
+	case "csv":
+		result, err = importCSV(*in, *productCode, duration, csvOptions, options)
+	default:
+		return fmt.Errorf("unknown format %s", *format)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d of %d rows into %s, duplicates=%d invalid=%d\n",
+		result.Imported, result.Rows, models.GetCandleTableName(*productCode, duration), result.Duplicates, result.Invalid)
+	return nil
+}
+
+func exportCSV(path string, productCode string, duration time.Duration, from, to time.Time, csvOptions csvFlags) (int, error) {
+	format, err := csvOptions.format()
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	count, err := models.ExportCandlesCSV(file, productCode, duration, from, to, format)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return count, err
+}
+
+func importCSV(path string, productCode string, duration time.Duration, csvOptions csvFlags, options models.ImportOptions) (*models.ImportResult, error) {
+	format, err := csvOptions.format()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return models.ImportCandlesCSV(file, productCode, duration, format, options)
+}
+
+func backtestCommand(ctx context.Context, args []string) error {
+	c := config.Config
+	flags := flag.NewFlagSet("backtest", flag.ExitOnError)
+	productCode := flags.String("product_code", c.ProductCode, "product to backtest")
+	durationName := flags.String("duration", "", "candle duration, the product's trade_duration when empty")
+	limit := flags.Int("limit", c.DataLimit, "how many of the latest candles to replay")
+	strategyName := flags.String("strategy", "", "backtest one strategy with its optimized parameters, all enabled strategies combined when empty")
+	fill := flags.String("fill", c.BacktestFill, "close or next_open")
+	ledgerPath := flags.String("ledger", "", "write the trade ledger as CSV to this file")
+	equityPath := flags.String("equity", "", "write the equity curve as CSV to this file")
+	flags.Parse(args)
+
+	product, ok := c.Product(*productCode)
+	if !ok {
+		product = config.ProductConfig{ProductCode: *productCode, TradeDuration: c.TradeDuration}
+	}
+	duration := product.TradeDuration
+	if *durationName != "" {
+		var err error
+		if duration, err = parseDuration(*durationName); err != nil {
+			return err
+		}
+	}
+	df, err := models.GetAllCandle(*productCode, duration, *limit)
+	if err != nil {
+		return err
+	}
+	cfg := models.DefaultBacktestConfig(*productCode)
+	cfg.Fill = *fill
+
+	var result *models.BacktestResult
+	if *strategyName != "" {
+		strategy, ok := models.GetStrategy(*strategyName)
+		if !ok {
+			return fmt.Errorf("unknown strategy %s", *strategyName)
+		}
+		_, params, err := df.Optimize(ctx, strategy)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("strategy=%s params=%v\n", strategy.Name(), params)
+		result = df.BackTest(strategy, params, cfg)
+	} else {
+		tradeParams, err := df.OptimizeParams(ctx)
+		if err != nil {
+			return err
+		}
+		if tradeParams == nil {
+			return fmt.Errorf("no strategy is profitable on %d candles of %s", len(df.Candles), models.GetCandleTableName(*productCode, duration))
+		}
+		for _, enabled := range tradeParams.Enabled() {
+			fmt.Printf("strategy=%s params=%v performance=%f\n", enabled.Name, enabled.Params, enabled.Performance)
+		}
+		combiner, err := models.NewSignalCombinerFromConfig()
+		if err != nil {
+			return err
+		}
+		result = df.BackTestCombined(tradeParams, combiner, cfg)
+	}
+	if result == nil {
+		return fmt.Errorf("not enough candles: %d", len(df.Candles))
+	}
+	report := result.Report()
+	fmt.Printf("candles=%d fills=%d initial=%f final=%f\n", len(df.Candles), len(result.Trades), result.InitialEquity, result.FinalEquity)
+	fmt.Printf("return=%.2f%% cagr=%.2f%% sharpe=%.2f sortino=%.2f calmar=%.2f\n",
+		report.TotalReturn*100, report.CAGR*100, report.Sharpe, report.Sortino, report.Calmar)
+	fmt.Printf("max_drawdown=%.2f%% max_drawdown_duration=%s exposure=%.2f%%\n",
+		report.MaxDrawdown*100, report.MaxDrawdownDuration, report.Exposure*100)
+	fmt.Printf("trades=%d win_rate=%.2f%% profit_factor=%.2f average_win=%f average_loss=%f\n",
+		report.Trades, report.WinRate*100, report.ProfitFactor, report.AverageWin, report.AverageLoss)
+
+	if *ledgerPath != "" {
+		if err := writeFile(*ledgerPath, result.WriteLedgerCSV); err != nil {
+			return err
+		}
+	}
+	if *equityPath != "" {
+		if err := writeFile(*equityPath, result.WriteEquityCSV); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkForwardCommand(ctx context.Context, args []string) error {
+	c := config.Config
+	wf := models.DefaultWalkForwardConfig(c.ProductCode)
+	flags := flag.NewFlagSet("walkforward", flag.ExitOnError)
+	productCode := flags.String("product_code", c.ProductCode, "product to walk forward")
+	durationName := flags.String("duration", "", "candle duration, the product's trade_duration when empty")
+	limit := flags.Int("limit", c.DataLimit, "how many of the latest candles to use")
+	flags.IntVar(&wf.InSample, "in_sample", wf.InSample, "candles each optimization sees")
+	flags.IntVar(&wf.OutOfSample, "out_of_sample", wf.OutOfSample, "candles the parameters are tested on")
+	flags.IntVar(&wf.Step, "step", wf.Step, "candles the windows move by")
+	flags.Parse(args)
+	wf.Optimizer = models.NewOptimizerFromConfig(*productCode)
+
+	product, ok := c.Product(*productCode)
+	if !ok {
+		product = config.ProductConfig{ProductCode: *productCode, TradeDuration: c.TradeDuration}
+	}
+	duration := product.TradeDuration
+	if *durationName != "" {
+		var err error
+		if duration, err = parseDuration(*durationName); err != nil {
+			return err
+		}
+	}
+	df, err := models.GetAllCandle(*productCode, duration, *limit)
+	if err != nil {
+		return err
+	}
+	combiner, err := models.NewSignalCombinerFromConfig()
+	if err != nil {
+		return err
+	}
+	result, err := df.WalkForward(ctx, wf, combiner)
+	if err != nil {
+		return err
+	}
+	for _, window := range result.Windows {
+		var enabled []string
+		if window.Params != nil {
+			for _, strategy := range window.Params.Enabled() {
+				enabled = append(enabled, fmt.Sprintf("%s%v", strategy.Name, strategy.Params))
+			}
+		}
+		fmt.Printf("in_sample=%s out_of_sample=%s..%s return=%.2f%% trades=%d passed=%t strategies=%v\n",
+			window.InSampleStart.Format(time.RFC3339), window.OutSampleStart.Format(time.RFC3339), window.OutSampleEnd.Format(time.RFC3339),
+			window.Report.TotalReturn*100, window.Report.Trades, window.Passed, enabled)
+	}
+	fmt.Printf("out_of_sample return=%.2f%% sharpe=%.2f max_drawdown=%.2f%% %s=%f passed=%t\n",
+		result.Report.TotalReturn*100, result.Report.Sharpe, result.Report.MaxDrawdown*100, wf.Optimizer.Objective, result.Score, result.Passed)
+	return nil
+}
+
+func optimizationsCommand(args []string) error {
+	c := config.Config
+	flags := flag.NewFlagSet("optimizations", flag.ExitOnError)
+	productCode := flags.String("product_code", c.ProductCode, "product whose optimization runs are listed")
+	durationName := flags.String("duration", "", "candle duration, the product's trade_duration when empty")
+	limit := flags.Int("limit", 10, "how many of the latest runs to list")
+	runID := flags.Int64("run", 0, "list the candidates of this run instead")
+	flags.Parse(args)
+
+	if *runID != 0 {
+		candidates, err := models.GetOptimizationCandidates(*runID)
+		if err != nil {
+			return err
+		}
+		for _, candidate := range candidates {
+			fmt.Printf("strategy=%s params=%v score=%f profitable=%t data=%s..%s\n", candidate.Strategy, candidate.Params, candidate.Score,
+				candidate.Profitable, candidate.DataFrom.Format(time.RFC3339), candidate.DataTo.Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	product, ok := c.Product(*productCode)
+	if !ok {
+		product = config.ProductConfig{ProductCode: *productCode, TradeDuration: c.TradeDuration}
+	}
+	duration := product.TradeDuration
+	if *durationName != "" {
+		var err error
+		if duration, err = parseDuration(*durationName); err != nil {
+			return err
+		}
+	}
+	runs, err := models.GetOptimizationRuns(*productCode, duration, *limit)
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		var enabled []string
+		if run.Params != nil {
+			for _, strategy := range run.Params.Enabled() {
+				enabled = append(enabled, fmt.Sprintf("%s%v", strategy.Name, strategy.Params))
+			}
+		}
+		fmt.Printf("run=%d finished_at=%s data=%s..%s candles=%d method=%s objective=%s accepted=%t strategies=%v %s\n",
+			run.ID, run.FinishedAt.Format(time.RFC3339), run.DataFrom.Format(time.RFC3339), run.DataTo.Format(time.RFC3339),
+			run.Candles, run.Method, run.Objective, run.Accepted, enabled, run.Reason)
+	}
+	return nil
+}
+
+// writeFile creates path and writes it with write
+func writeFile(path string, write func(io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
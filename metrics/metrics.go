@@ -0,0 +1,223 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const year = 365 * 24 * time.Hour
+
+// MaxProfitFactor is the profit factor of a run without losing trades, instead of +Inf
+const MaxProfitFactor = 100
+
+// MaxCalmar is the Calmar ratio of a growing run without drawdown, MaxSortino the Sortino ratio of
+// a growing run without a losing candle, instead of +Inf; both ratios are capped at them
+const (
+	MaxCalmar  = 100
+	MaxSortino = 100
+)
+
+// objectives the optimizer can rank by, every one of them is higher is better
+const (
+	ObjectiveProfit       = "profit"
+	ObjectiveReturn       = "return"
+	ObjectiveCAGR         = "cagr"
+	ObjectiveSharpe       = "sharpe"
+	ObjectiveSortino      = "sortino"
+	ObjectiveCalmar       = "calmar"
+	ObjectiveWinRate      = "win_rate"
+	ObjectiveProfitFactor = "profit_factor"
+)
+
+// Objectives lists every objective Report.Score accepts
+var Objectives = []string{
+	ObjectiveProfit, ObjectiveReturn, ObjectiveCAGR, ObjectiveSharpe,
+	ObjectiveSortino, ObjectiveCalmar, ObjectiveWinRate, ObjectiveProfitFactor,
+}
+
+// Point is the value of the account at one candle
+type Point struct {
+	Time    time.Time
+	Equity  float64
+	Exposed bool // a position was open at this candle
+}
+
+// Report is the performance of a trading run
+type Report struct {
+	Profit              float64       `json:"profit"`
+	TotalReturn         float64       `json:"total_return"` // 0.05 => +5%
+	CAGR                float64       `json:"cagr"`
+	Sharpe              float64       `json:"sharpe"`       // annualized, risk free rate 0
+	Sortino             float64       `json:"sortino"`      // MaxSortino when no candle lost
+	MaxDrawdown         float64       `json:"max_drawdown"` // 0.1 => the equity fell 10% from a peak
+	MaxDrawdownDuration time.Duration `json:"max_drawdown_duration"`
+	Calmar              float64       `json:"calmar"` // MaxCalmar when the equity never fell
+	WinRate             float64       `json:"win_rate"`
+	ProfitFactor        float64       `json:"profit_factor"` // MaxProfitFactor when no trade lost
+	AverageWin          float64       `json:"average_win"`
+	AverageLoss         float64       `json:"average_loss"` // negative
+	Exposure            float64       `json:"exposure"`     // share of the candles a position was open
+	Trades              int           `json:"trades"`
+}
+
+// Compute returns the report of an equity curve, one point per candle in time order,
+// and the realized profit of every closed trade
+func Compute(curve []Point, tradeProfits []float64) Report {
+	report := Report{Trades: len(tradeProfits)}
+	report.WinRate, report.ProfitFactor, report.AverageWin, report.AverageLoss = tradeStats(tradeProfits)
+	if len(curve) == 0 {
+		return report
+	}
+
+	first, last := curve[0], curve[len(curve)-1]
+	report.Profit = last.Equity - first.Equity
+	if first.Equity > 0 {
+		report.TotalReturn = report.Profit / first.Equity
+	}
+	span := last.Time.Sub(first.Time)
+	if span > 0 && first.Equity > 0 && last.Equity > 0 {
+		report.CAGR = math.Pow(last.Equity/first.Equity, float64(year)/float64(span)) - 1
+	}
+
+	exposed := 0
+	for _, point := range curve {
+		if point.Exposed {
+			exposed++
+		}
+	}
+	report.Exposure = float64(exposed) / float64(len(curve))
+
+	report.MaxDrawdown, report.MaxDrawdownDuration = drawdown(curve)
+	switch {
+	case report.MaxDrawdown > 0:
+		report.Calmar = math.Min(report.CAGR/report.MaxDrawdown, MaxCalmar)
+	case report.CAGR > 0:
+		report.Calmar = MaxCalmar
+	}
+	report.Sharpe, report.Sortino = riskAdjusted(curve)
+	return report
+}
+
+// Score returns the value of objective, higher is better
+func (r Report) Score(objective string) (float64, error) {
+	switch objective {
+	case ObjectiveProfit:
+		return r.Profit, nil
+	case ObjectiveReturn:
+		return r.TotalReturn, nil
+	case ObjectiveCAGR:
+		return r.CAGR, nil
+	case ObjectiveSharpe:
+		return r.Sharpe, nil
+	case ObjectiveSortino:
+		return r.Sortino, nil
+	case ObjectiveCalmar:
+		return r.Calmar, nil
+	case ObjectiveWinRate:
+		return r.WinRate, nil
+	case ObjectiveProfitFactor:
+		return r.ProfitFactor, nil
+	}
+	return 0, fmt.Errorf("unknown objective %q, expected one of %v", objective, Objectives)
+}
+
+// tradeStats returns the win rate, profit factor and average win and loss of the closed trades
+func tradeStats(profits []float64) (winRate, profitFactor, averageWin, averageLoss float64) {
+	wins, losses := 0, 0
+	grossWin, grossLoss := 0.0, 0.0
+	for _, profit := range profits {
+		switch {
+		case profit > 0:
+			wins++
+			grossWin += profit
+		case profit < 0:
+			losses++
+			grossLoss -= profit
+		}
+	}
+	if len(profits) > 0 {
+		winRate = float64(wins) / float64(len(profits))
+	}
+	if wins > 0 {
+		averageWin = grossWin / float64(wins)
+	}
+	if losses > 0 {
+		averageLoss = -grossLoss / float64(losses)
+	}
+	switch {
+	case grossLoss > 0:
+		profitFactor = math.Min(grossWin/grossLoss, MaxProfitFactor)
+	case grossWin > 0:
+		profitFactor = MaxProfitFactor
+	}
+	return winRate, profitFactor, averageWin, averageLoss
+}
+
+// drawdown returns the deepest fall from a peak as a ratio of the peak and the longest time below a peak
+func drawdown(curve []Point) (maxDrawdown float64, maxDuration time.Duration) {
+	peak, peakTime := curve[0].Equity, curve[0].Time
+	for _, point := range curve {
+		if point.Equity >= peak {
+			peak, peakTime = point.Equity, point.Time
+			continue
+		}
+		if peak > 0 {
+			maxDrawdown = math.Max(maxDrawdown, (peak-point.Equity)/peak)
+		}
+		if duration := point.Time.Sub(peakTime); duration > maxDuration {
+			maxDuration = duration
+		}
+	}
+	return maxDrawdown, maxDuration
+}
+
+// riskAdjusted returns the Sharpe and Sortino ratios of the returns between points,
+// annualized by the typical spacing of the points
+func riskAdjusted(curve []Point) (sharpe, sortino float64) {
+	if len(curve) < 3 {
+		return 0, 0
+	}
+	returns := make([]float64, 0, len(curve)-1)
+	spacings := make([]float64, 0, len(curve)-1)
+	for i := 1; i < len(curve); i++ {
+		if curve[i-1].Equity <= 0 {
+			continue
+		}
+		returns = append(returns, curve[i].Equity/curve[i-1].Equity-1)
+		spacings = append(spacings, float64(curve[i].Time.Sub(curve[i-1].Time)))
+	}
+	if len(returns) < 2 {
+		return 0, 0
+	}
+	sort.Float64s(spacings)
+	spacing := spacings[len(spacings)/2]
+	if spacing <= 0 {
+		return 0, 0
+	}
+	annualize := math.Sqrt(float64(year) / spacing)
+
+	mean := 0.0
+	for _, r := range returns {
+		mean += r
+	}
+	mean /= float64(len(returns))
+	variance, downside := 0.0, 0.0
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+		if r < 0 {
+			downside += r * r
+		}
+	}
+	if std := math.Sqrt(variance / float64(len(returns)-1)); std > 0 {
+		sharpe = mean / std * annualize
+	}
+	switch downsideDeviation := math.Sqrt(downside / float64(len(returns))); {
+	case downsideDeviation > 0:
+		sortino = math.Min(mean/downsideDeviation*annualize, MaxSortino)
+	case mean > 0:
+		sortino = MaxSortino
+	}
+	return sharpe, sortino
+}
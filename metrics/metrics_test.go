@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// testCurve is one point a day for every equity
+func testCurve(equities ...float64) []Point {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	curve := make([]Point, len(equities))
+	for i, equity := range equities {
+		curve[i] = Point{Time: start.Add(time.Duration(i) * 24 * time.Hour), Equity: equity, Exposed: i%2 == 1}
+	}
+	return curve
+}
+
+func TestCompute(t *testing.T) {
+	report := Compute(testCurve(100, 110, 99, 121), []float64{10, -11, 22})
+	if math.Abs(report.Profit-21) > 1e-9 || math.Abs(report.TotalReturn-0.21) > 1e-9 {
+		t.Errorf("Profit, TotalReturn = %v, %v, want 21, 0.21", report.Profit, report.TotalReturn)
+	}
+	if math.Abs(report.MaxDrawdown-0.1) > 1e-9 || report.MaxDrawdownDuration != 24*time.Hour {
+		t.Errorf("MaxDrawdown = %v for %s, want 0.1 for a day", report.MaxDrawdown, report.MaxDrawdownDuration)
+	}
+	if report.Trades != 3 || math.Abs(report.WinRate-2.0/3) > 1e-9 || math.Abs(report.ProfitFactor-32.0/11) > 1e-9 {
+		t.Errorf("Trades, WinRate, ProfitFactor = %d, %v, %v, want 3, 2/3, 32/11", report.Trades, report.WinRate, report.ProfitFactor)
+	}
+	if report.AverageWin != 16 || report.AverageLoss != -11 || report.Exposure != 0.5 {
+		t.Errorf("AverageWin, AverageLoss, Exposure = %v, %v, %v, want 16, -11, 0.5", report.AverageWin, report.AverageLoss, report.Exposure)
+	}
+	if report.Calmar <= 0 || report.Sortino <= 0 || report.Sharpe <= 0 {
+		t.Errorf("Calmar, Sortino, Sharpe = %v, %v, %v, want them positive", report.Calmar, report.Sortino, report.Sharpe)
+	}
+}
+
+func TestComputeCaps(t *testing.T) {
+	tests := []struct {
+		name         string
+		curve        []Point
+		profits      []float64
+		calmar       float64
+		sortino      float64
+		profitFactor float64
+	}{
+		{
+			name:         "growing without a loss",
+			curve:        testCurve(100, 101, 103, 106),
+			profits:      []float64{1, 2, 3},
+			calmar:       MaxCalmar,
+			sortino:      MaxSortino,
+			profitFactor: MaxProfitFactor,
+		},
+		{
+			name:  "flat",
+			curve: testCurve(100, 100, 100, 100),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := Compute(tt.curve, tt.profits)
+			if report.Calmar != tt.calmar || report.Sortino != tt.sortino || report.ProfitFactor != tt.profitFactor {
+				t.Errorf("Calmar, Sortino, ProfitFactor = %v, %v, %v, want %v, %v, %v",
+					report.Calmar, report.Sortino, report.ProfitFactor, tt.calmar, tt.sortino, tt.profitFactor)
+			}
+		})
+	}
+}
+
+func TestScore(t *testing.T) {
+	report := Report{Profit: 1, Calmar: 2}
+	if score, err := report.Score(ObjectiveCalmar); err != nil || score != 2 {
+		t.Errorf("Score(calmar) = %v, %v, want 2", score, err)
+	}
+	if _, err := report.Score("unknown"); err == nil {
+		t.Error("Score(unknown) err = nil, want an error")
+	}
+}
@@ -0,0 +1,473 @@
+package papertrade
+
+import (
+	"context"
+	"fmt"
+	"go-trading-bot/bitflyer"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// child order states as bitFlyer reports them
+const (
+	StateActive    = "ACTIVE"
+	StateCompleted = "COMPLETED"
+	StateCanceled  = "CANCELED"
+	StateExpired   = "EXPIRED"
+	StateRejected  = "REJECTED"
+)
+
+// MarketData is where the simulator gets real prices from, usually bitflyer.APIClient
+type MarketData interface {
+	GetTicker(productCode string) (*bitflyer.Ticker, error)
+	GetRealTimeTicker(ctx context.Context, symbol string, ch chan<- bitflyer.Ticker)
+	GetRealTimeExecutions(ctx context.Context, symbol string, ch chan<- []bitflyer.Execution)
+	GetRealTimeBoard(ctx context.Context, symbol string, ch chan<- bitflyer.Board)
+	ConnectionEvents() <-chan bitflyer.ConnectionEvent
+}
+
+// Exchange is a local simulated exchange: it keeps virtual balances, accepts
+// bitflyer.Order values and fills MARKET orders against the live best bid/ask,
+// LIMIT orders once the best bid/ask reaches their price
+// margin products such as FX_BTC_JPY trade against a virtual collateral instead of the balances
+type Exchange struct {
+	market     MarketData
+	feePercent float64
+	// FillDelay is how long an order stays ACTIVE before it can be filled,
+	// so callers polling ListOrder see the same transitions as on bitFlyer
+	FillDelay time.Duration
+	// Leverage is how many times the collateral the margin positions may be worth, 2 like bitFlyer
+	Leverage float64
+
+	mu         sync.Mutex
+	balances   map[string]float64
+	collateral float64
+	positions  map[string]position // net margin position by product code
+	tickers    map[string]bitflyer.Ticker
+	orders     []*bitflyer.Order
+	accepted   map[string]time.Time
+	seq        int
+}
+
+// position is the net margin position of a product
+type position struct {
+	size     float64 // negative when short
+	price    float64 // average price
+	openDate time.Time
+}
+
+// New creates a simulator with starting balances such as {"JPY": 1000000, "BTC": 0}
+// feePercent is charged on every fill in percent, e.g. 0.15 => 0.15%
+func New(market MarketData, balances map[string]float64, feePercent float64) *Exchange {
+	initial := make(map[string]float64, len(balances))
+	for code, amount := range balances {
+		initial[code] = amount
+	}
+	return &Exchange{
+		market:     market,
+		feePercent: feePercent,
+		FillDelay:  time.Second,
+		Leverage:   2,
+		balances:   initial,
+		positions:  map[string]position{},
+		tickers:    map[string]bitflyer.Ticker{},
+		accepted:   map[string]time.Time{},
+	}
+}
+
+// GetBalance returns the virtual balances, everything is available since orders fill immediately
+func (e *Exchange) GetBalance() ([]bitflyer.Balance, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	balances := make([]bitflyer.Balance, 0, len(e.balances))
+	for code, amount := range e.balances {
+		balances = append(balances, bitflyer.Balance{CurrentCode: code, Amount: amount, Available: amount})
+	}
+	return balances, nil
+}
+
+// SetCollateral sets the collateral the margin products trade against
+func (e *Exchange) SetCollateral(amount float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.collateral = amount
+}
+
+// GetCollateral values the margin account at the latest mid prices
+func (e *Exchange) GetCollateral() (*bitflyer.Collateral, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	collateral := &bitflyer.Collateral{Collateral: e.collateral}
+	for productCode, p := range e.positions {
+		collateral.OpenPositionPnl += e.pnl(productCode, p)
+		collateral.RequireCollateral += e.requireCollateral(p)
+	}
+	if collateral.RequireCollateral > 0 {
+		collateral.KeepRate = (collateral.Collateral + collateral.OpenPositionPnl) / collateral.RequireCollateral
+	}
+	return collateral, nil
+}
+
+// GetPositions returns the net margin position of productCode, none when it is flat
+func (e *Exchange) GetPositions(productCode string) ([]bitflyer.Position, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p, ok := e.positions[productCode]
+	if !ok {
+		return []bitflyer.Position{}, nil
+	}
+	side := "BUY"
+	if p.size < 0 {
+		side = "SELL"
+	}
+	return []bitflyer.Position{{
+		ProductCode:       productCode,
+		Side:              side,
+		Price:             p.price,
+		Size:              math.Abs(p.size),
+		RequireCollateral: e.requireCollateral(p),
+		OpenDate:          p.openDate.UTC().Format("2006-01-02T15:04:05.000"),
+		Leverage:          e.Leverage,
+		Pnl:               e.pnl(productCode, p),
+	}}, nil
+}
+
+// pnl is the open profit of p at the latest mid price of productCode, caller must hold mu
+func (e *Exchange) pnl(productCode string, p position) float64 {
+	ticker, ok := e.tickers[productCode]
+	if !ok {
+		return 0
+	}
+	return p.size * (ticker.GetMidPrice() - p.price)
+}
+
+// requireCollateral is the collateral p ties up, caller must hold mu
+func (e *Exchange) requireCollateral(p position) float64 {
+	if e.Leverage <= 0 {
+		return math.Abs(p.size) * p.price
+	}
+	return math.Abs(p.size) * p.price / e.Leverage
+}
+
+// GetTicker asks the real market and remembers the answer as the latest price
+func (e *Exchange) GetTicker(productCode string) (*bitflyer.Ticker, error) {
+	ticker, err := e.market.GetTicker(productCode)
+	if err != nil {
+		return nil, err
+	}
+	e.onTicker(*ticker)
+	return ticker, nil
+}
+
+// GetRealTimeTicker forwards the real ticker stream and matches pending orders on every tick
+func (e *Exchange) GetRealTimeTicker(ctx context.Context, symbol string, ch chan<- bitflyer.Ticker) {
+	upstream := make(chan bitflyer.Ticker)
+	go e.market.GetRealTimeTicker(ctx, symbol, upstream)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ticker := <-upstream:
+			e.onTicker(ticker)
+			select {
+			case ch <- ticker:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// GetRealTimeExecutions passes through the real trade prints
+func (e *Exchange) GetRealTimeExecutions(ctx context.Context, symbol string, ch chan<- []bitflyer.Execution) {
+	e.market.GetRealTimeExecutions(ctx, symbol, ch)
+}
+
+// GetRealTimeBoard passes through the real order book
+func (e *Exchange) GetRealTimeBoard(ctx context.Context, symbol string, ch chan<- bitflyer.Board) {
+	e.market.GetRealTimeBoard(ctx, symbol, ch)
+}
+
+// ConnectionEvents passes through the state of the real market data connection
+func (e *Exchange) ConnectionEvents() <-chan bitflyer.ConnectionEvent {
+	return e.market.ConnectionEvents()
+}
+
+func (e *Exchange) onTicker(ticker bitflyer.Ticker) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tickers[ticker.ProductCode] = ticker
+	e.match(time.Now())
+}
+
+// SendOrder accepts the order and returns its acceptance id
+// like bitFlyer, a rejected order returns a *bitflyer.APIError
+func (e *Exchange) SendOrder(order *bitflyer.Order) (*bitflyer.ResponseSendChildOrder, error) {
+	if order.Size <= 0 || (order.Side != "BUY" && order.Side != "SELL") {
+		log.Printf("action=papertrade.SendOrder status=rejected order=%+v", order)
+		return nil, &bitflyer.APIError{StatusCode: http.StatusBadRequest, Status: -110, ErrorMessage: "The minimum order size has not been reached."}
+	}
+	if order.ChildOrderType != "MARKET" && (order.ChildOrderType != "LIMIT" || order.Price <= 0) {
+		log.Printf("action=papertrade.SendOrder status=unsupported_type order=%+v", order)
+		return nil, &bitflyer.APIError{StatusCode: http.StatusBadRequest, Status: -100, ErrorMessage: "Invalid order type or price"}
+	}
+	if _, ok := e.latestTicker(order.ProductCode); !ok {
+		if _, err := e.GetTicker(order.ProductCode); err != nil {
+			return nil, err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	e.seq++
+	id := fmt.Sprintf("JRF%s-%06d", now.UTC().Format("20060102-150405"), e.seq)
+	accepted := *order
+	accepted.ID = e.seq
+	accepted.ChildOrderAcceptanceID = id
+	accepted.ChildOrderState = StateActive
+	accepted.ChildOrderDate = now.UTC().Format("2006-01-02T15:04:05")
+	accepted.OutstandingSize = order.Size
+	e.orders = append(e.orders, &accepted)
+	e.accepted[id] = now
+	return &bitflyer.ResponseSendChildOrder{ChildOrderAcceptanceID: id}, nil
+}
+
+// ListOrder answers me/getchildorders style queries, newest order first
+// supported keys: product_code, child_order_acceptance_id, child_order_state, count
+func (e *Exchange) ListOrder(query map[string]string) ([]bitflyer.Order, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.match(time.Now())
+
+	count := len(e.orders)
+	if v, ok := query["count"]; ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			count = n
+		}
+	}
+	var orders []bitflyer.Order
+	for i := len(e.orders) - 1; i >= 0 && len(orders) < count; i-- {
+		order := e.orders[i]
+		if v, ok := query["product_code"]; ok && v != order.ProductCode {
+			continue
+		}
+		if v, ok := query["child_order_acceptance_id"]; ok && v != order.ChildOrderAcceptanceID {
+			continue
+		}
+		if v, ok := query["child_order_state"]; ok && v != order.ChildOrderState {
+			continue
+		}
+		orders = append(orders, *order)
+	}
+	return orders, nil
+}
+
+// GetMyExecutions answers me/getexecutions style queries, newest first: a paper order fills at once,
+// so every executed order is one execution with its id; Page.Count limits them, Before and After are ignored
+func (e *Exchange) GetMyExecutions(query bitflyer.ExecutionQuery) ([]bitflyer.MyExecution, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.match(time.Now())
+
+	var executions []bitflyer.MyExecution
+	for i := len(e.orders) - 1; i >= 0 && (query.Count <= 0 || len(executions) < query.Count); i-- {
+		order := e.orders[i]
+		if order.ExecutedSize <= 0 {
+			continue
+		}
+		if query.ProductCode != "" && query.ProductCode != order.ProductCode {
+			continue
+		}
+		if query.ChildOrderAcceptanceID != "" && query.ChildOrderAcceptanceID != order.ChildOrderAcceptanceID {
+			continue
+		}
+		executions = append(executions, bitflyer.MyExecution{
+			ID:                     int64(order.ID),
+			Side:                   order.Side,
+			Price:                  order.AveragePrice,
+			Size:                   order.ExecutedSize,
+			Commission:             order.TotalCommission,
+			ExecDate:               order.ChildOrderDate,
+			ChildOrderAcceptanceID: order.ChildOrderAcceptanceID,
+		})
+	}
+	return executions, nil
+}
+
+// CancelChildOrder cancels an ACTIVE order, like bitFlyer it fails for unknown or finished orders
+func (e *Exchange) CancelChildOrder(productCode, childOrderAcceptanceID string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.match(time.Now())
+	for _, order := range e.orders {
+		if order.ProductCode != productCode || order.ChildOrderAcceptanceID != childOrderAcceptanceID {
+			continue
+		}
+		if order.ChildOrderState != StateActive {
+			return fmt.Errorf("cancel %s: order is %s", childOrderAcceptanceID, order.ChildOrderState)
+		}
+		order.ChildOrderState = StateCanceled
+		order.CancelSize = order.OutstandingSize
+		order.OutstandingSize = 0
+		return nil
+	}
+	return fmt.Errorf("cancel %s: order not found", childOrderAcceptanceID)
+}
+
+func (e *Exchange) latestTicker(productCode string) (bitflyer.Ticker, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ticker, ok := e.tickers[productCode]
+	return ticker, ok
+}
+
+// match fills every ACTIVE order that has waited FillDelay and whose price the book reached,
+// caller must hold mu
+func (e *Exchange) match(now time.Time) {
+	for _, order := range e.orders {
+		if order.ChildOrderState != StateActive {
+			continue
+		}
+		if now.Sub(e.accepted[order.ChildOrderAcceptanceID]) < e.FillDelay {
+			continue
+		}
+		ticker, ok := e.tickers[order.ProductCode]
+		if !ok {
+			continue
+		}
+		price := ticker.BestAsk
+		if order.Side == "SELL" {
+			price = ticker.BestBid
+		}
+		if order.ChildOrderType == "LIMIT" {
+			// a limit order fills at its price or better, never past it
+			if order.Side == "BUY" && (price <= 0 || price > order.Price) {
+				continue
+			}
+			if order.Side == "SELL" && price < order.Price {
+				continue
+			}
+		}
+		e.fill(order, price)
+	}
+}
+
+// fill executes the whole order at price
+// the commission is taken in the coin, the same way bitFlyer charges spot trades
+func (e *Exchange) fill(order *bitflyer.Order, price float64) {
+	codes := strings.Split(order.ProductCode, "_")
+	if len(codes) == 3 {
+		e.fillMargin(order, price)
+		return
+	}
+	if len(codes) != 2 {
+		order.ChildOrderState = StateRejected
+		return
+	}
+	coinCode, currencyCode := codes[0], codes[1]
+	commission := order.Size * e.feePercent / 100
+
+	if order.Side == "BUY" {
+		cost := price * order.Size
+		if price <= 0 || e.balances[currencyCode] < cost {
+			order.ChildOrderState = StateRejected
+			log.Printf("action=papertrade.fill status=insufficient_funds order=%+v", order)
+			return
+		}
+		e.balances[currencyCode] -= cost
+		e.balances[coinCode] += order.Size - commission
+	} else {
+		if price <= 0 || e.balances[coinCode] < order.Size {
+			order.ChildOrderState = StateRejected
+			log.Printf("action=papertrade.fill status=insufficient_funds order=%+v", order)
+			return
+		}
+		e.balances[coinCode] -= order.Size
+		e.balances[currencyCode] += price * (order.Size - commission)
+	}
+
+	if order.ChildOrderType == "MARKET" {
+		order.Price = price
+	}
+	order.AveragePrice = price
+	order.ExecutedSize = order.Size
+	order.OutstandingSize = 0
+	order.TotalCommission = commission
+	order.ChildOrderState = StateCompleted
+	log.Printf("action=papertrade.fill order=%+v", order)
+}
+
+// fillMargin executes the whole order at price against the collateral: it nets the position of the product,
+// realizes the profit of what it closes and charges the commission in the currency
+// an order growing the position is rejected when the collateral does not cover it at Leverage
+func (e *Exchange) fillMargin(order *bitflyer.Order, price float64) {
+	if price <= 0 {
+		order.ChildOrderState = StateRejected
+		log.Printf("action=papertrade.fill status=no_price order=%+v", order)
+		return
+	}
+	size := order.Size
+	if order.Side == "SELL" {
+		size = -size
+	}
+	current := e.positions[order.ProductCode]
+	next := current
+	next.size += size
+	realized := 0.0
+	switch {
+	case current.size == 0 || (current.size > 0) == (size > 0):
+		next.price = (current.price*math.Abs(current.size) + price*math.Abs(size)) / math.Abs(next.size)
+		if current.size == 0 {
+			next.openDate = time.Now()
+		}
+	default:
+		closed := math.Min(math.Abs(size), math.Abs(current.size))
+		realized = closed * (price - current.price)
+		if current.size < 0 {
+			realized = -realized
+		}
+		if next.size != 0 && (next.size > 0) != (current.size > 0) {
+			// the order closed the position and opened the other side with the rest
+			next.price, next.openDate = price, time.Now()
+		}
+	}
+	commission := order.Size * price * e.feePercent / 100
+	if math.Abs(next.size) > math.Abs(current.size) {
+		equity := e.collateral + realized - commission
+		required := 0.0
+		for productCode, p := range e.positions {
+			if productCode != order.ProductCode {
+				equity += e.pnl(productCode, p)
+				required += e.requireCollateral(p)
+			}
+		}
+		equity += e.pnl(order.ProductCode, next)
+		if required += e.requireCollateral(next); required > equity {
+			order.ChildOrderState = StateRejected
+			log.Printf("action=papertrade.fill status=insufficient_collateral order=%+v required=%f equity=%f", order, required, equity)
+			return
+		}
+	}
+	e.collateral += realized - commission
+	if math.Abs(next.size) < 1e-12 {
+		delete(e.positions, order.ProductCode)
+	} else {
+		e.positions[order.ProductCode] = next
+	}
+
+	if order.ChildOrderType == "MARKET" {
+		order.Price = price
+	}
+	order.AveragePrice = price
+	order.ExecutedSize = order.Size
+	order.OutstandingSize = 0
+	order.TotalCommission = order.Size * e.feePercent / 100
+	order.ChildOrderState = StateCompleted
+	log.Printf("action=papertrade.fill order=%+v realized=%f collateral=%f", order, realized, e.collateral)
+}
@@ -0,0 +1,129 @@
+package sizing
+
+import (
+	"fmt"
+	"math"
+)
+
+// sizing modes, how large a position the AI opens
+const (
+	FixedFraction = "fixed_fraction" // Fraction of the equity
+	FixedNotional = "fixed_notional" // Notional of the currency
+	Kelly         = "kelly"          // KellyFraction of the Kelly criterion of the past trades
+	Volatility    = "volatility"     // a position moving TargetVolatility percent of the equity per candle
+	RiskPerTrade  = "risk_per_trade" // losing RiskPercent of the equity when the stop is hit
+)
+
+// Modes lists every mode Config.Size accepts
+var Modes = []string{FixedFraction, FixedNotional, Kelly, Volatility, RiskPerTrade}
+
+// Config is how positions are sized
+type Config struct {
+	Mode             string
+	Fraction         float64 // share of the equity a position takes with FixedFraction and at most with the other modes
+	Notional         float64 // currency spent per position with FixedNotional
+	KellyFraction    float64 // share of the full Kelly fraction taken, e.g. 0.5 for half Kelly
+	KellyMinTrades   int     // trades the win rate needs before Kelly sizes anything
+	TargetVolatility float64 // percent of the equity the position moves by over one candle with Volatility
+	RiskPercent      float64 // percent of the equity lost at the stop with RiskPerTrade
+	FeePercent       float64 // commission kept aside so the order fits the cash
+	MinSize          float64 // smallest order the exchange accepts, smaller sizes are 0
+	SizeStep         float64 // sizes are rounded down to multiples of it
+	Leverage         float64 // on margin positions are worth up to this many times the equity, 1 when 0
+}
+
+// Input is the account and market a position is sized on
+type Input struct {
+	Cash        float64 // currency available to buy with, the collateral on margin
+	Position    float64 // coin already held, in the direction of the order
+	Price       float64 // expected fill price
+	Volatility  float64 // expected move of the price over one candle in percent, e.g. ATR / price * 100
+	StopPrice   float64 // price the position is closed at a loss
+	WinRate     float64 // share of the past trades that won
+	PayoffRatio float64 // average win over average loss of the past trades
+	Trades      int     // number of past trades WinRate and PayoffRatio come from
+}
+
+// Equity is the cash plus the position valued at Price
+func (in Input) Equity() float64 {
+	return in.Cash + in.Position*in.Price
+}
+
+// leverage is Leverage, 1 when unset
+func (c Config) leverage() float64 {
+	if c.Leverage <= 0 {
+		return 1
+	}
+	return c.Leverage
+}
+
+// Target returns the value of the position the mode targets, in the currency
+func (c Config) Target(in Input) (float64, error) {
+	equity := in.Equity()
+	switch c.Mode {
+	case FixedFraction, "":
+		return equity * c.Fraction * c.leverage(), nil
+	case FixedNotional:
+		return c.Notional, nil
+	case Kelly:
+		if in.Trades < c.KellyMinTrades {
+			return 0, fmt.Errorf("kelly needs %d past trades, got %d", c.KellyMinTrades, in.Trades)
+		}
+		if in.PayoffRatio <= 0 {
+			return 0, nil
+		}
+		// f = W - (1 - W) / R, no position when the edge is negative
+		kelly := in.WinRate - (1-in.WinRate)/in.PayoffRatio
+		if kelly <= 0 {
+			return 0, nil
+		}
+		return equity * kelly * c.KellyFraction, nil
+	case Volatility:
+		if in.Volatility <= 0 {
+			return 0, fmt.Errorf("volatility sizing needs a volatility, got %f", in.Volatility)
+		}
+		return equity * c.TargetVolatility / in.Volatility, nil
+	case RiskPerTrade:
+		// the stop is above the price of a short position
+		distance := math.Abs(in.Price - in.StopPrice)
+		if in.StopPrice <= 0 || distance == 0 {
+			return 0, fmt.Errorf("risk per trade needs a stop away from %f, got %f", in.Price, in.StopPrice)
+		}
+		return equity * c.RiskPercent / 100 / distance * in.Price, nil
+	}
+	return 0, fmt.Errorf("unknown sizing mode %q", c.Mode)
+}
+
+// Size returns the coin to buy so the position reaches the target of the mode, capped at Fraction
+// of the equity and at what the cash pays for, both times Leverage, 0 when the position is already
+// large enough or the order would be smaller than MinSize
+func (c Config) Size(in Input) (float64, error) {
+	if in.Price <= 0 {
+		return 0, fmt.Errorf("sizing needs a price, got %f", in.Price)
+	}
+	notional, err := c.Target(in)
+	if err != nil {
+		return 0, err
+	}
+	if limit := in.Equity() * c.Fraction * c.leverage(); c.Fraction > 0 && notional > limit {
+		notional = limit
+	}
+	size := notional/in.Price - in.Position
+	if affordable := in.Cash * c.leverage() / (in.Price * (1 + c.FeePercent/100)); size > affordable {
+		size = affordable
+	}
+	size = c.Round(size)
+	if size <= 0 || size < c.MinSize {
+		return 0, nil
+	}
+	return size, nil
+}
+
+// Round rounds size down to SizeStep
+func (c Config) Round(size float64) float64 {
+	if c.SizeStep <= 0 {
+		return size
+	}
+	steps := math.Floor(size/c.SizeStep + 1e-9)
+	return math.Round(steps*c.SizeStep*1e12) / 1e12
+}
@@ -0,0 +1,120 @@
+package sizing
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConfigSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		input   Input
+		want    float64
+		wantErr bool
+	}{
+		{
+			name:   "fixed fraction of the equity",
+			config: Config{Mode: FixedFraction, Fraction: 0.5, SizeStep: 0.001},
+			input:  Input{Cash: 1000000, Price: 5000000},
+			want:   0.1,
+		},
+		{
+			name:   "held coin counts towards the target",
+			config: Config{Mode: FixedFraction, Fraction: 0.5, SizeStep: 0.001},
+			input:  Input{Cash: 750000, Position: 0.05, Price: 5000000},
+			want:   0.05,
+		},
+		{
+			name:   "position already at the target",
+			config: Config{Mode: FixedFraction, Fraction: 0.5, SizeStep: 0.001},
+			input:  Input{Cash: 500000, Position: 0.1, Price: 5000000},
+			want:   0,
+		},
+		{
+			name:   "fixed notional capped at the fraction",
+			config: Config{Mode: FixedNotional, Notional: 900000, Fraction: 0.5, SizeStep: 0.001},
+			input:  Input{Cash: 1000000, Price: 5000000},
+			want:   0.1,
+		},
+		{
+			name:   "cash keeps the fee aside",
+			config: Config{Mode: FixedNotional, Notional: 1000000, FeePercent: 0.15, SizeStep: 0.001},
+			input:  Input{Cash: 1000000, Price: 5000000},
+			want:   0.199,
+		},
+		{
+			name:   "leverage on margin",
+			config: Config{Mode: FixedFraction, Fraction: 0.5, Leverage: 2, SizeStep: 0.001},
+			input:  Input{Cash: 1000000, Price: 5000000},
+			want:   0.2,
+		},
+		{
+			name:   "below the minimum size",
+			config: Config{Mode: FixedNotional, Notional: 4000, MinSize: 0.001, SizeStep: 0.00000001},
+			input:  Input{Cash: 1000000, Price: 5000000},
+			want:   0,
+		},
+		{
+			name:   "kelly criterion",
+			config: Config{Mode: Kelly, KellyFraction: 0.5, KellyMinTrades: 10, SizeStep: 0.001},
+			input:  Input{Cash: 1000000, Price: 5000000, WinRate: 0.6, PayoffRatio: 2, Trades: 20},
+			// f = 0.6 - 0.4 / 2 = 0.4, half of it
+			want: 0.04,
+		},
+		{
+			name:   "kelly without an edge",
+			config: Config{Mode: Kelly, KellyFraction: 1, SizeStep: 0.001},
+			input:  Input{Cash: 1000000, Price: 5000000, WinRate: 0.3, PayoffRatio: 1, Trades: 20},
+			want:   0,
+		},
+		{
+			name:    "kelly before enough trades",
+			config:  Config{Mode: Kelly, KellyFraction: 1, KellyMinTrades: 10},
+			input:   Input{Cash: 1000000, Price: 5000000, WinRate: 0.6, PayoffRatio: 2, Trades: 5},
+			wantErr: true,
+		},
+		{
+			name:   "volatility target",
+			config: Config{Mode: Volatility, TargetVolatility: 0.5, SizeStep: 0.001},
+			input:  Input{Cash: 1000000, Price: 5000000, Volatility: 2},
+			want:   0.05,
+		},
+		{
+			name:   "risk per trade with the stop of a short position",
+			config: Config{Mode: RiskPerTrade, RiskPercent: 1, SizeStep: 0.001},
+			input:  Input{Cash: 1000000, Price: 5000000, StopPrice: 5100000},
+			// losing 10000 over a distance of 100000
+			want: 0.1,
+		},
+		{
+			name:    "risk per trade without a stop",
+			config:  Config{Mode: RiskPerTrade, RiskPercent: 1},
+			input:   Input{Cash: 1000000, Price: 5000000},
+			wantErr: true,
+		},
+		{
+			name:    "no price",
+			config:  Config{Mode: FixedFraction, Fraction: 1},
+			input:   Input{Cash: 1000000},
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			config:  Config{Mode: "martingale"},
+			input:   Input{Cash: 1000000, Price: 5000000},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.config.Size(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Size() err = %v, wantErr %t", err, tt.wantErr)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("Size() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}